@@ -0,0 +1,117 @@
+// Package atomicfile provides crash-safe file writes and rotating backups.
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WriteFile writes data to path so that path holds either its old or its
+// new contents, never a mix, even after a crash or power cut: the data is
+// written to a temporary file in the same directory, synced, and renamed
+// over path.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Persist the rename itself; not supported on every platform
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// BackupPath returns the path of the nth backup of path, e.g.
+// /data/wolgate.json.bak.1 for the newest.
+func BackupPath(path string, n int) string {
+	return path + ".bak." + strconv.Itoa(n)
+}
+
+// Rotate copies the current contents of path to its first backup, shifting
+// older backups up and keeping at most keep of them. A missing path is not
+// an error.
+func Rotate(path string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Drop backups beyond the limit, e.g. after it was lowered
+	for _, b := range Backups(path) {
+		if n, _ := backupIndex(path, b); n >= keep {
+			os.Remove(b)
+		}
+	}
+	for n := keep - 1; n >= 1; n-- {
+		if err := os.Rename(BackupPath(path, n), BackupPath(path, n+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate backup: %w", err)
+		}
+	}
+	return WriteFile(BackupPath(path, 1), data, 0644)
+}
+
+// Backups returns the existing backups of path, newest first.
+func Backups(path string) []string {
+	matches, _ := filepath.Glob(path + ".bak.*")
+
+	type backup struct {
+		path string
+		n    int
+	}
+	var backups []backup
+	for _, m := range matches {
+		if n, ok := backupIndex(path, m); ok {
+			backups = append(backups, backup{m, n})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].n < backups[j].n })
+
+	result := make([]string, len(backups))
+	for i, b := range backups {
+		result[i] = b.path
+	}
+	return result
+}
+
+// backupIndex returns n if backup is BackupPath(path, n).
+func backupIndex(path, backup string) (int, bool) {
+	suffix, ok := strings.CutPrefix(backup, path+".bak.")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(suffix)
+	return n, err == nil && n > 0
+}
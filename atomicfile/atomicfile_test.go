@@ -0,0 +1,73 @@
+// Package atomicfile tests.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+
+	if err := WriteFile(path, []byte("one"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := WriteFile(path, []byte("two"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "two" {
+		t.Errorf("Content = %q, want %q", data, "two")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// No temp files are left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the target file, got %d entries", len(entries))
+	}
+}
+
+func TestWriteFile_MissingDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "data.json")
+	if err := WriteFile(path, []byte("x"), 0644); err == nil {
+		t.Error("WriteFile() should fail when the directory does not exist")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+
+	// Rotating a missing file is a no-op
+	if err := Rotate(path, 2); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		if err := Rotate(path, 2); err != nil {
+			t.Fatalf("Rotate() error = %v", err)
+		}
+		WriteFile(path, []byte(v), 0644)
+	}
+
+	backups := Backups(path)
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v", backups)
+	}
+	for i, want := range []string{"v3", "v2"} {
+		if data, _ := os.ReadFile(backups[i]); string(data) != want {
+			t.Errorf("Backup %d = %q, want %q", i+1, data, want)
+		}
+	}
+
+	// Lowering the limit drops the oldest backups
+	Rotate(path, 1)
+	if backups := Backups(path); len(backups) != 1 || backups[0] != BackupPath(path, 1) {
+		t.Errorf("Expected 1 backup after lowering the limit, got %v", backups)
+	}
+}
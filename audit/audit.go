@@ -0,0 +1,311 @@
+// Package audit keeps a bounded on-disk log of every wake attempt: when,
+// from which source, on whose behalf, to which device, and how it went.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// DefaultLimit is the default number of entries kept.
+const DefaultLimit = 10000
+
+// Results of a wake attempt.
+const (
+	ResultOK     = "ok"
+	ResultFailed = "failed"
+)
+
+// Target is where the magic packets of a wake were sent.
+type Target struct {
+	MAC     string `json:"mac"`
+	Iface   string `json:"iface,omitempty"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// Entry is the record of one wake attempt.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"` // One of the wake sources, e.g. ui, api, cli, schedule or rule
+	Detail   string    `json:"detail,omitempty"`
+	Client   string    `json:"client,omitempty"` // Address of the API client
+	User     string    `json:"user,omitempty"`   // Authenticated user, if known
+	MAC      string    `json:"mac"`
+	DeviceID string    `json:"device_id,omitempty"`
+	Device   string    `json:"device,omitempty"` // Device name, if stored
+	Targets  []Target  `json:"targets,omitempty"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Query selects the entries returned by Entries.
+type Query struct {
+	// DeviceID and MACs keep only wakes of the device with this ID, or of
+	// one of these MACs, in any format.
+	DeviceID string
+	MACs     []string
+
+	Since time.Time // Only wakes at or after this time, if set
+	Until time.Time // Only wakes before this time, if set
+	Limit int       // Only the newest entries; 0 for all
+}
+
+// Config holds the audit log configuration.
+type Config struct {
+	Path   string         // File the entries are appended to, a JSON object per line
+	Limit  int            // Entries kept; DefaultLimit if 0
+	Logger *logger.Logger // Optional logger
+}
+
+// Log is an audit log file. Processes sharing it hold an advisory lock on
+// LockPath of it while they append or trim it.
+type Log struct {
+	cfg   Config
+	mu    sync.Mutex
+	lines int   // Entries in the file, or -1 until counted
+	size  int64 // Size of the file when lines was counted
+}
+
+// LogPath returns the path of the audit log kept next to the data file at
+// dataFile.
+func LogPath(dataFile string) string {
+	return dataFile + ".audit"
+}
+
+// LockPath returns the path of the lock file guarding the audit log at
+// path.
+func LockPath(path string) string {
+	return path + ".lock"
+}
+
+// New returns the audit log at cfg.Path.
+func New(cfg Config) *Log {
+	if cfg.Limit <= 0 {
+		cfg.Limit = DefaultLimit
+	}
+	return &Log{cfg: cfg, lines: -1}
+}
+
+// RecordWakes records every wake attempt made through waker, naming the
+// devices woken from st, if not nil.
+func (l *Log) RecordWakes(waker *wake.Service, st *store.Store) {
+	waker.OnWake(func(r wake.Result) {
+		e := Entry{
+			Time:   r.Time.UTC(),
+			Source: r.Source,
+			Detail: r.Detail,
+			Client: r.Actor,
+			User:   r.User,
+			MAC:    r.MAC,
+			Result: ResultOK,
+		}
+		if st != nil {
+			if device, err := st.GetByMAC(r.MAC); err == nil {
+				e.DeviceID, e.Device = device.ID, device.Name
+			}
+		}
+		for _, t := range r.Targets {
+			e.Targets = append(e.Targets, Target{MAC: t.MAC, Iface: t.Iface, Address: t.Address, Port: t.Port})
+		}
+		if r.Err != nil {
+			e.Result, e.Error = ResultFailed, r.Err.Error()
+		}
+		if err := l.Record(e); err != nil && l.cfg.Logger != nil {
+			l.cfg.Logger.Error("Failed to record wake of %s in the audit log: %v", r.MAC, err)
+		}
+	})
+}
+
+// Record appends an entry, dropping the oldest beyond the limit.
+func (l *Log) Record(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	unlock, err := l.lockFileLocked()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Another process may have appended or trimmed since the last count
+	var size int64
+	if info, err := os.Stat(l.cfg.Path); err == nil {
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if l.lines < 0 || size != l.size {
+		data, err := os.ReadFile(l.cfg.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		l.lines, l.size = bytes.Count(data, []byte{'\n'}), int64(len(data))
+	}
+
+	// Appending is cheap; trim only once a quarter over the limit
+	if l.lines+1 > l.cfg.Limit+l.cfg.Limit/4 {
+		data, err := os.ReadFile(l.cfg.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		lines := bytes.SplitAfter(append(data, line...), []byte{'\n'})
+		lines = lines[:len(lines)-1] // After the last newline
+		lines = lines[max(len(lines)-l.cfg.Limit, 0):]
+		data = bytes.Join(lines, nil)
+		if err := atomicfile.WriteFile(l.cfg.Path, data, 0644); err != nil {
+			return err
+		}
+		l.lines, l.size = len(lines), int64(len(data))
+		return nil
+	}
+
+	f, err := os.OpenFile(l.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	l.lines++
+	l.size += int64(len(line))
+	return nil
+}
+
+// lockFileLocked takes the cross-process lock on the log, waiting for other
+// processes to release it, and returns a function releasing it (must be
+// called with mu held).
+func (l *Log) lockFileLocked() (func(), error) {
+	f, err := os.OpenFile(LockPath(l.cfg.Path), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// Entries returns the entries matching q, newest first. A missing log is
+// empty, and a truncated last line, left by a crash, is ignored.
+func (l *Log) Entries(q Query) ([]Entry, error) {
+	macs := make(map[string]bool, len(q.MACs))
+	for _, mac := range q.MACs {
+		macs[normalizeMAC(mac)] = true
+	}
+
+	l.mu.Lock()
+	f, err := os.Open(l.cfg.Path)
+	l.mu.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Entry{}, nil
+		}
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer f.Close()
+
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if !q.matchesDevice(e, macs) {
+			continue
+		}
+		if (!q.Since.IsZero() && e.Time.Before(q.Since)) || (!q.Until.IsZero() && !e.Time.Before(q.Until)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	// Newest first; entries are appended in order, but clocks may step
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	return entries, nil
+}
+
+// matchesDevice reports whether an entry is a wake of the device the query
+// selects, if any; macs are its MACs normalized.
+func (q Query) matchesDevice(e Entry, macs map[string]bool) bool {
+	if q.DeviceID == "" && len(macs) == 0 {
+		return true
+	}
+	return (q.DeviceID != "" && e.DeviceID == q.DeviceID) || macs[normalizeMAC(e.MAC)]
+}
+
+// CSVColumns are the columns written by WriteCSV.
+var CSVColumns = []string{"time", "source", "detail", "client", "user", "mac", "device_id", "device", "targets", "result", "error"}
+
+// WriteCSV writes entries to w as CSV, with a header line. Targets are
+// written as "mac@address:port%iface", separated by spaces.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	cw.Write(CSVColumns)
+	for _, e := range entries {
+		targets := make([]string, len(e.Targets))
+		for i, t := range e.Targets {
+			targets[i] = t.MAC + "@" + t.Address + ":" + strconv.Itoa(t.Port)
+			if t.Iface != "" {
+				targets[i] += "%" + t.Iface
+			}
+		}
+		cw.Write([]string{
+			e.Time.Format(time.RFC3339), e.Source, e.Detail, e.Client, e.User, e.MAC, e.DeviceID, e.Device,
+			strings.Join(targets, " "), e.Result, e.Error,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// normalizeMAC returns mac in a canonical form for comparison, or as
+// given if it is not a MAC.
+func normalizeMAC(mac string) string {
+	if n, err := wol.NormalizeMAC(mac); err == nil {
+		return n
+	}
+	return mac
+}
@@ -0,0 +1,201 @@
+// Package audit tests.
+package audit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+func TestLog_RecordLimit(t *testing.T) {
+	path := t.TempDir() + "/data.json.audit"
+	l := New(Config{Path: path, Limit: 4})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		if err := l.Record(Entry{Time: start.Add(time.Duration(i) * time.Minute), Source: wake.SourceAPI, MAC: "AA:BB:CC:DD:EE:FF", Result: ResultOK}); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	// The file grows past the limit only by a quarter before it is trimmed
+	data, _ := os.ReadFile(path)
+	if n := bytes.Count(data, []byte{'\n'}); n < 4 || n > 5 {
+		t.Errorf("Log has %d lines, want 4 or 5", n)
+	}
+	entries, err := l.Entries(Query{})
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	if len(entries) < 4 || !entries[0].Time.Equal(start.Add(11*time.Minute)) {
+		t.Errorf("Entries() = %+v", entries)
+	}
+
+	// A reopened log counts the lines already written
+	l = New(Config{Path: path, Limit: 4})
+	l.Record(Entry{Time: start.Add(time.Hour), MAC: "AA:BB:CC:DD:EE:FF", Result: ResultOK})
+	if entries, _ := l.Entries(Query{}); len(entries) > 5 || !entries[0].Time.Equal(start.Add(time.Hour)) {
+		t.Errorf("Entries() after reopening = %+v", entries)
+	}
+}
+
+func TestLog_RecordShared(t *testing.T) {
+	// Two logs on one file, as two processes would open it
+	path := t.TempDir() + "/data.json.audit"
+	a, b := New(Config{Path: path, Limit: 8}), New(Config{Path: path, Limit: 8})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 40; i++ {
+		l := a
+		if i%3 == 0 {
+			l = b
+		}
+		if err := l.Record(Entry{Time: start.Add(time.Duration(i) * time.Minute), MAC: "AA:BB:CC:DD:EE:FF", Result: ResultOK}); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	// Each log counts the lines the other appended, so neither lets the
+	// file grow unbounded, and no entry is lost to a stale trim
+	data, _ := os.ReadFile(path)
+	if n := bytes.Count(data, []byte{'\n'}); n < 8 || n > 10 {
+		t.Errorf("Log has %d lines, want 8 to 10", n)
+	}
+	entries, err := a.Entries(Query{})
+	if err != nil {
+		t.Fatalf("Entries() error = %v", err)
+	}
+	for i, e := range entries {
+		if want := start.Add(time.Duration(39-i) * time.Minute); !e.Time.Equal(want) {
+			t.Fatalf("Entries()[%d].Time = %v, want %v", i, e.Time, want)
+		}
+	}
+	if _, err := os.Stat(LockPath(path)); err != nil {
+		t.Errorf("Lock file not created: %v", err)
+	}
+}
+
+func TestLog_Entries(t *testing.T) {
+	path := t.TempDir() + "/data.json.audit"
+	l := New(Config{Path: path})
+
+	if entries, err := l.Entries(Query{}); err != nil || len(entries) != 0 {
+		t.Errorf("Entries() of a missing log = %v, %v", entries, err)
+	}
+
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	l.Record(Entry{Time: day.Add(time.Hour), MAC: "AA:BB:CC:DD:EE:01", DeviceID: "pc", Result: ResultOK})
+	l.Record(Entry{Time: day.Add(25 * time.Hour), MAC: "AA:BB:CC:DD:EE:02", Result: ResultFailed, Error: "no route"})
+	l.Record(Entry{Time: day.Add(49 * time.Hour), MAC: "aa-bb-cc-dd-ee-01", Result: ResultOK})
+
+	// A line cut short by a crash is skipped
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"time":"2024-03-04T00:00:00Z","ma`)
+	f.Close()
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []string // MACs, newest first
+	}{
+		{"all", Query{}, []string{"aa-bb-cc-dd-ee-01", "AA:BB:CC:DD:EE:02", "AA:BB:CC:DD:EE:01"}},
+		{"limit", Query{Limit: 1}, []string{"aa-bb-cc-dd-ee-01"}},
+		{"device ID", Query{DeviceID: "pc"}, []string{"AA:BB:CC:DD:EE:01"}},
+		{"MAC in any format", Query{MACs: []string{"aa:bb:cc:dd:ee:01"}}, []string{"aa-bb-cc-dd-ee-01", "AA:BB:CC:DD:EE:01"}},
+		{"since", Query{Since: day.Add(25 * time.Hour)}, []string{"aa-bb-cc-dd-ee-01", "AA:BB:CC:DD:EE:02"}},
+		{"until", Query{Until: day.Add(25 * time.Hour)}, []string{"AA:BB:CC:DD:EE:01"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := l.Entries(tt.query)
+			if err != nil {
+				t.Fatalf("Entries() error = %v", err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.MAC)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Entries() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Entries() = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestLog_RecordWakes(t *testing.T) {
+	st, err := store.NewStore(t.TempDir() + "/data.json")
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	st.Add(store.Device{Name: "Desktop", MAC: "AA:BB:CC:DD:EE:01"})
+	device, _ := st.GetByMAC("AA:BB:CC:DD:EE:01")
+
+	sender, _ := wol.NewSender("", "127.0.0.1")
+	waker := wake.NewService(sender)
+	l := New(Config{Path: LogPath(t.TempDir() + "/data.json")})
+	l.RecordWakes(waker, st)
+
+	waker.Wake(wake.Request{MAC: "aa:bb:cc:dd:ee:01", Source: wake.SourceAPI, Detail: "web UI", Actor: "192.0.2.1", User: "alice"})
+	waker.Wake(wake.Request{MAC: "invalid", Source: wake.SourceSchedule, Detail: "morning"})
+
+	entries, err := l.Entries(Query{})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Entries() = %+v, %v", entries, err)
+	}
+	failed, ok := entries[0], entries[1]
+	if ok.Source != wake.SourceAPI || ok.Client != "192.0.2.1" || ok.User != "alice" || ok.Result != ResultOK {
+		t.Errorf("Successful wake recorded as %+v", ok)
+	}
+	if ok.DeviceID != device.ID || ok.Device != "Desktop" {
+		t.Errorf("Successful wake device = %q %q, want %q Desktop", ok.DeviceID, ok.Device, device.ID)
+	}
+	if len(ok.Targets) == 0 || ok.Targets[0].Address != "127.0.0.1" || ok.Targets[0].Port == 0 {
+		t.Errorf("Successful wake targets = %+v", ok.Targets)
+	}
+	if failed.Source != wake.SourceSchedule || failed.Detail != "morning" || failed.Result != ResultFailed || failed.Error == "" {
+		t.Errorf("Failed wake recorded as %+v", failed)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteCSV(&buf, []Entry{{
+		Time:    time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC),
+		Source:  wake.SourceAPI,
+		Client:  "192.0.2.1",
+		MAC:     "AA:BB:CC:DD:EE:01",
+		Device:  "Desktop, upstairs",
+		Targets: []Target{{MAC: "AA:BB:CC:DD:EE:01", Address: "192.168.1.255", Port: 9, Iface: "eth0"}},
+		Result:  ResultOK,
+	}})
+	if err != nil {
+		t.Fatalf("WriteCSV() error = %v", err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("CSV = %v, %v", records, err)
+	}
+	row := make(map[string]string)
+	for i, column := range records[0] {
+		row[column] = records[1][i]
+	}
+	if row["time"] != "2024-03-01T08:30:00Z" || row["device"] != "Desktop, upstairs" || row["result"] != ResultOK {
+		t.Errorf("CSV row = %v", row)
+	}
+	if row["targets"] != "AA:BB:CC:DD:EE:01@192.168.1.255:9%eth0" {
+		t.Errorf("CSV targets = %q", row["targets"])
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+// Package audit file locking is only implemented on Unix; elsewhere only
+// writers within one process are serialized.
+package audit
+
+import "os"
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
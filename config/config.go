@@ -7,13 +7,27 @@ import (
 	"os"
 	"strings"
 
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/leases"
 	"github.com/hzhq1255/wolgate/store"
 )
 
 // ServerConfig holds server configuration.
 type ServerConfig struct {
-	Listen string `json:"listen" default:"127.0.0.1:9000"`
-	Data   string `json:"data" default:"/data/wolgate.json"`
+	Listen  string `json:"listen" default:"127.0.0.1:9000"`
+	Data    string `json:"data" default:"/data/wolgate.json"`
+	Backups int    `json:"backups" default:"5"`    // Previous versions of the data file kept; negative disables
+	Watch   int    `json:"watch" default:"2"`      // Seconds between checks of the data file for external edits; negative disables
+	Journal int    `json:"journal" default:"1000"` // Changes kept in the data file's journal; negative disables
+	Trash   int    `json:"trash" default:"30"`     // Days deleted devices are kept in the trash; negative deletes them permanently
+	Audit   int    `json:"audit" default:"10000"`  // Wake attempts kept in the audit log; negative disables
+	// TrustedProxies are the addresses or CIDRs of reverse proxies in front
+	// of the server; only their X-Forwarded-For and Remote-User headers are
+	// believed for the client address and user recorded in the audit log.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// DevicePolicy is how the devices declared in the config file are
+	// reconciled into the data file: seed or authoritative.
+	DevicePolicy string `json:"device_policy" default:"seed"`
 }
 
 // WakeConfig holds Wake-on-LAN configuration.
@@ -31,20 +45,115 @@ type LogConfig struct {
 	MaxAge     int    `json:"max_age" default:"7"`
 }
 
+// MonitorConfig holds device reachability monitoring configuration.
+type MonitorConfig struct {
+	Interval      int   `json:"interval" default:"10"`        // Seconds between reachability checks
+	ProbePorts    []int `json:"probe_ports"`                  // TCP ports probed on devices with an IP
+	ProbeTimeout  int   `json:"probe_timeout" default:"1"`    // Seconds per TCP probe
+	BootTimeout   int   `json:"boot_timeout" default:"600"`   // Seconds to wait for a woken device
+	BootThreshold int   `json:"boot_threshold" default:"120"` // Seconds after which a boot is flagged slow
+}
+
+// ScheduleConfig holds scheduled wake configuration.
+type ScheduleConfig struct {
+	CatchUp       string `json:"catch_up" default:"once"`      // Missed run policy: skip or once
+	CatchUpWindow int    `json:"catch_up_window" default:"60"` // Minutes a missed run stays eligible for catch-up
+	// Calendars maps calendar names to .ics files used by schedule rules.
+	// Calendars can also be uploaded through the API.
+	Calendars map[string]string `json:"calendars,omitempty"`
+}
+
+// ProxyConfig holds the wake-on-demand TCP proxy configuration.
+type ProxyConfig struct {
+	ConnectTimeout int            `json:"connect_timeout" default:"120"` // Seconds to wait for a backend to accept
+	RetryInterval  int            `json:"retry_interval" default:"2"`    // Seconds between backend connection attempts
+	MaxPending     int            `json:"max_pending" default:"16"`      // Connections allowed to wait for a backend
+	WakeCooldown   int            `json:"wake_cooldown" default:"30"`    // Seconds between wakes of the same device
+	Mappings       []ProxyMapping `json:"mappings"`
+}
+
+// ProxyMapping forwards a local port to a port on a device.
+type ProxyMapping struct {
+	Name   string `json:"name,omitempty"`
+	Listen string `json:"listen"`         // Local address, e.g. ":3389"
+	Device string `json:"device"`         // Device MAC address
+	Port   int    `json:"port"`           // Backend port on the device
+	Host   string `json:"host,omitempty"` // Backend host (default: the device IP)
+}
+
+// DNSConfig holds the wake-on-lookup DNS responder configuration.
+type DNSConfig struct {
+	Listen   string            `json:"listen"`                // UDP address; empty disables the responder
+	Domain   string            `json:"domain"`                // Optional domain stripped from queries, e.g. "home.lan"
+	TTL      int               `json:"ttl" default:"60"`      // TTL of answers in seconds
+	Cooldown int               `json:"cooldown" default:"60"` // Seconds between wakes of the same device
+	Upstream string            `json:"upstream"`              // Server for unknown names; NXDOMAIN if empty
+	Hosts    map[string]string `json:"hosts,omitempty"`       // Hostname -> device MAC
+}
+
+// SleepProxyConfig holds the sleep proxy configuration.
+type SleepProxyConfig struct {
+	Iface   string             `json:"iface"`   // Interface the devices are on (default: wake.iface)
+	Devices []SleepProxyDevice `json:"devices"` // Devices opted in to the proxy
+}
+
+// SleepProxyDevice opts a device in to the sleep proxy.
+type SleepProxyDevice struct {
+	Device string `json:"device"` // Device MAC address
+	Ports  []int  `json:"ports"`  // TCP ports whose connection attempts wake the device
+}
+
+// ImportConfig holds the device discovery sources offered for import.
+type ImportConfig struct {
+	// Leases maps lease file formats (dnsmasq, dhcpd, odhcpd, ethers or
+	// openwrt) to the file read for each; an empty path disables one.
+	Leases map[string]string `json:"leases"`
+}
+
+// ExportConfig holds the hosts files kept in sync with the device list.
+type ExportConfig struct {
+	Files []ExportFile `json:"files"`
+}
+
+// ExportFile is a hosts file rewritten on every change to the device list.
+type ExportFile struct {
+	Format string `json:"format"`           // ethers, dnsmasq or openwrt
+	Path   string `json:"path"`             // File written, atomically
+	Reload string `json:"reload,omitempty"` // Shell command run after the file is rewritten
+}
+
 // Config holds the complete configuration.
 type Config struct {
-	Server  ServerConfig   `json:"server"`
-	Wake    WakeConfig     `json:"wake"`
-	Log     LogConfig      `json:"log"`
-	Devices []store.Device `json:"devices"`
+	Server     ServerConfig     `json:"server"`
+	Wake       WakeConfig       `json:"wake"`
+	Log        LogConfig        `json:"log"`
+	Monitor    MonitorConfig    `json:"monitor"`
+	Schedule   ScheduleConfig   `json:"schedule"`
+	Proxy      ProxyConfig      `json:"proxy"`
+	DNS        DNSConfig        `json:"dns"`
+	SleepProxy SleepProxyConfig `json:"sleep_proxy"`
+	Import     ImportConfig     `json:"import"`
+	Export     ExportConfig     `json:"export"`
+	Devices    []store.Device   `json:"devices"`
 }
 
+// defaultProbePorts are common services on desktops and servers. A refused
+// connection also proves the host is up, so closed ports still count.
+var defaultProbePorts = []int{22, 80, 135, 139, 443, 445, 3389, 5900}
+
 // DefaultConfig returns a configuration with default values.
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Listen: "127.0.0.1:9000",
-			Data:   "/data/wolgate.json",
+			Listen:  "127.0.0.1:9000",
+			Data:    "/data/wolgate.json",
+			Backups: 5,
+			Watch:   2,
+			Journal: 1000,
+			Trash:   30,
+			Audit:   10000,
+
+			DevicePolicy: store.PolicySeed,
 		},
 		Wake: WakeConfig{
 			Iface:     "",
@@ -57,10 +166,43 @@ func DefaultConfig() *Config {
 			MaxBackups: 3,
 			MaxAge:     7,
 		},
+		Monitor: MonitorConfig{
+			Interval:      10,
+			ProbePorts:    append([]int(nil), defaultProbePorts...),
+			ProbeTimeout:  1,
+			BootTimeout:   600,
+			BootThreshold: 120,
+		},
+		Schedule: ScheduleConfig{
+			CatchUp:       "once",
+			CatchUpWindow: 60,
+		},
+		Proxy: ProxyConfig{
+			ConnectTimeout: 120,
+			RetryInterval:  2,
+			MaxPending:     16,
+			WakeCooldown:   30,
+		},
+		DNS: DNSConfig{
+			TTL:      60,
+			Cooldown: 60,
+		},
+		Import: ImportConfig{
+			Leases: defaultLeases(),
+		},
 		Devices: []store.Device{},
 	}
 }
 
+// defaultLeases returns the usual lease file of each format.
+func defaultLeases() map[string]string {
+	paths := make(map[string]string, len(leases.DefaultPaths))
+	for format, path := range leases.DefaultPaths {
+		paths[format] = path
+	}
+	return paths
+}
+
 // Load loads configuration from a file.
 // If the file doesn't exist, returns default configuration.
 // If the file exists but is invalid, returns an error.
@@ -104,6 +246,24 @@ func applyDefaults(cfg *Config) {
 	if cfg.Server.Data == "" {
 		cfg.Server.Data = "/data/wolgate.json"
 	}
+	if cfg.Server.DevicePolicy == "" {
+		cfg.Server.DevicePolicy = store.PolicySeed
+	}
+	if cfg.Server.Backups == 0 {
+		cfg.Server.Backups = 5
+	}
+	if cfg.Server.Watch == 0 {
+		cfg.Server.Watch = 2
+	}
+	if cfg.Server.Journal == 0 {
+		cfg.Server.Journal = 1000
+	}
+	if cfg.Server.Trash == 0 {
+		cfg.Server.Trash = 30
+	}
+	if cfg.Server.Audit == 0 {
+		cfg.Server.Audit = 10000
+	}
 
 	if cfg.Wake.Broadcast == "" {
 		cfg.Wake.Broadcast = "255.255.255.255"
@@ -125,6 +285,53 @@ func applyDefaults(cfg *Config) {
 		cfg.Log.MaxAge = 7
 	}
 
+	if cfg.Monitor.Interval <= 0 {
+		cfg.Monitor.Interval = 10
+	}
+	if cfg.Monitor.ProbePorts == nil {
+		cfg.Monitor.ProbePorts = append([]int(nil), defaultProbePorts...)
+	}
+	if cfg.Monitor.ProbeTimeout <= 0 {
+		cfg.Monitor.ProbeTimeout = 1
+	}
+	if cfg.Monitor.BootTimeout <= 0 {
+		cfg.Monitor.BootTimeout = 600
+	}
+	if cfg.Monitor.BootThreshold == 0 {
+		cfg.Monitor.BootThreshold = 120
+	}
+
+	if cfg.Schedule.CatchUp == "" {
+		cfg.Schedule.CatchUp = "once"
+	}
+	if cfg.Schedule.CatchUpWindow == 0 {
+		cfg.Schedule.CatchUpWindow = 60
+	}
+
+	if cfg.Proxy.ConnectTimeout <= 0 {
+		cfg.Proxy.ConnectTimeout = 120
+	}
+	if cfg.Proxy.RetryInterval <= 0 {
+		cfg.Proxy.RetryInterval = 2
+	}
+	if cfg.Proxy.MaxPending <= 0 {
+		cfg.Proxy.MaxPending = 16
+	}
+	if cfg.Proxy.WakeCooldown <= 0 {
+		cfg.Proxy.WakeCooldown = 30
+	}
+
+	if cfg.DNS.TTL <= 0 {
+		cfg.DNS.TTL = 60
+	}
+	if cfg.DNS.Cooldown <= 0 {
+		cfg.DNS.Cooldown = 60
+	}
+
+	if cfg.Import.Leases == nil {
+		cfg.Import.Leases = defaultLeases()
+	}
+
 	if cfg.Devices == nil {
 		cfg.Devices = []store.Device{}
 	}
@@ -179,6 +386,33 @@ func (c *Config) MergeFromEnv() *Config {
 		}
 	}
 
+	// Schedule config
+	if v := os.Getenv("WOLGATE_SCHEDULE__CATCH_UP"); v != "" {
+		c.Schedule.CatchUp = v
+	}
+
+	// DNS config
+	if v := os.Getenv("WOLGATE_DNS__LISTEN"); v != "" {
+		c.DNS.Listen = v
+	}
+	if v := os.Getenv("WOLGATE_DNS__UPSTREAM"); v != "" {
+		c.DNS.Upstream = v
+	}
+
+	// Monitor config
+	if v := os.Getenv("WOLGATE_MONITOR__INTERVAL"); v != "" {
+		var interval int
+		if _, err := fmt.Sscanf(v, "%d", &interval); err == nil && interval > 0 {
+			c.Monitor.Interval = interval
+		}
+	}
+	if v := os.Getenv("WOLGATE_MONITOR__BOOT_THRESHOLD"); v != "" {
+		var threshold int
+		if _, err := fmt.Sscanf(v, "%d", &threshold); err == nil && threshold > 0 {
+			c.Monitor.BootThreshold = threshold
+		}
+	}
+
 	return c
 }
 
@@ -204,6 +438,8 @@ func (c *Config) MergeFromCLI(params map[string]string) *Config {
 			c.mergeWakeField(field, value)
 		case "log":
 			c.mergeLogField(field, value)
+		case "monitor":
+			c.mergeMonitorField(field, value)
 		}
 	}
 
@@ -252,14 +488,36 @@ func (c *Config) mergeLogField(field, value string) {
 	}
 }
 
-// Save saves the configuration to a file.
+func (c *Config) mergeMonitorField(field, value string) {
+	var n int
+	if _, err := fmt.Sscanf(value, "%d", &n); err != nil || n <= 0 {
+		return
+	}
+
+	switch field {
+	case "interval":
+		c.Monitor.Interval = n
+	case "probe_timeout":
+		c.Monitor.ProbeTimeout = n
+	case "boot_timeout":
+		c.Monitor.BootTimeout = n
+	case "boot_threshold":
+		c.Monitor.BootThreshold = n
+	}
+}
+
+// Save saves the configuration to a file atomically, keeping the previous
+// version as a backup.
 func (c *Config) Save(path string) error {
 	data, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	if err := atomicfile.Rotate(path, c.Server.Backups); err != nil {
+		return fmt.Errorf("failed to back up config file: %w", err)
+	}
+	if err := atomicfile.WriteFile(path, data, 0644); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
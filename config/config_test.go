@@ -17,6 +17,9 @@ func TestDefaultConfig(t *testing.T) {
 	if cfg.Server.Data != "/data/wolgate.json" {
 		t.Errorf("Expected default data /data/wolgate.json, got %s", cfg.Server.Data)
 	}
+	if cfg.Server.Audit != 10000 {
+		t.Errorf("Expected default audit limit 10000, got %d", cfg.Server.Audit)
+	}
 	if cfg.Wake.Broadcast != "255.255.255.255" {
 		t.Errorf("Expected default broadcast 255.255.255.255, got %s", cfg.Wake.Broadcast)
 	}
@@ -29,9 +32,35 @@ func TestDefaultConfig(t *testing.T) {
 	if cfg.Log.MaxSize != 10 {
 		t.Errorf("Expected default max size 10, got %d", cfg.Log.MaxSize)
 	}
+	if cfg.Monitor.BootThreshold != 120 {
+		t.Errorf("Expected default boot threshold 120, got %d", cfg.Monitor.BootThreshold)
+	}
+	if len(cfg.Monitor.ProbePorts) == 0 {
+		t.Error("Expected default probe ports")
+	}
 	if cfg.Devices == nil {
 		t.Error("Expected devices to be initialized, got nil")
 	}
+	if cfg.Server.DevicePolicy != "seed" {
+		t.Errorf("Expected default device policy seed, got %s", cfg.Server.DevicePolicy)
+	}
+	if cfg.Import.Leases["dnsmasq"] != "/tmp/dhcp.leases" || len(cfg.Import.Leases) != 5 {
+		t.Errorf("Expected default lease paths, got %v", cfg.Import.Leases)
+	}
+}
+
+func TestLoad_LeasePaths(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "test.json")
+	os.WriteFile(cfgPath, []byte(`{"import": {"leases": {"dnsmasq": "/var/lib/misc/dnsmasq.leases", "ethers": ""}}}`), 0644)
+
+	cfg, err := Load(cfgPath)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	leases := cfg.Import.Leases
+	if leases["dnsmasq"] != "/var/lib/misc/dnsmasq.leases" || leases["ethers"] != "" || leases["dhcpd"] != "/var/lib/dhcp/dhcpd.leases" {
+		t.Errorf("Expected configured paths over the defaults, got %v", leases)
+	}
 }
 
 func TestLoad_NonExistentFile(t *testing.T) {
@@ -277,4 +306,14 @@ func TestSave(t *testing.T) {
 	if loaded.Server.Listen != "0.0.0.0:8080" {
 		t.Errorf("Saved config not persisted correctly, got %s", loaded.Server.Listen)
 	}
+
+	// Saving again keeps the previous version as a backup
+	cfg.Server.Listen = "0.0.0.0:9090"
+	if err := cfg.Save(cfgPath); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	backup, err := Load(cfgPath + ".bak.1")
+	if err != nil || backup.Server.Listen != "0.0.0.0:8080" {
+		t.Errorf("Expected the previous config as backup, got %v", err)
+	}
 }
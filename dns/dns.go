@@ -0,0 +1,391 @@
+// Package dns provides a minimal DNS responder that wakes devices when
+// their hostnames are resolved.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Default settings.
+const (
+	DefaultTTL      = 60
+	DefaultCooldown = time.Minute
+)
+
+// upstreamTimeout bounds the wait for a forwarded query.
+const upstreamTimeout = 3 * time.Second
+
+// maxPacket is the largest UDP message handled.
+const maxPacket = 4096
+
+// DNS constants.
+const (
+	typeA    = 1
+	typeAAAA = 28
+	classIN  = 1
+
+	rcodeSuccess  = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+)
+
+// Config holds the DNS responder configuration.
+type Config struct {
+	Listen   string            // UDP address, e.g. "127.0.0.1:5353"
+	Domain   string            // Optional domain stripped from queries, e.g. "home.lan"
+	Hosts    map[string]string // Hostname -> device MAC
+	TTL      uint32            // TTL of answers in seconds
+	Cooldown time.Duration     // Minimum time between wakes of a device
+	Upstream string            // Server for unknown names, e.g. "192.168.1.1:53"; NXDOMAIN if empty
+	// Online reports whether a device is known to be online; such devices
+	// are not woken. Optional.
+	Online func(mac string) bool
+	Logger *logger.Logger // Optional logger
+}
+
+// Server answers DNS queries for device hostnames.
+type Server struct {
+	store *store.Store
+	waker *wake.Service
+	cfg   Config
+	conn  net.PacketConn
+	done  chan struct{}
+
+	mu        sync.Mutex
+	hosts     map[string]string    // Normalized hostname -> MAC
+	lastWakes map[string]time.Time // Normalized MAC -> last wake
+}
+
+// New creates a DNS responder.
+func New(st *store.Store, waker *wake.Service, cfg Config) (*Server, error) {
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultCooldown
+	}
+	cfg.Domain = normalizeName(cfg.Domain)
+
+	s := &Server{
+		store:     st,
+		waker:     waker,
+		cfg:       cfg,
+		hosts:     make(map[string]string),
+		done:      make(chan struct{}),
+		lastWakes: make(map[string]time.Time),
+	}
+	for name, mac := range cfg.Hosts {
+		if err := wol.ValidateMAC(mac); err != nil {
+			return nil, fmt.Errorf("dns host %q: invalid MAC: %w", name, err)
+		}
+		s.hosts[s.hostKey(name)] = mac
+	}
+	return s, nil
+}
+
+// Start begins serving queries on the configured address.
+func (s *Server) Start() error {
+	conn, err := net.ListenPacket("udp", s.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+	s.conn = conn
+	s.infof("DNS responder listening on %s", conn.LocalAddr())
+
+	go s.serve()
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	<-s.done
+	return err
+}
+
+func (s *Server) serve() {
+	defer close(s.done)
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.errorf("DNS read failed: %v", err)
+			continue
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if reply := s.handle(query); reply != nil {
+				s.conn.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// question is the single question of a query.
+type question struct {
+	name  string
+	qtype uint16
+	class uint16
+	end   int // Offset just past the question
+}
+
+// handle returns the reply to a query, or nil to drop it.
+func (s *Server) handle(query []byte) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		// Too short to reply to, or a response
+		return nil
+	}
+
+	opcode := (query[2] >> 3) & 0x0f
+	if opcode != 0 {
+		return reply(query, 12, rcodeNotImp, nil)
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return reply(query, 12, rcodeFormErr, nil)
+	}
+
+	q, err := parseQuestion(query)
+	if err != nil {
+		return reply(query, 12, rcodeFormErr, nil)
+	}
+
+	s.mu.Lock()
+	mac, ok := s.hosts[s.hostKey(q.name)]
+	s.mu.Unlock()
+	if !ok {
+		if s.cfg.Upstream != "" {
+			resp, err := s.forward(query)
+			if err != nil {
+				s.warnf("DNS forward of %s failed: %v", q.name, err)
+				return reply(query, q.end, rcodeServFail, nil)
+			}
+			return resp
+		}
+		return reply(query, q.end, rcodeNXDomain, nil)
+	}
+
+	var answer []byte
+	if device, ok := s.device(mac); ok && q.class == classIN {
+		answer = s.answer(q.qtype, net.ParseIP(device.IP))
+	}
+	s.debugf("DNS %s %d -> %s", q.name, q.qtype, mac)
+
+	if q.qtype == typeA || q.qtype == typeAAAA {
+		s.wake(mac, q.name)
+	}
+
+	// Known names without a matching address get an empty answer (NODATA)
+	return reply(query, q.end, rcodeSuccess, answer)
+}
+
+// device returns the stored device with mac as its primary or an alias
+// MAC, ignoring MAC formatting.
+func (s *Server) device(mac string) (store.Device, bool) {
+	device, err := s.store.GetByMAC(mac)
+	if err != nil {
+		return store.Device{}, false
+	}
+	return *device, true
+}
+
+// answer builds the answer record for qtype, or nil if ip has no address
+// of that type.
+func (s *Server) answer(qtype uint16, ip net.IP) []byte {
+	var rdata []byte
+	switch {
+	case ip == nil:
+		return nil
+	case qtype == typeA && ip.To4() != nil:
+		rdata = ip.To4()
+	case qtype == typeAAAA && ip.To4() == nil:
+		rdata = ip.To16()
+	default:
+		return nil
+	}
+
+	rr := []byte{0xc0, 12} // Pointer to the question name
+	rr = binary.BigEndian.AppendUint16(rr, qtype)
+	rr = binary.BigEndian.AppendUint16(rr, classIN)
+	rr = binary.BigEndian.AppendUint32(rr, s.cfg.TTL)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// wake wakes a device unless it is online or was woken within the cooldown.
+func (s *Server) wake(mac, name string) {
+	if s.cfg.Online != nil && s.cfg.Online(mac) {
+		return
+	}
+
+	key := mac
+	if n, err := wol.NormalizeMAC(mac); err == nil {
+		key = n
+	}
+	s.mu.Lock()
+	if time.Since(s.lastWakes[key]) < s.cfg.Cooldown {
+		s.mu.Unlock()
+		return
+	}
+	s.lastWakes[key] = time.Now()
+	s.mu.Unlock()
+
+	if err := s.waker.Wake(wake.Request{MAC: mac, Source: wake.SourceDNS, Detail: name}); err != nil {
+		s.errorf("DNS lookup of %s failed to wake %s: %v", name, mac, err)
+		return
+	}
+	s.infof("DNS lookup of %s woke %s", name, mac)
+}
+
+// RenameMAC points the hostnames of the device oldMAC at newMAC, after the
+// device's MAC changed, returning the number of hostnames changed. The
+// config file still names oldMAC until it is edited.
+func (s *Server) RenameMAC(oldMAC, newMAC string) int {
+	old, err := wol.NormalizeMAC(oldMAC)
+	if err != nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	renamed := 0
+	for name, mac := range s.hosts {
+		if n, err := wol.NormalizeMAC(mac); err == nil && n == old {
+			s.hosts[name] = newMAC
+			renamed++
+		}
+	}
+	return renamed
+}
+
+// forward relays a query to the upstream server and returns its reply.
+func (s *Server) forward(query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", s.cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxPacket)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// hostKey normalizes a hostname and strips the configured domain.
+func (s *Server) hostKey(name string) string {
+	name = normalizeName(name)
+	if s.cfg.Domain != "" {
+		name = strings.TrimSuffix(name, "."+s.cfg.Domain)
+	}
+	return name
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// parseQuestion parses the question section of a query.
+func parseQuestion(msg []byte) (question, error) {
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return question{}, fmt.Errorf("truncated name")
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n&0xc0 != 0 || off+n > len(msg) {
+			// Questions never use compression
+			return question{}, fmt.Errorf("invalid label")
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return question{}, fmt.Errorf("truncated question")
+	}
+
+	return question{
+		name:  strings.Join(labels, "."),
+		qtype: binary.BigEndian.Uint16(msg[off : off+2]),
+		class: binary.BigEndian.Uint16(msg[off+2 : off+4]),
+		end:   off + 4,
+	}, nil
+}
+
+// reply builds a response to query, echoing the header and the first end
+// bytes (the question) and appending answer if set.
+func reply(query []byte, end int, rcode byte, answer []byte) []byte {
+	msg := append([]byte(nil), query[:end]...)
+	msg[2] = 0x80 | (query[2] & 0x79) | 0x04 // QR, opcode and RD from the query, AA
+	msg[3] = rcode
+	if end == 12 {
+		binary.BigEndian.PutUint16(msg[4:6], 0)
+	}
+
+	ancount := uint16(0)
+	if answer != nil {
+		ancount = 1
+	}
+	binary.BigEndian.PutUint16(msg[6:8], ancount)
+	binary.BigEndian.PutUint16(msg[8:10], 0)
+	binary.BigEndian.PutUint16(msg[10:12], 0)
+	return append(msg, answer...)
+}
+
+func (s *Server) infof(format string, args ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Info(format, args...)
+	}
+}
+
+func (s *Server) warnf(format string, args ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Warn(format, args...)
+	}
+}
+
+func (s *Server) errorf(format string, args ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Error(format, args...)
+	}
+}
+
+func (s *Server) debugf(format string, args ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Debug(format, args...)
+	}
+}
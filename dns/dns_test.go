@@ -0,0 +1,204 @@
+// Package dns tests.
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wake/waketest"
+)
+
+// buildQuery returns a DNS query for name and qtype.
+func buildQuery(id uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	msg[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, classIN)
+}
+
+// exchange sends a query to addr and returns the reply.
+func exchange(t *testing.T, addr net.Addr, query []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(query)
+	buf := make([]byte, maxPacket)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("No reply: %v", err)
+	}
+	return buf[:n]
+}
+
+// newTestServer returns a started server for two devices, and a recorder
+// of its wakes.
+func newTestServer(t *testing.T, cfg Config) (*Server, *waketest.Recorder) {
+	t.Helper()
+
+	st, err := store.NewStore(filepath.Join(t.TempDir(), "devices.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	st.Add(store.Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.1.10"})
+	st.Add(store.Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:02", IP: "192.168.1.20", Aliases: []store.MACAlias{{MAC: "AA:BB:CC:DD:EE:03"}}})
+
+	waker, woken := waketest.NewService(t)
+
+	cfg.Listen = "127.0.0.1:0"
+	cfg.Domain = "home.lan"
+	cfg.Hosts = map[string]string{"nas": "AA:BB:CC:DD:EE:01", "pc.home.lan": "aa:bb:cc:dd:ee:02", "pc-wifi": "aa-bb-cc-dd-ee-03"}
+	s, err := New(st, waker, cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, woken
+}
+
+func TestServer_Answer(t *testing.T) {
+	s, woken := newTestServer(t, Config{})
+
+	reply := exchange(t, s.Addr(), buildQuery(0x1234, "NAS.home.lan.", typeA))
+	if binary.BigEndian.Uint16(reply[0:2]) != 0x1234 {
+		t.Error("Reply ID should match the query")
+	}
+	if reply[2]&0x80 == 0 || reply[3]&0x0f != rcodeSuccess {
+		t.Errorf("Expected a successful response, flags %x %x", reply[2], reply[3])
+	}
+	if binary.BigEndian.Uint16(reply[6:8]) != 1 {
+		t.Fatalf("Expected 1 answer, got %d", binary.BigEndian.Uint16(reply[6:8]))
+	}
+	if ip := net.IP(reply[len(reply)-4:]); !ip.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("Answer = %v, want 192.168.1.10", ip)
+	}
+	if w := woken.Requests(); len(w) != 1 || w[0].Source != wake.SourceDNS {
+		t.Fatalf("Expected one DNS wake, got %+v", w)
+	}
+
+	// AAAA for an IPv4-only device is an empty answer, and the cooldown
+	// suppresses a second wake
+	reply = exchange(t, s.Addr(), buildQuery(2, "nas.home.lan", typeAAAA))
+	if reply[3]&0x0f != rcodeSuccess || binary.BigEndian.Uint16(reply[6:8]) != 0 {
+		t.Errorf("Expected NODATA for AAAA, rcode %d answers %d", reply[3]&0x0f, binary.BigEndian.Uint16(reply[6:8]))
+	}
+	if w := woken.Requests(); len(w) != 1 {
+		t.Errorf("Cooldown should suppress repeated wakes, got %d", len(w))
+	}
+
+	// Hosts configured with the full domain match too
+	reply = exchange(t, s.Addr(), buildQuery(3, "pc.home.lan", typeA))
+	if binary.BigEndian.Uint16(reply[6:8]) != 1 {
+		t.Error("Expected an answer for pc.home.lan")
+	}
+
+	// Hosts mapped to an alias MAC get the device's IP
+	reply = exchange(t, s.Addr(), buildQuery(4, "pc-wifi.home.lan", typeA))
+	if binary.BigEndian.Uint16(reply[6:8]) != 1 {
+		t.Fatal("Expected an answer for a host mapped to an alias MAC")
+	}
+	if ip := net.IP(reply[len(reply)-4:]); !ip.Equal(net.ParseIP("192.168.1.20")) {
+		t.Errorf("Answer = %v, want 192.168.1.20", ip)
+	}
+}
+
+func TestServer_RenameMAC(t *testing.T) {
+	s, woken := newTestServer(t, Config{})
+
+	nas, err := s.store.GetByMAC("AA:BB:CC:DD:EE:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := *nas
+	changed.MAC = "AA:BB:CC:DD:EE:09"
+	if _, err := s.store.Replace(nas.ID, changed, store.Origin{}); err != nil {
+		t.Fatalf("Replace() error = %v", err)
+	}
+
+	if n := s.RenameMAC("aa-bb-cc-dd-ee-01", "AA:BB:CC:DD:EE:09"); n != 1 {
+		t.Fatalf("RenameMAC() = %d, want 1", n)
+	}
+	reply := exchange(t, s.Addr(), buildQuery(1, "nas.home.lan", typeA))
+	if binary.BigEndian.Uint16(reply[6:8]) != 1 {
+		t.Fatal("Expected an answer for nas after its MAC changed")
+	}
+	if ip := net.IP(reply[len(reply)-4:]); !ip.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("Answer = %v, want 192.168.1.10", ip)
+	}
+	if w := woken.Requests(); len(w) != 1 || w[0].MAC != "AA:BB:CC:DD:EE:09" {
+		t.Errorf("Expected a wake of the new MAC, got %+v", w)
+	}
+}
+
+func TestServer_SkipsOnlineDevices(t *testing.T) {
+	s, woken := newTestServer(t, Config{Online: func(mac string) bool { return true }})
+
+	exchange(t, s.Addr(), buildQuery(1, "nas.home.lan", typeA))
+	if w := woken.Requests(); len(w) != 0 {
+		t.Errorf("Online devices should not be woken, got %d wakes", len(w))
+	}
+}
+
+func TestServer_Unknown(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+
+	reply := exchange(t, s.Addr(), buildQuery(1, "unknown.home.lan", typeA))
+	if reply[3]&0x0f != rcodeNXDomain {
+		t.Errorf("Expected NXDOMAIN, got rcode %d", reply[3]&0x0f)
+	}
+}
+
+func TestServer_Forward(t *testing.T) {
+	// Fake upstream answering every query with a fixed rcode
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, maxPacket)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp := append([]byte(nil), buf[:n]...)
+			resp[2] |= 0x80
+			resp[3] = 5 // REFUSED, to tell it apart from local replies
+			upstream.WriteTo(resp, addr)
+		}
+	}()
+
+	s, _ := newTestServer(t, Config{Upstream: upstream.LocalAddr().String()})
+
+	reply := exchange(t, s.Addr(), buildQuery(7, "example.com", typeA))
+	if binary.BigEndian.Uint16(reply[0:2]) != 7 || reply[3]&0x0f != 5 {
+		t.Errorf("Expected the upstream reply, got rcode %d", reply[3]&0x0f)
+	}
+}
+
+func TestNew_InvalidHost(t *testing.T) {
+	if _, err := New(nil, nil, Config{Hosts: map[string]string{"nas": "invalid"}}); err == nil {
+		t.Error("New() should reject invalid MACs")
+	}
+}
@@ -0,0 +1,200 @@
+// Package events provides a publish/subscribe hub for live server events.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+)
+
+// Event types published by the server.
+const (
+	DeviceAdded   = "device.added"
+	DeviceUpdated = "device.updated"
+	DeviceDeleted = "device.deleted"
+	WakeSent      = "wake.sent"
+	WakeFailed    = "wake.failed"
+	DeviceOnline  = "device.online"
+	DeviceOffline = "device.offline"
+
+	// Resync tells a client that events were missed and it must reload
+	// its state, e.g. after the backlog overflowed or the server restarted.
+	Resync = "resync"
+)
+
+// DefaultBacklog is the number of events kept for resuming clients.
+const DefaultBacklog = 256
+
+// subscriberBuffer is the number of events queued per subscriber before
+// it is considered too slow and disconnected.
+const subscriberBuffer = 64
+
+// Event is a typed event with a sequence number.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// DeviceData is the payload of device added/updated/deleted events.
+type DeviceData struct {
+	Device   store.Device  `json:"device"`
+	Previous *store.Device `json:"previous,omitempty"`
+}
+
+// WakeData is the payload of wake sent/failed events.
+type WakeData struct {
+	MAC    string `json:"mac"`
+	Name   string `json:"name,omitempty"`
+	Source string `json:"source,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// StatusData is the payload of device online/offline events.
+type StatusData struct {
+	MAC  string `json:"mac"`
+	Name string `json:"name,omitempty"`
+}
+
+// Subscription receives events published after it was created.
+// C is closed when the subscriber falls too far behind or is cancelled.
+type Subscription struct {
+	C  <-chan Event
+	ch chan Event
+}
+
+// Hub distributes events to subscribers and keeps a bounded backlog.
+type Hub struct {
+	mu      sync.Mutex
+	seq     uint64
+	backlog []Event
+	size    int
+	subs    map[*Subscription]bool
+}
+
+// NewHub creates a hub keeping up to size events for resuming clients.
+func NewHub(size int) *Hub {
+	if size <= 0 {
+		size = DefaultBacklog
+	}
+	return &Hub{
+		size: size,
+		subs: make(map[*Subscription]bool),
+	}
+}
+
+// Publish assigns the next sequence number to an event and delivers it.
+func (h *Hub) Publish(eventType string, data interface{}) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	ev := Event{
+		ID:   h.seq,
+		Type: eventType,
+		Time: time.Now(),
+		Data: data,
+	}
+
+	h.backlog = append(h.backlog, ev)
+	if len(h.backlog) > h.size {
+		h.backlog = h.backlog[len(h.backlog)-h.size:]
+	}
+
+	for sub := range h.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			// Slow subscriber: disconnect it so it reconnects and resumes
+			// from the backlog instead of blocking everyone else.
+			delete(h.subs, sub)
+			close(sub.ch)
+		}
+	}
+
+	return ev
+}
+
+// Subscribe registers a subscriber. Events after lastID still in the
+// backlog are returned for replay. complete is false if some events after
+// lastID are no longer available, in which case the client must resync.
+// A lastID of 0 means a fresh client with nothing to replay.
+func (h *Hub) Subscribe(lastID uint64) (sub *Subscription, replay []Event, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, subscriberBuffer)
+	sub = &Subscription{C: ch, ch: ch}
+	h.subs[sub] = true
+
+	if lastID == 0 {
+		return sub, nil, true
+	}
+	if lastID > h.seq {
+		// Client saw events from a previous server run
+		return sub, nil, false
+	}
+
+	complete = true
+	if len(h.backlog) > 0 && h.backlog[0].ID > lastID+1 {
+		complete = false
+	}
+	for _, ev := range h.backlog {
+		if ev.ID > lastID {
+			replay = append(replay, ev)
+		}
+	}
+	return sub, replay, complete
+}
+
+// Unsubscribe removes a subscriber and closes its channel.
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// PublishStoreChanges publishes device events for every mutation of st.
+func (h *Hub) PublishStoreChanges(st *store.Store) {
+	st.OnChange(func(c store.Change) {
+		switch c.Op {
+		case store.OpAdd:
+			h.Publish(DeviceAdded, DeviceData{Device: c.Device})
+		case store.OpUpdate:
+			h.Publish(DeviceUpdated, DeviceData{Device: c.Device, Previous: c.Previous})
+		case store.OpDelete:
+			h.Publish(DeviceDeleted, DeviceData{Device: c.Device})
+		}
+	})
+}
+
+// PublishWakes publishes wake sent/failed events for every attempt made
+// through w, naming the device from st when known.
+func (h *Hub) PublishWakes(w *wake.Service, st *store.Store) {
+	w.OnWake(func(r wake.Result) {
+		data := WakeData{MAC: r.MAC, Source: r.Source}
+		if device, err := st.GetByMAC(r.MAC); err == nil {
+			data.Name = device.Name
+		}
+		if r.Err != nil {
+			data.Error = r.Err.Error()
+			h.Publish(WakeFailed, data)
+			return
+		}
+		h.Publish(WakeSent, data)
+	})
+}
+
+// LastID returns the sequence number of the most recent event.
+func (h *Hub) LastID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seq
+}
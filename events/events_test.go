@@ -0,0 +1,115 @@
+// Package events tests.
+package events
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hzhq1255/wolgate/store"
+)
+
+func TestHub_PublishSubscribe(t *testing.T) {
+	h := NewHub(10)
+
+	sub, replay, complete := h.Subscribe(0)
+	defer h.Unsubscribe(sub)
+
+	if len(replay) != 0 || !complete {
+		t.Errorf("Fresh subscriber should have no replay, got %d events", len(replay))
+	}
+
+	h.Publish(WakeSent, WakeData{MAC: "AA:BB:CC:DD:EE:FF"})
+	h.Publish(WakeFailed, WakeData{MAC: "AA:BB:CC:DD:EE:FF"})
+
+	first := <-sub.C
+	second := <-sub.C
+	if first.ID != 1 || first.Type != WakeSent {
+		t.Errorf("Unexpected first event: %+v", first)
+	}
+	if second.ID != 2 || second.Type != WakeFailed {
+		t.Errorf("Unexpected second event: %+v", second)
+	}
+}
+
+func TestHub_Resume(t *testing.T) {
+	h := NewHub(3)
+	for i := 0; i < 5; i++ {
+		h.Publish(DeviceOnline, nil)
+	}
+
+	// Events 3-5 are in the backlog
+	sub, replay, complete := h.Subscribe(3)
+	h.Unsubscribe(sub)
+	if !complete {
+		t.Error("Resume within backlog should be complete")
+	}
+	if len(replay) != 2 || replay[0].ID != 4 {
+		t.Errorf("Expected replay of events 4-5, got %+v", replay)
+	}
+
+	// Event 2 has been dropped from the backlog
+	sub, replay, complete = h.Subscribe(1)
+	h.Unsubscribe(sub)
+	if complete {
+		t.Error("Resume past backlog should be incomplete")
+	}
+	if len(replay) != 3 {
+		t.Errorf("Expected replay of remaining 3 events, got %d", len(replay))
+	}
+
+	// ID from a previous server run
+	sub, _, complete = h.Subscribe(100)
+	h.Unsubscribe(sub)
+	if complete {
+		t.Error("Unknown future ID should be incomplete")
+	}
+}
+
+func TestHub_SlowSubscriber(t *testing.T) {
+	h := NewHub(0)
+	sub, _, _ := h.Subscribe(0)
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		h.Publish(DeviceOnline, nil)
+	}
+
+	count := 0
+	for range sub.C {
+		count++
+	}
+	if count != subscriberBuffer {
+		t.Errorf("Expected %d buffered events before disconnect, got %d", subscriberBuffer, count)
+	}
+
+	// Unsubscribing a dropped subscriber must not panic
+	h.Unsubscribe(sub)
+}
+
+func TestHub_PublishStoreChanges(t *testing.T) {
+	st, err := store.NewStore(filepath.Join(t.TempDir(), "test.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	h := NewHub(0)
+	h.PublishStoreChanges(st)
+
+	sub, _, _ := h.Subscribe(0)
+	defer h.Unsubscribe(sub)
+
+	st.Add(store.Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:FF"})
+	st.Update("AA:BB:CC:DD:EE:FF", store.Device{Name: "Desktop"})
+	st.Delete("AA:BB:CC:DD:EE:FF")
+
+	for _, want := range []string{DeviceAdded, DeviceUpdated, DeviceDeleted} {
+		ev := <-sub.C
+		if ev.Type != want {
+			t.Errorf("Expected %s event, got %s", want, ev.Type)
+		}
+	}
+
+	ev := h.backlog[1]
+	data, ok := ev.Data.(DeviceData)
+	if !ok || data.Previous == nil || data.Previous.Name != "PC" || data.Device.Name != "Desktop" {
+		t.Errorf("Update event should carry old and new device, got %+v", ev.Data)
+	}
+}
@@ -0,0 +1,151 @@
+// Package hostsfile renders the device list as the MAC-to-name files of
+// DHCP servers: /etc/ethers, dnsmasq dhcp-host lines and OpenWrt host
+// sections.
+package hostsfile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// File formats.
+const (
+	Ethers  = "ethers"  // /etc/ethers lines
+	Dnsmasq = "dnsmasq" // dnsmasq dhcp-host= lines
+	OpenWrt = "openwrt" // OpenWrt UCI config host sections
+)
+
+// Formats are the supported formats.
+var Formats = []string{Ethers, Dnsmasq, OpenWrt}
+
+// ErrUnknownFormat is returned for a format not in Formats.
+var ErrUnknownFormat = errors.New("unknown hosts file format")
+
+// header starts every rendered file.
+const header = "# Generated by wolgate from its device list; changes will be overwritten"
+
+// ValidFormat reports whether format is one of Formats.
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// host is a device as written to a hosts file.
+type host struct {
+	name string
+	macs []string
+	ip   string
+}
+
+// Render writes devices to w in format. Each device is named by its
+// hostname, or else by its name made a valid hostname; devices left
+// without one are skipped, and repeated names get a numeric suffix.
+func Render(w io.Writer, format string, devices []store.Device) error {
+	if !ValidFormat(format) {
+		return fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, header)
+	for _, h := range hosts(devices) {
+		switch format {
+		case Ethers:
+			for _, mac := range h.macs {
+				fmt.Fprintf(bw, "%s %s\n", mac, h.name)
+			}
+		case Dnsmasq:
+			fields := append([]string{}, h.macs...)
+			if ip := net.ParseIP(h.ip); ip != nil && ip.To4() == nil {
+				fields = append(fields, "["+h.ip+"]")
+			} else if ip != nil {
+				fields = append(fields, h.ip)
+			}
+			fmt.Fprintf(bw, "dhcp-host=%s\n", strings.Join(append(fields, h.name), ","))
+		case OpenWrt:
+			fmt.Fprintf(bw, "\nconfig host\n")
+			fmt.Fprintf(bw, "\toption name %s\n", uciQuote(h.name))
+			fmt.Fprintf(bw, "\toption mac %s\n", uciQuote(strings.Join(h.macs, " ")))
+			if net.ParseIP(h.ip) != nil {
+				fmt.Fprintf(bw, "\toption ip %s\n", uciQuote(h.ip))
+			}
+			fmt.Fprintf(bw, "\toption dns '1'\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// hosts returns the devices that can be written, uniquely named.
+func hosts(devices []store.Device) []host {
+	var result []host
+	used := make(map[string]bool)
+	for _, d := range devices {
+		base := Hostname(d)
+		if base == "" {
+			continue
+		}
+		name := base
+		for n := 2; used[name]; n++ {
+			name = base + "-" + strconv.Itoa(n)
+		}
+		used[name] = true
+
+		h := host{name: name, ip: d.IP}
+		for _, mac := range d.MACs() {
+			if n, err := wol.NormalizeMAC(mac); err == nil {
+				h.macs = append(h.macs, strings.ToLower(n))
+			}
+		}
+		if len(h.macs) > 0 {
+			result = append(result, h)
+		}
+	}
+	return result
+}
+
+// Hostname returns the name a device is given in hosts files: its
+// hostname, or else its name, lowercase, with characters not allowed in
+// a hostname label replaced by dashes. The result may be empty.
+func Hostname(d store.Device) string {
+	name := d.Hostname
+	if name == "" {
+		name = d.Name
+	}
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.' && d.Hostname != "":
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	result := strings.Trim(b.String(), "-.")
+	limit := 63 // A label; a hostname may be a longer domain name
+	if d.Hostname != "" {
+		limit = 253
+	}
+	if len(result) > limit {
+		result = strings.TrimRight(result[:limit], "-.")
+	}
+	return result
+}
+
+// uciQuote quotes a UCI option value.
+func uciQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,146 @@
+// Package hostsfile tests.
+package hostsfile
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+)
+
+var testDevices = []store.Device{
+	{Name: "Living Room PC", MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.1.10",
+		Aliases: []store.MACAlias{{MAC: "aa-bb-cc-dd-ee-02"}}},
+	{Name: "NAS", Hostname: "nas.home.lan", MAC: "AA:BB:CC:DD:EE:03", IP: "fd00::3"},
+	{Name: "nas", MAC: "AA:BB:CC:DD:EE:04"},
+	{Name: "电视", MAC: "AA:BB:CC:DD:EE:05"},
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{Ethers, header + `
+aa:bb:cc:dd:ee:01 living-room-pc
+aa:bb:cc:dd:ee:02 living-room-pc
+aa:bb:cc:dd:ee:03 nas.home.lan
+aa:bb:cc:dd:ee:04 nas
+`},
+		{Dnsmasq, header + `
+dhcp-host=aa:bb:cc:dd:ee:01,aa:bb:cc:dd:ee:02,192.168.1.10,living-room-pc
+dhcp-host=aa:bb:cc:dd:ee:03,[fd00::3],nas.home.lan
+dhcp-host=aa:bb:cc:dd:ee:04,nas
+`},
+		{OpenWrt, header + `
+
+config host
+	option name 'living-room-pc'
+	option mac 'aa:bb:cc:dd:ee:01 aa:bb:cc:dd:ee:02'
+	option ip '192.168.1.10'
+	option dns '1'
+
+config host
+	option name 'nas.home.lan'
+	option mac 'aa:bb:cc:dd:ee:03'
+	option ip 'fd00::3'
+	option dns '1'
+
+config host
+	option name 'nas'
+	option mac 'aa:bb:cc:dd:ee:04'
+	option dns '1'
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Render(&buf, tt.format, testDevices); err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("Render() =\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+
+	if err := Render(&bytes.Buffer{}, "hosts", nil); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Render() error = %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestHostname(t *testing.T) {
+	tests := map[string]store.Device{
+		"living-room-pc": {Name: "  Living Room PC!"},
+		"nas.lan":        {Name: "NAS", Hostname: "NAS.lan"},
+		"pc-2":           {Name: "PC #2"},
+		"":               {Name: "..."},
+	}
+	for want, d := range tests {
+		if got := Hostname(d); got != want {
+			t.Errorf("Hostname(%+v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestSyncer(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewStore(filepath.Join(dir, "data.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	st.Create(store.Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, store.Origin{})
+
+	ethers := filepath.Join(dir, "ethers")
+	reloads := filepath.Join(dir, "reloads")
+	syncer, err := NewSyncer(st, Config{
+		Targets: []Target{{Format: Ethers, Path: ethers, Reload: "echo reload >> " + reloads}},
+		Delay:   10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSyncer() error = %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go syncer.Run(stop)
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			data, _ := os.ReadFile(ethers)
+			if strings.Contains(string(data), want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %q in the exported file, got %q", want, data)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor("aa:bb:cc:dd:ee:01 pc")
+	st.Create(store.Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}, store.Origin{})
+	waitFor("aa:bb:cc:dd:ee:02 nas")
+
+	// A sync without changes leaves the file and skips the reload
+	if err := syncer.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if data, _ := os.ReadFile(reloads); strings.Count(string(data), "reload") != 2 {
+		t.Errorf("Expected 2 reloads, got %q", data)
+	}
+
+	if _, err := NewSyncer(st, Config{Targets: []Target{{Format: "hosts", Path: ethers}}}); err == nil {
+		t.Error("NewSyncer() with an unknown format should fail")
+	}
+	if _, err := WriteTarget(Target{Format: Ethers, Path: filepath.Join(dir, "x"), Reload: "exit 3"}, nil, time.Second); err == nil {
+		t.Error("WriteTarget() with a failing reload should fail")
+	}
+}
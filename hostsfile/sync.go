@@ -0,0 +1,166 @@
+// Package hostsfile keeps rendered hosts files in sync with the device list.
+package hostsfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+)
+
+// Default settings.
+const (
+	DefaultDelay         = time.Second
+	DefaultReloadTimeout = 30 * time.Second
+)
+
+// Target is a file kept in sync with the device list.
+type Target struct {
+	Format string // One of Formats
+	Path   string
+	Reload string // Shell command run after the file is rewritten; optional
+}
+
+// Config holds the syncer configuration.
+type Config struct {
+	Targets []Target
+	// Delay gathers a burst of changes, such as an import, into one
+	// rewrite.
+	Delay         time.Duration
+	ReloadTimeout time.Duration  // Limit on each reload command
+	Logger        *logger.Logger // Optional logger
+}
+
+// Syncer rewrites its targets whenever the device list changes.
+type Syncer struct {
+	store   *store.Store
+	cfg     Config
+	changed chan struct{}
+}
+
+// NewSyncer creates a syncer for the targets in cfg, which must have known
+// formats and paths.
+func NewSyncer(st *store.Store, cfg Config) (*Syncer, error) {
+	for _, t := range cfg.Targets {
+		if !ValidFormat(t.Format) {
+			return nil, fmt.Errorf("export %s: %w: %q", t.Path, ErrUnknownFormat, t.Format)
+		}
+		if t.Path == "" {
+			return nil, fmt.Errorf("export %s: path is required", t.Format)
+		}
+	}
+	if cfg.Delay <= 0 {
+		cfg.Delay = DefaultDelay
+	}
+	if cfg.ReloadTimeout <= 0 {
+		cfg.ReloadTimeout = DefaultReloadTimeout
+	}
+
+	s := &Syncer{store: st, cfg: cfg, changed: make(chan struct{}, 1)}
+	st.OnChange(func(store.Change) {
+		select {
+		case s.changed <- struct{}{}:
+		default:
+		}
+	})
+	return s, nil
+}
+
+// Run writes the targets, then rewrites them after each change to the
+// device list, until stop is closed.
+func (s *Syncer) Run(stop <-chan struct{}) {
+	s.Sync()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.changed:
+		}
+
+		timer := time.NewTimer(s.cfg.Delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		select {
+		case <-s.changed:
+		default:
+		}
+		s.Sync()
+	}
+}
+
+// Sync writes every target whose content changed and runs its reload
+// command, and returns the first error.
+func (s *Syncer) Sync() error {
+	devices := s.store.List()
+	var first error
+	for _, t := range s.cfg.Targets {
+		written, err := WriteTarget(t, devices, s.cfg.ReloadTimeout)
+		switch {
+		case err != nil:
+			s.errorf("Failed to export devices to %s: %v", t.Path, err)
+			if first == nil {
+				first = err
+			}
+		case written:
+			s.infof("Exported %d device(s) to %s", len(devices), t.Path)
+		}
+	}
+	return first
+}
+
+// WriteTarget renders devices to the target's file, atomically, and runs
+// its reload command. A file that already has the content is left alone,
+// and reports false.
+func WriteTarget(t Target, devices []store.Device, reloadTimeout time.Duration) (bool, error) {
+	var buf bytes.Buffer
+	if err := Render(&buf, t.Format, devices); err != nil {
+		return false, err
+	}
+	if current, err := os.ReadFile(t.Path); err == nil && bytes.Equal(current, buf.Bytes()) {
+		return false, nil
+	}
+	if err := atomicfile.WriteFile(t.Path, buf.Bytes(), 0644); err != nil {
+		return false, err
+	}
+	if t.Reload == "" {
+		return true, nil
+	}
+	if err := RunReload(t.Reload, reloadTimeout); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// RunReload runs a reload command with sh, and returns an error with its
+// output if it fails or takes longer than timeout.
+func RunReload(command string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("reload command %q: %v: %s", command, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func (s *Syncer) infof(format string, args ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Info(format, args...)
+	}
+}
+
+func (s *Syncer) errorf(format string, args ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Error(format, args...)
+	}
+}
@@ -0,0 +1,345 @@
+// Package inventory reads and writes device lists as CSV and JSON files,
+// for exports and bulk imports.
+package inventory
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+)
+
+// File formats.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// Columns are the CSV columns written by Write, in order. All but the
+// timestamps are read back by Read; id only matches stored devices.
+var Columns = []string{
+	"id", "name", "mac", "aliases", "ip", "hostname", "group", "type", "tags", "notes",
+	"created_at", "updated_at", "last_woken_at",
+}
+
+// importable are the CSV columns Read sets on a device.
+var importable = map[string]bool{
+	"id": true, "name": true, "mac": true, "aliases": true, "ip": true,
+	"hostname": true, "group": true, "type": true, "tags": true, "notes": true,
+}
+
+// storeFields are the device fields owned by the store, never imported.
+var storeFields = map[string]bool{
+	"revision": true, "created_at": true, "updated_at": true, "last_woken_at": true, "managed": true,
+}
+
+// Record is a device read from a file.
+type Record struct {
+	Row    int // Position in the file, the first device being 1
+	Device store.Device
+	Fields []string // JSON names of the fields the record gives
+	Err    error    // Why the record could not be read
+}
+
+// Result is the outcome of importing one record.
+type Result struct {
+	Row    int           `json:"row"`
+	Op     string        `json:"op,omitempty"` // See store.ImportOutcome
+	Device *store.Device `json:"device,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Report summarizes an import.
+type Report struct {
+	DryRun    bool     `json:"dry_run"`
+	Added     int      `json:"added"`
+	Updated   int      `json:"updated"`
+	Skipped   int      `json:"skipped"`
+	Unchanged int      `json:"unchanged"`
+	Failed    int      `json:"failed"`
+	Ignored   []string `json:"ignored_columns,omitempty"` // CSV columns not imported
+	Rows      []Result `json:"rows"`
+}
+
+// FormatOf returns the format of a file by its name's extension, or "".
+func FormatOf(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return FormatCSV
+	case ".json":
+		return FormatJSON
+	}
+	return ""
+}
+
+// Write writes devices to w in format.
+func Write(w io.Writer, format string, devices []store.Device) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(devices)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(Columns)
+		for _, d := range devices {
+			cw.Write(row(d))
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// row returns the CSV columns of a device.
+func row(d store.Device) []string {
+	aliases := make([]string, len(d.Aliases))
+	for i, a := range d.Aliases {
+		aliases[i] = a.MAC
+	}
+	lastWoken := ""
+	if d.LastWokenAt != nil {
+		lastWoken = d.LastWokenAt.Format(time.RFC3339)
+	}
+	return []string{
+		d.ID, d.Name, d.MAC, strings.Join(aliases, ","), d.IP, d.Hostname, d.Group, d.Type,
+		strings.Join(d.Tags, ","), d.Notes,
+		d.CreatedAt.Format(time.RFC3339), d.UpdatedAt.Format(time.RFC3339), lastWoken,
+	}
+}
+
+// Read reads the devices in a file in format. For CSV, the first line is
+// the header; columns are matched to Columns by name, ignoring case,
+// spaces and dashes, or by mapping, from header to column, which takes
+// precedence. Lists are separated by commas or semicolons, and empty cells
+// are not given. JSON is an array of devices, or an object with one under
+// "devices", such as a data file. Read also returns the CSV columns it
+// ignored.
+func Read(r io.Reader, format string, mapping map[string]string) ([]Record, []string, error) {
+	switch format {
+	case FormatJSON:
+		records, err := readJSON(r)
+		return records, nil, err
+	case FormatCSV:
+		return readCSV(r, mapping)
+	}
+	return nil, nil, fmt.Errorf("unknown format %q", format)
+}
+
+// readJSON reads a JSON file of devices.
+func readJSON(r io.Reader) ([]Record, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var items []json.RawMessage
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var doc struct {
+			Devices []json.RawMessage `json:"devices"`
+		}
+		err = json.Unmarshal(data, &doc)
+		items = doc.Devices
+	} else {
+		err = json.Unmarshal(data, &items)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	records := make([]Record, len(items))
+	for i, item := range items {
+		records[i].Row = i + 1
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(item, &fields); err != nil {
+			records[i].Err = errors.New("not a device object")
+			continue
+		}
+		if err := json.Unmarshal(item, &records[i].Device); err != nil {
+			records[i].Err = fmt.Errorf("invalid device: %v", err)
+			continue
+		}
+		for f := range fields {
+			if !storeFields[f] {
+				records[i].Fields = append(records[i].Fields, f)
+			}
+		}
+	}
+	return records, nil
+}
+
+// readCSV reads a CSV file of devices with a header line.
+func readCSV(r io.Reader, mapping map[string]string) ([]Record, []string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, errors.New("empty CSV file")
+		}
+		return nil, nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+
+	mapped := make(map[string]string, len(mapping))
+	for from, to := range mapping {
+		to = columnName(to)
+		if !importable[to] {
+			return nil, nil, fmt.Errorf("cannot map %q to unknown column %q", from, to)
+		}
+		mapped[strings.ToLower(strings.TrimSpace(from))] = to
+	}
+	columns := make([]string, len(header))
+	var ignored []string
+	for i, h := range header {
+		h = strings.TrimPrefix(h, "\ufeff") // Byte order mark, as written by Excel
+		column, ok := mapped[strings.ToLower(strings.TrimSpace(h))]
+		if !ok {
+			column = columnName(h)
+		}
+		if importable[column] {
+			columns[i] = column
+		} else {
+			ignored = append(ignored, h)
+		}
+	}
+
+	var records []Record
+	for {
+		cells, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		record := Record{Row: len(records) + 1}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, nil, err
+			}
+			record.Err = parseErr.Err
+			records = append(records, record)
+			continue
+		}
+		for i, cell := range cells {
+			cell = strings.TrimSpace(cell)
+			if i >= len(columns) || columns[i] == "" || cell == "" {
+				continue
+			}
+			setColumn(&record.Device, columns[i], cell)
+			record.Fields = append(record.Fields, columns[i])
+		}
+		records = append(records, record)
+	}
+	return records, ignored, nil
+}
+
+// ParseMapping parses CSV header mappings given as "header=column".
+func ParseMapping(values []string) (map[string]string, error) {
+	mapping := make(map[string]string, len(values))
+	for _, v := range values {
+		from, to, ok := strings.Cut(v, "=")
+		if !ok || strings.TrimSpace(from) == "" {
+			return nil, fmt.Errorf("invalid mapping %q, want header=column", v)
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
+// columnName returns the column a CSV header names.
+func columnName(header string) string {
+	name := strings.ToLower(strings.TrimSpace(header))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+// setColumn sets the field of d named by a CSV column.
+func setColumn(d *store.Device, column, value string) {
+	switch column {
+	case "id":
+		d.ID = value
+	case "name":
+		d.Name = value
+	case "mac":
+		d.MAC = value
+	case "aliases":
+		for _, mac := range splitList(value) {
+			d.Aliases = append(d.Aliases, store.MACAlias{MAC: mac})
+		}
+	case "ip":
+		d.IP = value
+	case "hostname":
+		d.Hostname = value
+	case "group":
+		d.Group = value
+	case "type":
+		d.Type = strings.ToLower(value)
+	case "tags":
+		d.Tags = splitList(value)
+	case "notes":
+		d.Notes = value
+	}
+}
+
+// splitList splits a list separated by commas or semicolons.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Import imports records into st, and reports the outcome of each.
+// Records that could not be read are reported as failed.
+func Import(st *store.Store, records []Record, opts store.ImportOptions) (Report, error) {
+	report := Report{DryRun: opts.DryRun, Rows: make([]Result, len(records))}
+	var items []store.ImportItem
+	var rows []int
+	for i, r := range records {
+		report.Rows[i] = Result{Row: r.Row}
+		if r.Err != nil {
+			report.Rows[i].Error = r.Err.Error()
+			continue
+		}
+		items = append(items, store.ImportItem{Device: r.Device, Fields: r.Fields})
+		rows = append(rows, i)
+	}
+
+	outcomes, err := st.Import(items, opts)
+	if err != nil {
+		return report, err
+	}
+	for n, o := range outcomes {
+		result := &report.Rows[rows[n]]
+		if o.Err != nil {
+			result.Error = o.Err.Error()
+			continue
+		}
+		device := o.Device
+		result.Op, result.Device = o.Op, &device
+	}
+
+	for _, r := range report.Rows {
+		switch r.Op {
+		case store.OpAdd:
+			report.Added++
+		case store.OpUpdate:
+			report.Updated++
+		case store.ImportSkipped:
+			report.Skipped++
+		case store.ImportUnchanged:
+			report.Unchanged++
+		default:
+			report.Failed++
+		}
+	}
+	return report, nil
+}
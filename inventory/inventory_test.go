@@ -0,0 +1,117 @@
+// Package inventory tests.
+package inventory
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hzhq1255/wolgate/store"
+)
+
+func TestWriteRead_CSV(t *testing.T) {
+	devices := []store.Device{{
+		ID: "abc", Name: "PC", MAC: "AA:BB:CC:DD:EE:01", IP: "192.168.1.10",
+		Aliases: []store.MACAlias{{MAC: "AA:BB:CC:DD:EE:11"}}, Tags: []string{"lab", "desk"}, Notes: "a, b",
+	}}
+	var buf bytes.Buffer
+	if err := Write(&buf, FormatCSV, devices); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	records, ignored, err := Read(&buf, FormatCSV, nil)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Read() = %+v, %v", records, err)
+	}
+	if strings.Join(ignored, ",") != "created_at,updated_at,last_woken_at" {
+		t.Errorf("Ignored columns = %v", ignored)
+	}
+	d := records[0].Device
+	if d.ID != "abc" || d.Name != "PC" || d.Notes != "a, b" || len(d.Aliases) != 1 || len(d.Tags) != 2 {
+		t.Errorf("Read device = %+v", d)
+	}
+	if strings.Join(records[0].Fields, ",") != "id,name,mac,aliases,ip,tags,notes" {
+		t.Errorf("Fields = %v", records[0].Fields)
+	}
+}
+
+func TestRead_CSVMapping(t *testing.T) {
+	data := "\ufeffHOSTNAME,Ethernet,Label,Owner\nnas.lan,aa-bb-cc-dd-ee-02,NAS,me\n\"unterminated\n"
+	mapping, err := ParseMapping([]string{"Ethernet=mac", "label=name"})
+	if err != nil {
+		t.Fatalf("ParseMapping() error = %v", err)
+	}
+	records, ignored, err := Read(strings.NewReader(data), FormatCSV, mapping)
+	if err != nil || len(records) != 2 || len(ignored) != 1 || ignored[0] != "Owner" {
+		t.Fatalf("Read() = %+v, %v, %v", records, ignored, err)
+	}
+	if d := records[0].Device; d.Hostname != "nas.lan" || d.MAC != "aa-bb-cc-dd-ee-02" || d.Name != "NAS" {
+		t.Errorf("Read device = %+v", d)
+	}
+	if records[1].Err == nil {
+		t.Error("Expected an error for a malformed row")
+	}
+
+	if _, err := ParseMapping([]string{"Ethernet"}); err == nil {
+		t.Error("ParseMapping() without a column should fail")
+	}
+	if _, _, err := Read(strings.NewReader(data), FormatCSV, map[string]string{"Label": "owner"}); err == nil {
+		t.Error("Read() mapping to an unknown column should fail")
+	}
+}
+
+func TestRead_JSON(t *testing.T) {
+	data := `{"version": 8, "devices": [
+		{"name": "PC", "mac": "AA:BB:CC:DD:EE:01", "revision": 3, "managed": true},
+		"PC",
+		{"name": 1}
+	]}`
+	records, _, err := Read(strings.NewReader(data), FormatJSON, nil)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Read() = %+v, %v", records, err)
+	}
+	if strings.Join(records[0].Fields, ",") == "" || strings.Contains(strings.Join(records[0].Fields, ","), "revision") {
+		t.Errorf("Fields = %v", records[0].Fields)
+	}
+	if records[1].Err == nil || records[2].Err == nil {
+		t.Errorf("Expected errors for invalid devices, got %+v", records[1:])
+	}
+
+	if _, _, err := Read(strings.NewReader("[{"), FormatJSON, nil); err == nil {
+		t.Error("Read() of invalid JSON should fail")
+	}
+}
+
+func TestImport(t *testing.T) {
+	st, err := store.NewStore(filepath.Join(t.TempDir(), "test.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	st.Create(store.Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, store.Origin{})
+
+	data := "name,mac\nPC,AA:BB:CC:DD:EE:01\nNAS,AA:BB:CC:DD:EE:02\n\"bad\n"
+	records, _, _ := Read(strings.NewReader(data), FormatCSV, nil)
+	report, err := Import(st, records, store.ImportOptions{})
+	if err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if report.Added != 1 || report.Skipped != 1 || report.Failed != 1 || len(report.Rows) != 3 {
+		t.Errorf("Report = %+v", report)
+	}
+	if r := report.Rows[1]; r.Row != 2 || r.Op != store.OpAdd || r.Device == nil || r.Device.Name != "NAS" {
+		t.Errorf("Row 2 = %+v", r)
+	}
+	if r := report.Rows[2]; r.Row != 3 || r.Error == "" {
+		t.Errorf("Row 3 = %+v", r)
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	tests := map[string]string{"devices.CSV": FormatCSV, "data.json": FormatJSON, "devices.txt": "", "": ""}
+	for name, want := range tests {
+		if got := FormatOf(name); got != want {
+			t.Errorf("FormatOf(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package leases parses ISC dhcpd lease databases.
+package leases
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// parseDHCPD parses a dhcpd.leases file: lease declarations, and the host
+// declarations dhcpd records for reservations made over OMAPI.
+//
+//	lease 192.168.1.10 {
+//	  hardware ethernet aa:bb:cc:dd:ee:ff;
+//	  client-hostname "pc";
+//	}
+//	host nas {
+//	  hardware ethernet 11:22:33:44:55:66;
+//	  fixed-address 192.168.1.5;
+//	}
+//
+// Other declarations, such as DHCPv6 ia-na blocks, are skipped.
+func parseDHCPD(r io.Reader) ([]Entry, error) {
+	tokens, err := dhcpdTokens(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for len(tokens) > 0 {
+		var header, body []string
+		header, body, tokens = nextDeclaration(tokens)
+		if len(header) != 2 || (header[0] != "lease" && header[0] != "host") {
+			continue
+		}
+		entry, ok := dhcpdEntry(header, body)
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// dhcpdEntry returns the host a lease or host declaration describes, from
+// the statements of its body.
+func dhcpdEntry(header, body []string) (Entry, bool) {
+	var entry Entry
+	var mac string
+	if header[0] == "lease" {
+		entry.IP = header[1]
+	}
+	for len(body) > 0 {
+		var stmt []string
+		stmt, _, body = nextDeclaration(body)
+		switch {
+		case len(stmt) == 3 && stmt[0] == "hardware" && stmt[1] == "ethernet":
+			mac = stmt[2]
+		case len(stmt) == 2 && stmt[0] == "client-hostname":
+			entry.Hostname = stmt[1]
+		case len(stmt) == 2 && stmt[0] == "fixed-address":
+			entry.IP = stmt[1]
+		case len(stmt) == 1 && stmt[0] == "deleted":
+			return Entry{}, false
+		}
+	}
+	if header[0] == "host" && entry.Hostname == "" {
+		entry.Hostname = header[1]
+	}
+	var ok bool
+	entry.MAC, ok = normalizeMAC(mac)
+	return entry, ok
+}
+
+// nextDeclaration splits the first statement off tokens: its words, the
+// tokens of its block if it has one, and the tokens after it.
+func nextDeclaration(tokens []string) (words, block, rest []string) {
+	for i, t := range tokens {
+		switch t {
+		case ";":
+			return tokens[:i], nil, tokens[i+1:]
+		case "{":
+			depth := 0
+			for j := i; j < len(tokens); j++ {
+				switch tokens[j] {
+				case "{":
+					depth++
+				case "}":
+					depth--
+				}
+				if depth == 0 {
+					return tokens[:i], tokens[i+1 : j], tokens[j+1:]
+				}
+			}
+			return tokens[:i], tokens[i+1:], nil
+		case "}":
+			// Unbalanced; skip it
+			return tokens[:i], nil, tokens[i+1:]
+		}
+	}
+	return tokens, nil, nil
+}
+
+// dhcpdTokens splits a dhcpd file into words, quoted strings (unquoted),
+// braces and semicolons, dropping comments.
+func dhcpdTokens(r io.Reader) ([]string, error) {
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for i := 0; i < len(line); {
+			c := line[i]
+			switch {
+			case c == '#':
+				i = len(line)
+			case c == '{' || c == '}' || c == ';':
+				tokens = append(tokens, string(c))
+				i++
+			case c == '"':
+				end := i + 1
+				for end < len(line) && line[end] != '"' {
+					if line[end] == '\\' {
+						end++
+					}
+					end++
+				}
+				tokens = append(tokens, strings.ReplaceAll(line[i+1:min(end, len(line))], `\"`, `"`))
+				i = end + 1
+			case unicode.IsSpace(rune(c)):
+				i++
+			default:
+				end := i
+				for end < len(line) && !strings.ContainsRune(" \t{};\"#", rune(line[end])) {
+					end++
+				}
+				tokens = append(tokens, line[i:end])
+				i = end
+			}
+		}
+	}
+	return tokens, scanner.Err()
+}
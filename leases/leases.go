@@ -0,0 +1,242 @@
+// Package leases reads the hosts known to DHCP servers from their lease
+// files and static lease configs, for device discovery.
+package leases
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Lease file formats.
+const (
+	Dnsmasq = "dnsmasq" // dnsmasq lease file
+	DHCPD   = "dhcpd"   // ISC dhcpd dhcpd.leases
+	Odhcpd  = "odhcpd"  // odhcpd lease file (its leasefile option)
+	Ethers  = "ethers"  // /etc/ethers
+	OpenWrt = "openwrt" // OpenWrt /etc/config/dhcp host sections
+)
+
+// Formats are the supported formats, in the order they are offered.
+var Formats = []string{Dnsmasq, DHCPD, Odhcpd, Ethers, OpenWrt}
+
+// DefaultPaths are the usual locations of each format's file.
+var DefaultPaths = map[string]string{
+	Dnsmasq: "/tmp/dhcp.leases",
+	DHCPD:   "/var/lib/dhcp/dhcpd.leases",
+	Odhcpd:  "/tmp/hosts/odhcpd",
+	Ethers:  "/etc/ethers",
+	OpenWrt: "/etc/config/dhcp",
+}
+
+// ErrUnknownFormat is returned for a format not in Formats.
+var ErrUnknownFormat = errors.New("unknown lease file format")
+
+// Entry is a host known to a DHCP server.
+type Entry struct {
+	MAC      string   // Lowercase, colon-separated
+	Aliases  []string // Further MACs of the same host
+	IP       string   // Leased or reserved address, if any
+	Hostname string   // Name the host gave or was given, if any
+}
+
+// invalidMACs are placeholder MACs never offered for import.
+var invalidMACs = map[string]bool{
+	"00:00:00:00:00:00": true,
+	"ff:ff:ff:ff:ff:ff": true,
+}
+
+// ParsePath parses the file at path in format.
+func ParsePath(format, path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease file: %w", err)
+	}
+	defer file.Close()
+	return Parse(format, file)
+}
+
+// Parse parses a file in format. Hosts are returned once, in the order
+// first seen; later lines of a file update earlier ones, as DHCP servers
+// append renewed leases.
+func Parse(format string, r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	var err error
+	switch format {
+	case Dnsmasq:
+		entries, err = parseLines(r, parseDnsmasqLine)
+	case DHCPD:
+		entries, err = parseDHCPD(r)
+	case Odhcpd:
+		entries, err = parseLines(r, parseOdhcpdLine)
+	case Ethers:
+		entries, err = parseLines(r, parseEthersLine)
+	case OpenWrt:
+		entries, err = parseOpenWrt(r)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s lease file: %w", format, err)
+	}
+	return merge(entries), nil
+}
+
+// parseLines parses a file of one host per line with parse, which reports
+// false for lines that are not hosts.
+func parseLines(r io.Reader, parse func(line string) (Entry, bool)) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if entry, ok := parse(strings.TrimSpace(scanner.Text())); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// parseDnsmasqLine parses a dnsmasq lease:
+// <expiry> <mac> <ip> <hostname or *> <client-id or *>
+// DHCPv6 leases, which have an IAID in place of the MAC, are skipped.
+func parseDnsmasqLine(line string) (Entry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return Entry{}, false
+	}
+	mac, ok := normalizeMAC(fields[1])
+	if !ok {
+		return Entry{}, false
+	}
+	entry := Entry{MAC: mac, IP: fields[2]}
+	if fields[3] != "*" {
+		entry.Hostname = fields[3]
+	}
+	return entry, true
+}
+
+// parseOdhcpdLine parses a lease written by odhcpd, a comment ahead of the
+// hosts lines:
+// # <iface> <hwaddr or DUID> <"ipv4" or IAID> <hostname or -> <valid> <id> <length> <addr/len>...
+// DHCPv6 leases give a MAC only through a link-layer DUID.
+func parseOdhcpdLine(line string) (Entry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "#" {
+		return Entry{}, false
+	}
+	id := strings.ToLower(fields[2])
+	if fields[3] != "ipv4" {
+		switch {
+		case strings.HasPrefix(id, "00030001") && len(id) == 20: // DUID-LL, Ethernet
+			id = id[8:]
+		case strings.HasPrefix(id, "00010001") && len(id) == 28: // DUID-LLT, Ethernet
+			id = id[16:]
+		default:
+			return Entry{}, false
+		}
+	}
+	mac, ok := normalizeMAC(id)
+	if !ok {
+		return Entry{}, false
+	}
+	entry := Entry{MAC: mac}
+	if host := fields[4]; host != "-" && !strings.HasPrefix(host, `broken\x20`) {
+		entry.Hostname = host
+	}
+	if len(fields) > 8 {
+		entry.IP, _, _ = strings.Cut(fields[8], "/")
+	}
+	return entry, true
+}
+
+// parseEthersLine parses an /etc/ethers line: <mac> <hostname or ip>.
+func parseEthersLine(line string) (Entry, bool) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return Entry{}, false
+	}
+	mac, ok := normalizeMAC(fields[0])
+	if !ok {
+		return Entry{}, false
+	}
+	entry := Entry{MAC: mac}
+	if net.ParseIP(fields[1]) != nil {
+		entry.IP = fields[1]
+	} else {
+		entry.Hostname = fields[1]
+	}
+	return entry, true
+}
+
+// normalizeMAC returns mac lowercase and colon-separated, also accepting
+// the unpadded octets of /etc/ethers and bare hex, and reports whether it
+// is a usable MAC.
+func normalizeMAC(mac string) (string, bool) {
+	if parts := strings.Split(mac, ":"); len(parts) == 6 {
+		for i, p := range parts {
+			if len(p) == 1 {
+				parts[i] = "0" + p
+			}
+		}
+		mac = strings.Join(parts, ":")
+	} else if len(mac) == 12 && !strings.ContainsAny(mac, ":-.") {
+		mac = mac[0:4] + "." + mac[4:8] + "." + mac[8:12]
+	}
+	n, err := wol.NormalizeMAC(mac)
+	if err != nil {
+		return "", false
+	}
+	n = strings.ToLower(n)
+	return n, !invalidMACs[n]
+}
+
+// merge combines the entries for the same MAC into the first, with the
+// fields set by later entries, except that an IPv6 address does not
+// replace an IPv4 one.
+func merge(entries []Entry) []Entry {
+	index := make(map[string]int)
+	var merged []Entry
+	for _, e := range entries {
+		i, ok := index[e.MAC]
+		if !ok {
+			index[e.MAC] = len(merged)
+			merged = append(merged, e)
+			continue
+		}
+		m := &merged[i]
+		if e.IP != "" && (m.IP == "" || !isIPv4(m.IP) || isIPv4(e.IP)) {
+			m.IP = e.IP
+		}
+		if e.Hostname != "" {
+			m.Hostname = e.Hostname
+		}
+		for _, alias := range e.Aliases {
+			if !containsMAC(m.Aliases, alias) {
+				m.Aliases = append(m.Aliases, alias)
+			}
+		}
+	}
+	return merged
+}
+
+// isIPv4 reports whether s is an IPv4 address.
+func isIPv4(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() != nil
+}
+
+// containsMAC reports whether macs contains mac.
+func containsMAC(macs []string, mac string) bool {
+	for _, m := range macs {
+		if m == mac {
+			return true
+		}
+	}
+	return false
+}
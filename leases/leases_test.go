@@ -0,0 +1,140 @@
+// Package leases tests.
+package leases
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		want   []Entry
+	}{
+		{Dnsmasq, `1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 pc 01:aa:bb:cc:dd:ee:01
+1700000000 AA:BB:CC:DD:EE:02 192.168.1.11 * *
+duid 00:01:00:01:2a:2b:2c:2d:aa:bb:cc:dd:ee:03
+1700000000 1234567 fd00::10 pc6 00:01:00:01:2a:2b:2c:2d:aa:bb:cc:dd:ee:03
+1700000100 aa:bb:cc:dd:ee:01 192.168.1.12 desktop *
+`, []Entry{
+			{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.12", Hostname: "desktop"},
+			{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.11"},
+		}},
+		{DHCPD, `# The format of this file is documented in the dhcpd.leases(5) manual page.
+authoring-byte-order little-endian;
+server-duid "\000\001\000\001";
+
+lease 192.168.1.10 {
+  starts 4 2024/01/04 10:00:00;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+  uid "\001\252\273\314\335\356\001";
+  client-hostname "pc";
+}
+ia-na "\001\000" {
+  iaaddr fd00::10 {
+    binding state active;
+  }
+}
+host nas {
+  dynamic;
+  hardware ethernet aa:bb:cc:dd:ee:02;
+  fixed-address 192.168.1.5;
+}
+host old {
+  dynamic;
+  deleted;
+}
+lease 192.168.1.10 {
+  binding state free;
+  hardware ethernet aa:bb:cc:dd:ee:01;
+}
+`, []Entry{
+			{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.10", Hostname: "pc"},
+			{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.5", Hostname: "nas"},
+		}},
+		{Odhcpd, `# br-lan 000300012a2b2c2d2e01 5f2d pc 1700000000 100 128 fd00::10/128 fd00::11/128
+fd00::10 pc
+# br-lan aabbccddee01 ipv4 pc 1700000000 c0a8010a 32 192.168.1.10/32
+# br-lan 0002000000090c0000 1 tv 1700000000 101 128 fd00::20/128
+# br-lan aabbccddee02 ipv4 broken\x20name 1700000000 c0a8010b 32 192.168.1.11/32
+# br-lan aabbccddee03 ipv4 - 1700000000 c0a8010c 32
+`, []Entry{
+			{MAC: "2a:2b:2c:2d:2e:01", IP: "fd00::10", Hostname: "pc"},
+			{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.10", Hostname: "pc"},
+			{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.11"},
+			{MAC: "aa:bb:cc:dd:ee:03"},
+		}},
+		{Ethers, `# /etc/ethers
+8:0:20:1:2:3    sun
+AA-BB-CC-DD-EE-02 192.168.1.11 # printer
+00:00:00:00:00:00 nobody
+broken
+`, []Entry{
+			{MAC: "08:00:20:01:02:03", Hostname: "sun"},
+			{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.11"},
+		}},
+		{OpenWrt, `config dnsmasq
+	option domain 'lan'
+
+config host
+	option name 'nas'
+	option dns '1'
+	option mac '11:22:33:44:55:66 11:22:33:44:55:67'
+	option ip '192.168.1.5'
+
+config host 'tv'
+	option name "tv"
+	list mac '11:22:33:44:55:68'
+	list mac '11:22:33:44:55:69' # wifi
+
+config host
+	option name 'nomac'
+	option ip '192.168.1.9'
+`, []Entry{
+			{MAC: "11:22:33:44:55:66", Aliases: []string{"11:22:33:44:55:67"}, IP: "192.168.1.5", Hostname: "nas"},
+			{MAC: "11:22:33:44:55:68", Aliases: []string{"11:22:33:44:55:69"}, Hostname: "tv"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := Parse(tt.format, strings.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			for i := range got {
+				if len(got[i].Aliases) == 0 {
+					got[i].Aliases = nil
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_UnknownFormat(t *testing.T) {
+	if _, err := Parse("hosts", strings.NewReader("")); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Parse() error = %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ethers")
+	os.WriteFile(path, []byte("aa:bb:cc:dd:ee:01 pc\n"), 0644)
+	entries, err := ParsePath(Ethers, path)
+	if err != nil || len(entries) != 1 || entries[0].Hostname != "pc" {
+		t.Errorf("ParsePath() = %+v, %v", entries, err)
+	}
+
+	if _, err := ParsePath(Ethers, filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ParsePath() of a missing file error = %v", err)
+	}
+}
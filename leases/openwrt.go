@@ -0,0 +1,97 @@
+// Package leases parses OpenWrt static leases.
+package leases
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// parseOpenWrt parses the host sections of an OpenWrt /etc/config/dhcp,
+// a UCI file:
+//
+//	config host
+//		option name 'nas'
+//		option mac '11:22:33:44:55:66 11:22:33:44:55:67'
+//		option ip '192.168.1.5'
+//
+// The MACs of a section may also be given as list options. The first is
+// the entry's MAC and the rest its aliases.
+func parseOpenWrt(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	var section string
+	var host Entry
+	var macs []string
+	flush := func() {
+		if section == "host" && len(macs) > 0 {
+			host.MAC, host.Aliases = macs[0], macs[1:]
+			entries = append(entries, host)
+		}
+		host, macs = Entry{}, nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		words := uciWords(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		switch {
+		case words[0] == "config" && len(words) >= 2:
+			flush()
+			section = words[1]
+		case (words[0] == "option" || words[0] == "list") && len(words) >= 3:
+			switch words[1] {
+			case "name":
+				host.Hostname = words[2]
+			case "ip":
+				host.IP = words[2]
+			case "mac":
+				for _, m := range strings.Fields(words[2]) {
+					if mac, ok := normalizeMAC(m); ok && !containsMAC(macs, mac) {
+						macs = append(macs, mac)
+					}
+				}
+			}
+		}
+	}
+	flush()
+	return entries, scanner.Err()
+}
+
+// uciWords splits a UCI line into words, unquoting single- and
+// double-quoted words and dropping comments.
+func uciWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == '#':
+			i = len(line)
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
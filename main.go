@@ -2,17 +2,35 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/audit"
 	"github.com/hzhq1255/wolgate/config"
+	"github.com/hzhq1255/wolgate/dns"
+	"github.com/hzhq1255/wolgate/events"
+	"github.com/hzhq1255/wolgate/hostsfile"
+	"github.com/hzhq1255/wolgate/inventory"
+	"github.com/hzhq1255/wolgate/leases"
 	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/monitor"
+	"github.com/hzhq1255/wolgate/proxy"
+	"github.com/hzhq1255/wolgate/rules"
+	"github.com/hzhq1255/wolgate/schedule"
+	"github.com/hzhq1255/wolgate/sleepproxy"
 	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
 	"github.com/hzhq1255/wolgate/web"
 	"github.com/hzhq1255/wolgate/wol"
 )
@@ -47,6 +65,9 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Commands:\n")
 		fmt.Fprintf(os.Stderr, "  server    Start web management service\n")
 		fmt.Fprintf(os.Stderr, "  wake      Send WOL magic packet to a device\n")
+		fmt.Fprintf(os.Stderr, "  device    List, export or import stored devices\n")
+		fmt.Fprintf(os.Stderr, "  group     List or wake device groups\n")
+		fmt.Fprintf(os.Stderr, "  store     Manage the device data file (migrate, restore)\n")
 		fmt.Fprintf(os.Stderr, "  version   Show version information\n")
 		fmt.Fprintf(os.Stderr, "  help      Show this help message\n\n")
 		fmt.Fprintf(os.Stderr, "Global Options:\n")
@@ -90,6 +111,12 @@ func main() {
 		runServer(args[1:])
 	case "wake":
 		runWake(args[1:])
+	case "device":
+		runDevice(args[1:])
+	case "group":
+		runGroup(args[1:])
+	case "store":
+		runStore(args[1:])
 	case "version":
 		fmt.Printf("wolgate version %s\n", Version)
 	case "help", "-h", "--help":
@@ -154,6 +181,49 @@ func runServer(args []string) {
 		log.Error("Failed to initialize store: %v", err)
 		os.Exit(1)
 	}
+	st.SetBackups(cfg.Server.Backups)
+	st.SetJournal(cfg.Server.Journal)
+	st.SetRetention(time.Duration(cfg.Server.Trash) * 24 * time.Hour)
+	if m := st.Migrated(); m != nil {
+		log.Warn("Data file upgraded from version %d to %d, original kept as %s", m.From, m.To, m.Backup)
+	}
+	if r := st.Recovered(); r != nil {
+		log.Warn("!!! Data file %s is corrupt (%v)", cfg.Server.Data, r.Err)
+		log.Warn("!!! Recovered %d device(s) from backup %s", st.Count(), r.Backup)
+		if r.Corrupt != "" {
+			log.Warn("!!! Corrupt file kept as %s", r.Corrupt)
+		}
+	}
+	reconcileDevices(st, cfg, log)
+	st.OnReload(func(r store.ReloadResult) {
+		if r.Err != nil {
+			log.Error("Failed to reload data file, keeping %d device(s) in memory: %v", st.Count(), r.Err)
+			return
+		}
+		log.Info("Reloaded data file: %d added, %d updated, %d deleted", r.Added, r.Updated, r.Deleted)
+	})
+
+	// Reload the data file when it is edited externally, and on SIGHUP,
+	// which also reconciles the devices declared in the config file again
+	stop := make(chan struct{})
+	var stopped sync.WaitGroup // Components finishing their work after stop
+	if cfg.Server.Watch > 0 {
+		go st.Watch(stop, time.Duration(cfg.Server.Watch)*time.Second)
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			log.Info("Received SIGHUP, reloading data file")
+			st.Reload()
+			if reloaded, err := loadConfig(); err != nil {
+				log.Error("Failed to reload config, keeping declared devices: %v", err)
+			} else {
+				cfg.Devices, cfg.Server.DevicePolicy = reloaded.Devices, reloaded.Server.DevicePolicy
+			}
+			reconcileDevices(st, cfg, log)
+		}
+	}()
 
 	// Initialize WOL sender
 	wolSender, err := wol.NewSender(cfg.Wake.Iface, cfg.Wake.Broadcast)
@@ -162,8 +232,251 @@ func runServer(args []string) {
 		os.Exit(1)
 	}
 
+	// All wake sources share one service, so every wake is tracked and published
+	waker := wake.NewService(wolSender)
+	waker.SetTargets(deviceTargets(st))
+
+	// Record every wake attempt in the audit log
+	var auditLog *audit.Log
+	if cfg.Server.Audit > 0 {
+		auditLog = audit.New(audit.Config{Path: audit.LogPath(cfg.Server.Data), Limit: cfg.Server.Audit, Logger: log})
+		auditLog.RecordWakes(waker, st)
+	}
+
+	// Initialize reachability monitor
+	mon := monitor.New(st, monitor.Config{
+		Interval:      time.Duration(cfg.Monitor.Interval) * time.Second,
+		ProbePorts:    cfg.Monitor.ProbePorts,
+		ProbeTimeout:  time.Duration(cfg.Monitor.ProbeTimeout) * time.Second,
+		BootTimeout:   time.Duration(cfg.Monitor.BootTimeout) * time.Second,
+		BootThreshold: time.Duration(cfg.Monitor.BootThreshold) * time.Second,
+		StatsFile:     sidecarPath(cfg.Server.Data, "boot"),
+		Logger:        log,
+	})
+
+	// Publish live events for the web UI
+	hub := events.NewHub(events.DefaultBacklog)
+	hub.PublishStoreChanges(st)
+	hub.PublishWakes(waker, st)
+	waker.OnWake(func(r wake.Result) {
+		// Start measuring the time until the device comes online
+		if r.Err == nil {
+			// The monitor tracks devices by their primary MAC
+			mac := r.MAC
+			if device, err := st.GetByMAC(mac); err == nil {
+				mac = device.MAC
+			}
+			mon.RecordWake(mac)
+			st.MarkWoken(mac, r.Time)
+		}
+	})
+	mon.OnChange(func(mac string, online bool) {
+		data := events.StatusData{MAC: mac}
+		if device, err := st.GetByMAC(mac); err == nil {
+			data.Name = device.Name
+		}
+		if online {
+			hub.Publish(events.DeviceOnline, data)
+		} else {
+			hub.Publish(events.DeviceOffline, data)
+		}
+	})
+	go mon.Run(stop)
+
+	// Initialize scheduler
+	schedules, err := schedule.NewStore(sidecarPath(cfg.Server.Data, "schedules"))
+	if err != nil {
+		log.Error("Failed to initialize schedules: %v", err)
+		os.Exit(1)
+	}
+	calendarDir := strings.TrimSuffix(cfg.Server.Data, filepath.Ext(cfg.Server.Data)) + ".calendars"
+	calendars, err := schedule.NewCalendars(calendarDir, cfg.Schedule.Calendars)
+	if err != nil {
+		// Schedules still run; rules naming a missing calendar are ignored
+		log.Warn("Failed to load calendars: %v", err)
+	}
+	scheduler := schedule.NewScheduler(schedules, st, waker, schedule.Config{
+		CatchUp:       cfg.Schedule.CatchUp,
+		CatchUpWindow: time.Duration(cfg.Schedule.CatchUpWindow) * time.Minute,
+		Calendars:     calendars,
+		Logger:        log,
+	})
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		scheduler.Run(stop)
+	}()
+
+	// Initialize automation rules
+	ruleStore, err := rules.NewStore(sidecarPath(cfg.Server.Data, "rules"))
+	if err != nil {
+		log.Error("Failed to initialize rules: %v", err)
+		os.Exit(1)
+	}
+	engine := rules.NewEngine(ruleStore, st, waker, wolSender, rules.Config{
+		PollInterval: time.Duration(cfg.Monitor.Interval) * time.Second,
+		HistoryFile:  rules.HistoryPath(cfg.Server.Data),
+		Logger:       log,
+	})
+	mon.OnChange(engine.DeviceChanged)
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		engine.Run(stop)
+	}()
+
+	// Schedules and rules refer to groups by name
+	st.OnGroupRename(func(oldName, newName string) {
+		n, err := schedules.RenameGroup(oldName, newName)
+		if err != nil {
+			log.Error("Failed to rename group %q in schedules: %v", oldName, err)
+		}
+		m, err := ruleStore.RenameGroup(oldName, newName)
+		if err != nil {
+			log.Error("Failed to rename group %q in rules: %v", oldName, err)
+		}
+		log.Info("Renamed group %q to %q in %d schedule(s) and %d rule(s)", oldName, newName, n, m)
+	})
+
+	// Keep hosts files in sync with the device list
+	if len(cfg.Export.Files) > 0 {
+		targets := make([]hostsfile.Target, len(cfg.Export.Files))
+		for i, f := range cfg.Export.Files {
+			targets[i] = hostsfile.Target{Format: f.Format, Path: f.Path, Reload: f.Reload}
+		}
+		syncer, err := hostsfile.NewSyncer(st, hostsfile.Config{Targets: targets, Logger: log})
+		if err != nil {
+			log.Error("Failed to set up hosts file export: %v", err)
+		} else {
+			go syncer.Run(stop)
+		}
+	}
+
+	// Initialize wake-on-demand proxy
+	var px *proxy.Proxy
+	if len(cfg.Proxy.Mappings) > 0 {
+		mappings := make([]proxy.Mapping, len(cfg.Proxy.Mappings))
+		for i, m := range cfg.Proxy.Mappings {
+			mappings[i] = proxy.Mapping{Name: m.Name, Listen: m.Listen, Device: m.Device, Port: m.Port, Host: m.Host}
+		}
+		px, err = proxy.New(st, waker, proxy.Config{
+			Mappings:       mappings,
+			ConnectTimeout: time.Duration(cfg.Proxy.ConnectTimeout) * time.Second,
+			RetryInterval:  time.Duration(cfg.Proxy.RetryInterval) * time.Second,
+			MaxPending:     cfg.Proxy.MaxPending,
+			WakeCooldown:   time.Duration(cfg.Proxy.WakeCooldown) * time.Second,
+			Logger:         log,
+		})
+		if err == nil {
+			err = px.Start()
+		}
+		if err != nil {
+			log.Error("Failed to start proxy: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// Initialize wake-on-lookup DNS responder
+	var dnsServer *dns.Server
+	if cfg.DNS.Listen != "" {
+		dnsServer, err = dns.New(st, waker, dns.Config{
+			Listen:   cfg.DNS.Listen,
+			Domain:   cfg.DNS.Domain,
+			Hosts:    cfg.DNS.Hosts,
+			TTL:      uint32(cfg.DNS.TTL),
+			Cooldown: time.Duration(cfg.DNS.Cooldown) * time.Second,
+			Upstream: cfg.DNS.Upstream,
+			Online:   mon.Online,
+			Logger:   log,
+		})
+		if err == nil {
+			err = dnsServer.Start()
+		}
+		if err != nil {
+			log.Error("Failed to start DNS responder: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// Initialize sleep proxy; it needs raw sockets, so failing to start it
+	// leaves the rest of the server running
+	var sp *sleepproxy.Proxy
+	if len(cfg.SleepProxy.Devices) > 0 {
+		iface := cfg.SleepProxy.Iface
+		if iface == "" {
+			iface = cfg.Wake.Iface
+		}
+		devices := make([]sleepproxy.Device, len(cfg.SleepProxy.Devices))
+		for i, d := range cfg.SleepProxy.Devices {
+			devices[i] = sleepproxy.Device{MAC: d.Device, Ports: d.Ports}
+		}
+		sp, err = sleepproxy.New(st, waker, sleepproxy.Config{
+			Interface: iface,
+			Devices:   devices,
+			Online:    mon.Online,
+			Logger:    log,
+		})
+		if err == nil {
+			err = sp.Start()
+		}
+		if err != nil {
+			log.Error("Failed to start sleep proxy: %v", err)
+			sp = nil
+		}
+	}
+
+	// Schedules, rules, boot stats and proxies refer to devices by MAC
+	st.OnMACChange(func(oldMAC, newMAC string) {
+		n, err := schedules.RenameMAC(oldMAC, newMAC)
+		if err != nil {
+			log.Error("Failed to change MAC %s in schedules: %v", oldMAC, err)
+		}
+		m, err := ruleStore.RenameMAC(oldMAC, newMAC)
+		if err != nil {
+			log.Error("Failed to change MAC %s in rules: %v", oldMAC, err)
+		}
+		mon.RenameMAC(oldMAC, newMAC)
+		log.Info("Changed MAC %s to %s in %d schedule(s) and %d rule(s)", oldMAC, newMAC, n, m)
+
+		// Proxies and DNS hosts are configured in the config file, which is
+		// not rewritten
+		proxied := 0
+		if px != nil {
+			proxied += px.RenameMAC(oldMAC, newMAC)
+		}
+		if sp != nil {
+			proxied += sp.RenameMAC(oldMAC, newMAC)
+		}
+		if dnsServer != nil {
+			proxied += dnsServer.RenameMAC(oldMAC, newMAC)
+		}
+		if proxied > 0 {
+			log.Warn("Device MAC changed from %s to %s; update the proxy and DNS settings in the config file to keep them after a restart", oldMAC, newMAC)
+		}
+	})
+
 	// Initialize HTTP handler
 	handler := web.NewHandler(st, wolSender)
+	handler.SetWaker(waker)
+	handler.SetLogger(log)
+	if err := handler.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Error("Invalid server.trusted_proxies: %v", err)
+		os.Exit(1)
+	}
+	handler.SetAudit(auditLog)
+	handler.SetMonitor(mon)
+	handler.SetEvents(hub)
+	handler.SetScheduler(scheduler)
+	handler.SetCalendars(calendars)
+	handler.SetProxy(px)
+	handler.SetSleepProxy(sp)
+	handler.SetRules(engine)
+	handler.SetLeases(cfg.Import.Leases)
+	for format := range cfg.Import.Leases {
+		if _, ok := leases.DefaultPaths[format]; !ok {
+			log.Warn("Unknown lease file format %q in import.leases, ignored", format)
+		}
+	}
 
 	// Register routes
 	mux := http.NewServeMux()
@@ -182,6 +495,16 @@ func runServer(args []string) {
 		<-sigChan
 
 		log.Info("Shutting down...")
+		close(stop)
+		if px != nil {
+			px.Close()
+		}
+		if dnsServer != nil {
+			dnsServer.Close()
+		}
+		if sp != nil {
+			sp.Close()
+		}
 		server.Shutdown(context.Background())
 	}()
 
@@ -193,9 +516,27 @@ func runServer(args []string) {
 		os.Exit(1)
 	}
 
+	// Let staggered schedule runs and rule firings wind down
+	stopped.Wait()
 	log.Info("Server stopped")
 }
 
+// reconcileDevices brings the store in line with the devices declared in
+// the config file, logging every change.
+func reconcileDevices(st *store.Store, cfg *config.Config, log *logger.Logger) {
+	changes, err := st.Reconcile(cfg.Devices, cfg.Server.DevicePolicy)
+	if err != nil {
+		log.Error("Failed to reconcile devices declared in the config file: %v", err)
+		return
+	}
+	for _, c := range changes {
+		log.Info("Config devices (%s): %s %s (%s)", cfg.Server.DevicePolicy, c.Op, c.Device.Name, c.Device.MAC)
+	}
+	if len(cfg.Devices) > 0 || len(changes) > 0 {
+		log.Info("Reconciled %d declared device(s) with policy %s: %d change(s)", len(cfg.Devices), cfg.Server.DevicePolicy, len(changes))
+	}
+}
+
 // runWake sends a WOL magic packet.
 func runWake(args []string) {
 	// Define wake-specific flags
@@ -255,7 +596,33 @@ func runWake(args []string) {
 	}
 	log.Info("Broadcast: %s", cfg.Wake.Broadcast)
 
-	if err := wolSender.SendRepeat(*mac, 3); err != nil {
+	waker := wake.NewService(wolSender)
+	var st *store.Store
+	if _, err := os.Stat(cfg.Server.Data); err == nil {
+		// Wake every MAC of a stored device, and name it in the audit log
+		if st, err = store.NewStore(cfg.Server.Data); err != nil {
+			log.Warn("Failed to load devices: %v", err)
+			st = nil
+		}
+	}
+	if st != nil {
+		// -iface and -bcast win over the device's own wake settings
+		targets := deviceTargets(st)
+		waker.SetTargets(func(m string) []wake.Target {
+			ts := targets(m)
+			for i := range ts {
+				if *iface != "" {
+					ts[i].Iface = *iface
+				}
+				if *bcast != "" {
+					ts[i].Address = *bcast
+				}
+			}
+			return ts
+		})
+	}
+	recordCLIWakes(waker, cfg, st)
+	if err := waker.Wake(wake.Request{MAC: *mac, Source: wake.SourceCLI, User: os.Getenv("USER")}); err != nil {
 		log.Error("Failed to send WOL packet: %v", err)
 		os.Exit(1)
 	}
@@ -264,6 +631,568 @@ func runWake(args []string) {
 	fmt.Printf("✓ WOL packet sent to %s\n", *mac)
 }
 
+// runDevice runs a device subcommand.
+func runDevice(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			runDeviceList(args[1:])
+			return
+		case "export":
+			runDeviceExport(args[1:])
+			return
+		case "import":
+			runDeviceImport(args[1:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: wolgate device list [-q text] [-group name] [-type type] [-tag tags]\n")
+	fmt.Fprintf(os.Stderr, "                           [-sort field] [-limit n] [-offset n | -cursor c] [-data path]\n")
+	fmt.Fprintf(os.Stderr, "       wolgate device export [-format csv|json|ethers|dnsmasq|openwrt] [-o file] [-reload cmd]\n")
+	fmt.Fprintf(os.Stderr, "                             [-data path]\n")
+	fmt.Fprintf(os.Stderr, "       wolgate device import -file path [-format csv|json] [-mode skip|overwrite|merge]\n")
+	fmt.Fprintf(os.Stderr, "                             [-map header=column]... [-dry-run] [-data path]\n")
+	os.Exit(1)
+}
+
+// runDeviceList prints the stored devices matching a query, the same one
+// the device list API takes.
+func runDeviceList(args []string) {
+	fs := flag.NewFlagSet("device list", flag.ExitOnError)
+	search := fs.String("q", "", "Search the name, hostname, MAC, IP, tags and notes")
+	group := fs.String("group", "", "Only devices in this group")
+	deviceType := fs.String("type", "", "Only devices of this type")
+	tags := fs.String("tag", "", "Only devices with all these comma-separated tags")
+	sortBy := fs.String("sort", "", "Sort by "+strings.Join(store.SortFields, ", ")+"; prefix with - for descending")
+	limit := fs.Int("limit", 0, "Maximum number of devices")
+	offset := fs.Int("offset", 0, "Number of devices to skip")
+	cursor := fs.String("cursor", "", "Continue after a previous page")
+	dataFile := fs.String("data", "", "Device data file path")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load configuration for the data file path
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		cfg = config.DefaultConfig()
+	}
+	if *dataFile != "" {
+		cfg.Server.Data = *dataFile
+	}
+
+	st, err := store.NewStore(cfg.Server.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	q := store.Query{
+		Search: *search,
+		Group:  *group,
+		Type:   *deviceType,
+		Sort:   *sortBy,
+		Limit:  *limit,
+		Offset: *offset,
+		Cursor: *cursor,
+	}
+	if *tags != "" {
+		q.Tags = strings.Split(*tags, ",")
+	}
+	page, err := st.Find(q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, d := range page.Devices {
+		fmt.Printf("%-20s %-17s %-15s %s\n", d.Name, d.MAC, d.IP, d.Group)
+	}
+	fmt.Printf("%d of %d device(s)\n", len(page.Devices), page.Total)
+	if page.Next != "" {
+		fmt.Printf("Next page: -cursor %s\n", page.Next)
+	}
+}
+
+// runDeviceExport writes the stored devices to a CSV, JSON or hosts file,
+// or to standard output.
+func runDeviceExport(args []string) {
+	fs := flag.NewFlagSet("device export", flag.ExitOnError)
+	format := fs.String("format", "", "File format: csv, json, ethers, dnsmasq or openwrt (default: by the file name, or json)")
+	output := fs.String("o", "", "Output file, written atomically (default: standard output)")
+	reload := fs.String("reload", "", "Shell command run after a hosts file is rewritten")
+	dataFile := fs.String("data", "", "Device data file path")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *format == "" {
+		*format = inventory.FormatOf(*output)
+	}
+	if *format == "" {
+		*format = inventory.FormatJSON
+	}
+
+	// Load configuration for the data file path
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		cfg = config.DefaultConfig()
+	}
+	if *dataFile != "" {
+		cfg.Server.Data = *dataFile
+	}
+
+	st, err := store.NewStore(cfg.Server.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if hostsfile.ValidFormat(*format) {
+		exportHostsFile(st, *format, *output, *reload)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := inventory.Write(&buf, *format, st.List()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *output == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	if err := atomicfile.WriteFile(*output, buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✓ Exported %d device(s) to %s\n", st.Count(), *output)
+}
+
+// exportHostsFile writes the stored devices as a hosts file to output, or
+// to standard output. The file is only rewritten, and reloaded, when its
+// content changes.
+func exportHostsFile(st *store.Store, format, output, reload string) {
+	if output == "" {
+		if err := hostsfile.Render(os.Stdout, format, st.List()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	target := hostsfile.Target{Format: format, Path: output, Reload: reload}
+	written, err := hostsfile.WriteTarget(target, st.List(), hostsfile.DefaultReloadTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !written {
+		fmt.Printf("%s is up to date\n", output)
+		return
+	}
+	fmt.Printf("✓ Exported %d device(s) to %s\n", st.Count(), output)
+}
+
+// runDeviceImport imports devices from a CSV or JSON file, validated as
+// the API does. It is safe to run while the server is running.
+func runDeviceImport(args []string) {
+	fs := flag.NewFlagSet("device import", flag.ExitOnError)
+	file := fs.String("file", "", "CSV or JSON file to import (required)")
+	format := fs.String("format", "", "File format: csv or json (default: by the file name)")
+	mode := fs.String("mode", store.ConflictSkip, "For devices already stored: skip, overwrite or merge")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be imported")
+	var mappings stringList
+	fs.Var(&mappings, "map", "Map a CSV header to a column, as header=column (repeatable)")
+	dataFile := fs.String("data", "", "Device data file path")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *file == "" {
+		fmt.Fprintf(os.Stderr, "Error: -file is required\n")
+		os.Exit(1)
+	}
+	if *format == "" {
+		*format = inventory.FormatOf(*file)
+	}
+	mapping, err := inventory.ParseMapping(mappings)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load configuration for the data file path
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		cfg = config.DefaultConfig()
+	}
+	if *dataFile != "" {
+		cfg.Server.Data = *dataFile
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	records, ignored, err := inventory.Read(f, *format, mapping)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	st, err := store.NewStore(cfg.Server.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	st.SetBackups(cfg.Server.Backups)
+	st.SetJournal(cfg.Server.Journal)
+	st.SetRetention(time.Duration(cfg.Server.Trash) * 24 * time.Hour)
+
+	report, err := inventory.Import(st, records, store.ImportOptions{
+		Mode:     *mode,
+		DryRun:   *dryRun,
+		Validate: web.ValidateDevice,
+		Origin:   store.Origin{Source: store.SourceImport, Actor: os.Getenv("USER")},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, column := range ignored {
+		fmt.Printf("Ignored column %q\n", column)
+	}
+	for _, r := range report.Rows {
+		switch {
+		case r.Error != "":
+			fmt.Printf("  row %-4d error  %s\n", r.Row, r.Error)
+		default:
+			fmt.Printf("  row %-4d %-9s %s (%s)\n", r.Row, r.Op, r.Device.Name, r.Device.MAC)
+		}
+	}
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s: %d added, %d updated, %d skipped, %d unchanged, %d failed\n",
+		verb, report.Added, report.Updated, report.Skipped, report.Unchanged, report.Failed)
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runGroup runs a device group subcommand.
+func runGroup(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			runGroupList(args[1:])
+			return
+		case "wake":
+			runGroupWake(args[1:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: wolgate group list [-data path]\n")
+	fmt.Fprintf(os.Stderr, "       wolgate group wake -name <group> [-iface name] [-bcast address] [-data path]\n")
+	os.Exit(1)
+}
+
+// runGroupList prints the device groups in order, with their members.
+func runGroupList(args []string) {
+	fs := flag.NewFlagSet("group list", flag.ExitOnError)
+	dataFile := fs.String("data", "", "Device data file path")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load configuration for the data file path
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		cfg = config.DefaultConfig()
+	}
+	if *dataFile != "" {
+		cfg.Server.Data = *dataFile
+	}
+
+	st, err := store.NewStore(cfg.Server.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	groups := st.ListGroups()
+	if len(groups) == 0 {
+		fmt.Println("No groups")
+		return
+	}
+	for _, g := range groups {
+		members := st.GetByGroup(g.Name)
+		fmt.Printf("%s (%d device(s))", g.Name, len(members))
+		if g.Description != "" {
+			fmt.Printf(" - %s", g.Description)
+		}
+		fmt.Println()
+		for _, d := range members {
+			fmt.Printf("  %-20s %s\n", d.Name, d.MAC)
+		}
+	}
+}
+
+// runGroupWake sends WOL magic packets to every member of a group, pausing
+// for the group's stagger delay between members.
+func runGroupWake(args []string) {
+	fs := flag.NewFlagSet("group wake", flag.ExitOnError)
+	name := fs.String("name", "", "Group name (required)")
+	iface := fs.String("iface", "", "Network interface")
+	bcast := fs.String("bcast", "", "Broadcast address")
+	dataFile := fs.String("data", "", "Device data file path")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *name == "" {
+		fmt.Fprintf(os.Stderr, "Error: -name is required\n")
+		os.Exit(1)
+	}
+
+	// Load configuration for defaults
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		cfg = config.DefaultConfig()
+	}
+	if *iface != "" {
+		cfg.Wake.Iface = *iface
+	}
+	if *bcast != "" {
+		cfg.Wake.Broadcast = *bcast
+	}
+	if *dataFile != "" {
+		cfg.Server.Data = *dataFile
+	}
+
+	st, err := store.NewStore(cfg.Server.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	group, err := st.GroupByName(*name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	wolSender, err := wol.NewSender(cfg.Wake.Iface, cfg.Wake.Broadcast)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	waker := wake.NewService(wolSender)
+	waker.SetTargets(deviceTargets(st))
+	recordCLIWakes(waker, cfg, st)
+
+	members := st.GetByGroup(group.Name)
+	failed := 0
+	for i, d := range members {
+		if i > 0 {
+			time.Sleep(group.StaggerDelay())
+		}
+		err := waker.Wake(wake.Request{MAC: d.MAC, Source: wake.SourceCLI, Detail: "group " + group.Name, User: os.Getenv("USER")})
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "✗ %s (%s): %v\n", d.Name, d.MAC, err)
+			continue
+		}
+		fmt.Printf("✓ WOL packet sent to %s (%s)\n", d.Name, d.MAC)
+	}
+	fmt.Printf("Woke %d of %d device(s) in %s\n", len(members)-failed, len(members), group.Name)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// recordCLIWakes records the wakes sent by a command in the audit log next
+// to the data file, as the server does. st names the devices, if not nil.
+func recordCLIWakes(waker *wake.Service, cfg *config.Config, st *store.Store) {
+	if cfg.Server.Audit <= 0 {
+		return
+	}
+	auditLog := audit.New(audit.Config{Path: audit.LogPath(cfg.Server.Data), Limit: cfg.Server.Audit})
+	auditLog.RecordWakes(waker, st)
+}
+
+// deviceTargets returns the wake targets of stored devices: every network
+// interface of the device, with the device's wake settings over its
+// group's defaults.
+func deviceTargets(st *store.Store) func(mac string) []wake.Target {
+	return func(mac string) []wake.Target {
+		device, err := st.GetByMAC(mac)
+		if err != nil {
+			return nil
+		}
+		group, groupErr := st.GroupByName(device.Group)
+		var targets []wake.Target
+		for _, m := range device.MACs() {
+			target := device.WakeTarget(m)
+			if device.Group != "" && groupErr == nil {
+				target = group.WakeDefaults(target)
+			}
+			targets = append(targets, wake.Target{MAC: m, Target: target})
+		}
+		return targets
+	}
+}
+
+// runStore runs a data file maintenance subcommand.
+func runStore(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			runMigrate(args[1:])
+			return
+		case "restore":
+			runRestore(args[1:])
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: wolgate store migrate [-check] [-data path]\n")
+	fmt.Fprintf(os.Stderr, "       wolgate store restore -to <revision> [-data path]\n")
+	os.Exit(1)
+}
+
+// runMigrate upgrades the data file to the current format. With -check it
+// only reports pending migrations, exiting with status 1 if there are any.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("store migrate", flag.ExitOnError)
+	check := fs.Bool("check", false, "Only report pending migrations")
+	dataFile := fs.String("data", "", "Device data file path")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Load configuration for the data file path
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		cfg = config.DefaultConfig()
+	}
+	if *dataFile != "" {
+		cfg.Server.Data = *dataFile
+	}
+
+	pending, version, err := store.Pending(cfg.Server.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(pending) == 0 {
+		fmt.Printf("%s is up to date (version %d)\n", cfg.Server.Data, version)
+		return
+	}
+
+	fmt.Printf("%s is at version %d, %d migration(s) pending:\n", cfg.Server.Data, version, len(pending))
+	for _, m := range pending {
+		fmt.Printf("  v%d -> v%d: %s\n", m.From, m.To, m.Description)
+	}
+	if *check {
+		os.Exit(1)
+	}
+
+	st, err := store.NewStore(cfg.Server.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if r := st.Migrated(); r != nil {
+		fmt.Printf("✓ Migrated to version %d, original kept as %s\n", r.To, r.Backup)
+	}
+}
+
+// runRestore returns the device list to an earlier revision from the
+// data file's journal. It is safe to run while the server is running.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("store restore", flag.ExitOnError)
+	to := fs.Int64("to", -1, "Revision to restore")
+	dataFile := fs.String("data", "", "Device data file path")
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *to < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -to is required\n")
+		os.Exit(1)
+	}
+
+	// Load configuration for the data file path
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		cfg = config.DefaultConfig()
+	}
+	if *dataFile != "" {
+		cfg.Server.Data = *dataFile
+	}
+
+	st, err := store.NewStore(cfg.Server.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	st.SetBackups(cfg.Server.Backups)
+	st.SetJournal(cfg.Server.Journal)
+	st.SetRetention(time.Duration(cfg.Server.Trash) * 24 * time.Hour)
+
+	changes, err := st.Restore(*to, store.Origin{Source: store.SourceRestore, Actor: os.Getenv("USER")})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(changes) == 0 {
+		fmt.Printf("Device list already matches revision %d\n", *to)
+		return
+	}
+	for _, c := range changes {
+		fmt.Printf("  %-6s %s (%s)\n", c.Op, c.Device.Name, c.Device.MAC)
+	}
+	fmt.Printf("✓ Restored revision %d as revision %d\n", *to, st.Revision())
+}
+
+// sidecarPath returns the path of an auxiliary file stored next to the
+// data file, e.g. /data/wolgate.json -> /data/wolgate.boot.json.
+func sidecarPath(dataFile, name string) string {
+	ext := filepath.Ext(dataFile)
+	return strings.TrimSuffix(dataFile, ext) + "." + name + ".json"
+}
+
 // loadConfig loads the configuration file.
 func loadConfig() (*config.Config, error) {
 	return config.Load(configFile)
@@ -0,0 +1,490 @@
+// Package monitor tracks device reachability and wake-to-online boot times.
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hzhq1255/wolgate/arp"
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// maxSamples is the number of boot durations kept per device.
+const maxSamples = 50
+
+// pendingInterval is how often devices with an outstanding wake are checked,
+// so boot times are measured more precisely than the regular interval allows.
+const pendingInterval = 2 * time.Second
+
+// Config holds the monitor configuration.
+type Config struct {
+	Interval      time.Duration  // Time between full reachability checks
+	ProbePorts    []int          // TCP ports probed on devices with an IP
+	ProbeTimeout  time.Duration  // Timeout per TCP probe
+	BootTimeout   time.Duration  // Give up waiting for a woken device after this
+	BootThreshold time.Duration  // Boots slower than this are flagged
+	ARPPath       string         // ARP table path (default: arp.DefaultARPPath)
+	StatsFile     string         // Optional file to persist boot samples
+	Logger        *logger.Logger // Optional logger
+}
+
+// Status describes the reachability of a device.
+type Status struct {
+	Online   bool      `json:"online"`
+	Source   string    `json:"source,omitempty"` // "probe" or "arp"
+	LastSeen time.Time `json:"last_seen,omitempty"`
+	Since    time.Time `json:"since,omitempty"` // When the current state began
+}
+
+// BootStats summarizes wake-to-online durations for a device, in seconds.
+type BootStats struct {
+	Count    int       `json:"count"`
+	P50      float64   `json:"p50"`
+	P95      float64   `json:"p95"`
+	Max      float64   `json:"max"`
+	Last     float64   `json:"last"`
+	LastWake time.Time `json:"last_wake,omitempty"`
+	Pending  bool      `json:"pending"`   // Waiting for the device to come online
+	TimedOut bool      `json:"timed_out"` // Last wake never saw the device online
+	Slow     bool      `json:"slow"`      // Last boot exceeded the threshold
+}
+
+// bootRecord holds the persisted boot history of a device.
+type bootRecord struct {
+	Samples  []float64 `json:"samples"`
+	LastWake time.Time `json:"last_wake,omitempty"`
+	TimedOut bool      `json:"timed_out,omitempty"`
+}
+
+// Monitor periodically checks device reachability.
+type Monitor struct {
+	store     *store.Store
+	cfg       Config
+	mu        sync.Mutex
+	status    map[string]*Status
+	pending   map[string]time.Time
+	boots     map[string]*bootRecord
+	listeners []func(mac string, online bool)
+}
+
+// New creates a new monitor for the devices in st.
+func New(st *store.Store, cfg Config) *Monitor {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = time.Second
+	}
+	if cfg.BootTimeout <= 0 {
+		cfg.BootTimeout = 10 * time.Minute
+	}
+	if cfg.ARPPath == "" {
+		cfg.ARPPath = arp.DefaultARPPath
+	}
+
+	m := &Monitor{
+		store:   st,
+		cfg:     cfg,
+		status:  make(map[string]*Status),
+		pending: make(map[string]time.Time),
+		boots:   make(map[string]*bootRecord),
+	}
+	m.loadStats()
+	return m
+}
+
+// OnChange registers a callback invoked when a device goes online or offline.
+func (m *Monitor) OnChange(fn func(mac string, online bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, fn)
+}
+
+// Run checks reachability until stop is closed.
+func (m *Monitor) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pendingInterval)
+	defer ticker.Stop()
+
+	m.Check()
+	lastFull := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if now.Sub(lastFull) >= m.cfg.Interval {
+				m.Check()
+				lastFull = now
+			} else if m.hasPending() {
+				m.checkPending()
+			}
+		}
+	}
+}
+
+// Check performs one reachability pass over all devices.
+func (m *Monitor) Check() {
+	m.check(m.store.List())
+}
+
+// checkPending checks only devices with an outstanding wake.
+func (m *Monitor) checkPending() {
+	var devices []store.Device
+	for _, d := range m.store.List() {
+		if m.isPending(normalize(d.MAC)) {
+			devices = append(devices, d)
+		}
+	}
+	m.check(devices)
+}
+
+// check probes the given devices and records the results.
+func (m *Monitor) check(devices []store.Device) {
+	if len(devices) == 0 {
+		return
+	}
+
+	seen := m.arpMACs()
+	results := make([]Status, len(devices))
+
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		go func(i int, d store.Device) {
+			defer wg.Done()
+			results[i] = m.reachable(d, seen)
+		}(i, d)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	for i, d := range devices {
+		m.update(normalize(d.MAC), results[i], now)
+	}
+}
+
+// arpMACs returns the set of MAC addresses with complete ARP entries.
+func (m *Monitor) arpMACs() map[string]bool {
+	seen := make(map[string]bool)
+	entries, err := arp.ParsePath(m.cfg.ARPPath)
+	if err != nil {
+		m.debugf("Failed to read ARP table: %v", err)
+		return seen
+	}
+	for _, e := range entries {
+		seen[normalize(e.MAC)] = true
+	}
+	return seen
+}
+
+// reachable determines whether a device is online by TCP probe, or by any
+// of its MACs in the ARP table.
+func (m *Monitor) reachable(d store.Device, seen map[string]bool) Status {
+	if d.IP != "" && m.probe(d.IP) {
+		return Status{Online: true, Source: "probe"}
+	}
+	for _, mac := range d.MACs() {
+		if seen[normalize(mac)] {
+			return Status{Online: true, Source: "arp"}
+		}
+	}
+	return Status{}
+}
+
+// probe reports whether any configured port accepts or actively refuses
+// a TCP connection, either of which proves the host is up.
+func (m *Monitor) probe(ip string) bool {
+	if len(m.cfg.ProbePorts) == 0 {
+		return false
+	}
+
+	found := make(chan bool, len(m.cfg.ProbePorts))
+	for _, port := range m.cfg.ProbePorts {
+		go func(port int) {
+			addr := net.JoinHostPort(ip, strconv.Itoa(port))
+			conn, err := net.DialTimeout("tcp", addr, m.cfg.ProbeTimeout)
+			if err == nil {
+				conn.Close()
+				found <- true
+				return
+			}
+			found <- errors.Is(err, syscall.ECONNREFUSED)
+		}(port)
+	}
+
+	for range m.cfg.ProbePorts {
+		if <-found {
+			return true
+		}
+	}
+	return false
+}
+
+// update records a reachability result and completes pending boots.
+func (m *Monitor) update(mac string, result Status, now time.Time) {
+	m.mu.Lock()
+
+	st, ok := m.status[mac]
+	if !ok {
+		st = &Status{Since: now}
+		m.status[mac] = st
+	}
+
+	changed := ok && st.Online != result.Online
+	if changed {
+		st.Since = now
+	}
+	st.Online = result.Online
+	st.Source = result.Source
+	if result.Online {
+		st.LastSeen = now
+	}
+
+	var bootTime time.Duration
+	if wokeAt, pending := m.pending[mac]; pending {
+		if result.Online {
+			bootTime = now.Sub(wokeAt)
+			delete(m.pending, mac)
+			m.addSample(mac, bootTime)
+		} else if now.Sub(wokeAt) > m.cfg.BootTimeout {
+			delete(m.pending, mac)
+			m.boot(mac).TimedOut = true
+			m.saveStatsLocked()
+			m.warnf("Device %s did not come online within %s of wake", mac, m.cfg.BootTimeout)
+		}
+	}
+
+	listeners := append([]func(string, bool){}, m.listeners...)
+	m.mu.Unlock()
+
+	if bootTime > 0 {
+		if m.cfg.BootThreshold > 0 && bootTime > m.cfg.BootThreshold {
+			m.warnf("Device %s took %s to boot (threshold %s)", mac, bootTime.Round(time.Second), m.cfg.BootThreshold)
+		} else {
+			m.infof("Device %s online %s after wake", mac, bootTime.Round(time.Second))
+		}
+	}
+
+	if changed {
+		for _, fn := range listeners {
+			fn(mac, result.Online)
+		}
+	}
+}
+
+// RecordWake notes that a wake packet was sent to mac. The boot time is
+// measured until the device is next seen online. Devices that are already
+// online are ignored, since there is no boot to measure.
+func (m *Monitor) RecordWake(mac string) {
+	mac = normalize(mac)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if st, ok := m.status[mac]; ok && st.Online {
+		return
+	}
+	if _, ok := m.pending[mac]; ok {
+		// Keep the first wake time so retries don't shorten the measurement
+		return
+	}
+
+	now := time.Now()
+	m.pending[mac] = now
+	rec := m.boot(mac)
+	rec.LastWake = now
+	rec.TimedOut = false
+}
+
+// RenameMAC moves the status and boot history of oldMAC to newMAC, after
+// the device's MAC changed.
+func (m *Monitor) RenameMAC(oldMAC, newMAC string) {
+	oldMAC, newMAC = normalize(oldMAC), normalize(newMAC)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if st, ok := m.status[oldMAC]; ok {
+		m.status[newMAC] = st
+		delete(m.status, oldMAC)
+	}
+	if t, ok := m.pending[oldMAC]; ok {
+		m.pending[newMAC] = t
+		delete(m.pending, oldMAC)
+	}
+	if rec, ok := m.boots[oldMAC]; ok {
+		m.boots[newMAC] = rec
+		delete(m.boots, oldMAC)
+		m.saveStatsLocked()
+	}
+}
+
+// Status returns the reachability status of a device.
+func (m *Monitor) Status(mac string) (Status, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st, ok := m.status[normalize(mac)]
+	if !ok {
+		return Status{}, false
+	}
+	return *st, true
+}
+
+// Online reports whether a device is currently known to be online.
+func (m *Monitor) Online(mac string) bool {
+	st, _ := m.Status(mac)
+	return st.Online
+}
+
+// BootStats returns the boot time statistics of a device.
+func (m *Monitor) BootStats(mac string) BootStats {
+	mac = normalize(mac)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := BootStats{}
+	_, stats.Pending = m.pending[mac]
+
+	rec, ok := m.boots[mac]
+	if !ok {
+		return stats
+	}
+
+	stats.Count = len(rec.Samples)
+	stats.LastWake = rec.LastWake
+	stats.TimedOut = rec.TimedOut
+	if stats.Count > 0 {
+		sorted := append([]float64(nil), rec.Samples...)
+		sort.Float64s(sorted)
+		stats.P50 = percentile(sorted, 50)
+		stats.P95 = percentile(sorted, 95)
+		stats.Max = sorted[len(sorted)-1]
+		stats.Last = rec.Samples[len(rec.Samples)-1]
+	}
+
+	threshold := m.cfg.BootThreshold.Seconds()
+	stats.Slow = rec.TimedOut || (threshold > 0 && stats.Last > threshold)
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// boot returns the boot record for mac, creating it if needed.
+// Must be called with lock held.
+func (m *Monitor) boot(mac string) *bootRecord {
+	rec, ok := m.boots[mac]
+	if !ok {
+		rec = &bootRecord{}
+		m.boots[mac] = rec
+	}
+	return rec
+}
+
+// addSample appends a boot duration (must be called with lock held).
+func (m *Monitor) addSample(mac string, d time.Duration) {
+	rec := m.boot(mac)
+	rec.Samples = append(rec.Samples, d.Round(time.Millisecond).Seconds())
+	if len(rec.Samples) > maxSamples {
+		rec.Samples = rec.Samples[len(rec.Samples)-maxSamples:]
+	}
+	rec.TimedOut = false
+	m.saveStatsLocked()
+}
+
+func (m *Monitor) hasPending() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.pending) > 0
+}
+
+func (m *Monitor) isPending(mac string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.pending[mac]
+	return ok
+}
+
+// loadStats loads persisted boot samples, if any.
+func (m *Monitor) loadStats() {
+	if m.cfg.StatsFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(m.cfg.StatsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.warnf("Failed to read boot stats: %v", err)
+		}
+		return
+	}
+
+	if err := json.Unmarshal(data, &m.boots); err != nil {
+		m.warnf("Failed to parse boot stats: %v", err)
+		m.boots = make(map[string]*bootRecord)
+	}
+}
+
+// saveStatsLocked persists boot samples (must be called with lock held).
+func (m *Monitor) saveStatsLocked() {
+	if m.cfg.StatsFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(m.boots, "", "  ")
+	if err != nil {
+		m.warnf("Failed to marshal boot stats: %v", err)
+		return
+	}
+	if err := atomicfile.WriteFile(m.cfg.StatsFile, data, 0644); err != nil {
+		m.warnf("Failed to write boot stats: %v", err)
+	}
+}
+
+func (m *Monitor) debugf(format string, args ...interface{}) {
+	if m.cfg.Logger != nil {
+		m.cfg.Logger.Debug(format, args...)
+	}
+}
+
+func (m *Monitor) infof(format string, args ...interface{}) {
+	if m.cfg.Logger != nil {
+		m.cfg.Logger.Info(format, args...)
+	}
+}
+
+func (m *Monitor) warnf(format string, args ...interface{}) {
+	if m.cfg.Logger != nil {
+		m.cfg.Logger.Warn(format, args...)
+	}
+}
+
+// normalize returns mac in canonical form, or unchanged if invalid.
+func normalize(mac string) string {
+	if n, err := wol.NormalizeMAC(mac); err == nil {
+		return n
+	}
+	return mac
+}
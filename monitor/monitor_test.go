@@ -0,0 +1,190 @@
+// Package monitor tests.
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+)
+
+const testARPHeader = "IP address       HW type     Flags       HW address            Mask     Device\n"
+
+func newTestMonitor(t *testing.T, cfg Config) (*Monitor, *store.Store, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	st, err := store.NewStore(filepath.Join(tmpDir, "devices.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+
+	arpPath := filepath.Join(tmpDir, "arp")
+	if err := os.WriteFile(arpPath, []byte(testARPHeader), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ARPPath = arpPath
+
+	return New(st, cfg), st, arpPath
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	if got := percentile(values, 50); got != 5 {
+		t.Errorf("p50 = %v, want 5", got)
+	}
+	if got := percentile(values, 95); got != 10 {
+		t.Errorf("p95 = %v, want 10", got)
+	}
+	if got := percentile([]float64{42}, 95); got != 42 {
+		t.Errorf("p95 of single value = %v, want 42", got)
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of empty = %v, want 0", got)
+	}
+}
+
+func TestMonitor_CheckARP(t *testing.T) {
+	m, st, arpPath := newTestMonitor(t, Config{})
+	st.Add(store.Device{Name: "PC", MAC: "aa:bb:cc:dd:ee:ff"})
+
+	m.Check()
+	if m.Online("AA:BB:CC:DD:EE:FF") {
+		t.Error("Device should be offline before appearing in ARP table")
+	}
+
+	var changes []bool
+	m.OnChange(func(mac string, online bool) {
+		if mac != "AA:BB:CC:DD:EE:FF" {
+			t.Errorf("OnChange() mac = %s", mac)
+		}
+		changes = append(changes, online)
+	})
+
+	os.WriteFile(arpPath, []byte(testARPHeader+
+		"192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:ff    *        br-lan\n"), 0644)
+	m.Check()
+
+	status, ok := m.Status("aa:bb:cc:dd:ee:ff")
+	if !ok || !status.Online {
+		t.Fatalf("Device should be online, got %+v", status)
+	}
+	if status.Source != "arp" {
+		t.Errorf("Expected source arp, got %s", status.Source)
+	}
+	if len(changes) != 1 || !changes[0] {
+		t.Errorf("Expected one online transition, got %v", changes)
+	}
+}
+
+func TestMonitor_CheckARPAlias(t *testing.T) {
+	m, st, arpPath := newTestMonitor(t, Config{})
+	st.Add(store.Device{Name: "Laptop", MAC: "aa:bb:cc:dd:ee:01", Aliases: []store.MACAlias{{MAC: "aa:bb:cc:dd:ee:02"}}})
+
+	// Only the wireless interface is connected
+	os.WriteFile(arpPath, []byte(testARPHeader+
+		"192.168.1.11     0x1         0x2         aa:bb:cc:dd:ee:02    *        br-lan\n"), 0644)
+	m.Check()
+
+	if !m.Online("aa:bb:cc:dd:ee:01") {
+		t.Error("Device should be online when seen by an alias MAC")
+	}
+}
+
+func TestMonitor_BootStats(t *testing.T) {
+	m, _, _ := newTestMonitor(t, Config{BootThreshold: 60 * time.Second})
+	mac := "AA:BB:CC:DD:EE:FF"
+
+	now := time.Now()
+	for _, secs := range []int{30, 40, 50, 90} {
+		m.update(mac, Status{}, now)
+		m.RecordWake(mac)
+		m.mu.Lock()
+		m.pending[mac] = now
+		m.mu.Unlock()
+		m.update(mac, Status{Online: true, Source: "probe"}, now.Add(time.Duration(secs)*time.Second))
+	}
+
+	stats := m.BootStats(mac)
+	if stats.Count != 4 {
+		t.Fatalf("Expected 4 samples, got %d", stats.Count)
+	}
+	if stats.P50 != 40 {
+		t.Errorf("Expected p50 40, got %v", stats.P50)
+	}
+	if stats.Max != 90 || stats.P95 != 90 {
+		t.Errorf("Expected max/p95 90, got %v/%v", stats.Max, stats.P95)
+	}
+	if stats.Last != 90 {
+		t.Errorf("Expected last 90, got %v", stats.Last)
+	}
+	if !stats.Slow {
+		t.Error("Last boot above threshold should be flagged slow")
+	}
+	if stats.Pending {
+		t.Error("No wake should be pending")
+	}
+}
+
+func TestMonitor_RecordWake_AlreadyOnline(t *testing.T) {
+	m, _, _ := newTestMonitor(t, Config{})
+	mac := "AA:BB:CC:DD:EE:FF"
+
+	m.update(mac, Status{Online: true, Source: "arp"}, time.Now())
+	m.RecordWake(mac)
+
+	if m.BootStats(mac).Pending {
+		t.Error("Wake of an online device should not be measured")
+	}
+}
+
+func TestMonitor_BootTimeout(t *testing.T) {
+	m, _, _ := newTestMonitor(t, Config{BootTimeout: time.Minute})
+	mac := "AA:BB:CC:DD:EE:FF"
+
+	m.RecordWake(mac)
+	m.mu.Lock()
+	wokeAt := m.pending[mac]
+	m.mu.Unlock()
+
+	m.update(mac, Status{}, wokeAt.Add(2*time.Minute))
+
+	stats := m.BootStats(mac)
+	if stats.Pending {
+		t.Error("Timed out wake should no longer be pending")
+	}
+	if !stats.TimedOut || !stats.Slow {
+		t.Errorf("Timed out wake should be flagged, got %+v", stats)
+	}
+}
+
+func TestMonitor_StatsPersistence(t *testing.T) {
+	statsFile := filepath.Join(t.TempDir(), "boot.json")
+	m, st, _ := newTestMonitor(t, Config{StatsFile: statsFile})
+	mac := "AA:BB:CC:DD:EE:FF"
+
+	now := time.Now()
+	m.RecordWake(mac)
+	m.mu.Lock()
+	m.pending[mac] = now
+	m.mu.Unlock()
+	m.update(mac, Status{Online: true}, now.Add(45*time.Second))
+
+	reloaded := New(st, Config{StatsFile: statsFile})
+	stats := reloaded.BootStats(mac)
+	if stats.Count != 1 || stats.Last != 45 {
+		t.Errorf("Expected persisted sample of 45s, got %+v", stats)
+	}
+
+	// The history follows the device to its new MAC
+	reloaded.RenameMAC(mac, "aa:bb:cc:dd:ee:01")
+	if stats := New(st, Config{StatsFile: statsFile}).BootStats("AA:BB:CC:DD:EE:01"); stats.Count != 1 {
+		t.Errorf("Expected sample under the new MAC, got %+v", stats)
+	}
+	if stats := reloaded.BootStats(mac); stats.Count != 0 {
+		t.Errorf("Expected no samples under the old MAC, got %+v", stats)
+	}
+}
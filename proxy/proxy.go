@@ -0,0 +1,516 @@
+// Package proxy wakes devices on demand by proxying TCP connections to them.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Default settings.
+const (
+	DefaultConnectTimeout = 2 * time.Minute
+	DefaultRetryInterval  = 2 * time.Second
+	DefaultMaxPending     = 16
+	DefaultWakeCooldown   = 30 * time.Second
+)
+
+// maxEarlyData is the most data kept from a client before its backend
+// answers; once reached, the client is no longer watched for hanging up.
+const maxEarlyData = 64 * 1024
+
+// Mapping forwards a listening address to a port on a device.
+type Mapping struct {
+	Name   string // Display name (default: the listen address)
+	Listen string // Local address, e.g. ":3389"
+	Device string // Device MAC address
+	Port   int    // Backend port on the device
+	Host   string // Backend host (default: the device IP)
+}
+
+// Config holds the proxy configuration.
+type Config struct {
+	Mappings       []Mapping
+	ConnectTimeout time.Duration  // Give up on the backend after this
+	RetryInterval  time.Duration  // Time between backend connection attempts
+	MaxPending     int            // Connections waiting for their backend, across all mappings
+	WakeCooldown   time.Duration  // Minimum time between wakes of the same device
+	Logger         *logger.Logger // Optional logger
+}
+
+// Stats are the metrics of a mapping.
+type Stats struct {
+	Name        string    `json:"name"`
+	Listen      string    `json:"listen"`
+	Device      string    `json:"device"`
+	Port        int       `json:"port"`
+	Accepted    uint64    `json:"accepted"`  // Connections accepted
+	Rejected    uint64    `json:"rejected"`  // Connections refused because too many were pending
+	Failed      uint64    `json:"failed"`    // Connections whose backend never answered
+	Wakes       uint64    `json:"wakes"`     // Wakes sent
+	Active      int64     `json:"active"`    // Connections being spliced
+	Pending     int64     `json:"pending"`   // Connections waiting for the backend
+	BytesIn     uint64    `json:"bytes_in"`  // Client to backend
+	BytesOut    uint64    `json:"bytes_out"` // Backend to client
+	LastConnect time.Time `json:"last_connect,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	WaitP50     float64   `json:"wait_p50"` // Median wait for the backend, in seconds
+	WaitMax     float64   `json:"wait_max"` // Longest wait for the backend, in seconds
+}
+
+// maxWaits is the number of connection waits kept per mapping.
+const maxWaits = 50
+
+// mapping is a running mapping with its counters.
+type mapping struct {
+	Mapping
+	listener net.Listener
+
+	accepted, rejected, failed, wakes atomic.Uint64
+	active, pending                   atomic.Int64
+	bytesIn, bytesOut                 atomic.Uint64
+
+	mu          sync.Mutex
+	lastConnect time.Time
+	lastError   string
+	waits       []time.Duration
+}
+
+// Proxy accepts connections on the mapped addresses and splices them to
+// their devices, waking the devices as needed.
+type Proxy struct {
+	store    *store.Store
+	waker    *wake.Service
+	cfg      Config
+	mappings []*mapping
+	pending  chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	lastWakes map[string]time.Time // Normalized MAC -> last wake
+}
+
+// New creates a proxy for cfg.Mappings.
+func New(st *store.Store, waker *wake.Service, cfg Config) (*Proxy, error) {
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = DefaultMaxPending
+	}
+	if cfg.WakeCooldown <= 0 {
+		cfg.WakeCooldown = DefaultWakeCooldown
+	}
+
+	p := &Proxy{
+		store:     st,
+		waker:     waker,
+		cfg:       cfg,
+		pending:   make(chan struct{}, cfg.MaxPending),
+		stop:      make(chan struct{}),
+		lastWakes: make(map[string]time.Time),
+	}
+	for _, m := range cfg.Mappings {
+		if err := wol.ValidateMAC(m.Device); err != nil {
+			return nil, fmt.Errorf("proxy %s: invalid device MAC: %w", m.Listen, err)
+		}
+		if m.Port <= 0 || m.Port > 65535 {
+			return nil, fmt.Errorf("proxy %s: invalid backend port %d", m.Listen, m.Port)
+		}
+		if m.Name == "" {
+			m.Name = m.Listen
+		}
+		p.mappings = append(p.mappings, &mapping{Mapping: m})
+	}
+	return p, nil
+}
+
+// Start opens the listeners of all mappings and begins accepting
+// connections. If any listener fails, the others are closed.
+func (p *Proxy) Start() error {
+	for _, m := range p.mappings {
+		ln, err := net.Listen("tcp", m.Listen)
+		if err != nil {
+			p.Close()
+			return fmt.Errorf("proxy %s: %w", m.Name, err)
+		}
+		m.listener = ln
+		p.infof("Proxy %s listening on %s -> %s port %d", m.Name, ln.Addr(), m.Device, m.Port)
+	}
+
+	for _, m := range p.mappings {
+		p.wg.Add(1)
+		go p.accept(m)
+	}
+	return nil
+}
+
+// Close stops accepting connections and aborts connections still waiting
+// for their backend. Spliced connections are left to finish.
+func (p *Proxy) Close() error {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	for _, m := range p.mappings {
+		if m.listener != nil {
+			m.listener.Close()
+		}
+	}
+	p.wg.Wait()
+	return nil
+}
+
+// Stats returns the metrics of every mapping.
+func (p *Proxy) Stats() []Stats {
+	stats := make([]Stats, len(p.mappings))
+	for i, m := range p.mappings {
+		listen := m.Listen
+		if m.listener != nil {
+			listen = m.listener.Addr().String()
+		}
+
+		m.mu.Lock()
+		s := Stats{
+			Name:        m.Name,
+			Listen:      listen,
+			Device:      m.Device,
+			Port:        m.Port,
+			LastConnect: m.lastConnect,
+			LastError:   m.lastError,
+		}
+		if len(m.waits) > 0 {
+			sorted := append([]time.Duration(nil), m.waits...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			s.WaitP50 = sorted[(len(sorted)-1)/2].Seconds()
+			s.WaitMax = sorted[len(sorted)-1].Seconds()
+		}
+		m.mu.Unlock()
+
+		s.Accepted = m.accepted.Load()
+		s.Rejected = m.rejected.Load()
+		s.Failed = m.failed.Load()
+		s.Wakes = m.wakes.Load()
+		s.Active = m.active.Load()
+		s.Pending = m.pending.Load()
+		s.BytesIn = m.bytesIn.Load()
+		s.BytesOut = m.bytesOut.Load()
+		stats[i] = s
+	}
+	return stats
+}
+
+// accept serves connections of a mapping until its listener is closed.
+func (p *Proxy) accept(m *mapping) {
+	defer p.wg.Done()
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			p.errorf("Proxy %s accept failed: %v", m.Name, err)
+			return
+		}
+
+		m.accepted.Add(1)
+		select {
+		case p.pending <- struct{}{}:
+		default:
+			m.rejected.Add(1)
+			p.warnf("Proxy %s rejected %s: too many pending connections", m.Name, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go p.handle(m, conn)
+	}
+}
+
+// handle connects a client to its backend, waking the device if the
+// backend does not answer, then splices the two connections. A client
+// hanging up while it waits gives up its pending slot.
+func (p *Proxy) handle(m *mapping, client net.Conn) {
+	m.pending.Add(1)
+	start := time.Now()
+	watch := watchClient(client)
+	backend, err := p.dialBackend(m, watch.gone)
+	early, gone := watch.stop()
+	m.pending.Add(-1)
+	<-p.pending
+
+	if err == nil && gone {
+		backend.Close()
+		err = errClientGone
+	}
+	if err == errClientGone {
+		p.infof("Proxy %s: %s hung up while waiting for the backend", m.Name, client.RemoteAddr())
+		client.Close()
+		return
+	}
+	if err != nil {
+		m.failed.Add(1)
+		m.setError(err)
+		p.warnf("Proxy %s: %v", m.Name, err)
+		client.Close()
+		return
+	}
+	m.recordConnect(time.Since(start))
+
+	// Forward what the client sent while waiting
+	if len(early) > 0 {
+		n, err := backend.Write(early)
+		m.bytesIn.Add(uint64(n))
+		if err != nil {
+			p.warnf("Proxy %s: %v", m.Name, err)
+			client.Close()
+			backend.Close()
+			return
+		}
+	}
+
+	m.active.Add(1)
+	defer m.active.Add(-1)
+	splice(client, backend, &m.bytesIn, &m.bytesOut)
+}
+
+// errClientGone is returned by dialBackend when the client hung up.
+var errClientGone = errors.New("client hung up")
+
+// dialBackend connects to the backend of m, retrying until the connect
+// timeout or until gone is closed. The device is woken whenever a
+// connection attempt fails.
+func (p *Proxy) dialBackend(m *mapping, gone <-chan struct{}) (net.Conn, error) {
+	deadline := time.Now().Add(p.cfg.ConnectTimeout)
+	for {
+		addr, err := p.backendAddr(m)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, p.cfg.RetryInterval)
+		if err == nil {
+			return conn, nil
+		}
+
+		p.wake(m)
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("backend %s not reachable within %s: %v", addr, p.cfg.ConnectTimeout, err)
+		}
+
+		// Refused connections fail fast; wait before the next attempt
+		select {
+		case <-p.stop:
+			return nil, fmt.Errorf("proxy stopped")
+		case <-gone:
+			return nil, errClientGone
+		case <-time.After(p.cfg.RetryInterval):
+		}
+	}
+}
+
+// clientWatch reads from a client while its backend is dialed, to notice
+// the client hanging up. What the client sends meanwhile is kept, up to
+// maxEarlyData, to be forwarded once the backend answers.
+type clientWatch struct {
+	client   net.Conn
+	gone     chan struct{} // Closed when the client hangs up
+	done     chan struct{} // Closed when reading stops
+	stopping atomic.Bool
+	data     []byte
+}
+
+// watchClient starts watching client.
+func watchClient(client net.Conn) *clientWatch {
+	w := &clientWatch{client: client, gone: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		buf := make([]byte, 4096)
+		for len(w.data) < maxEarlyData {
+			n, err := client.Read(buf)
+			w.data = append(w.data, buf[:n]...)
+			if err == nil {
+				continue
+			}
+			// A client may send a request and half-close, still waiting
+			// for the answer
+			if !w.stopping.Load() && (err != io.EOF || len(w.data) == 0) {
+				close(w.gone)
+			}
+			return
+		}
+	}()
+	return w
+}
+
+// stop ends the watch, returning the data the client sent and whether it
+// hung up.
+func (w *clientWatch) stop() ([]byte, bool) {
+	w.stopping.Store(true)
+	w.client.SetReadDeadline(time.Now())
+	<-w.done
+	w.client.SetReadDeadline(time.Time{})
+
+	select {
+	case <-w.gone:
+		return w.data, true
+	default:
+		return w.data, false
+	}
+}
+
+// backendAddr resolves the backend address of m. The device IP is looked
+// up on every attempt so edits apply to new connections.
+func (p *Proxy) backendAddr(m *mapping) (string, error) {
+	host := m.Host
+	if host == "" {
+		mac := m.device()
+		device, err := p.store.GetByMAC(mac)
+		if err != nil {
+			return "", fmt.Errorf("device %s: %w", mac, err)
+		}
+		if device.IP == "" {
+			return "", fmt.Errorf("device %s has no IP address", mac)
+		}
+		host = device.IP
+	}
+	return net.JoinHostPort(host, strconv.Itoa(m.Port)), nil
+}
+
+// wake wakes the device of m unless it was woken within the cooldown, so
+// a burst of connections sends one wake instead of many.
+func (p *Proxy) wake(m *mapping) {
+	mac := m.device()
+	key := mac
+	if n, err := wol.NormalizeMAC(mac); err == nil {
+		key = n
+	}
+
+	p.mu.Lock()
+	if time.Since(p.lastWakes[key]) < p.cfg.WakeCooldown {
+		p.mu.Unlock()
+		return
+	}
+	p.lastWakes[key] = time.Now()
+	p.mu.Unlock()
+
+	m.wakes.Add(1)
+	err := p.waker.Wake(wake.Request{MAC: mac, Source: wake.SourceProxy, Detail: m.Name})
+	if err != nil {
+		p.errorf("Proxy %s failed to wake %s: %v", m.Name, mac, err)
+		return
+	}
+	p.infof("Proxy %s woke %s for an incoming connection", m.Name, mac)
+}
+
+// RenameMAC points the mappings of the device oldMAC at newMAC, after the
+// device's MAC changed, returning the number of mappings changed. The
+// config file still names oldMAC until it is edited.
+func (p *Proxy) RenameMAC(oldMAC, newMAC string) int {
+	old, err := wol.NormalizeMAC(oldMAC)
+	if err != nil {
+		return 0
+	}
+	renamed := 0
+	for _, m := range p.mappings {
+		m.mu.Lock()
+		if n, err := wol.NormalizeMAC(m.Device); err == nil && n == old {
+			m.Device = newMAC
+			renamed++
+		}
+		m.mu.Unlock()
+	}
+	return renamed
+}
+
+// device returns the MAC of the mapping's device.
+func (m *mapping) device() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Device
+}
+
+// splice copies data in both directions until both sides are done.
+func splice(client, backend net.Conn, in, out *atomic.Uint64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(backend, client)
+		in.Add(uint64(n))
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(client, backend)
+		out.Add(uint64(n))
+		closeWrite(client)
+	}()
+	wg.Wait()
+	client.Close()
+	backend.Close()
+}
+
+// closeWrite half-closes TCP connections so the peer sees EOF while the
+// other direction keeps flowing.
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+func (m *mapping) recordConnect(wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastConnect = time.Now()
+	m.waits = append(m.waits, wait)
+	if len(m.waits) > maxWaits {
+		m.waits = m.waits[len(m.waits)-maxWaits:]
+	}
+}
+
+func (m *mapping) setError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastError = err.Error()
+}
+
+func (p *Proxy) infof(format string, args ...interface{}) {
+	if p.cfg.Logger != nil {
+		p.cfg.Logger.Info(format, args...)
+	}
+}
+
+func (p *Proxy) warnf(format string, args ...interface{}) {
+	if p.cfg.Logger != nil {
+		p.cfg.Logger.Warn(format, args...)
+	}
+}
+
+func (p *Proxy) errorf(format string, args ...interface{}) {
+	if p.cfg.Logger != nil {
+		p.cfg.Logger.Error(format, args...)
+	}
+}
@@ -0,0 +1,259 @@
+// Package proxy tests.
+package proxy
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wake/waketest"
+)
+
+const testMAC = "AA:BB:CC:DD:EE:01"
+
+// newTestProxy returns a proxy with one mapping to port on 127.0.0.1 and
+// a channel receiving every wake request.
+func newTestProxy(t *testing.T, port int, cfg Config) (*Proxy, <-chan wake.Request) {
+	t.Helper()
+
+	st, err := store.NewStore(filepath.Join(t.TempDir(), "devices.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	st.Add(store.Device{Name: "PC", MAC: testMAC, IP: "127.0.0.1"})
+
+	waker, woken := waketest.NewService(t)
+	cfg.Mappings = []Mapping{{Name: "rdp", Listen: "127.0.0.1:0", Device: testMAC, Port: port}}
+	p, err := New(st, waker, cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, woken.C
+}
+
+// freePort returns a local port with nothing listening on it.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+// echo serves an echo server on ln.
+func echo(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+// roundTrip sends msg through the proxy and returns the echoed reply.
+func roundTrip(t *testing.T, addr, msg string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(msg))
+	conn.(*net.TCPConn).CloseWrite()
+	reply, _ := io.ReadAll(conn)
+	return string(reply)
+}
+
+func TestProxy_Splice(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	p, wakes := newTestProxy(t, ln.Addr().(*net.TCPAddr).Port, Config{})
+
+	if reply := roundTrip(t, p.Stats()[0].Listen, "hello"); reply != "hello" {
+		t.Errorf("Reply = %q, want %q", reply, "hello")
+	}
+	if len(wakes) != 0 {
+		t.Error("A reachable backend should not be woken")
+	}
+
+	stats := p.Stats()[0]
+	if stats.Accepted != 1 || stats.BytesIn != 5 || stats.BytesOut != 5 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestProxy_WakeAndRetry(t *testing.T) {
+	port := freePort(t)
+	p, wakes := newTestProxy(t, port, Config{RetryInterval: 50 * time.Millisecond, ConnectTimeout: 5 * time.Second})
+
+	// The backend "boots" once the wake is sent
+	booted := make(chan net.Listener, 1)
+	go func() {
+		req := <-wakes
+		if req.Source != wake.SourceProxy || req.Detail != "rdp" {
+			t.Errorf("Unexpected wake request: %+v", req)
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			t.Errorf("Listen() error = %v", err)
+			close(booted)
+			return
+		}
+		go echo(ln)
+		booted <- ln
+	}()
+
+	if reply := roundTrip(t, p.Stats()[0].Listen, "wake up"); reply != "wake up" {
+		t.Errorf("Reply = %q, want %q", reply, "wake up")
+	}
+	if stats := p.Stats()[0]; stats.Wakes != 1 || stats.Failed != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if ln, ok := <-booted; ok {
+		ln.Close()
+	}
+}
+
+func TestProxy_MaxPending(t *testing.T) {
+	port := freePort(t)
+	p, _ := newTestProxy(t, port, Config{
+		RetryInterval:  50 * time.Millisecond,
+		ConnectTimeout: 500 * time.Millisecond,
+		MaxPending:     1,
+	})
+	addr := p.Stats()[0].Listen
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// Wait until the first connection is pending
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats()[0].Pending == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Second connection should be closed, got %v", err)
+	}
+
+	// The first connection gives up after the connect timeout
+	first.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := first.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("First connection should be closed after the timeout, got %v", err)
+	}
+
+	stats := p.Stats()[0]
+	if stats.Rejected != 1 || stats.Failed != 1 || stats.LastError == "" {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestProxy_ClientHangsUp(t *testing.T) {
+	port := freePort(t)
+	p, _ := newTestProxy(t, port, Config{
+		RetryInterval:  20 * time.Millisecond,
+		ConnectTimeout: time.Minute,
+		MaxPending:     1,
+		WakeCooldown:   time.Millisecond,
+	})
+	addr := p.Stats()[0].Listen
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With a short cooldown, the device is woken on every retry
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats()[0].Wakes < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := p.Stats()[0]; stats.Wakes < 2 || stats.Pending != 1 {
+		t.Fatalf("Unexpected stats while waiting: %+v", stats)
+	}
+
+	// Hanging up frees the pending slot long before the connect timeout
+	conn.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for p.Stats()[0].Pending != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := p.Stats()[0]; stats.Pending != 0 || stats.Failed != 0 {
+		t.Fatalf("Unexpected stats after hanging up: %+v", stats)
+	}
+
+	// The next connection is accepted rather than rejected
+	next, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for p.Stats()[0].Pending == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := p.Stats()[0]; stats.Rejected != 0 || stats.Pending != 1 {
+		t.Errorf("Unexpected stats for the next connection: %+v", stats)
+	}
+}
+
+func TestProxy_RenameMAC(t *testing.T) {
+	p, err := New(nil, nil, Config{Mappings: []Mapping{
+		{Listen: ":0", Device: strings.ToLower(testMAC), Port: 22},
+		{Listen: ":0", Device: "AA:BB:CC:DD:EE:99", Port: 22},
+	}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if n := p.RenameMAC(testMAC, "AA:BB:CC:DD:EE:02"); n != 1 {
+		t.Errorf("RenameMAC() = %d, want 1", n)
+	}
+	if stats := p.Stats(); stats[0].Device != "AA:BB:CC:DD:EE:02" || stats[1].Device != "AA:BB:CC:DD:EE:99" {
+		t.Errorf("Mapping devices after RenameMAC() = %s, %s", stats[0].Device, stats[1].Device)
+	}
+}
+
+func TestNew_InvalidMapping(t *testing.T) {
+	tests := []Mapping{
+		{Listen: ":0", Device: "invalid", Port: 22},
+		{Listen: ":0", Device: testMAC, Port: 0},
+	}
+	for _, m := range tests {
+		if _, err := New(nil, nil, Config{Mappings: []Mapping{m}}); err == nil {
+			t.Errorf("New() should reject %+v", m)
+		}
+	}
+}
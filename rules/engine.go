@@ -0,0 +1,580 @@
+// Package rules runs automation rules inside the server.
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/arp"
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/schedule"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// DefaultPollInterval is the default time between ARP table reads.
+const DefaultPollInterval = 10 * time.Second
+
+// maxHistory is the number of rule firings kept in the log.
+const maxHistory = 200
+
+// HistoryPath returns the path of the firing log kept next to the data
+// file at dataFile.
+func HistoryPath(dataFile string) string {
+	return dataFile + ".firings"
+}
+
+// webhookTimeout bounds each outgoing webhook call.
+const webhookTimeout = 10 * time.Second
+
+// ErrHookNotFound is returned when no enabled rule listens on a hook.
+var ErrHookNotFound = errors.New("hook not found")
+
+// Config holds the rule engine configuration.
+type Config struct {
+	PollInterval time.Duration  // Time between ARP table reads
+	ARPPath      string         // ARP table path (default: arp.DefaultARPPath)
+	HistoryFile  string         // Optional file the firing log is kept in, a JSON object per line
+	Logger       *logger.Logger // Optional logger
+}
+
+// Firing records a triggered rule and the outcome of its actions.
+type Firing struct {
+	Time    time.Time      `json:"time"`
+	RuleID  string         `json:"rule_id"`
+	Rule    string         `json:"rule"`
+	Trigger string         `json:"trigger"`           // What fired the rule, e.g. "online AA:BB:CC:DD:EE:FF"
+	Skipped string         `json:"skipped,omitempty"` // Condition that blocked the rule
+	Actions []ActionResult `json:"actions,omitempty"`
+}
+
+// ActionResult is the outcome of one action of a firing.
+type ActionResult struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Engine evaluates rules against presence, status, schedule and webhook
+// events and runs their actions.
+type Engine struct {
+	rules   *Store
+	devices *store.Store
+	waker   *wake.Service
+	sender  *wol.WOLSender
+	cfg     Config
+	client  *http.Client
+	done    chan struct{} // Closed when Run stops, cutting staggered actions short
+
+	mu       sync.Mutex
+	present  map[string]bool // Normalized MACs in the ARP table; nil before the first read
+	lastTick time.Time       // Last evaluation of schedule triggers
+	history  []Firing        // Oldest first, as in the history file
+	lines    int             // Firings in the history file
+	now      func() time.Time
+	firing   sync.WaitGroup // Firings still running their actions
+}
+
+// NewEngine creates a rule engine for the rules in rules.
+func NewEngine(rules *Store, devices *store.Store, waker *wake.Service, sender *wol.WOLSender, cfg Config) *Engine {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.ARPPath == "" {
+		cfg.ARPPath = arp.DefaultARPPath
+	}
+	e := &Engine{
+		rules:   rules,
+		devices: devices,
+		waker:   waker,
+		sender:  sender,
+		cfg:     cfg,
+		client:  &http.Client{Timeout: webhookTimeout},
+		done:    make(chan struct{}),
+		now:     time.Now,
+	}
+	e.loadHistory()
+	return e
+}
+
+// Run watches the ARP table and schedule triggers until stop is closed.
+// Staggered actions still pausing between their devices are then cut
+// short, and Run returns once running firings have finished.
+func (e *Engine) Run(stop <-chan struct{}) {
+	e.mu.Lock()
+	e.lastTick = e.now()
+	e.mu.Unlock()
+	e.pollARP()
+
+	ticker := time.NewTicker(e.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		// Schedule triggers are checked on the minute
+		now := e.now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		select {
+		case <-stop:
+			timer.Stop()
+			close(e.done)
+			e.firing.Wait()
+			return
+		case <-ticker.C:
+			timer.Stop()
+			e.pollARP()
+		case <-timer.C:
+			e.tick()
+		}
+	}
+}
+
+// List returns all rules.
+func (e *Engine) List() []Rule {
+	return e.rules.List()
+}
+
+// Get returns a rule by ID.
+func (e *Engine) Get(id string) (Rule, error) {
+	return e.rules.Get(id)
+}
+
+// Add creates a rule.
+func (e *Engine) Add(r Rule) (Rule, error) {
+	return e.rules.Add(r)
+}
+
+// Update replaces a rule.
+func (e *Engine) Update(id string, r Rule) (Rule, error) {
+	return e.rules.Update(id, r)
+}
+
+// Delete removes a rule.
+func (e *Engine) Delete(id string) error {
+	return e.rules.Delete(id)
+}
+
+// History returns the most recent rule firings, newest first.
+func (e *Engine) History() []Firing {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]Firing, len(e.history))
+	for i, f := range e.history {
+		result[len(e.history)-1-i] = f
+	}
+	return result
+}
+
+// DeviceChanged fires online and offline rules for mac. It is meant to be
+// registered with the monitor's OnChange.
+func (e *Engine) DeviceChanged(mac string, online bool) {
+	typ := TriggerOffline
+	if online {
+		typ = TriggerOnline
+	}
+	// Webhook actions may be slow; don't hold up the monitor
+	e.dispatch(func() { e.fireMatching(typ, normalize(mac), typ+" "+mac) })
+}
+
+// Hook fires the rules listening on a webhook and returns how many rules
+// were triggered.
+func (e *Engine) Hook(name string) (int, error) {
+	count := 0
+	for _, r := range e.rules.List() {
+		if r.Enabled && r.Trigger.Type == TriggerWebhook && r.Trigger.Hook == name {
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, ErrHookNotFound
+	}
+	e.dispatch(func() { e.fireMatching(TriggerWebhook, name, "webhook "+name) })
+	return count, nil
+}
+
+// pollARP reads the ARP table and fires presence rules for MACs that
+// appeared or disappeared since the last read. The first read only
+// records the table, so rules don't fire for everything present at startup.
+// A stored device is present while any of its MACs is, so rules fire once
+// when its first MAC appears and once when its last one disappears.
+func (e *Engine) pollARP() {
+	entries, err := arp.ParsePath(e.cfg.ARPPath)
+	if err != nil {
+		e.debugf("Failed to read ARP table: %v", err)
+		return
+	}
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		present[normalize(entry.MAC)] = true
+	}
+
+	e.mu.Lock()
+	previous := e.present
+	e.present = present
+	e.mu.Unlock()
+	if previous == nil {
+		return
+	}
+
+	// Actions may be slow; don't hold up the next poll
+	fired := make(map[string]bool) // Devices whose rules fired in this poll
+	for mac := range present {
+		if !previous[mac] && e.deviceChanged(mac, previous, fired) {
+			mac := mac
+			e.dispatch(func() { e.fireMatching(TriggerARPPresent, mac, "arp_present "+mac) })
+		}
+	}
+	fired = make(map[string]bool)
+	for mac := range previous {
+		if !present[mac] && e.deviceChanged(mac, present, fired) {
+			mac := mac
+			e.dispatch(func() { e.fireMatching(TriggerARPAbsent, mac, "arp_absent "+mac) })
+		}
+	}
+}
+
+// deviceChanged reports whether the presence of the device with mac
+// changed when mac appeared or disappeared: none of its other MACs is in
+// others, the MACs present before or after, and its rules did not fire yet
+// for another of its MACs. MACs of no stored device always count.
+func (e *Engine) deviceChanged(mac string, others, fired map[string]bool) bool {
+	device, err := e.devices.GetByMAC(mac)
+	if err != nil {
+		return true
+	}
+	if fired[device.ID] {
+		return false
+	}
+	for _, m := range device.MACs() {
+		if others[normalize(m)] {
+			return false
+		}
+	}
+	fired[device.ID] = true
+	return true
+}
+
+// tick fires schedule rules with a cron match since the last tick.
+func (e *Engine) tick() {
+	now := e.now()
+	e.mu.Lock()
+	since := e.lastTick
+	e.lastTick = now
+	e.mu.Unlock()
+
+	for _, r := range e.rules.List() {
+		if !r.Enabled || r.Trigger.Type != TriggerSchedule {
+			continue
+		}
+		c, err := schedule.ParseCron(r.Trigger.Cron)
+		if err != nil {
+			continue
+		}
+		loc, err := schedule.LoadLocation(r.Conditions.Timezone)
+		if err != nil {
+			continue
+		}
+		if next := c.Next(since.In(loc)); !next.IsZero() && !next.After(now) {
+			// Staggered wakes may take minutes; don't hold up the next tick
+			r := r
+			e.dispatch(func() { e.fire(r, "schedule "+r.Trigger.Cron) })
+		}
+	}
+}
+
+// dispatch runs a firing in the background, so slow webhooks and
+// staggered wakes hold up no other trigger.
+func (e *Engine) dispatch(fn func()) {
+	e.firing.Add(1)
+	go func() {
+		defer e.firing.Done()
+		fn()
+	}()
+}
+
+// fireMatching fires every enabled rule whose trigger has type typ and
+// matches key (a normalized MAC, or a hook name). A MAC trigger matches
+// any MAC of the stored device with key.
+func (e *Engine) fireMatching(typ, key, trigger string) {
+	var device *store.Device
+	if typ != TriggerWebhook {
+		device, _ = e.devices.GetByMAC(key)
+	}
+	for _, r := range e.rules.List() {
+		if !r.Enabled || r.Trigger.Type != typ {
+			continue
+		}
+		match := r.Trigger.Hook == key
+		if typ != TriggerWebhook {
+			match = normalize(r.Trigger.MAC) == key || (device != nil && device.HasMAC(r.Trigger.MAC))
+		}
+		if match {
+			e.fire(r, trigger)
+		}
+	}
+}
+
+// fire runs a rule's actions if its conditions hold, and logs the firing.
+func (e *Engine) fire(r Rule, trigger string) {
+	f := Firing{Time: e.now(), RuleID: r.ID, Rule: r.Name, Trigger: trigger}
+
+	r, reason, err := e.rules.claim(r.ID, f.Time)
+	if errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err != nil {
+		e.errorf("Failed to record firing of rule %q: %v", r.Name, err)
+	}
+	if reason != "" {
+		f.Skipped = reason
+		e.debugf("Rule %q triggered by %s, skipped (%s)", r.Name, trigger, reason)
+		e.record(f)
+		return
+	}
+
+	for _, a := range r.Actions {
+		f.Actions = append(f.Actions, e.run(r, a, trigger)...)
+	}
+	failed := 0
+	for _, res := range f.Actions {
+		if res.Error != "" {
+			failed++
+		}
+	}
+	e.infof("Rule %q triggered by %s ran %d action(s), %d failed", r.Name, trigger, len(f.Actions), failed)
+	e.record(f)
+}
+
+// run executes one action, returning a result per target.
+func (e *Engine) run(r Rule, a Action, trigger string) []ActionResult {
+	if a.Type == ActionWebhook {
+		res := ActionResult{Type: a.Type, Target: a.URL}
+		if err := e.callWebhook(r, a, trigger); err != nil {
+			res.Error = err.Error()
+			e.errorf("Rule %q webhook %s failed: %v", r.Name, a.URL, err)
+		}
+		return []ActionResult{res}
+	}
+
+	var results []ActionResult
+	for _, t := range e.targets(a) {
+		if t.delay > 0 {
+			timer := time.NewTimer(t.delay)
+			select {
+			case <-e.done:
+				timer.Stop()
+				return append(results, ActionResult{Type: a.Type, Target: t.mac, Error: "stopped"})
+			case <-timer.C:
+			}
+		}
+		mac := t.mac
+		var err error
+		if a.Type == ActionWake {
+			err = e.waker.Wake(wake.Request{MAC: mac, Source: wake.SourceRule, Detail: r.Name})
+		} else {
+			err = e.sender.SendSleep(mac)
+		}
+		res := ActionResult{Type: a.Type, Target: mac}
+		if err != nil {
+			res.Error = err.Error()
+			e.errorf("Rule %q failed to %s %s: %v", r.Name, a.Type, mac, err)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// target is a MAC to act on, and how long to pause before acting on it.
+type target struct {
+	mac   string
+	delay time.Duration
+}
+
+// targets resolves the device and group of an action to unique MACs.
+// Members of the group after the first are delayed by its stagger.
+func (e *Engine) targets(a Action) []target {
+	seen := make(map[string]bool)
+	var targets []target
+	add := func(mac string, delay time.Duration) bool {
+		key := normalize(mac)
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		targets = append(targets, target{mac: mac, delay: delay})
+		return true
+	}
+
+	if a.MAC != "" {
+		add(a.MAC, 0)
+	}
+	if a.Group != "" {
+		var stagger, delay time.Duration
+		if g, err := e.devices.GroupByName(a.Group); err == nil {
+			stagger = g.StaggerDelay()
+		}
+		for _, d := range e.devices.GetByGroup(a.Group) {
+			if add(d.MAC, delay) {
+				delay = stagger
+			}
+		}
+	}
+	return targets
+}
+
+// webhookPayload is the body sent by webhook actions.
+type webhookPayload struct {
+	Rule    string    `json:"rule"`
+	RuleID  string    `json:"rule_id"`
+	Trigger string    `json:"trigger"`
+	Time    time.Time `json:"time"`
+}
+
+// callWebhook calls the URL of a webhook action.
+func (e *Engine) callWebhook(r Rule, a Action, trigger string) error {
+	method := a.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	var body []byte
+	if method != http.MethodGet {
+		body, _ = json.Marshal(webhookPayload{Rule: r.Name, RuleID: r.ID, Trigger: trigger, Time: e.now()})
+	}
+	req, err := http.NewRequest(method, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// record appends a firing to the bounded history, and to the history
+// file if there is one.
+func (e *Engine) record(f Firing) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.history = append(e.history, f)
+	if len(e.history) > maxHistory {
+		e.history = append([]Firing(nil), e.history[len(e.history)-maxHistory:]...)
+	}
+	if e.cfg.HistoryFile == "" {
+		return
+	}
+	if err := e.appendHistoryLocked(f); err != nil {
+		e.errorf("Failed to write rule history: %v", err)
+	}
+}
+
+// appendHistoryLocked appends a firing to the history file, rewriting it
+// with the history in memory once it is a quarter over the limit (must be
+// called with lock held).
+func (e *Engine) appendHistoryLocked(f Firing) error {
+	if e.lines+1 > maxHistory+maxHistory/4 {
+		var buf bytes.Buffer
+		for _, h := range e.history {
+			line, err := json.Marshal(h)
+			if err != nil {
+				return err
+			}
+			buf.Write(append(line, '\n'))
+		}
+		if err := atomicfile.WriteFile(e.cfg.HistoryFile, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		e.lines = len(e.history)
+		return nil
+	}
+
+	line, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(e.cfg.HistoryFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	e.lines++
+	return nil
+}
+
+// loadHistory loads the newest firings from the history file, if any. A
+// truncated last line, left by a crash, is ignored.
+func (e *Engine) loadHistory() {
+	if e.cfg.HistoryFile == "" {
+		return
+	}
+	data, err := os.ReadFile(e.cfg.HistoryFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			e.errorf("Failed to read rule history: %v", err)
+		}
+		return
+	}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		e.lines++
+		var f Firing
+		if err := json.Unmarshal(line, &f); err == nil {
+			e.history = append(e.history, f)
+		}
+	}
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// normalize returns mac in canonical form, or unchanged if invalid.
+func normalize(mac string) string {
+	if n, err := wol.NormalizeMAC(mac); err == nil {
+		return n
+	}
+	return mac
+}
+
+func (e *Engine) infof(format string, args ...interface{}) {
+	if e.cfg.Logger != nil {
+		e.cfg.Logger.Info(format, args...)
+	}
+}
+
+func (e *Engine) errorf(format string, args ...interface{}) {
+	if e.cfg.Logger != nil {
+		e.cfg.Logger.Error(format, args...)
+	}
+}
+
+func (e *Engine) debugf(format string, args ...interface{}) {
+	if e.cfg.Logger != nil {
+		e.cfg.Logger.Debug(format, args...)
+	}
+}
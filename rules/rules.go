@@ -0,0 +1,489 @@
+// Package rules provides automation rules and their persistence.
+package rules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/schedule"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Trigger types.
+const (
+	TriggerARPPresent = "arp_present" // A MAC appears in the ARP table
+	TriggerARPAbsent  = "arp_absent"  // A MAC disappears from the ARP table
+	TriggerOnline     = "online"      // A monitored device comes online
+	TriggerOffline    = "offline"     // A monitored device goes offline
+	TriggerSchedule   = "schedule"    // A cron expression matches
+	TriggerWebhook    = "webhook"     // POST /api/hooks/{hook}
+)
+
+// Action types.
+const (
+	ActionWake    = "wake"    // Send a wake packet
+	ActionSleep   = "sleep"   // Send a Sleep-on-LAN packet
+	ActionWebhook = "webhook" // Call a URL
+)
+
+// ErrNotFound is returned when a rule does not exist.
+var ErrNotFound = errors.New("rule not found")
+
+// Rule runs actions when its trigger fires and its conditions hold.
+type Rule struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Enabled    bool       `json:"enabled"`
+	Trigger    Trigger    `json:"trigger"`
+	Conditions Conditions `json:"conditions"`
+	Actions    []Action   `json:"actions"`
+	LastFired  time.Time  `json:"last_fired,omitempty"`
+}
+
+// Trigger describes the event a rule reacts to.
+type Trigger struct {
+	Type string `json:"type"`
+	MAC  string `json:"mac,omitempty"`  // For ARP and online/offline triggers
+	Cron string `json:"cron,omitempty"` // For schedule triggers, evaluated in the conditions' timezone
+	Hook string `json:"hook,omitempty"` // For webhook triggers, the name in /api/hooks/{hook}
+}
+
+// Conditions restrict when a triggered rule may fire.
+type Conditions struct {
+	Timezone string   `json:"timezone,omitempty"` // IANA name or fixed offset; empty for local time
+	Windows  []string `json:"windows,omitempty"`  // Time ranges like "22:00-06:00"; empty for any time
+	Weekdays []int    `json:"weekdays,omitempty"` // 0 = Sunday; empty for every day
+	Cooldown int      `json:"cooldown,omitempty"` // Minimum seconds between firings
+}
+
+// Action is a step run when a rule fires.
+type Action struct {
+	Type   string `json:"type"`
+	MAC    string `json:"mac,omitempty"`    // Device for wake and sleep actions
+	Group  string `json:"group,omitempty"`  // Device group for wake and sleep actions
+	URL    string `json:"url,omitempty"`    // For webhook actions
+	Method string `json:"method,omitempty"` // For webhook actions (default: POST)
+}
+
+// Validate checks that the rule is well-formed.
+func (r *Rule) Validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return fmt.Errorf("rule name is required")
+	}
+
+	switch r.Trigger.Type {
+	case TriggerARPPresent, TriggerARPAbsent, TriggerOnline, TriggerOffline:
+		if err := wol.ValidateMAC(r.Trigger.MAC); err != nil {
+			return fmt.Errorf("invalid trigger MAC: %w", err)
+		}
+	case TriggerSchedule:
+		if _, err := schedule.ParseCron(r.Trigger.Cron); err != nil {
+			return err
+		}
+	case TriggerWebhook:
+		if !validHook(r.Trigger.Hook) {
+			return fmt.Errorf("invalid hook name %q (use letters, digits, '-' and '_')", r.Trigger.Hook)
+		}
+	default:
+		return fmt.Errorf("invalid trigger type %q", r.Trigger.Type)
+	}
+
+	if _, err := schedule.LoadLocation(r.Conditions.Timezone); err != nil {
+		return err
+	}
+	for _, w := range r.Conditions.Windows {
+		if _, _, err := parseWindow(w); err != nil {
+			return err
+		}
+	}
+	for _, d := range r.Conditions.Weekdays {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("invalid weekday %d (use 0-6, 0 = Sunday)", d)
+		}
+	}
+	if r.Conditions.Cooldown < 0 {
+		return fmt.Errorf("cooldown must not be negative")
+	}
+
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("rule must have at least one action")
+	}
+	for _, a := range r.Actions {
+		switch a.Type {
+		case ActionWake, ActionSleep:
+			if a.MAC == "" && a.Group == "" {
+				return fmt.Errorf("%s action must target a device or group", a.Type)
+			}
+			if a.MAC != "" {
+				if err := wol.ValidateMAC(a.MAC); err != nil {
+					return fmt.Errorf("invalid action MAC: %w", err)
+				}
+			}
+		case ActionWebhook:
+			u, err := url.Parse(a.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid webhook URL %q", a.URL)
+			}
+		default:
+			return fmt.Errorf("invalid action type %q (use %s, %s or %s)", a.Type, ActionWake, ActionSleep, ActionWebhook)
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether the rule's conditions hold at t, returning the
+// reason when they don't.
+func (r *Rule) Allowed(t time.Time) (bool, string) {
+	c := r.Conditions
+	if c.Cooldown > 0 && !r.LastFired.IsZero() && t.Sub(r.LastFired) < time.Duration(c.Cooldown)*time.Second {
+		return false, "cooldown"
+	}
+
+	loc, err := schedule.LoadLocation(c.Timezone)
+	if err != nil {
+		return false, err.Error()
+	}
+	t = t.In(loc)
+
+	if len(c.Weekdays) > 0 {
+		ok := false
+		for _, d := range c.Weekdays {
+			if time.Weekday(d) == t.Weekday() {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false, "weekday"
+		}
+	}
+
+	if len(c.Windows) > 0 {
+		minute := t.Hour()*60 + t.Minute()
+		ok := false
+		for _, w := range c.Windows {
+			from, to, err := parseWindow(w)
+			if err != nil {
+				continue
+			}
+			if from <= to && minute >= from && minute < to ||
+				from > to && (minute >= from || minute < to) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false, "time window"
+		}
+	}
+	return true, ""
+}
+
+// parseWindow parses "HH:MM-HH:MM" into minutes since midnight. Windows
+// whose end is before their start wrap past midnight.
+func parseWindow(w string) (int, int, error) {
+	fromStr, toStr, ok := strings.Cut(strings.TrimSpace(w), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid time window %q (use HH:MM-HH:MM)", w)
+	}
+	from, err1 := parseClock(fromStr)
+	to, err2 := parseClock(toStr)
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid time window %q (use HH:MM-HH:MM)", w)
+	}
+	return from, to, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight; "24:00" is the
+// end of the day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	hours, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.Atoi(m)
+	if err != nil {
+		return 0, err
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || hours == 24 && minutes != 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// validHook reports whether name can be used in a hook URL.
+func validHook(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Store persists rules in a JSON file.
+type Store struct {
+	filePath string
+	rules    []*Rule
+	mu       sync.RWMutex
+}
+
+// NewStore creates a rule store backed by filePath.
+func NewStore(filePath string) (*Store, error) {
+	s := &Store{filePath: filePath}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read rule file: %w", err)
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rule file: %w", err)
+	}
+	return s, nil
+}
+
+// List returns all rules.
+func (s *Store) List() []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Rule, len(s.rules))
+	for i, r := range s.rules {
+		result[i] = *r
+	}
+	return result
+}
+
+// Get returns a rule by ID.
+func (s *Store) Get(id string) (Rule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.rules {
+		if r.ID == id {
+			return *r, nil
+		}
+	}
+	return Rule{}, ErrNotFound
+}
+
+// Add validates and stores a new rule, assigning it an ID.
+func (s *Store) Add(r Rule) (Rule, error) {
+	if err := r.Validate(); err != nil {
+		return Rule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = newID()
+	r.LastFired = time.Time{}
+	s.rules = append(s.rules, &r)
+	if err := s.saveLocked(); err != nil {
+		s.rules = s.rules[:len(s.rules)-1]
+		return Rule{}, err
+	}
+	return r, nil
+}
+
+// Update replaces a rule, keeping its ID and last firing time.
+func (s *Store) Update(id string, r Rule) (Rule, error) {
+	if err := r.Validate(); err != nil {
+		return Rule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, old := range s.rules {
+		if old.ID == id {
+			r.ID = id
+			r.LastFired = old.LastFired
+			s.rules[i] = &r
+			if err := s.saveLocked(); err != nil {
+				s.rules[i] = old
+				return Rule{}, err
+			}
+			return r, nil
+		}
+	}
+	return Rule{}, ErrNotFound
+}
+
+// Delete removes a rule by ID.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, r := range s.rules {
+		if r.ID == id {
+			old := s.rules
+			s.rules = append(append([]*Rule{}, old[:i]...), old[i+1:]...)
+			if err := s.saveLocked(); err != nil {
+				s.rules = old
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// RenameGroup replaces the device group oldName with newName in every
+// rule action, returning the number of rules changed.
+func (s *Store) RenameGroup(oldName, newName string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.rules
+	s.rules = make([]*Rule, len(old))
+	renamed := 0
+	for i, r := range old {
+		s.rules[i] = r
+		for j, a := range r.Actions {
+			if a.Group != oldName {
+				continue
+			}
+			if s.rules[i] == r {
+				// Copy, as rules returned earlier share the actions
+				updated := *r
+				updated.Actions = append([]Action{}, r.Actions...)
+				s.rules[i] = &updated
+				renamed++
+			}
+			s.rules[i].Actions[j].Group = newName
+		}
+	}
+	if renamed == 0 {
+		s.rules = old
+		return 0, nil
+	}
+	if err := s.saveLocked(); err != nil {
+		s.rules = old
+		return 0, err
+	}
+	return renamed, nil
+}
+
+// RenameMAC replaces the device MAC oldMAC, in any notation, with newMAC
+// in every rule trigger and action, returning the number of rules changed.
+func (s *Store) RenameMAC(oldMAC, newMAC string) (int, error) {
+	old, err := wol.NormalizeMAC(oldMAC)
+	if err != nil {
+		return 0, err
+	}
+	matches := func(mac string) bool {
+		n, err := wol.NormalizeMAC(mac)
+		return err == nil && n == old
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.rules
+	s.rules = make([]*Rule, len(previous))
+	renamed := 0
+	for i, r := range previous {
+		s.rules[i] = r
+		changed := matches(r.Trigger.MAC)
+		for _, a := range r.Actions {
+			changed = changed || matches(a.MAC)
+		}
+		if !changed {
+			continue
+		}
+
+		// Copy, as rules returned earlier share the actions
+		updated := *r
+		updated.Actions = append([]Action{}, r.Actions...)
+		if matches(updated.Trigger.MAC) {
+			updated.Trigger.MAC = newMAC
+		}
+		for j, a := range updated.Actions {
+			if matches(a.MAC) {
+				updated.Actions[j].MAC = newMAC
+			}
+		}
+		s.rules[i] = &updated
+		renamed++
+	}
+	if renamed == 0 {
+		s.rules = previous
+		return 0, nil
+	}
+	if err := s.saveLocked(); err != nil {
+		s.rules = previous
+		return 0, err
+	}
+	return renamed, nil
+}
+
+// claim records that a rule fires at t if its conditions still allow it,
+// returning the reason when they don't. Checking and recording under one
+// lock keeps concurrent triggers from firing a rule twice within its
+// cooldown.
+func (s *Store) claim(id string, t time.Time) (Rule, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.rules {
+		if r.ID != id {
+			continue
+		}
+		if ok, reason := r.Allowed(t); !ok {
+			return *r, reason, nil
+		}
+		r.LastFired = t
+		return *r, "", s.saveLocked()
+	}
+	return Rule{}, "", ErrNotFound
+}
+
+// saveLocked writes rules to file (must be called with lock held).
+func (s *Store) saveLocked() error {
+	if dir := filepath.Dir(s.filePath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(s.rules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rules: %w", err)
+	}
+	if err := atomicfile.WriteFile(s.filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write rule file: %w", err)
+	}
+	return nil
+}
+
+// newID returns a random identifier.
+func newID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
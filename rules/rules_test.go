@@ -0,0 +1,425 @@
+// Package rules tests.
+package rules
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wake/waketest"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+const (
+	phoneMAC   = "AA:BB:CC:DD:EE:01"
+	desktopMAC = "AA:BB:CC:DD:EE:02"
+)
+
+const arpHeader = "IP address       HW type     Flags       HW address            Mask     Device\n"
+
+// arpLine returns an ARP table line for mac.
+func arpLine(mac string) string {
+	return "192.168.1.50     0x1         0x2         " + mac + "     *        eth0\n"
+}
+
+// newTestEngine returns an engine reading a temp ARP table, and a channel
+// receiving every wake request.
+func newTestEngine(t *testing.T) (*Engine, string, <-chan wake.Request) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	devices, err := store.NewStore(filepath.Join(tmpDir, "devices.json"))
+	if err != nil {
+		t.Fatalf("store.NewStore() error = %v", err)
+	}
+	devices.Add(store.Device{Name: "Desktop", MAC: desktopMAC, Group: "office"})
+
+	ruleStore, err := NewStore(filepath.Join(tmpDir, "rules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arpPath := filepath.Join(tmpDir, "arp")
+	if err := os.WriteFile(arpPath, []byte(arpHeader), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := wol.NewSender("", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+	waker := wake.NewService(sender)
+	woken := waketest.Record(waker)
+
+	e := NewEngine(ruleStore, devices, waker, sender, Config{ARPPath: arpPath})
+	return e, arpPath, woken.C
+}
+
+func TestRule_Validate(t *testing.T) {
+	valid := Rule{
+		Name:    "Phone home",
+		Trigger: Trigger{Type: TriggerARPPresent, MAC: phoneMAC},
+		Actions: []Action{{Type: ActionWake, MAC: desktopMAC}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	tests := map[string]func(r *Rule){
+		"no name":         func(r *Rule) { r.Name = "" },
+		"unknown trigger": func(r *Rule) { r.Trigger.Type = "reboot" },
+		"trigger MAC":     func(r *Rule) { r.Trigger.MAC = "invalid" },
+		"cron":            func(r *Rule) { r.Trigger = Trigger{Type: TriggerSchedule, Cron: "* *"} },
+		"hook name":       func(r *Rule) { r.Trigger = Trigger{Type: TriggerWebhook, Hook: "a/b"} },
+		"window":          func(r *Rule) { r.Conditions.Windows = []string{"25:00-26:00"} },
+		"weekday":         func(r *Rule) { r.Conditions.Weekdays = []int{7} },
+		"no actions":      func(r *Rule) { r.Actions = nil },
+		"no target":       func(r *Rule) { r.Actions = []Action{{Type: ActionSleep}} },
+		"webhook URL":     func(r *Rule) { r.Actions = []Action{{Type: ActionWebhook, URL: "ftp://host"}} },
+	}
+	for name, mutate := range tests {
+		r := valid
+		mutate(&r)
+		if err := r.Validate(); err == nil {
+			t.Errorf("%s: Validate() should fail", name)
+		}
+	}
+}
+
+func TestRule_Allowed(t *testing.T) {
+	r := Rule{Conditions: Conditions{
+		Timezone: "UTC",
+		Windows:  []string{"22:00-06:00"},
+		Weekdays: []int{1, 2, 3, 4, 5},
+		Cooldown: 600,
+	}}
+
+	// Monday 2024-01-01
+	tests := []struct {
+		time   string
+		reason string
+	}{
+		{"2024-01-01T23:30:00Z", ""},
+		{"2024-01-02T05:59:00Z", ""},
+		{"2024-01-01T12:00:00Z", "time window"},
+		{"2024-01-06T23:30:00Z", "weekday"},
+	}
+	for _, tt := range tests {
+		at, _ := time.Parse(time.RFC3339, tt.time)
+		if _, reason := r.Allowed(at); reason != tt.reason {
+			t.Errorf("Allowed(%s) reason = %q, want %q", tt.time, reason, tt.reason)
+		}
+	}
+
+	r.LastFired, _ = time.Parse(time.RFC3339, "2024-01-01T23:25:00Z")
+	at, _ := time.Parse(time.RFC3339, "2024-01-01T23:30:00Z")
+	if ok, reason := r.Allowed(at); ok || reason != "cooldown" {
+		t.Errorf("Expected cooldown, got %v %q", ok, reason)
+	}
+}
+
+func TestEngine_ARPPresence(t *testing.T) {
+	e, arpPath, wakes := newTestEngine(t)
+	rule, err := e.Add(Rule{
+		Name:       "Phone home",
+		Enabled:    true,
+		Trigger:    Trigger{Type: TriggerARPPresent, MAC: "aa:bb:cc:dd:ee:01"},
+		Conditions: Conditions{Cooldown: 3600},
+		Actions:    []Action{{Type: ActionWake, Group: "office"}},
+	})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// The first read only records what is present
+	os.WriteFile(arpPath, []byte(arpHeader+arpLine(phoneMAC)), 0644)
+	e.pollARP()
+	e.firing.Wait()
+	if len(wakes) != 0 {
+		t.Fatal("Devices present at startup should not fire rules")
+	}
+
+	// Leave and come back
+	os.WriteFile(arpPath, []byte(arpHeader), 0644)
+	e.pollARP()
+	e.firing.Wait()
+	os.WriteFile(arpPath, []byte(arpHeader+arpLine(phoneMAC)), 0644)
+	e.pollARP()
+	e.firing.Wait()
+
+	if len(wakes) != 1 {
+		t.Fatalf("Expected 1 wake, got %d", len(wakes))
+	}
+	if req := <-wakes; req.MAC != desktopMAC || req.Source != wake.SourceRule || req.Detail != "Phone home" {
+		t.Errorf("Unexpected wake request: %+v", req)
+	}
+
+	// A second arrival within the cooldown is logged but does nothing
+	os.WriteFile(arpPath, []byte(arpHeader), 0644)
+	e.pollARP()
+	e.firing.Wait()
+	os.WriteFile(arpPath, []byte(arpHeader+arpLine(phoneMAC)), 0644)
+	e.pollARP()
+	e.firing.Wait()
+	if len(wakes) != 0 {
+		t.Error("Cooldown should suppress the second firing")
+	}
+
+	history := e.History()
+	if len(history) != 2 || history[0].Skipped != "cooldown" || len(history[1].Actions) != 1 {
+		t.Errorf("Unexpected history: %+v", history)
+	}
+	if stored, _ := e.Get(rule.ID); stored.LastFired.IsZero() {
+		t.Error("LastFired should be recorded")
+	}
+}
+
+func TestEngine_ARPPresenceAlias(t *testing.T) {
+	e, arpPath, wakes := newTestEngine(t)
+	const dockMAC = "AA:BB:CC:DD:EE:03"
+	if err := e.devices.Add(store.Device{Name: "Laptop", MAC: phoneMAC, Aliases: []store.MACAlias{{MAC: dockMAC}}}); err != nil {
+		t.Fatal(err)
+	}
+	present, err := e.Add(Rule{
+		Name:    "Docked",
+		Enabled: true,
+		Trigger: Trigger{Type: TriggerARPPresent, MAC: phoneMAC},
+		Actions: []Action{{Type: ActionWake, MAC: desktopMAC}},
+	})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	absent, err := e.Add(Rule{
+		Name:    "Gone",
+		Enabled: true,
+		Trigger: Trigger{Type: TriggerARPAbsent, MAC: phoneMAC},
+		Actions: []Action{{Type: ActionWake, MAC: desktopMAC}},
+	})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	poll := func(macs ...string) {
+		table := arpHeader
+		for _, mac := range macs {
+			table += arpLine(mac)
+		}
+		if err := os.WriteFile(arpPath, []byte(table), 0644); err != nil {
+			t.Fatal(err)
+		}
+		e.pollARP()
+		e.firing.Wait()
+	}
+	fired := func(id string) int {
+		n := 0
+		for _, f := range e.History() {
+			if f.RuleID == id {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Only the dock's NIC appears: the laptop is present
+	poll()
+	poll(dockMAC)
+	if fired(present.ID) != 1 || len(wakes) != 1 {
+		t.Fatalf("Expected the alias MAC to fire the presence rule, fired %d", fired(present.ID))
+	}
+
+	// The laptop stays present while any of its MACs is
+	poll(dockMAC, phoneMAC)
+	poll(phoneMAC)
+	if fired(present.ID) != 1 || fired(absent.ID) != 0 {
+		t.Errorf("Rules fired %d and %d times while the laptop stayed present", fired(present.ID), fired(absent.ID))
+	}
+
+	poll()
+	if fired(absent.ID) != 1 {
+		t.Errorf("Expected the absence rule to fire once the last MAC left, fired %d", fired(absent.ID))
+	}
+}
+
+func TestEngine_HistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json.firings")
+	e := NewEngine(nil, nil, nil, nil, Config{HistoryFile: path})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < maxHistory+maxHistory/2; i++ {
+		e.record(Firing{Time: start.Add(time.Duration(i) * time.Minute), Rule: "Rule " + strconv.Itoa(i)})
+	}
+
+	// The file is trimmed once a quarter over the limit
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if n := strings.Count(string(data), "\n"); n < maxHistory || n > maxHistory+maxHistory/4 {
+		t.Errorf("History file has %d lines", n)
+	}
+
+	// A restarted engine serves the firings from the file, newest first
+	reopened := NewEngine(nil, nil, nil, nil, Config{HistoryFile: path})
+	history := reopened.History()
+	if len(history) != maxHistory || history[0].Rule != "Rule 299" || history[maxHistory-1].Rule != "Rule 100" {
+		t.Errorf("Reopened history has %d firings, %q to %q", len(history), history[0].Rule, history[len(history)-1].Rule)
+	}
+}
+
+func TestEngine_WebhookAndHook(t *testing.T) {
+	e, _, _ := newTestEngine(t)
+
+	calls := make(chan webhookPayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		calls <- p
+	}))
+	defer srv.Close()
+
+	e.Add(Rule{
+		Name:    "Notify",
+		Enabled: true,
+		Trigger: Trigger{Type: TriggerWebhook, Hook: "doorbell"},
+		Actions: []Action{{Type: ActionWebhook, URL: srv.URL}},
+	})
+
+	if _, err := e.Hook("unknown"); err != ErrHookNotFound {
+		t.Errorf("Hook(unknown) error = %v, want ErrHookNotFound", err)
+	}
+	if n, err := e.Hook("doorbell"); err != nil || n != 1 {
+		t.Fatalf("Hook() = %d, %v", n, err)
+	}
+
+	select {
+	case p := <-calls:
+		if p.Rule != "Notify" || p.Trigger != "webhook doorbell" {
+			t.Errorf("Unexpected payload: %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not called")
+	}
+}
+
+func TestEngine_StopStaggeredAction(t *testing.T) {
+	e, _, wakes := newTestEngine(t)
+	e.devices.Add(store.Device{Name: "Laptop", MAC: phoneMAC, Group: "office"})
+	office, err := e.devices.GroupByName("office")
+	if err != nil {
+		t.Fatalf("GroupByName() error = %v", err)
+	}
+	office.Wake = &store.GroupWake{Stagger: 3600 * 1000}
+	if _, err := e.devices.UpdateGroup(office.ID, office, store.Origin{}); err != nil {
+		t.Fatalf("UpdateGroup() error = %v", err)
+	}
+	e.Add(Rule{
+		Name:    "Morning",
+		Enabled: true,
+		Trigger: Trigger{Type: TriggerWebhook, Hook: "morning"},
+		Actions: []Action{{Type: ActionWake, Group: "office"}},
+	})
+
+	if _, err := e.Hook("morning"); err != nil {
+		t.Fatalf("Hook() error = %v", err)
+	}
+	select {
+	case <-wakes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The first device was not woken")
+	}
+
+	// Stopping cuts the hour-long pause short, and Run waits for the firing
+	stop := make(chan struct{})
+	close(stop)
+	done := make(chan struct{})
+	go func() {
+		e.Run(stop)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after stop")
+	}
+	history := e.History()
+	if len(history) != 1 || len(history[0].Actions) != 2 || history[0].Actions[1].Error != "stopped" {
+		t.Errorf("Unexpected history: %+v", history)
+	}
+	if len(wakes) != 0 {
+		t.Error("The second device should not be woken")
+	}
+}
+
+func TestEngine_Schedule(t *testing.T) {
+	e, _, wakes := newTestEngine(t)
+	e.Add(Rule{
+		Name:       "Morning",
+		Enabled:    true,
+		Trigger:    Trigger{Type: TriggerSchedule, Cron: "30 8 * * *"},
+		Conditions: Conditions{Timezone: "UTC"},
+		Actions:    []Action{{Type: ActionWake, MAC: desktopMAC}},
+	})
+
+	now, _ := time.Parse(time.RFC3339, "2024-01-01T08:29:00Z")
+	e.now = func() time.Time { return now }
+	e.lastTick = now.Add(-time.Minute)
+
+	e.tick()
+	if len(wakes) != 0 {
+		t.Fatal("Rule fired before its time")
+	}
+
+	now = now.Add(time.Minute)
+	e.tick()
+	e.firing.Wait()
+	if len(wakes) != 1 {
+		t.Fatalf("Expected 1 wake at 08:30, got %d", len(wakes))
+	}
+}
+
+func TestStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	r, err := s.Add(Rule{
+		Name:    "Sleep B",
+		Trigger: Trigger{Type: TriggerOffline, MAC: phoneMAC},
+		Actions: []Action{{Type: ActionSleep, MAC: desktopMAC}},
+	})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	got, err := reloaded.Get(r.ID)
+	if err != nil || got.Actions[0].Type != ActionSleep {
+		t.Errorf("Reloaded rule = %+v, %v", got, err)
+	}
+	if err := reloaded.Delete("missing"); err != ErrNotFound {
+		t.Errorf("Delete(missing) error = %v, want ErrNotFound", err)
+	}
+
+	// MACs are matched in any notation, in triggers and actions
+	if n, err := reloaded.RenameMAC(strings.ToLower(desktopMAC), "AA:BB:CC:DD:EE:99"); err != nil || n != 1 {
+		t.Fatalf("RenameMAC() = %d, %v", n, err)
+	}
+	if got, _ := reloaded.Get(r.ID); got.Actions[0].MAC != "AA:BB:CC:DD:EE:99" || got.Trigger.MAC != phoneMAC {
+		t.Errorf("Rule after RenameMAC() = %+v", got)
+	}
+	if n, _ := reloaded.RenameMAC("AA:BB:CC:DD:EE:00", desktopMAC); n != 0 {
+		t.Errorf("RenameMAC() of an unused MAC changed %d rules", n)
+	}
+}
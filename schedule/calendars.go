@@ -0,0 +1,181 @@
+// Package schedule manages the holiday calendars used by schedule rules.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hzhq1255/wolgate/atomicfile"
+)
+
+// Calendar sources.
+const (
+	SourceFile   = "file"   // Configured path on disk
+	SourceUpload = "upload" // Uploaded through the API
+)
+
+// ErrCalendarNotFound is returned when a calendar does not exist.
+var ErrCalendarNotFound = errors.New("calendar not found")
+
+// validCalendarName restricts calendar names, which become file names.
+var validCalendarName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// CalendarInfo describes a loaded calendar.
+type CalendarInfo struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Path   string `json:"path"`
+	Events int    `json:"events"`
+}
+
+// Calendars holds the calendars available to schedule rules. Calendars
+// come from configured files and from uploads saved in a directory.
+type Calendars struct {
+	dir   string            // Upload directory
+	files map[string]string // Configured calendars: name -> path
+
+	mu   sync.RWMutex
+	cals map[string]*Calendar
+	info map[string]CalendarInfo
+}
+
+// NewCalendars loads the configured calendar files and every .ics file in
+// dir. Calendars that fail to load are skipped; their errors are returned
+// together so the caller can log them.
+func NewCalendars(dir string, files map[string]string) (*Calendars, error) {
+	c := &Calendars{
+		dir:   dir,
+		files: files,
+		cals:  make(map[string]*Calendar),
+		info:  make(map[string]CalendarInfo),
+	}
+
+	var errs []error
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to read calendar directory: %w", err))
+		}
+		for _, e := range entries {
+			if e.IsDir() || filepath.Ext(e.Name()) != ".ics" {
+				continue
+			}
+			name := strings.TrimSuffix(e.Name(), ".ics")
+			if err := c.load(name, filepath.Join(dir, e.Name()), SourceUpload); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	// Configured files take precedence over uploads of the same name
+	for name, path := range files {
+		if err := c.load(name, path, SourceFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return c, errors.Join(errs...)
+}
+
+// load parses a calendar file and registers it under name.
+func (c *Calendars) load(name, path, source string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read calendar %q: %w", name, err)
+	}
+	cal, err := ParseICS(name, data)
+	if err != nil {
+		return fmt.Errorf("failed to parse calendar %q: %w", name, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cals[name] = cal
+	c.info[name] = CalendarInfo{Name: name, Source: source, Path: path, Events: len(cal.Events)}
+	return nil
+}
+
+// Get returns a calendar by name.
+func (c *Calendars) Get(name string) (*Calendar, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cal, ok := c.cals[name]
+	return cal, ok
+}
+
+// List returns all loaded calendars sorted by name.
+func (c *Calendars) List() []CalendarInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	result := make([]CalendarInfo, 0, len(c.info))
+	for _, info := range c.info {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Upload parses data and saves it as calendar name in the upload
+// directory, replacing a previous upload of the same name.
+func (c *Calendars) Upload(name string, data []byte) (CalendarInfo, error) {
+	if !validCalendarName.MatchString(name) {
+		return CalendarInfo{}, fmt.Errorf("invalid calendar name %q", name)
+	}
+	if _, ok := c.files[name]; ok {
+		return CalendarInfo{}, fmt.Errorf("calendar %q is configured from a file and cannot be replaced", name)
+	}
+	if c.dir == "" {
+		return CalendarInfo{}, fmt.Errorf("calendar uploads are not enabled")
+	}
+
+	cal, err := ParseICS(name, data)
+	if err != nil {
+		return CalendarInfo{}, err
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return CalendarInfo{}, fmt.Errorf("failed to create calendar directory: %w", err)
+	}
+	path := filepath.Join(c.dir, name+".ics")
+	if err := atomicfile.WriteFile(path, data, 0644); err != nil {
+		return CalendarInfo{}, fmt.Errorf("failed to write calendar: %w", err)
+	}
+
+	info := CalendarInfo{Name: name, Source: SourceUpload, Path: path, Events: len(cal.Events)}
+	c.mu.Lock()
+	c.cals[name] = cal
+	c.info[name] = info
+	c.mu.Unlock()
+	return info, nil
+}
+
+// Delete removes an uploaded calendar. Configured calendars cannot be
+// deleted through the API.
+func (c *Calendars) Delete(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, ok := c.info[name]
+	if !ok {
+		return ErrCalendarNotFound
+	}
+	if info.Source != SourceUpload {
+		return fmt.Errorf("calendar %q is configured from a file and cannot be deleted", name)
+	}
+	if err := os.Remove(info.Path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete calendar: %w", err)
+	}
+	delete(c.cals, name)
+	delete(c.info, name)
+	return nil
+}
@@ -0,0 +1,255 @@
+// Package schedule implements cron-style scheduled wakes.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed five-field cron expression:
+//
+//	minute hour day-of-month month day-of-week
+//
+// Fields accept *, lists (1,15), ranges (1-5), steps (*/10, 8-18/2) and
+// month/weekday names (jan, mon). The @yearly, @monthly, @weekly, @daily
+// and @hourly shorthands are also supported.
+type Cron struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	// Like standard cron, when both day fields are restricted a day
+	// matches if either of them matches.
+	domStar bool
+	dowStar bool
+}
+
+// field describes the valid range and names of a cron field.
+type field struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day-of-month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = field{name: "day-of-week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// shorthands maps @-expressions to their five-field equivalents.
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression.
+func ParseCron(expr string) (*Cron, error) {
+	spec := strings.TrimSpace(expr)
+	if s, ok := shorthands[strings.ToLower(spec)]; ok {
+		spec = s
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	c := &Cron{expr: expr}
+	var err error
+	if c.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseField(fields[2], domField); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseField(fields[4], dowField); err != nil {
+		return nil, err
+	}
+
+	// Sunday may be written as 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = isStar(fields[2])
+	c.dowStar = isStar(fields[4])
+
+	return c, nil
+}
+
+// String returns the original expression.
+func (c *Cron) String() string {
+	return c.expr
+}
+
+func isStar(s string) bool {
+	return s == "*" || s == "?"
+}
+
+// parseField parses one comma-separated cron field into a bit set.
+func parseField(s string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		b, err := parseRange(part, f)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+// parseRange parses a single range term like "*", "5", "1-5" or "*/15".
+func parseRange(s string, f field) (uint64, error) {
+	step := 1
+	if i := strings.Index(s, "/"); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid step in %s field: %q", f.name, s)
+		}
+		step = n
+		s = s[:i]
+	}
+
+	var lo, hi int
+	switch {
+	case isStar(s):
+		lo, hi = f.min, f.max
+	case strings.Contains(s, "-"):
+		parts := strings.SplitN(s, "-", 2)
+		var err error
+		if lo, err = parseValue(parts[0], f); err != nil {
+			return 0, err
+		}
+		if hi, err = parseValue(parts[1], f); err != nil {
+			return 0, err
+		}
+	default:
+		v, err := parseValue(s, f)
+		if err != nil {
+			return 0, err
+		}
+		lo, hi = v, v
+		if step > 1 {
+			// "5/15" means starting at 5 through the end of the range
+			hi = f.max
+		}
+	}
+
+	if lo > hi {
+		return 0, fmt.Errorf("invalid range in %s field: %q", f.name, s)
+	}
+
+	var bits uint64
+	for v := lo; v <= hi; v += step {
+		bits |= 1 << uint(v)
+	}
+	return bits, nil
+}
+
+// parseValue parses a number or name within the field's range.
+func parseValue(s string, f field) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s field: %q", f.name, s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s value %d out of range %d-%d", f.name, v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Matches reports whether t (truncated to the minute) matches the expression.
+func (c *Cron) Matches(t time.Time) bool {
+	return c.minute&(1<<uint(t.Minute())) != 0 &&
+		c.hour&(1<<uint(t.Hour())) != 0 &&
+		c.month&(1<<uint(t.Month())) != 0 &&
+		c.matchesDay(t)
+}
+
+// everyDay returns a copy of the expression that keeps the minute and hour
+// fields but matches every day of every month.
+func (c *Cron) everyDay() *Cron {
+	d := *c
+	d.dom = (1<<32 - 1) &^ 1   // Days 1-31
+	d.month = (1<<13 - 1) &^ 1 // Months 1-12
+	d.dow = 1<<7 - 1
+	d.domStar, d.dowStar = true, true
+	return &d
+}
+
+func (c *Cron) matchesDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// maxSearch bounds the search for the next run. Every valid expression
+// matches at least once in five years (Feb 29 needs up to eight, which is
+// accepted as never for practical purposes).
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// Next returns the first matching time strictly after t, in t's location.
+// It returns the zero time if there is no match within the search window.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+	loc := t.Location()
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if !next.After(t) {
+				// DST fall-back repeats an hour; step past it
+				next = t.Add(time.Hour).Truncate(time.Hour)
+			}
+			t = next
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
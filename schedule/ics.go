@@ -0,0 +1,433 @@
+// Package schedule provides iCalendar (.ics) parsing for holiday calendars.
+package schedule
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a calendar event, possibly recurring.
+type Event struct {
+	Summary    string    `json:"summary"`
+	Categories []string  `json:"categories,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	AllDay     bool      `json:"all_day,omitempty"`
+	// Floating events (all-day events and local times without a timezone)
+	// are interpreted in the timezone of the schedule being evaluated.
+	Floating bool        `json:"-"`
+	rule     *recurrence `json:"-"`
+}
+
+// recurrence is the supported subset of an RRULE.
+type recurrence struct {
+	freq     string // DAILY, WEEKLY, MONTHLY or YEARLY
+	interval int
+	count    int       // 0 means unlimited
+	until    time.Time // zero means unlimited
+}
+
+// Calendar is a parsed iCalendar file.
+type Calendar struct {
+	Name   string
+	Events []Event
+}
+
+// ParseICS parses iCalendar data. Only VEVENT components are read; RRULEs
+// support FREQ, INTERVAL, COUNT and UNTIL, which covers typical holiday
+// calendars.
+func ParseICS(name string, data []byte) (*Calendar, error) {
+	lines := unfold(data)
+	cal := &Calendar{Name: name}
+
+	var ev *Event
+	var dtstart, dtend, duration, rrule *property
+	began := false
+
+	for i, line := range lines {
+		p, err := parseProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		switch {
+		case p.name == "BEGIN" && strings.EqualFold(p.value, "VCALENDAR"):
+			began = true
+		case p.name == "BEGIN" && strings.EqualFold(p.value, "VEVENT"):
+			ev = &Event{}
+			dtstart, dtend, duration, rrule = nil, nil, nil, nil
+		case p.name == "END" && strings.EqualFold(p.value, "VEVENT"):
+			if ev == nil {
+				return nil, fmt.Errorf("line %d: END:VEVENT without BEGIN", i+1)
+			}
+			if err := finishEvent(ev, dtstart, dtend, duration, rrule); err != nil {
+				return nil, fmt.Errorf("event %q: %w", ev.Summary, err)
+			}
+			cal.Events = append(cal.Events, *ev)
+			ev = nil
+		case ev == nil:
+			// Properties outside events are ignored
+		case p.name == "SUMMARY":
+			ev.Summary = unescapeText(p.value)
+		case p.name == "CATEGORIES":
+			for _, c := range splitEscaped(p.value) {
+				if c = strings.TrimSpace(unescapeText(c)); c != "" {
+					ev.Categories = append(ev.Categories, c)
+				}
+			}
+		case p.name == "DTSTART":
+			dtstart = p
+		case p.name == "DTEND":
+			dtend = p
+		case p.name == "DURATION":
+			duration = p
+		case p.name == "RRULE":
+			rrule = p
+		}
+	}
+
+	if !began {
+		return nil, fmt.Errorf("not an iCalendar file: missing BEGIN:VCALENDAR")
+	}
+	return cal, nil
+}
+
+// finishEvent resolves the start, end and recurrence of an event.
+func finishEvent(ev *Event, dtstart, dtend, duration, rrule *property) error {
+	if dtstart == nil {
+		return fmt.Errorf("missing DTSTART")
+	}
+
+	var err error
+	ev.Start, ev.AllDay, ev.Floating, err = parseDateTime(dtstart)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case dtend != nil:
+		if ev.End, _, _, err = parseDateTime(dtend); err != nil {
+			return err
+		}
+	case duration != nil:
+		d, err := parseDuration(duration.value)
+		if err != nil {
+			return err
+		}
+		ev.End = ev.Start.Add(d)
+	case ev.AllDay:
+		ev.End = ev.Start.AddDate(0, 0, 1)
+	default:
+		ev.End = ev.Start
+	}
+
+	if rrule != nil {
+		if ev.rule, err = parseRRule(rrule.value, ev.Floating); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// property is a content line: NAME;PARAM=VALUE:value
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// parseProperty parses a single unfolded content line.
+func parseProperty(line string) (*property, error) {
+	// The value starts at the first colon outside a quoted parameter
+	inQuote := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			inQuote = !inQuote
+		} else if r == ':' && !inQuote {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return nil, fmt.Errorf("invalid content line %q", line)
+	}
+
+	p := &property{params: make(map[string]string), value: line[colon+1:]}
+	parts := strings.Split(line[:colon], ";")
+	p.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		if k, v, ok := strings.Cut(param, "="); ok {
+			p.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return p, nil
+}
+
+// unfold joins folded lines (continuations start with a space or tab).
+func unfold(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseDateTime parses a DATE or DATE-TIME property value.
+func parseDateTime(p *property) (t time.Time, allDay, floating bool, err error) {
+	value := p.value
+	if strings.EqualFold(p.params["VALUE"], "DATE") || len(value) == 8 {
+		t, err = time.Parse("20060102", value)
+		if err != nil {
+			return t, false, false, fmt.Errorf("invalid date %q", value)
+		}
+		return t, true, true, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return t, false, false, fmt.Errorf("invalid date-time %q", value)
+		}
+		return t, false, false, nil
+	}
+
+	loc := time.UTC
+	floating = true
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, err := LoadLocation(tzid); err == nil {
+			loc = l
+			floating = false
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return t, false, false, fmt.Errorf("invalid date-time %q", value)
+	}
+	return t, false, floating, nil
+}
+
+// parseDuration parses an iCalendar duration such as P1D or PT1H30M.
+func parseDuration(s string) (time.Duration, error) {
+	orig := s
+	sign := time.Duration(1)
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+	}
+	s = strings.TrimLeft(s, "+-")
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("invalid duration %q", orig)
+	}
+	s = s[1:]
+
+	var d time.Duration
+	inTime := false
+	num := ""
+	for _, r := range s {
+		switch {
+		case r == 'T':
+			inTime = true
+		case r >= '0' && r <= '9':
+			num += string(r)
+		default:
+			n, err := strconv.Atoi(num)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", orig)
+			}
+			num = ""
+			switch {
+			case r == 'W':
+				d += time.Duration(n) * 7 * 24 * time.Hour
+			case r == 'D':
+				d += time.Duration(n) * 24 * time.Hour
+			case r == 'H' && inTime:
+				d += time.Duration(n) * time.Hour
+			case r == 'M' && inTime:
+				d += time.Duration(n) * time.Minute
+			case r == 'S' && inTime:
+				d += time.Duration(n) * time.Second
+			default:
+				return 0, fmt.Errorf("invalid duration %q", orig)
+			}
+		}
+	}
+	return sign * d, nil
+}
+
+// parseRRule parses the supported subset of a recurrence rule.
+func parseRRule(s string, floating bool) (*recurrence, error) {
+	r := &recurrence{interval: 1}
+	for _, part := range strings.Split(s, ";") {
+		k, v, _ := strings.Cut(part, "=")
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			r.freq = strings.ToUpper(v)
+		case "INTERVAL":
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid RRULE interval %q", v)
+			}
+			r.interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid RRULE count %q", v)
+			}
+			r.count = n
+		case "UNTIL":
+			p := &property{value: v, params: map[string]string{}}
+			t, _, _, err := parseDateTime(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RRULE until %q", v)
+			}
+			r.until = t
+		}
+	}
+
+	switch r.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, fmt.Errorf("unsupported RRULE frequency %q", r.freq)
+	}
+	return r, nil
+}
+
+// unescapeText reverses iCalendar TEXT escaping.
+func unescapeText(s string) string {
+	r := strings.NewReplacer(`\\`, `\`, `\;`, `;`, `\,`, `,`, `\n`, "\n", `\N`, "\n")
+	return r.Replace(s)
+}
+
+// splitEscaped splits a comma-separated list, honoring escaped commas.
+func splitEscaped(s string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == ',' {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// maxOccurrences bounds the recurrence expansion when checking a time.
+const maxOccurrences = 10000
+
+// OccursAt reports whether any occurrence of the event covers t. Floating
+// events are placed in t's location.
+func (e *Event) OccursAt(t time.Time) bool {
+	start := e.place(e.Start, t.Location())
+	end := e.place(e.End, t.Location())
+	length := end.Sub(start)
+	if length <= 0 {
+		// Zero-length events cover the minute they start in
+		length = time.Minute
+	}
+
+	if e.rule == nil {
+		return !t.Before(start) && t.Before(start.Add(length))
+	}
+
+	until := time.Time{}
+	if !e.rule.until.IsZero() {
+		until = e.place(e.rule.until, t.Location())
+	}
+
+	// Daily and weekly rules can jump close to t directly; monthly and
+	// yearly ones are walked, which is cheap for holiday calendars.
+	k := 0
+	if step := e.rule.step(); step > 0 && t.After(start) {
+		k = int(t.Sub(start)/step) - 1
+		if k < 0 {
+			k = 0
+		}
+	}
+
+	for ; k < maxOccurrences; k++ {
+		if e.rule.count > 0 && k >= e.rule.count {
+			return false
+		}
+		occ := e.rule.nth(start, k)
+		if occ.After(t) || (!until.IsZero() && occ.After(until)) {
+			return false
+		}
+		if t.Before(occ.Add(length)) {
+			return true
+		}
+	}
+	return false
+}
+
+// place returns t in loc for floating events, or t unchanged otherwise.
+func (e *Event) place(t time.Time, loc *time.Location) time.Time {
+	if !e.Floating {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+}
+
+// step returns the fixed spacing of daily and weekly rules, or 0.
+func (r *recurrence) step() time.Duration {
+	switch r.freq {
+	case "DAILY":
+		return time.Duration(r.interval) * 24 * time.Hour
+	case "WEEKLY":
+		return time.Duration(r.interval) * 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+// nth returns the k-th occurrence (0-based) starting at start.
+func (r *recurrence) nth(start time.Time, k int) time.Time {
+	n := k * r.interval
+	switch r.freq {
+	case "DAILY":
+		return start.AddDate(0, 0, n)
+	case "WEEKLY":
+		return start.AddDate(0, 0, 7*n)
+	case "MONTHLY":
+		return start.AddDate(0, n, 0)
+	default:
+		return start.AddDate(n, 0, 0)
+	}
+}
+
+// Matches reports whether the event matches text against its summary or
+// categories, case-insensitively. field restricts the match to "summary"
+// or "category"; an empty text matches every event.
+func (e *Event) Matches(field, text string) bool {
+	if text == "" {
+		return true
+	}
+	if field == "" || field == "summary" {
+		if strings.Contains(strings.ToLower(e.Summary), strings.ToLower(text)) {
+			return true
+		}
+	}
+	if field == "" || field == "category" {
+		for _, c := range e.Categories {
+			if strings.EqualFold(c, text) {
+				return true
+			}
+		}
+	}
+	return false
+}
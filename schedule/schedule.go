@@ -0,0 +1,492 @@
+// Package schedule provides schedule definitions and their persistence.
+package schedule
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Catch-up policies for runs missed while the server was down.
+const (
+	CatchUpSkip = "skip" // Drop missed runs
+	CatchUpOnce = "once" // Run once at startup if the last missed run is recent enough
+)
+
+// Calendar rule actions.
+const (
+	ActionSkip  = "skip"  // Suppress runs that fall on a matching event
+	ActionForce = "force" // Run at the schedule's time of day during a matching event
+)
+
+// ErrNotFound is returned when a schedule does not exist.
+var ErrNotFound = errors.New("schedule not found")
+
+// Schedule wakes a set of devices and groups according to a cron expression.
+type Schedule struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	Cron     string         `json:"cron"`
+	Timezone string         `json:"timezone,omitempty"` // IANA name or fixed offset like +08:00; empty for local time
+	Devices  []string       `json:"devices,omitempty"`  // Device MAC addresses
+	Groups   []string       `json:"groups,omitempty"`   // Device group names
+	Enabled  bool           `json:"enabled"`
+	CatchUp  string         `json:"catch_up,omitempty"` // Overrides the default catch-up policy
+	Rules    []CalendarRule `json:"rules,omitempty"`    // Calendar exceptions, e.g. skip public holidays
+	LastRun  time.Time      `json:"last_run,omitempty"`
+}
+
+// CalendarRule suppresses or forces runs of a schedule based on the events
+// of a calendar. A forced run happens at a time matching the minute and
+// hour fields of the cron expression, even on days the expression excludes;
+// when both kinds of rule match, force wins.
+type CalendarRule struct {
+	Calendar string `json:"calendar"`
+	Field    string `json:"field,omitempty"` // "summary", "category", or empty for either
+	Match    string `json:"match,omitempty"` // Summary substring or category name; empty matches every event
+	Action   string `json:"action"`          // ActionSkip or ActionForce
+}
+
+// RuleMatch records a calendar rule that applied to a run.
+type RuleMatch struct {
+	Time     time.Time `json:"time"`
+	Calendar string    `json:"calendar"`
+	Match    string    `json:"match,omitempty"`
+	Event    string    `json:"event"` // Summary of the matching event
+}
+
+// Plan is the result of computing the next run of a schedule.
+type Plan struct {
+	Next     time.Time   // Zero if the schedule never runs again
+	ForcedBy *RuleMatch  // Set when Next only happens because of a force rule
+	Skipped  []RuleMatch // Runs before Next suppressed by skip rules
+}
+
+// Validate checks that the schedule is well-formed.
+func (s *Schedule) Validate() error {
+	if strings.TrimSpace(s.Name) == "" {
+		return fmt.Errorf("schedule name is required")
+	}
+	if _, err := ParseCron(s.Cron); err != nil {
+		return err
+	}
+	if _, err := LoadLocation(s.Timezone); err != nil {
+		return err
+	}
+	if len(s.Devices) == 0 && len(s.Groups) == 0 {
+		return fmt.Errorf("schedule must target at least one device or group")
+	}
+	for _, mac := range s.Devices {
+		if err := wol.ValidateMAC(mac); err != nil {
+			return fmt.Errorf("invalid device MAC: %w", err)
+		}
+	}
+	switch s.CatchUp {
+	case "", CatchUpSkip, CatchUpOnce:
+	default:
+		return fmt.Errorf("invalid catch-up policy %q (use %s or %s)", s.CatchUp, CatchUpSkip, CatchUpOnce)
+	}
+	for _, r := range s.Rules {
+		if strings.TrimSpace(r.Calendar) == "" {
+			return fmt.Errorf("calendar rule must name a calendar")
+		}
+		switch r.Field {
+		case "", "summary", "category":
+		default:
+			return fmt.Errorf("invalid calendar rule field %q (use summary or category)", r.Field)
+		}
+		switch r.Action {
+		case ActionSkip, ActionForce:
+		default:
+			return fmt.Errorf("invalid calendar rule action %q (use %s or %s)", r.Action, ActionSkip, ActionForce)
+		}
+	}
+	return nil
+}
+
+// Next returns the first run of the schedule strictly after t, ignoring
+// calendar rules.
+func (s *Schedule) Next(t time.Time) time.Time {
+	return s.Plan(t, nil).Next
+}
+
+// maxPlanSteps bounds the candidate times examined by Plan.
+const maxPlanSteps = 100000
+
+// maxSkipped bounds the skipped runs reported by Plan.
+const maxSkipped = 20
+
+// Plan returns the first run of the schedule strictly after t, applying
+// its calendar rules against cals. Rules naming unknown calendars are
+// ignored.
+func (s *Schedule) Plan(t time.Time, cals *Calendars) Plan {
+	c, err := ParseCron(s.Cron)
+	if err != nil {
+		return Plan{}
+	}
+	loc, err := LoadLocation(s.Timezone)
+	if err != nil {
+		return Plan{}
+	}
+	t = t.In(loc)
+
+	if cals == nil || len(s.Rules) == 0 {
+		return Plan{Next: c.Next(t)}
+	}
+
+	// With force rules, every day is a candidate at the cron's time of day
+	candidates := c
+	for _, r := range s.Rules {
+		if r.Action == ActionForce {
+			candidates = c.everyDay()
+			break
+		}
+	}
+
+	var p Plan
+	limit := t.Add(maxSearch)
+	for i := 0; i < maxPlanSteps; i++ {
+		t = candidates.Next(t)
+		if t.IsZero() || t.After(limit) {
+			return Plan{Skipped: p.Skipped}
+		}
+
+		forced := s.matchRule(t, ActionForce, cals)
+		if !c.Matches(t) {
+			if forced != nil {
+				p.Next, p.ForcedBy = t, forced
+				return p
+			}
+			continue
+		}
+		if forced == nil {
+			if skipped := s.matchRule(t, ActionSkip, cals); skipped != nil {
+				if len(p.Skipped) < maxSkipped {
+					p.Skipped = append(p.Skipped, *skipped)
+				}
+				continue
+			}
+		}
+		p.Next = t
+		return p
+	}
+	return Plan{Skipped: p.Skipped}
+}
+
+// matchRule returns the first rule with the given action whose calendar
+// has a matching event at t.
+func (s *Schedule) matchRule(t time.Time, action string, cals *Calendars) *RuleMatch {
+	for _, r := range s.Rules {
+		if r.Action != action {
+			continue
+		}
+		cal, ok := cals.Get(r.Calendar)
+		if !ok {
+			continue
+		}
+		for i := range cal.Events {
+			ev := &cal.Events[i]
+			if ev.Matches(r.Field, r.Match) && ev.OccursAt(t) {
+				return &RuleMatch{Time: t, Calendar: r.Calendar, Match: r.Match, Event: ev.Summary}
+			}
+		}
+	}
+	return nil
+}
+
+// LoadLocation resolves a timezone name. Besides IANA names (which need
+// tzdata on the system), fixed offsets such as "+08:00" or "UTC-5" are
+// accepted, since small routers often ship without a zoneinfo database.
+func LoadLocation(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.EqualFold(name, "local") {
+		return time.Local, nil
+	}
+
+	offset := strings.TrimPrefix(strings.TrimPrefix(name, "UTC"), "GMT")
+	if offset != name || strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-") {
+		if offset == "" {
+			return time.UTC, nil
+		}
+		if secs, ok := parseOffset(offset); ok {
+			return time.FixedZone(name, secs), nil
+		}
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// parseOffset parses "+8", "+08", "+0800" or "+08:00" into seconds east of UTC.
+func parseOffset(s string) (int, bool) {
+	if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+		return 0, false
+	}
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+	}
+	s = strings.ReplaceAll(s[1:], ":", "")
+
+	var hours, minutes int
+	var err error
+	switch len(s) {
+	case 1, 2:
+		hours, err = strconv.Atoi(s)
+	case 4:
+		hours, err = strconv.Atoi(s[:2])
+		if err == nil {
+			minutes, err = strconv.Atoi(s[2:])
+		}
+	default:
+		return 0, false
+	}
+	if err != nil || hours > 14 || minutes > 59 {
+		return 0, false
+	}
+	return sign * (hours*3600 + minutes*60), true
+}
+
+// Store persists schedules in a JSON file.
+type Store struct {
+	filePath  string
+	schedules []*Schedule
+	mu        sync.RWMutex
+}
+
+// NewStore creates a schedule store backed by filePath.
+func NewStore(filePath string) (*Store, error) {
+	s := &Store{filePath: filePath}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read schedule file: %w", err)
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.schedules); err != nil {
+		return nil, fmt.Errorf("failed to parse schedule file: %w", err)
+	}
+	return s, nil
+}
+
+// List returns all schedules.
+func (s *Store) List() []Schedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Schedule, len(s.schedules))
+	for i, sc := range s.schedules {
+		result[i] = *sc
+	}
+	return result
+}
+
+// Get returns a schedule by ID.
+func (s *Store) Get(id string) (Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, sc := range s.schedules {
+		if sc.ID == id {
+			return *sc, nil
+		}
+	}
+	return Schedule{}, ErrNotFound
+}
+
+// Add validates and stores a new schedule, assigning it an ID.
+func (s *Store) Add(sc Schedule) (Schedule, error) {
+	if err := sc.Validate(); err != nil {
+		return Schedule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc.ID = newID()
+	sc.LastRun = time.Time{}
+	s.schedules = append(s.schedules, &sc)
+	if err := s.saveLocked(); err != nil {
+		s.schedules = s.schedules[:len(s.schedules)-1]
+		return Schedule{}, err
+	}
+	return sc, nil
+}
+
+// Update replaces a schedule, keeping its ID and last run time.
+func (s *Store) Update(id string, sc Schedule) (Schedule, error) {
+	if err := sc.Validate(); err != nil {
+		return Schedule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, old := range s.schedules {
+		if old.ID == id {
+			sc.ID = id
+			sc.LastRun = old.LastRun
+			s.schedules[i] = &sc
+			if err := s.saveLocked(); err != nil {
+				s.schedules[i] = old
+				return Schedule{}, err
+			}
+			return sc, nil
+		}
+	}
+	return Schedule{}, ErrNotFound
+}
+
+// Delete removes a schedule by ID.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, sc := range s.schedules {
+		if sc.ID == id {
+			old := s.schedules
+			s.schedules = append(append([]*Schedule{}, old[:i]...), old[i+1:]...)
+			if err := s.saveLocked(); err != nil {
+				s.schedules = old
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// RenameGroup replaces the device group oldName with newName in every
+// schedule, returning the number of schedules changed.
+func (s *Store) RenameGroup(oldName, newName string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.schedules
+	s.schedules = make([]*Schedule, len(old))
+	renamed := 0
+	for i, sc := range old {
+		s.schedules[i] = sc
+		for j, g := range sc.Groups {
+			if g != oldName {
+				continue
+			}
+			if s.schedules[i] == sc {
+				// Copy, as schedules returned earlier share the groups
+				updated := *sc
+				updated.Groups = append([]string{}, sc.Groups...)
+				s.schedules[i] = &updated
+				renamed++
+			}
+			s.schedules[i].Groups[j] = newName
+		}
+	}
+	if renamed == 0 {
+		s.schedules = old
+		return 0, nil
+	}
+	if err := s.saveLocked(); err != nil {
+		s.schedules = old
+		return 0, err
+	}
+	return renamed, nil
+}
+
+// RenameMAC replaces the device MAC oldMAC, in any notation, with newMAC
+// in every schedule, returning the number of schedules changed.
+func (s *Store) RenameMAC(oldMAC, newMAC string) (int, error) {
+	old, err := wol.NormalizeMAC(oldMAC)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := s.schedules
+	s.schedules = make([]*Schedule, len(previous))
+	renamed := 0
+	for i, sc := range previous {
+		s.schedules[i] = sc
+		for j, mac := range sc.Devices {
+			if n, err := wol.NormalizeMAC(mac); err != nil || n != old {
+				continue
+			}
+			if s.schedules[i] == sc {
+				// Copy, as schedules returned earlier share the devices
+				updated := *sc
+				updated.Devices = append([]string{}, sc.Devices...)
+				s.schedules[i] = &updated
+				renamed++
+			}
+			s.schedules[i].Devices[j] = newMAC
+		}
+	}
+	if renamed == 0 {
+		s.schedules = previous
+		return 0, nil
+	}
+	if err := s.saveLocked(); err != nil {
+		s.schedules = previous
+		return 0, err
+	}
+	return renamed, nil
+}
+
+// SetLastRun records when a schedule last ran.
+func (s *Store) SetLastRun(id string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sc := range s.schedules {
+		if sc.ID == id {
+			sc.LastRun = t
+			return s.saveLocked()
+		}
+	}
+	return ErrNotFound
+}
+
+// saveLocked writes schedules to file (must be called with lock held).
+func (s *Store) saveLocked() error {
+	if dir := filepath.Dir(s.filePath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(s.schedules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schedules: %w", err)
+	}
+	if err := atomicfile.WriteFile(s.filePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write schedule file: %w", err)
+	}
+	return nil
+}
+
+// newID returns a random identifier.
+func newID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
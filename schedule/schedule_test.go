@@ -0,0 +1,522 @@
+// Package schedule tests.
+package schedule
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wake/waketest"
+)
+
+func TestParseCron(t *testing.T) {
+	valid := []string{
+		"* * * * *",
+		"30 8 * * 1-5",
+		"*/15 8-18 * * mon-fri",
+		"0 0 1,15 * *",
+		"0 12 * jan,jul sun",
+		"5/10 * * * *",
+		"0 0 * * 7",
+		"@daily",
+		"@hourly",
+	}
+	for _, expr := range valid {
+		if _, err := ParseCron(expr); err != nil {
+			t.Errorf("ParseCron(%q) error = %v", expr, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"abc * * * *",
+	}
+	for _, expr := range invalid {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestCron_Next(t *testing.T) {
+	loc := time.UTC
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		// Friday 09:00 -> Monday 08:30
+		{"30 8 * * 1-5", time.Date(2026, 10, 16, 9, 0, 0, 0, loc), time.Date(2026, 10, 19, 8, 30, 0, 0, loc)},
+		// Same day, later
+		{"30 8 * * 1-5", time.Date(2026, 10, 19, 7, 0, 0, 0, loc), time.Date(2026, 10, 19, 8, 30, 0, 0, loc)},
+		// Strictly after the given time
+		{"30 8 * * *", time.Date(2026, 10, 19, 8, 30, 0, 0, loc), time.Date(2026, 10, 20, 8, 30, 0, 0, loc)},
+		{"*/15 * * * *", time.Date(2026, 1, 1, 10, 7, 30, 0, loc), time.Date(2026, 1, 1, 10, 15, 0, 0, loc)},
+		{"@monthly", time.Date(2026, 12, 15, 0, 0, 0, 0, loc), time.Date(2027, 1, 1, 0, 0, 0, 0, loc)},
+		// Sunday as 7
+		{"0 0 * * 7", time.Date(2026, 10, 14, 0, 0, 0, 0, loc), time.Date(2026, 10, 18, 0, 0, 0, 0, loc)},
+		// Both day fields restricted: the 1st or any Monday
+		{"0 0 1 * mon", time.Date(2026, 10, 20, 0, 0, 0, 0, loc), time.Date(2026, 10, 26, 0, 0, 0, 0, loc)},
+		{"0 0 29 2 *", time.Date(2026, 3, 1, 0, 0, 0, 0, loc), time.Date(2028, 2, 29, 0, 0, 0, 0, loc)},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) error = %v", tt.expr, err)
+		}
+		if got := c.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q.Next(%v) = %v, want %v", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestLoadLocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+	}{
+		{"+08:00", 8 * 3600},
+		{"UTC+8", 8 * 3600},
+		{"-0530", -(5*3600 + 30*60)},
+		{"UTC", 0},
+	}
+	ref := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		loc, err := LoadLocation(tt.name)
+		if err != nil {
+			t.Errorf("LoadLocation(%q) error = %v", tt.name, err)
+			continue
+		}
+		if _, offset := ref.In(loc).Zone(); offset != tt.offset {
+			t.Errorf("LoadLocation(%q) offset = %d, want %d", tt.name, offset, tt.offset)
+		}
+	}
+
+	if loc, err := LoadLocation(""); err != nil || loc != time.Local {
+		t.Error("Empty timezone should be local time")
+	}
+	if _, err := LoadLocation("Not/AZone"); err == nil {
+		t.Error("LoadLocation() should fail for unknown zone")
+	}
+}
+
+func TestSchedule_Validate(t *testing.T) {
+	valid := Schedule{Name: "Office", Cron: "30 8 * * 1-5", Groups: []string{"Office"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	invalid := []Schedule{
+		{Cron: "30 8 * * *", Groups: []string{"Office"}},
+		{Name: "x", Cron: "bad", Groups: []string{"Office"}},
+		{Name: "x", Cron: "30 8 * * *"},
+		{Name: "x", Cron: "30 8 * * *", Devices: []string{"not-a-mac"}},
+		{Name: "x", Cron: "30 8 * * *", Groups: []string{"g"}, Timezone: "+99:00"},
+		{Name: "x", Cron: "30 8 * * *", Groups: []string{"g"}, CatchUp: "always"},
+	}
+	for i, sc := range invalid {
+		if err := sc.Validate(); err == nil {
+			t.Errorf("Validate() case %d should fail", i)
+		}
+	}
+}
+
+func TestStore_CRUD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.json")
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+
+	sc, err := s.Add(Schedule{Name: "Office", Cron: "30 8 * * 1-5", Devices: []string{"AA:BB:CC:DD:EE:01"}, Groups: []string{"Office"}, Enabled: true})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if sc.ID == "" {
+		t.Fatal("Add() should assign an ID")
+	}
+
+	runAt := time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)
+	s.SetLastRun(sc.ID, runAt)
+
+	sc.Name = "Office PCs"
+	if _, err := s.Update(sc.ID, sc); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	got, err := reloaded.Get(sc.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Name != "Office PCs" || !got.LastRun.Equal(runAt) {
+		t.Errorf("Schedule not persisted correctly: %+v", got)
+	}
+
+	if n, err := reloaded.RenameGroup("Office", "Work"); err != nil || n != 1 {
+		t.Fatalf("RenameGroup() = %d, %v", n, err)
+	}
+	if got, _ := reloaded.Get(sc.ID); got.Groups[0] != "Work" {
+		t.Errorf("Groups after RenameGroup() = %v", got.Groups)
+	}
+	if n, err := reloaded.RenameMAC("aa-bb-cc-dd-ee-01", "AA:BB:CC:DD:EE:02"); err != nil || n != 1 {
+		t.Fatalf("RenameMAC() = %d, %v", n, err)
+	}
+	if got, _ := reloaded.Get(sc.ID); got.Devices[0] != "AA:BB:CC:DD:EE:02" {
+		t.Errorf("Devices after RenameMAC() = %v", got.Devices)
+	}
+
+	if err := reloaded.Delete(sc.ID); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := reloaded.Delete(sc.ID); err != ErrNotFound {
+		t.Errorf("Delete() of missing schedule = %v, want ErrNotFound", err)
+	}
+}
+
+// newTestScheduler returns a scheduler with a fake clock and a recorder of
+// its wakes.
+func newTestScheduler(t *testing.T, cfg Config) (*Scheduler, *time.Time, *waketest.Recorder) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	devices, err := store.NewStore(filepath.Join(tmpDir, "devices.json"))
+	if err != nil {
+		t.Fatalf("store.NewStore() error = %v", err)
+	}
+	devices.Add(store.Device{Name: "PC1", MAC: "AA:BB:CC:DD:EE:01", Group: "Office"})
+	devices.Add(store.Device{Name: "PC2", MAC: "AA:BB:CC:DD:EE:02", Group: "Office"})
+
+	schedules, err := NewStore(filepath.Join(tmpDir, "schedules.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+
+	waker, woken := waketest.NewService(t)
+	s := NewScheduler(schedules, devices, waker, cfg)
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, &now, woken
+}
+
+func TestScheduler_RunDue(t *testing.T) {
+	s, now, woken := newTestScheduler(t, Config{})
+
+	_, err := s.Add(Schedule{
+		Name:     "Office",
+		Cron:     "30 8 * * 1-5",
+		Timezone: "UTC",
+		Devices:  []string{"aa:bb:cc:dd:ee:01"},
+		Groups:   []string{"Office"},
+		Enabled:  true,
+	})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	s.runDue()
+	if len(woken.Requests()) != 0 {
+		t.Fatalf("Nothing should run before 08:30, woke %d", len(woken.Requests()))
+	}
+
+	*now = now.Add(31 * time.Minute)
+	s.runDue()
+	if len(woken.Requests()) != 2 {
+		t.Fatalf("Expected 2 unique devices woken, got %d", len(woken.Requests()))
+	}
+	if woken.Requests()[0].Source != wake.SourceSchedule || woken.Requests()[0].Detail != "Office" {
+		t.Errorf("Unexpected wake request: %+v", woken.Requests()[0])
+	}
+
+	// Not run twice for the same minute
+	s.runDue()
+	if len(woken.Requests()) != 2 {
+		t.Errorf("Schedule ran twice, woke %d", len(woken.Requests()))
+	}
+
+	entries := s.List()
+	if entries[0].LastRun.IsZero() {
+		t.Error("Last run should be recorded")
+	}
+	want := time.Date(2026, 10, 20, 8, 30, 0, 0, time.UTC)
+	if !entries[0].NextRun.Equal(want) {
+		t.Errorf("NextRun = %v, want %v", entries[0].NextRun, want)
+	}
+}
+
+func TestScheduler_StaggeredRun(t *testing.T) {
+	s, now, woken := newTestScheduler(t, Config{})
+	office, err := s.devices.GroupByName("Office")
+	if err != nil {
+		t.Fatalf("GroupByName() error = %v", err)
+	}
+	office.Wake = &store.GroupWake{Stagger: 200}
+	if _, err := s.devices.UpdateGroup(office.ID, office, store.Origin{}); err != nil {
+		t.Fatalf("UpdateGroup() error = %v", err)
+	}
+	s.Add(Schedule{Name: "Office", Cron: "30 8 * * *", Timezone: "UTC", Groups: []string{"Office"}, Enabled: true})
+
+	s.runDue()
+
+	// The staggered wakes continue in the background
+	*now = now.Add(31 * time.Minute)
+	start := time.Now()
+	s.runDue()
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("runDue() waited %v for the stagger", elapsed)
+	}
+	s.running.Wait()
+	if len(woken.Requests()) != 2 {
+		t.Errorf("Expected 2 devices woken, got %d", len(woken.Requests()))
+	}
+	if entries := s.List(); entries[0].LastRun.IsZero() {
+		t.Error("Last run should be recorded")
+	}
+}
+
+func TestScheduler_StopStaggeredRun(t *testing.T) {
+	s, now, woken := newTestScheduler(t, Config{})
+	office, err := s.devices.GroupByName("Office")
+	if err != nil {
+		t.Fatalf("GroupByName() error = %v", err)
+	}
+	office.Wake = &store.GroupWake{Stagger: 3600 * 1000}
+	if _, err := s.devices.UpdateGroup(office.ID, office, store.Origin{}); err != nil {
+		t.Fatalf("UpdateGroup() error = %v", err)
+	}
+	s.Add(Schedule{Name: "Office", Cron: "30 8 * * *", Timezone: "UTC", Groups: []string{"Office"}, Enabled: true})
+
+	s.runDue()
+	*now = now.Add(31 * time.Minute)
+	s.runDue()
+
+	// Stopping cuts the hour-long pause short, and Run waits for the run
+	stop := make(chan struct{})
+	close(stop)
+	done := make(chan struct{})
+	go func() {
+		s.Run(stop)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after stop")
+	}
+	if n := len(woken.Requests()); n == 0 || n == 2 {
+		t.Errorf("Expected the run to stop after the first device, woke %d", n)
+	}
+	if entries := s.List(); !entries[0].LastRun.IsZero() {
+		t.Error("A run cut short should not be recorded")
+	}
+}
+
+func TestScheduler_CatchUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		downtime time.Duration
+		wantRun  bool
+	}{
+		{"once within window", CatchUpOnce, 20 * time.Minute, true},
+		{"once outside window", CatchUpOnce, 3 * time.Hour, false},
+		{"skip", CatchUpSkip, 20 * time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, now, woken := newTestScheduler(t, Config{CatchUp: tt.policy, CatchUpWindow: time.Hour})
+
+			sc, _ := s.schedules.Add(Schedule{
+				Name:     "Office",
+				Cron:     "30 8 * * *",
+				Timezone: "UTC",
+				Groups:   []string{"Office"},
+				Enabled:  true,
+			})
+			// Last ran yesterday; the server was down over today's 08:30 run
+			s.schedules.SetLastRun(sc.ID, time.Date(2026, 10, 18, 8, 30, 0, 0, time.UTC))
+			*now = time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC).Add(tt.downtime)
+
+			s.catchUp()
+
+			if ran := len(woken.Requests()) > 0; ran != tt.wantRun {
+				t.Errorf("catch-up ran = %v, want %v", ran, tt.wantRun)
+			}
+		})
+	}
+}
+
+const testICS = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"SUMMARY:National Day\\, observed\r\n" +
+	"CATEGORIES:Holiday,Public\r\n" +
+	"DTSTART;VALUE=DATE:20261019\r\n" +
+	"DTEND;VALUE=DATE:20261020\r\n" +
+	"RRULE:FREQ=YEARLY;COUNT=2\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"SUMMARY:Make-up \r\n" +
+	" workday\r\n" +
+	"CATEGORIES:Workday\r\n" +
+	"DTSTART;VALUE=DATE:20261024\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"SUMMARY:Maintenance\r\n" +
+	"DTSTART:20261021T080000Z\r\n" +
+	"DURATION:PT1H\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseICS(t *testing.T) {
+	cal, err := ParseICS("test", []byte(testICS))
+	if err != nil {
+		t.Fatalf("ParseICS() error = %v", err)
+	}
+	if len(cal.Events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(cal.Events))
+	}
+
+	holiday := cal.Events[0]
+	if holiday.Summary != "National Day, observed" {
+		t.Errorf("Summary = %q", holiday.Summary)
+	}
+	if len(holiday.Categories) != 2 || !holiday.Matches("category", "holiday") {
+		t.Errorf("Categories = %v", holiday.Categories)
+	}
+	if cal.Events[1].Summary != "Make-up workday" {
+		t.Errorf("Folded summary = %q", cal.Events[1].Summary)
+	}
+
+	loc := time.FixedZone("UTC+8", 8*3600)
+	tests := []struct {
+		event int
+		at    time.Time
+		want  bool
+	}{
+		{0, time.Date(2026, 10, 19, 0, 0, 0, 0, loc), true},
+		{0, time.Date(2026, 10, 19, 23, 59, 0, 0, loc), true},
+		{0, time.Date(2026, 10, 20, 0, 0, 0, 0, loc), false},
+		{0, time.Date(2027, 10, 19, 8, 30, 0, 0, loc), true},  // Second yearly occurrence
+		{0, time.Date(2028, 10, 19, 8, 30, 0, 0, loc), false}, // COUNT=2 exhausted
+		{1, time.Date(2026, 10, 24, 12, 0, 0, 0, loc), true},  // All-day without DTEND
+		{2, time.Date(2026, 10, 21, 8, 30, 0, 0, time.UTC), true},
+		{2, time.Date(2026, 10, 21, 9, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := cal.Events[tt.event].OccursAt(tt.at); got != tt.want {
+			t.Errorf("Event %d OccursAt(%v) = %v, want %v", tt.event, tt.at, got, tt.want)
+		}
+	}
+
+	if _, err := ParseICS("bad", []byte("hello")); err == nil {
+		t.Error("ParseICS() should reject non-calendar data")
+	}
+}
+
+func TestSchedule_Plan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cn.ics")
+	if err := os.WriteFile(path, []byte(testICS), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cals, err := NewCalendars("", map[string]string{"cn": path})
+	if err != nil {
+		t.Fatalf("NewCalendars() error = %v", err)
+	}
+
+	sc := Schedule{
+		Name:     "Office",
+		Cron:     "30 8 * * 1-5",
+		Timezone: "+08:00",
+		Groups:   []string{"Office"},
+		Rules: []CalendarRule{
+			{Calendar: "cn", Field: "category", Match: "Holiday", Action: ActionSkip},
+			{Calendar: "cn", Match: "make-up", Action: ActionForce},
+		},
+	}
+	loc, _ := LoadLocation(sc.Timezone)
+
+	// Monday's run is skipped for the holiday
+	p := sc.Plan(time.Date(2026, 10, 18, 12, 0, 0, 0, loc), cals)
+	if want := time.Date(2026, 10, 20, 8, 30, 0, 0, loc); !p.Next.Equal(want) {
+		t.Errorf("Next = %v, want %v", p.Next, want)
+	}
+	if len(p.Skipped) != 1 || p.Skipped[0].Calendar != "cn" || p.Skipped[0].Event != "National Day, observed" {
+		t.Errorf("Skipped = %+v", p.Skipped)
+	}
+
+	// Saturday's make-up workday is forced
+	p = sc.Plan(time.Date(2026, 10, 23, 12, 0, 0, 0, loc), cals)
+	if want := time.Date(2026, 10, 24, 8, 30, 0, 0, loc); !p.Next.Equal(want) || p.ForcedBy == nil {
+		t.Errorf("Next = %v (forced by %+v), want forced run at %v", p.Next, p.ForcedBy, want)
+	}
+
+	// Without calendars the rules are ignored
+	if next := sc.Next(time.Date(2026, 10, 18, 12, 0, 0, 0, loc)); !next.Equal(time.Date(2026, 10, 19, 8, 30, 0, 0, loc)) {
+		t.Errorf("Next() without calendars = %v", next)
+	}
+
+	s, _, _ := newTestScheduler(t, Config{Calendars: cals})
+	sc.Rules = append(sc.Rules, CalendarRule{Calendar: "missing", Action: ActionSkip})
+	if _, err := s.Add(sc); err == nil {
+		t.Error("Add() should reject rules naming unknown calendars")
+	}
+}
+
+func TestCalendars_Upload(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "calendars")
+	cals, err := NewCalendars(dir, nil)
+	if err != nil {
+		t.Fatalf("NewCalendars() error = %v", err)
+	}
+
+	if _, err := cals.Upload("../evil", []byte(testICS)); err == nil {
+		t.Error("Upload() should reject unsafe names")
+	}
+	if _, err := cals.Upload("bad", []byte("not a calendar")); err == nil {
+		t.Error("Upload() should reject invalid calendars")
+	}
+
+	info, err := cals.Upload("holidays", []byte(testICS))
+	if err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	if info.Events != 3 || info.Source != SourceUpload {
+		t.Errorf("Upload() = %+v", info)
+	}
+
+	// Uploads survive a restart
+	reloaded, err := NewCalendars(dir, nil)
+	if err != nil {
+		t.Fatalf("NewCalendars() error = %v", err)
+	}
+	if _, ok := reloaded.Get("holidays"); !ok {
+		t.Fatal("Uploaded calendar not reloaded")
+	}
+
+	if err := reloaded.Delete("holidays"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if len(reloaded.List()) != 0 {
+		t.Error("Calendar should be deleted")
+	}
+	if err := reloaded.Delete("holidays"); err != ErrCalendarNotFound {
+		t.Errorf("Delete() of missing calendar = %v, want ErrCalendarNotFound", err)
+	}
+}
@@ -0,0 +1,387 @@
+// Package schedule runs scheduled wakes inside the server.
+package schedule
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// maxCatchUpScan bounds the number of missed runs examined at startup.
+const maxCatchUpScan = 100000
+
+// Config holds the scheduler configuration.
+type Config struct {
+	CatchUp       string         // Default catch-up policy (CatchUpSkip or CatchUpOnce)
+	CatchUpWindow time.Duration  // Only catch up runs missed within this window
+	Calendars     *Calendars     // Optional calendars for schedule rules
+	Logger        *logger.Logger // Optional logger
+}
+
+// Entry is a schedule with its next run time.
+type Entry struct {
+	Schedule
+	NextRun  time.Time   `json:"next_run,omitempty"`
+	ForcedBy *RuleMatch  `json:"forced_by,omitempty"` // Calendar rule forcing the next run
+	Skipped  []RuleMatch `json:"skipped,omitempty"`   // Runs before the next run skipped by calendar rules
+}
+
+// Scheduler wakes devices when their schedules are due.
+type Scheduler struct {
+	schedules *Store
+	devices   *store.Store
+	waker     *wake.Service
+	cfg       Config
+	kick      chan struct{}
+	done      chan struct{}  // Closed when Run stops, cutting staggered runs short
+	running   sync.WaitGroup // Staggered runs still waking their devices
+
+	mu      sync.Mutex
+	checked map[string]time.Time // Last time each schedule was evaluated
+	now     func() time.Time
+}
+
+// NewScheduler creates a scheduler for the schedules in schedules.
+func NewScheduler(schedules *Store, devices *store.Store, waker *wake.Service, cfg Config) *Scheduler {
+	if cfg.CatchUp == "" {
+		cfg.CatchUp = CatchUpOnce
+	}
+	return &Scheduler{
+		schedules: schedules,
+		devices:   devices,
+		waker:     waker,
+		cfg:       cfg,
+		kick:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		checked:   make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// Run executes due schedules until stop is closed. Staggered runs still
+// pausing between their devices are then cut short, and Run returns once
+// they have stopped.
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	s.catchUp()
+
+	for {
+		wait := time.Minute
+		now := s.now()
+		if next := s.nextDue(now); !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			close(s.done)
+			s.running.Wait()
+			return
+		case <-s.kick:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		s.runDue()
+	}
+}
+
+// List returns all schedules with their next run times.
+func (s *Scheduler) List() []Entry {
+	now := s.now()
+	schedules := s.schedules.List()
+	entries := make([]Entry, len(schedules))
+	for i, sc := range schedules {
+		entries[i] = s.entry(sc, now)
+	}
+	return entries
+}
+
+// Get returns a schedule with its next run time.
+func (s *Scheduler) Get(id string) (Entry, error) {
+	sc, err := s.schedules.Get(id)
+	if err != nil {
+		return Entry{}, err
+	}
+	return s.entry(sc, s.now()), nil
+}
+
+// Add creates a schedule.
+func (s *Scheduler) Add(sc Schedule) (Entry, error) {
+	if err := s.checkCalendars(sc); err != nil {
+		return Entry{}, err
+	}
+	sc, err := s.schedules.Add(sc)
+	if err != nil {
+		return Entry{}, err
+	}
+	s.notify()
+	return s.entry(sc, s.now()), nil
+}
+
+// Update replaces a schedule.
+func (s *Scheduler) Update(id string, sc Schedule) (Entry, error) {
+	if err := s.checkCalendars(sc); err != nil {
+		return Entry{}, err
+	}
+	sc, err := s.schedules.Update(id, sc)
+	if err != nil {
+		return Entry{}, err
+	}
+	s.notify()
+	return s.entry(sc, s.now()), nil
+}
+
+// Delete removes a schedule.
+func (s *Scheduler) Delete(id string) error {
+	if err := s.schedules.Delete(id); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+func (s *Scheduler) entry(sc Schedule, now time.Time) Entry {
+	e := Entry{Schedule: sc}
+	if sc.Enabled {
+		p := sc.Plan(now, s.cfg.Calendars)
+		e.NextRun, e.ForcedBy, e.Skipped = p.Next, p.ForcedBy, p.Skipped
+	}
+	return e
+}
+
+// checkCalendars verifies that the calendars referenced by sc's rules exist.
+func (s *Scheduler) checkCalendars(sc Schedule) error {
+	for _, r := range sc.Rules {
+		if _, ok := s.cfg.Calendars.Get(r.Calendar); !ok {
+			return fmt.Errorf("unknown calendar %q", r.Calendar)
+		}
+	}
+	return nil
+}
+
+// notify wakes the run loop so it picks up schedule changes.
+func (s *Scheduler) notify() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// nextDue returns the earliest next run among enabled schedules.
+func (s *Scheduler) nextDue(now time.Time) time.Time {
+	var earliest time.Time
+	for _, sc := range s.schedules.List() {
+		if !sc.Enabled {
+			continue
+		}
+		next := sc.Plan(s.since(sc.ID, now), s.cfg.Calendars).Next
+		if !next.IsZero() && (earliest.IsZero() || next.Before(earliest)) {
+			earliest = next
+		}
+	}
+	return earliest
+}
+
+// since returns when a schedule was last evaluated. Schedules seen for the
+// first time start from now, so creating a schedule never fires a past run.
+func (s *Scheduler) since(id string, now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.checked[id]
+	if !ok {
+		s.checked[id] = now
+		return now
+	}
+	return t
+}
+
+// runDue runs every schedule with a run between its last evaluation and now.
+func (s *Scheduler) runDue() {
+	now := s.now()
+	for _, sc := range s.schedules.List() {
+		if !sc.Enabled {
+			continue
+		}
+		p := sc.Plan(s.since(sc.ID, now), s.cfg.Calendars)
+		s.mu.Lock()
+		s.checked[sc.ID] = now
+		s.mu.Unlock()
+
+		for _, skip := range p.Skipped {
+			if !skip.Time.After(now) {
+				s.infof("Schedule %q run at %s skipped by calendar %q (%s)", sc.Name, skip.Time.Format(time.RFC3339), skip.Calendar, skip.Event)
+			}
+		}
+		if !p.Next.IsZero() && !p.Next.After(now) {
+			note := ""
+			if p.ForcedBy != nil {
+				note = "forced by " + p.ForcedBy.Event
+			}
+			s.run(sc, note)
+		}
+	}
+}
+
+// catchUp handles runs missed while the server was down, according to
+// each schedule's catch-up policy.
+func (s *Scheduler) catchUp() {
+	now := s.now()
+	for _, sc := range s.schedules.List() {
+		s.mu.Lock()
+		s.checked[sc.ID] = now
+		s.mu.Unlock()
+
+		if !sc.Enabled || sc.LastRun.IsZero() {
+			continue
+		}
+
+		missed, count := s.lastMissed(sc, now)
+		if count == 0 {
+			continue
+		}
+
+		policy := sc.CatchUp
+		if policy == "" {
+			policy = s.cfg.CatchUp
+		}
+
+		if policy == CatchUpOnce && (s.cfg.CatchUpWindow <= 0 || now.Sub(missed) <= s.cfg.CatchUpWindow) {
+			s.infof("Schedule %q missed %d run(s), catching up run of %s", sc.Name, count, missed.Format(time.RFC3339))
+			s.run(sc, "catch-up")
+			continue
+		}
+		s.infof("Schedule %q missed %d run(s), last at %s; skipping (policy %s)", sc.Name, count, missed.Format(time.RFC3339), policy)
+	}
+}
+
+// lastMissed returns the most recent run between sc.LastRun and now and
+// the number of runs missed in that interval. Runs skipped by calendar
+// rules are not counted as missed.
+func (s *Scheduler) lastMissed(sc Schedule, now time.Time) (time.Time, int) {
+	next := func(t time.Time) time.Time { return sc.Plan(t, s.cfg.Calendars).Next }
+
+	var last time.Time
+	count := 0
+	for t := next(sc.LastRun); !t.IsZero() && !t.After(now) && count < maxCatchUpScan; t = next(t) {
+		last = t
+		count++
+	}
+	return last, count
+}
+
+// run wakes every device targeted by a schedule. A run staggered by
+// group delays continues in the background, so it holds up no other
+// schedule.
+func (s *Scheduler) run(sc Schedule, note string) {
+	detail := sc.Name
+	if note != "" {
+		detail += " (" + note + ")"
+	}
+
+	targets := s.targets(sc)
+	for _, t := range targets {
+		if t.Delay > 0 {
+			s.running.Add(1)
+			go func() {
+				defer s.running.Done()
+				s.wakeTargets(sc, detail, targets)
+			}()
+			return
+		}
+	}
+	s.wakeTargets(sc, detail, targets)
+}
+
+// wakeTargets wakes the targets of a run in turn, pausing before each as
+// it asks, and records the run. A run cut short by Run stopping is not
+// recorded, so it is caught up on the next start.
+func (s *Scheduler) wakeTargets(sc Schedule, detail string, targets []wakeTarget) {
+	failed := 0
+	for i, t := range targets {
+		if t.Delay > 0 {
+			timer := time.NewTimer(t.Delay)
+			select {
+			case <-s.done:
+				timer.Stop()
+				s.infof("Schedule %q stopped after %d of %d device(s)", sc.Name, i, len(targets))
+				return
+			case <-timer.C:
+			}
+		}
+		err := s.waker.Wake(wake.Request{
+			MAC:    t.MAC,
+			Source: wake.SourceSchedule,
+			Detail: detail,
+		})
+		if err != nil {
+			failed++
+			s.errorf("Schedule %q failed to wake %s: %v", sc.Name, t.MAC, err)
+		}
+	}
+	s.infof("Schedule %q woke %d of %d device(s)", sc.Name, len(targets)-failed, len(targets))
+
+	if err := s.schedules.SetLastRun(sc.ID, s.now()); err != nil {
+		s.errorf("Failed to record run of schedule %q: %v", sc.Name, err)
+	}
+}
+
+// wakeTarget is a MAC to wake, and how long to pause before waking it.
+type wakeTarget struct {
+	MAC   string
+	Delay time.Duration
+}
+
+// targets resolves the devices and groups of a schedule to unique MACs.
+// Members of a group after the first are delayed by the group's stagger.
+func (s *Scheduler) targets(sc Schedule) []wakeTarget {
+	seen := make(map[string]bool)
+	var targets []wakeTarget
+	add := func(mac string, delay time.Duration) bool {
+		key := mac
+		if n, err := wol.NormalizeMAC(mac); err == nil {
+			key = n
+		}
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		targets = append(targets, wakeTarget{MAC: mac, Delay: delay})
+		return true
+	}
+
+	for _, mac := range sc.Devices {
+		add(mac, 0)
+	}
+	for _, name := range sc.Groups {
+		var stagger, delay time.Duration
+		if g, err := s.devices.GroupByName(name); err == nil {
+			stagger = g.StaggerDelay()
+		}
+		for _, d := range s.devices.GetByGroup(name) {
+			if add(d.MAC, delay) {
+				delay = stagger
+			}
+		}
+	}
+	return targets
+}
+
+func (s *Scheduler) infof(format string, args ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Info(format, args...)
+	}
+}
+
+func (s *Scheduler) errorf(format string, args ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Error(format, args...)
+	}
+}
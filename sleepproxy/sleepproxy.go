@@ -0,0 +1,454 @@
+// Package sleepproxy answers ARP requests on behalf of sleeping devices and
+// wakes them when a connection attempt arrives, similar to the Bonjour
+// Sleep Proxy.
+package sleepproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/arp"
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// DefaultCheckInterval is how often device state is refreshed.
+const DefaultCheckInterval = 5 * time.Second
+
+// wakeCooldown is the minimum time between wakes of the same device;
+// clients retransmit SYNs, which must not each send a wake.
+const wakeCooldown = 30 * time.Second
+
+// errTimeout is returned by rawConn reads that time out, so the read loop
+// can notice Close.
+var errTimeout = errors.New("read timeout")
+
+// Device opts a device in to the sleep proxy.
+type Device struct {
+	MAC   string // Device MAC address
+	Ports []int  // TCP ports whose connection attempts wake the device
+}
+
+// Config holds the sleep proxy configuration.
+type Config struct {
+	Interface     string        // Interface the devices are reachable on, e.g. "br-lan"
+	Devices       []Device      // Devices handled by the proxy
+	CheckInterval time.Duration // Time between state refreshes
+	ARPPath       string        // ARP table path (default: arp.DefaultARPPath)
+	// Online reports whether a device is known to be online. Devices are
+	// only proxied while they are offline and absent from the ARP table.
+	Online func(mac string) bool
+	Logger *logger.Logger // Optional logger
+}
+
+// Status describes the proxy state of a device.
+type Status struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip,omitempty"`
+	Ports    []int     `json:"ports"`
+	Proxying bool      `json:"proxying"` // Answering ARP for the device
+	Since    time.Time `json:"since,omitempty"`
+	Wakes    uint64    `json:"wakes"`
+	LastWake time.Time `json:"last_wake,omitempty"`
+}
+
+// rawConn sends and receives Ethernet frames on one interface.
+type rawConn interface {
+	ReadFrame(buf []byte) (int, error)
+	WriteFrame(frame []byte) error
+	Close() error
+}
+
+// device is the runtime state of a proxied device.
+type device struct {
+	Device
+	key      string // Normalized MAC
+	ip       net.IP // IPv4 address while proxying
+	ports    map[uint16]bool
+	proxying bool
+	since    time.Time
+	wakes    uint64
+	lastWake time.Time
+}
+
+// Proxy is a sleep proxy for the configured devices.
+type Proxy struct {
+	store *store.Store
+	waker *wake.Service
+	cfg   Config
+	hw    net.HardwareAddr // MAC of the interface, used in ARP replies
+	conn  rawConn
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	devices []*device
+}
+
+// New creates a sleep proxy. It does not touch the network until Start.
+func New(st *store.Store, waker *wake.Service, cfg Config) (*Proxy, error) {
+	if cfg.Interface == "" {
+		return nil, fmt.Errorf("sleep proxy: interface is required")
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = DefaultCheckInterval
+	}
+	if cfg.ARPPath == "" {
+		cfg.ARPPath = arp.DefaultARPPath
+	}
+
+	p := &Proxy{store: st, waker: waker, cfg: cfg, stop: make(chan struct{})}
+	for _, d := range cfg.Devices {
+		key, err := wol.NormalizeMAC(d.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("sleep proxy: invalid device MAC: %w", err)
+		}
+		ports := make(map[uint16]bool)
+		for _, port := range d.Ports {
+			if port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("sleep proxy: invalid port %d for %s", port, d.MAC)
+			}
+			ports[uint16(port)] = true
+		}
+		p.devices = append(p.devices, &device{Device: d, key: key, ports: ports})
+	}
+	return p, nil
+}
+
+// Start checks for the required privileges, opens a raw socket on the
+// interface and begins proxying.
+func (p *Proxy) Start() error {
+	iface, err := net.InterfaceByName(p.cfg.Interface)
+	if err != nil {
+		return fmt.Errorf("sleep proxy: %w", err)
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("sleep proxy: interface %s has no Ethernet address", iface.Name)
+	}
+	if err := checkCapabilities(); err != nil {
+		return err
+	}
+
+	conn, err := openRaw(iface)
+	if err != nil {
+		return fmt.Errorf("sleep proxy: %w", err)
+	}
+	p.start(conn, iface.HardwareAddr)
+	p.infof("Sleep proxy started on %s for %d device(s)", iface.Name, len(p.devices))
+	return nil
+}
+
+// start runs the proxy on conn; split from Start for tests.
+func (p *Proxy) start(conn rawConn, hw net.HardwareAddr) {
+	p.conn = conn
+	p.hw = hw
+	p.refresh()
+
+	p.wg.Add(2)
+	go p.readLoop()
+	go p.refreshLoop()
+}
+
+// Close stops the proxy.
+func (p *Proxy) Close() error {
+	select {
+	case <-p.stop:
+		return nil
+	default:
+		close(p.stop)
+	}
+	p.wg.Wait()
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+	return nil
+}
+
+// Status returns the state of every proxied device.
+func (p *Proxy) Status() []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := make([]Status, len(p.devices))
+	for i, d := range p.devices {
+		result[i] = Status{
+			MAC:      d.MAC,
+			Ports:    d.Ports,
+			Proxying: d.proxying,
+			Since:    d.since,
+			Wakes:    d.wakes,
+			LastWake: d.lastWake,
+		}
+		if d.ip != nil {
+			result[i].IP = d.ip.String()
+		}
+	}
+	return result
+}
+
+func (p *Proxy) refreshLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.refresh()
+		}
+	}
+}
+
+// refresh decides which devices to proxy. A device is proxied while it is
+// offline and absent from the ARP table, and released as soon as it
+// reappears in the ARP table.
+func (p *Proxy) refresh() {
+	present := make(map[string]bool)
+	if entries, err := arp.ParsePath(p.cfg.ARPPath); err == nil {
+		for _, e := range entries {
+			if n, err := wol.NormalizeMAC(e.MAC); err == nil {
+				present[n] = true
+			}
+		}
+	}
+
+	ips := make(map[string]net.IP)
+	if p.store != nil {
+		for _, d := range p.store.List() {
+			if n, err := wol.NormalizeMAC(d.MAC); err == nil {
+				ips[n] = net.ParseIP(d.IP).To4()
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, d := range p.devices {
+		online := p.cfg.Online != nil && p.cfg.Online(d.MAC)
+		ip := ips[d.key]
+		proxying := ip != nil && !online && !present[d.key]
+
+		if proxying != d.proxying || (proxying && !ip.Equal(d.ip)) {
+			d.since = time.Now()
+			if proxying {
+				p.infof("Sleep proxy answering for %s (%s)", d.MAC, ip)
+			} else {
+				p.infof("Sleep proxy released %s", d.MAC)
+			}
+		}
+		d.proxying = proxying
+		d.ip = nil
+		if proxying {
+			d.ip = ip
+		}
+	}
+}
+
+func (p *Proxy) readLoop() {
+	defer p.wg.Done()
+	buf := make([]byte, 1600)
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		n, err := p.conn.ReadFrame(buf)
+		if err != nil {
+			if errors.Is(err, errTimeout) {
+				continue
+			}
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+			p.errorf("Sleep proxy read failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if reply := p.handleFrame(buf[:n]); reply != nil {
+			if err := p.conn.WriteFrame(reply); err != nil {
+				p.errorf("Sleep proxy failed to send ARP reply: %v", err)
+			}
+		}
+	}
+}
+
+// Ethernet and protocol constants.
+const (
+	etherTypeARP  = 0x0806
+	etherTypeIPv4 = 0x0800
+	arpRequest    = 1
+	arpReply      = 2
+	protoTCP      = 6
+	tcpSYN        = 0x02
+	tcpACK        = 0x10
+)
+
+// handleFrame processes one received frame. It returns an ARP reply to
+// send, or nil. TCP SYNs to a watched port of a proxied device wake it.
+func (p *Proxy) handleFrame(frame []byte) []byte {
+	if len(frame) < 14 {
+		return nil
+	}
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeARP:
+		return p.handleARP(frame)
+	case etherTypeIPv4:
+		p.handleIPv4(frame[14:])
+	}
+	return nil
+}
+
+// handleARP answers requests for the IP of a proxied device with the
+// interface's own MAC.
+func (p *Proxy) handleARP(frame []byte) []byte {
+	a := frame[14:]
+	if len(a) < 28 ||
+		binary.BigEndian.Uint16(a[0:2]) != 1 || // Ethernet
+		binary.BigEndian.Uint16(a[2:4]) != etherTypeIPv4 ||
+		a[4] != 6 || a[5] != 4 ||
+		binary.BigEndian.Uint16(a[6:8]) != arpRequest {
+		return nil
+	}
+
+	senderMAC := net.HardwareAddr(a[8:14])
+	senderIP := net.IP(a[14:18])
+	targetIP := net.IP(a[24:28])
+	if senderIP.Equal(targetIP) {
+		// Gratuitous ARP, e.g. from the device itself waking up
+		return nil
+	}
+
+	d := p.proxied(targetIP)
+	if d == nil {
+		return nil
+	}
+	p.mu.Lock()
+	own := strings.EqualFold(senderMAC.String(), d.key)
+	p.mu.Unlock()
+	if own {
+		return nil
+	}
+
+	reply := make([]byte, 42)
+	copy(reply[0:6], senderMAC)
+	copy(reply[6:12], p.hw)
+	binary.BigEndian.PutUint16(reply[12:14], etherTypeARP)
+	r := reply[14:]
+	binary.BigEndian.PutUint16(r[0:2], 1)
+	binary.BigEndian.PutUint16(r[2:4], etherTypeIPv4)
+	r[4], r[5] = 6, 4
+	binary.BigEndian.PutUint16(r[6:8], arpReply)
+	copy(r[8:14], p.hw)
+	copy(r[14:18], targetIP.To4())
+	copy(r[18:24], senderMAC)
+	copy(r[24:28], senderIP.To4())
+	return reply
+}
+
+// handleIPv4 wakes a proxied device when a TCP SYN for one of its watched
+// ports arrives.
+func (p *Proxy) handleIPv4(pkt []byte) {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 || pkt[9] != protoTCP {
+		return
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if ihl < 20 || len(pkt) < ihl+14 {
+		return
+	}
+
+	tcp := pkt[ihl:]
+	flags := tcp[13]
+	if flags&tcpSYN == 0 || flags&tcpACK != 0 {
+		return
+	}
+
+	d := p.proxied(net.IP(pkt[16:20]))
+	if d == nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(tcp[2:4])
+
+	p.mu.Lock()
+	mac := d.MAC
+	watched := d.ports[port]
+	due := watched && time.Since(d.lastWake) >= wakeCooldown
+	if due {
+		d.lastWake = time.Now()
+		d.wakes++
+	}
+	p.mu.Unlock()
+	if !due {
+		return
+	}
+
+	src := net.IP(pkt[12:16])
+	err := p.waker.Wake(wake.Request{MAC: mac, Source: wake.SourceSleepProxy, Detail: fmt.Sprintf("%s -> port %d", src, port)})
+	if err != nil {
+		p.errorf("Sleep proxy failed to wake %s: %v", mac, err)
+		return
+	}
+	p.infof("Sleep proxy woke %s for a connection from %s to port %d", mac, src, port)
+}
+
+// RenameMAC proxies the device oldMAC as newMAC, after the device's MAC
+// changed, returning the number of devices changed. The config file still
+// names oldMAC until it is edited.
+func (p *Proxy) RenameMAC(oldMAC, newMAC string) int {
+	old, err := wol.NormalizeMAC(oldMAC)
+	if err != nil {
+		return 0
+	}
+	key, err := wol.NormalizeMAC(newMAC)
+	if err != nil {
+		return 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	renamed := 0
+	for _, d := range p.devices {
+		if d.key == old {
+			d.MAC, d.key = newMAC, key
+			renamed++
+		}
+	}
+	return renamed
+}
+
+// proxied returns the proxied device with ip, or nil.
+func (p *Proxy) proxied(ip net.IP) *device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, d := range p.devices {
+		if d.proxying && d.ip.Equal(ip) {
+			return d
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) infof(format string, args ...interface{}) {
+	if p.cfg.Logger != nil {
+		p.cfg.Logger.Info(format, args...)
+	}
+}
+
+func (p *Proxy) errorf(format string, args ...interface{}) {
+	if p.cfg.Logger != nil {
+		p.cfg.Logger.Error(format, args...)
+	}
+}
@@ -0,0 +1,258 @@
+// Package sleepproxy tests.
+package sleepproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wake/waketest"
+)
+
+const (
+	deviceMAC = "AA:BB:CC:DD:EE:01"
+	deviceIP  = "192.168.1.10"
+)
+
+var (
+	routerHW = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	clientHW = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	clientIP = net.ParseIP("192.168.1.50").To4()
+)
+
+const arpHeader = "IP address       HW type     Flags       HW address            Mask     Device\n"
+
+// newTestProxy returns a proxy for the test device, with an ARP table
+// file the test can rewrite and a record of wake requests.
+func newTestProxy(t *testing.T) (*Proxy, string, *waketest.Recorder) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	st, err := store.NewStore(filepath.Join(tmpDir, "devices.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	st.Add(store.Device{Name: "PC", MAC: deviceMAC, IP: deviceIP})
+
+	arpPath := filepath.Join(tmpDir, "arp")
+	if err := os.WriteFile(arpPath, []byte(arpHeader), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	waker, woken := waketest.NewService(t)
+
+	p, err := New(st, waker, Config{
+		Interface: "eth0",
+		Devices:   []Device{{MAC: "aa:bb:cc:dd:ee:01", Ports: []int{22}}},
+		ARPPath:   arpPath,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	p.hw = routerHW
+	p.refresh()
+	return p, arpPath, woken
+}
+
+// arpRequestFrame returns an ARP request from the client for ip.
+func arpRequestFrame(ip string) []byte {
+	f := make([]byte, 42)
+	copy(f[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(f[6:12], clientHW)
+	binary.BigEndian.PutUint16(f[12:14], etherTypeARP)
+	a := f[14:]
+	binary.BigEndian.PutUint16(a[0:2], 1)
+	binary.BigEndian.PutUint16(a[2:4], etherTypeIPv4)
+	a[4], a[5] = 6, 4
+	binary.BigEndian.PutUint16(a[6:8], arpRequest)
+	copy(a[8:14], clientHW)
+	copy(a[14:18], clientIP)
+	copy(a[24:28], net.ParseIP(ip).To4())
+	return f
+}
+
+// tcpFrame returns a TCP segment from the client to ip:port with flags.
+func tcpFrame(ip string, port uint16, flags byte) []byte {
+	f := make([]byte, 14+20+20)
+	copy(f[0:6], routerHW)
+	copy(f[6:12], clientHW)
+	binary.BigEndian.PutUint16(f[12:14], etherTypeIPv4)
+	ipHdr := f[14:]
+	ipHdr[0] = 0x45
+	ipHdr[9] = protoTCP
+	copy(ipHdr[12:16], clientIP)
+	copy(ipHdr[16:20], net.ParseIP(ip).To4())
+	tcp := ipHdr[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], 50000)
+	binary.BigEndian.PutUint16(tcp[2:4], port)
+	tcp[13] = flags
+	return f
+}
+
+func TestProxy_AnswersARP(t *testing.T) {
+	p, arpPath, _ := newTestProxy(t)
+
+	reply := p.handleFrame(arpRequestFrame(deviceIP))
+	if reply == nil {
+		t.Fatal("Expected an ARP reply for a sleeping device")
+	}
+	if !bytes.Equal(reply[0:6], clientHW) {
+		t.Errorf("Reply sent to %v, want %v", net.HardwareAddr(reply[0:6]), clientHW)
+	}
+	a := reply[14:]
+	if binary.BigEndian.Uint16(a[6:8]) != arpReply {
+		t.Error("Expected an ARP reply opcode")
+	}
+	if !bytes.Equal(a[8:14], routerHW) || !net.IP(a[14:18]).Equal(net.ParseIP(deviceIP)) {
+		t.Errorf("Reply claims %v is at %v", net.IP(a[14:18]), net.HardwareAddr(a[8:14]))
+	}
+
+	if p.handleFrame(arpRequestFrame("192.168.1.99")) != nil {
+		t.Error("Requests for other IPs must not be answered")
+	}
+
+	// Once the device is back in the ARP table, proxying stops
+	os.WriteFile(arpPath, []byte(arpHeader+deviceIP+"     0x1         0x2         aa:bb:cc:dd:ee:01     *        eth0\n"), 0644)
+	p.refresh()
+	if p.handleFrame(arpRequestFrame(deviceIP)) != nil {
+		t.Error("A device present in the ARP table must not be proxied")
+	}
+	if p.Status()[0].Proxying {
+		t.Error("Status should report proxying stopped")
+	}
+}
+
+func TestProxy_OnlineDevicesNotProxied(t *testing.T) {
+	p, _, _ := newTestProxy(t)
+	p.cfg.Online = func(mac string) bool { return true }
+	p.refresh()
+
+	if p.handleFrame(arpRequestFrame(deviceIP)) != nil {
+		t.Error("Online devices must not be proxied")
+	}
+}
+
+func TestProxy_WakesOnSYN(t *testing.T) {
+	p, _, woken := newTestProxy(t)
+
+	p.handleFrame(tcpFrame(deviceIP, 80, tcpSYN))
+	p.handleFrame(tcpFrame(deviceIP, 22, tcpSYN|tcpACK))
+	if w := woken.Requests(); len(w) != 0 {
+		t.Fatalf("Unwatched ports and SYN-ACKs must not wake, got %d wakes", len(w))
+	}
+
+	p.handleFrame(tcpFrame(deviceIP, 22, tcpSYN))
+	if w := woken.Requests(); len(w) != 1 || w[0].Source != wake.SourceSleepProxy {
+		t.Fatalf("Expected one sleep proxy wake, got %+v", w)
+	}
+
+	// Retransmitted SYNs within the cooldown don't wake again
+	p.handleFrame(tcpFrame(deviceIP, 22, tcpSYN))
+	if w := woken.Requests(); len(w) != 1 {
+		t.Errorf("Expected 1 wake within the cooldown, got %d", len(w))
+	}
+	if st := p.Status()[0]; st.Wakes != 1 || st.LastWake.IsZero() {
+		t.Errorf("Unexpected status: %+v", st)
+	}
+}
+
+func TestProxy_RenameMAC(t *testing.T) {
+	p, _, woken := newTestProxy(t)
+
+	if n := p.RenameMAC(deviceMAC, "aa:bb:cc:dd:ee:02"); n != 1 {
+		t.Fatalf("RenameMAC() = %d, want 1", n)
+	}
+	p.handleFrame(tcpFrame(deviceIP, 22, tcpSYN))
+	if w := woken.Requests(); len(w) != 1 || w[0].MAC != "aa:bb:cc:dd:ee:02" {
+		t.Errorf("Expected a wake of the new MAC, got %+v", w)
+	}
+	if st := p.Status()[0]; st.MAC != "aa:bb:cc:dd:ee:02" {
+		t.Errorf("Status MAC = %s", st.MAC)
+	}
+}
+
+func TestOpenRaw_Filter(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("No loopback interface: %v", err)
+	}
+	recv, err := openRaw(lo)
+	if err != nil {
+		t.Skipf("Cannot open raw socket: %v", err)
+	}
+	defer recv.Close()
+	send, err := openRaw(lo)
+	if err != nil {
+		t.Fatalf("openRaw() error = %v", err)
+	}
+	defer send.Close()
+
+	reply := arpRequestFrame(deviceIP)
+	binary.BigEndian.PutUint16(reply[20:22], arpReply)
+	udp := tcpFrame(deviceIP, 4, 0)
+	udp[14+9] = 17
+	ipv6 := tcpFrame(deviceIP, 5, tcpSYN)
+	binary.BigEndian.PutUint16(ipv6[12:14], 0x86dd)
+	fragment := tcpFrame(deviceIP, 6, tcpSYN)
+	binary.BigEndian.PutUint16(fragment[14+6:14+8], 100)
+
+	// The frames the proxy handles go last, so once they arrive every
+	// frame that should have been dropped had its chance
+	frames := [][]byte{
+		reply, udp, ipv6, fragment,
+		tcpFrame(deviceIP, 2, tcpSYN|tcpACK),
+		tcpFrame(deviceIP, 3, tcpACK),
+		arpRequestFrame(deviceIP),
+		tcpFrame(deviceIP, 1, tcpSYN),
+	}
+	for _, f := range frames {
+		if err := send.WriteFrame(f); err != nil {
+			t.Fatalf("WriteFrame() error = %v", err)
+		}
+	}
+
+	var got []string
+	buf := make([]byte, 2048)
+	deadline := time.Now().Add(3 * time.Second)
+	for len(got) < 2 && time.Now().Before(deadline) {
+		n, err := recv.ReadFrame(buf)
+		if err != nil {
+			continue
+		}
+		f := buf[:n]
+		if n < 42 || !bytes.Equal(f[6:12], clientHW) {
+			continue // Other traffic on the loopback
+		}
+		switch {
+		case bytes.Equal(f, arpRequestFrame(deviceIP)):
+			got = append(got, "ARP request")
+		case binary.BigEndian.Uint16(f[12:14]) == etherTypeIPv4 && n >= 54:
+			got = append(got, fmt.Sprintf("TCP port %d flags %#x", binary.BigEndian.Uint16(f[36:38]), f[47]))
+		default:
+			got = append(got, fmt.Sprintf("frame %x", f[12:22]))
+		}
+	}
+	if want := []string{"ARP request", "TCP port 1 flags 0x2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Frames received = %q, want %q", got, want)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []Config{
+		{Devices: []Device{{MAC: deviceMAC}}},
+		{Interface: "eth0", Devices: []Device{{MAC: "invalid"}}},
+		{Interface: "eth0", Devices: []Device{{MAC: deviceMAC, Ports: []int{70000}}}},
+	}
+	for _, cfg := range tests {
+		if _, err := New(nil, nil, cfg); err == nil {
+			t.Errorf("New(%+v) should fail", cfg)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+// Package sleepproxy implements raw Ethernet sockets on Linux.
+package sleepproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// capNetRaw is the CAP_NET_RAW capability bit.
+const capNetRaw = 13
+
+// checkCapabilities verifies that the process may open raw sockets.
+func checkCapabilities() error {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		// Can't tell; let opening the socket decide
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil || caps&(1<<capNetRaw) != 0 {
+			return nil
+		}
+		return errNoCapability
+	}
+	return nil
+}
+
+// errNoCapability explains how to grant the raw socket capability.
+var errNoCapability = errors.New("sleep proxy needs CAP_NET_RAW: run as root or grant it with 'setcap cap_net_raw+ep <wolgate binary>'")
+
+// packetConn is an AF_PACKET socket bound to one interface.
+type packetConn struct {
+	fd      int
+	ifindex int
+}
+
+// frameFilter is a classic BPF program passing only the frames the proxy
+// handles, ARP requests and IPv4 TCP SYNs, so the kernel does not copy
+// every frame on the interface to the proxy.
+var frameFilter = []syscall.SockFilter{
+	{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 12},                         // 0: A = EtherType
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: etherTypeARP, Jf: 2},       // 1: ARP, else 4
+	{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 20},                         // 2: A = ARP opcode
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: arpRequest, Jt: 9, Jf: 10}, // 3: Request, else drop
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: etherTypeIPv4, Jf: 9},      // 4: IPv4, else drop
+	{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: 23},                         // 5: A = IP protocol
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: protoTCP, Jf: 7},           // 6: TCP, else drop
+	{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 20},                         // 7: A = fragment offset
+	{Code: syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K, K: 0x1fff, Jt: 5},            // 8: First fragment, else drop
+	{Code: syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH, K: 14},                        // 9: X = IP header length
+	{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_IND, K: 14 + 13},                    // 10: A = TCP flags
+	{Code: syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K, K: tcpSYN | tcpACK},           // 11: A &= SYN|ACK
+	{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: tcpSYN, Jf: 1},             // 12: SYN alone, else drop
+	{Code: syscall.BPF_RET | syscall.BPF_K, K: 0x40000},                                     // 13: Accept
+	{Code: syscall.BPF_RET | syscall.BPF_K, K: 0},                                           // 14: Drop
+}
+
+// openRaw opens an AF_PACKET socket receiving the frames on iface that the
+// proxy handles, see frameFilter.
+func openRaw(iface *net.Interface) (rawConn, error) {
+	// The socket receives nothing until bound, so no frame gets past the
+	// filter attached in between
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			return nil, errNoCapability
+		}
+		return nil, fmt.Errorf("failed to open raw socket: %w", err)
+	}
+
+	if err := syscall.AttachLsf(fd, frameFilter); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to attach socket filter: %w", err)
+	}
+
+	proto := htons(syscall.ETH_P_ALL)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind raw socket to %s: %w", iface.Name, err)
+	}
+
+	// Wake up periodically so the read loop notices Close
+	tv := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set socket timeout: %w", err)
+	}
+
+	return &packetConn{fd: fd, ifindex: iface.Index}, nil
+}
+
+// ReadFrame reads one incoming frame, skipping frames sent by this host.
+func (c *packetConn) ReadFrame(buf []byte) (int, error) {
+	for {
+		n, from, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				return 0, errTimeout
+			}
+			return 0, err
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		return n, nil
+	}
+}
+
+// WriteFrame sends a complete Ethernet frame.
+func (c *packetConn) WriteFrame(frame []byte) error {
+	addr := &syscall.SockaddrLinklayer{Ifindex: c.ifindex, Halen: 6}
+	copy(addr.Addr[:], frame[0:6])
+	return syscall.Sendto(c.fd, frame, 0, addr)
+}
+
+// Close closes the socket.
+func (c *packetConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// htons converts a 16-bit value to network byte order.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
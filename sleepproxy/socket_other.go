@@ -0,0 +1,20 @@
+//go:build !linux
+
+// Package sleepproxy raw sockets are only implemented on Linux.
+package sleepproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// errUnsupported is returned when starting the proxy off Linux.
+var errUnsupported = errors.New("sleep proxy is only supported on Linux")
+
+func checkCapabilities() error {
+	return errUnsupported
+}
+
+func openRaw(iface *net.Interface) (rawConn, error) {
+	return nil, errUnsupported
+}
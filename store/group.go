@@ -0,0 +1,426 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Group errors.
+var (
+	ErrGroupNotFound = errors.New("group not found")
+	ErrGroupExists   = errors.New("group with this name already exists")
+)
+
+// Group is a named set of devices, the devices whose Group is its name.
+// Groups referenced by devices are created automatically.
+type Group struct {
+	ID          string     `json:"id"`       // Stable identifier, assigned by the store
+	Revision    int        `json:"revision"` // Incremented on every change
+	Name        string     `json:"name"`     // Display name, stored in each member's Group
+	Description string     `json:"description,omitempty"`
+	Order       int        `json:"order"`          // Position in lists, lowest first
+	Wake        *GroupWake `json:"wake,omitempty"` // Defaults for the members' wake settings
+	CreatedAt   time.Time  `json:"created_at"`     // Set by the store
+	UpdatedAt   time.Time  `json:"updated_at"`     // Set by the store
+}
+
+// GroupWake holds the wake defaults of a group. Members' own settings take
+// precedence.
+type GroupWake struct {
+	Iface     string `json:"iface,omitempty"`
+	Broadcast string `json:"broadcast,omitempty"`
+	Stagger   int    `json:"stagger,omitempty"` // Milliseconds between members when the group is woken
+}
+
+// WakeDefaults returns target with the group's interface and broadcast
+// address filled in where target has none.
+func (g Group) WakeDefaults(target wol.Target) wol.Target {
+	if g.Wake == nil {
+		return target
+	}
+	if target.Iface == "" {
+		target.Iface = g.Wake.Iface
+	}
+	if target.Address == "" {
+		target.Address = g.Wake.Broadcast
+	}
+	return target
+}
+
+// StaggerDelay returns the pause between members when the group is woken.
+func (g Group) StaggerDelay() time.Duration {
+	if g.Wake == nil {
+		return 0
+	}
+	return time.Duration(g.Wake.Stagger) * time.Millisecond
+}
+
+// OnGroupRename registers a callback invoked after a group is renamed, so
+// references to it by name can be updated. Callbacks run after the store
+// lock is released.
+func (s *Store) OnGroupRename(fn func(oldName, newName string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renamed = append(s.renamed, fn)
+}
+
+// ListGroups returns all groups in order.
+func (s *Store) ListGroups() []Group {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]Group, len(s.groups))
+	for i, g := range s.groups {
+		result[i] = *g
+	}
+	sortGroups(result)
+	return result
+}
+
+// Groups returns the names of all groups in order.
+func (s *Store) Groups() []string {
+	groups := s.ListGroups()
+	names := make([]string, len(groups))
+	for i, g := range groups {
+		names[i] = g.Name
+	}
+	return names
+}
+
+// GetGroup returns a group by ID.
+func (s *Store) GetGroup(id string) (Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i := s.groupIndexLocked(id); i >= 0 {
+		return *s.groups[i], nil
+	}
+	return Group{}, fmt.Errorf("%w: %s", ErrGroupNotFound, id)
+}
+
+// GroupByName returns a group by name.
+func (s *Store) GroupByName(name string) (Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i := s.groupByNameLocked(name, ""); i >= 0 {
+		return *s.groups[i], nil
+	}
+	return Group{}, fmt.Errorf("%w: %s", ErrGroupNotFound, name)
+}
+
+// CreateGroup adds a new group, assigning it an ID, and returns it. Names
+// are unique. A group without an order is placed after the others.
+func (s *Store) CreateGroup(group Group) (Group, error) {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return Group{}, err
+	}
+	defer unlock()
+
+	if s.groupByNameLocked(group.Name, "") >= 0 {
+		return Group{}, fmt.Errorf("%w: %s", ErrGroupExists, group.Name)
+	}
+
+	if group.Order == 0 {
+		for _, g := range s.groups {
+			group.Order = max(group.Order, g.Order+1)
+		}
+	}
+	group.ID = newID()
+	group.Revision = 1
+	group.CreatedAt = time.Now().UTC()
+	group.UpdatedAt = group.CreatedAt
+	oldGroups := s.groups
+	s.groups = append(append([]*Group{}, oldGroups...), &group)
+
+	if err := s.writeLocked(true); err != nil {
+		// Rollback on save error
+		s.groups = oldGroups
+		return Group{}, err
+	}
+	return group, nil
+}
+
+// UpdateGroup replaces the group with the given ID, keeping the ID. If the
+// name changes, every member is moved to the new name as one store
+// revision. If group.Revision is set, it must match the stored revision or
+// ErrConflict is returned.
+func (s *Store) UpdateGroup(id string, group Group, origin Origin) (Group, error) {
+	var changes []Change
+	var renamed [2]string
+	defer func() {
+		s.notify(changes)
+		if renamed[0] != "" {
+			s.notifyRename(renamed[0], renamed[1])
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return Group{}, err
+	}
+	defer unlock()
+
+	i := s.groupIndexLocked(id)
+	if i < 0 {
+		return Group{}, fmt.Errorf("%w: %s", ErrGroupNotFound, id)
+	}
+	previous := s.groups[i]
+	if group.Revision != 0 && group.Revision != previous.Revision {
+		return Group{}, fmt.Errorf("%w: revision %d, current revision %d", ErrConflict, group.Revision, previous.Revision)
+	}
+	if s.groupByNameLocked(group.Name, id) >= 0 {
+		return Group{}, fmt.Errorf("%w: %s", ErrGroupExists, group.Name)
+	}
+
+	group.ID = id
+	group.Revision = previous.Revision + 1
+	group.CreatedAt = previous.CreatedAt
+	group.UpdatedAt = time.Now().UTC()
+	oldGroups := s.groups
+	s.groups = append([]*Group{}, oldGroups...)
+	s.groups[i] = &group
+
+	moved, err := s.regroupLocked(origin, func(d *Device) string {
+		if d.Group == previous.Name {
+			return group.Name
+		}
+		return d.Group
+	})
+	if err != nil {
+		s.groups = oldGroups
+		return Group{}, err
+	}
+
+	changes = append(changes, moved...)
+	if group.Name != previous.Name {
+		renamed = [2]string{previous.Name, group.Name}
+	}
+	return group, nil
+}
+
+// DeleteGroup removes the group with the given ID. Its members are kept,
+// without a group, as one store revision.
+func (s *Store) DeleteGroup(id string, origin Origin) error {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	i := s.groupIndexLocked(id)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrGroupNotFound, id)
+	}
+	name := s.groups[i].Name
+	oldGroups := s.groups
+	s.groups = append(append([]*Group{}, oldGroups[:i]...), oldGroups[i+1:]...)
+
+	moved, err := s.regroupLocked(origin, func(d *Device) string {
+		if d.Group == name {
+			return ""
+		}
+		return d.Group
+	})
+	if err != nil {
+		s.groups = oldGroups
+		return err
+	}
+	changes = append(changes, moved...)
+	return nil
+}
+
+// SetGroupMembers makes the devices with the given IDs the members of the
+// group with the given ID, moving them from their previous groups; members
+// not listed are left without a group. The changes are one store revision.
+func (s *Store) SetGroupMembers(id string, deviceIDs []string, origin Origin) ([]Change, error) {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	i := s.groupIndexLocked(id)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrGroupNotFound, id)
+	}
+	name := s.groups[i].Name
+
+	members := make(map[string]bool, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		if s.indexLocked(deviceID) < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, deviceID)
+		}
+		members[deviceID] = true
+	}
+
+	moved, err := s.regroupLocked(origin, func(d *Device) string {
+		switch {
+		case members[d.ID]:
+			return name
+		case d.Group == name:
+			return ""
+		}
+		return d.Group
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, moved...)
+	return moved, nil
+}
+
+// regroupLocked moves each device to the group named by group, committing
+// the devices changed as one store revision; with none changed, only the
+// groups are written. Managed devices keep the group the config file gives
+// them (must be called with lock held, and the file lock taken by
+// syncLocked).
+func (s *Store) regroupLocked(origin Origin, group func(*Device) string) ([]Change, error) {
+	now := time.Now().UTC()
+	oldDevices := s.devices
+	s.devices = append([]*Device{}, oldDevices...)
+
+	var changes []Change
+	for i, d := range s.devices {
+		group := group(d)
+		if group == d.Group || d.Managed {
+			continue
+		}
+		device := *d
+		device.Group = group
+		device.Revision++
+		device.UpdatedAt = now
+		s.devices[i] = &device
+		changes = append(changes, Change{Op: OpUpdate, Device: device, Previous: d, Origin: origin})
+	}
+
+	var err error
+	if len(changes) > 0 {
+		err = s.commitLocked(changes)
+	} else {
+		err = s.writeLocked(true)
+	}
+	if err != nil {
+		// Rollback on save error
+		s.devices = oldDevices
+		return nil, err
+	}
+	return changes, nil
+}
+
+// notifyRename delivers a group rename to listeners (must be called
+// without lock held).
+func (s *Store) notifyRename(oldName, newName string) {
+	s.mu.RLock()
+	listeners := append([]func(string, string){}, s.renamed...)
+	s.mu.RUnlock()
+
+	for _, fn := range listeners {
+		fn(oldName, newName)
+	}
+}
+
+// groupIndexLocked returns the index of the group with the given ID, or -1
+// (must be called with lock held).
+func (s *Store) groupIndexLocked(id string) int {
+	for i, g := range s.groups {
+		if g.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// groupByNameLocked returns the index of a group other than exceptID named
+// name, or -1 (must be called with lock held).
+func (s *Store) groupByNameLocked(name, exceptID string) int {
+	for i, g := range s.groups {
+		if g.ID != exceptID && g.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// fillGroups creates the groups devices refer to that do not exist yet,
+// ordered by name after the existing ones, and gives groups added to the
+// file by hand an ID, first revision and timestamps. It returns the groups
+// and whether any were created or changed.
+func fillGroups(groups []*Group, devices []*Device) ([]*Group, bool) {
+	names := make(map[string]bool, len(groups))
+	order := 0
+	for _, g := range groups {
+		names[g.Name] = true
+		order = max(order, g.Order)
+	}
+
+	var missing []string
+	for _, d := range devices {
+		if d.Group != "" && !names[d.Group] {
+			names[d.Group] = true
+			missing = append(missing, d.Group)
+		}
+	}
+	sort.Strings(missing)
+
+	now := time.Now().UTC()
+	filled := len(missing) > 0
+	for _, name := range missing {
+		order++
+		groups = append(groups, &Group{Name: name, Order: order})
+	}
+	for _, g := range groups {
+		if g.ID == "" || g.Revision < 1 || g.CreatedAt.IsZero() {
+			filled = true
+		}
+		if g.ID == "" {
+			g.ID = newID()
+		}
+		if g.Revision < 1 {
+			g.Revision = 1
+		}
+		if g.CreatedAt.IsZero() {
+			g.CreatedAt = now
+			g.UpdatedAt = now
+		}
+	}
+	return groups, filled
+}
+
+// sortGroups sorts groups by order, then name.
+func sortGroups(groups []Group) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Order != groups[j].Order {
+			return groups[i].Order < groups[j].Order
+		}
+		return strings.ToLower(groups[i].Name) < strings.ToLower(groups[j].Name)
+	})
+}
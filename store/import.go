@@ -0,0 +1,202 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrManaged is returned when importing over a device managed by the config
+// file.
+var ErrManaged = errors.New("device is managed by the config file")
+
+// Import conflict modes, for imported devices that are already stored.
+const (
+	ConflictSkip      = "skip"      // Keep the stored device
+	ConflictOverwrite = "overwrite" // Replace the stored device
+	ConflictMerge     = "merge"     // Set only the fields the import gives
+)
+
+// Import outcomes besides OpAdd and OpUpdate.
+const (
+	ImportSkipped   = "skip"      // The device exists and the mode is ConflictSkip
+	ImportUnchanged = "unchanged" // The device exists and already matches
+)
+
+// ImportItem is a device to import.
+type ImportItem struct {
+	Device Device
+	// Fields are the JSON names of the fields the import gives, set by
+	// ConflictMerge; nil gives them all.
+	Fields []string
+}
+
+// ImportOptions control Import.
+type ImportOptions struct {
+	Mode     string              // One of the Conflict constants; default ConflictSkip
+	DryRun   bool                // Report the outcomes without changing the store
+	Validate func(*Device) error // Checks and normalizes each device before it is stored
+	Origin   Origin
+}
+
+// ImportOutcome is what Import did, or would do, with an item.
+type ImportOutcome struct {
+	Op     string // OpAdd, OpUpdate, ImportSkipped or ImportUnchanged
+	Device Device // The device as stored
+	Err    error  // Why the item was not imported
+}
+
+// Import adds the devices in items, or updates those already stored as
+// opts.Mode says, as one store revision, and returns the outcome of each
+// item in order. An imported device matches the stored device with its ID,
+// if it has one, or else with its MAC. Items that fail validation, clash
+// with the MAC of another device or match a managed device are reported
+// and left out; the rest are imported.
+func (s *Store) Import(items []ImportItem, opts ImportOptions) ([]ImportOutcome, error) {
+	mode := opts.Mode
+	if mode == "" {
+		mode = ConflictSkip
+	}
+	if mode != ConflictSkip && mode != ConflictOverwrite && mode != ConflictMerge {
+		return nil, fmt.Errorf("invalid import mode %q", mode)
+	}
+
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	now := time.Now().UTC()
+	oldDevices := s.devices
+	s.devices = append([]*Device{}, oldDevices...)
+
+	outcomes := make([]ImportOutcome, len(items))
+	var imported []Change
+	for n, item := range items {
+		outcome, change := s.importLocked(item, mode, opts.Validate, now)
+		if change != nil {
+			change.Origin = opts.Origin
+			imported = append(imported, *change)
+		}
+		outcomes[n] = outcome
+	}
+
+	if opts.DryRun || len(imported) == 0 {
+		s.devices = oldDevices
+		return outcomes, nil
+	}
+	if err := s.commitLocked(imported); err != nil {
+		// Rollback on save error
+		s.devices = oldDevices
+		return nil, err
+	}
+	changes = append(changes, imported...)
+	return outcomes, nil
+}
+
+// importLocked imports one item into s.devices, returning its outcome and
+// the change made, if any (must be called with lock held).
+func (s *Store) importLocked(item ImportItem, mode string, validate func(*Device) error, now time.Time) (ImportOutcome, *Change) {
+	device := item.Device
+	device.Managed = false // Only the config file manages devices
+	i := -1
+	if device.ID != "" {
+		i = s.indexLocked(device.ID)
+	}
+	if i < 0 && device.MAC != "" {
+		i = s.indexByMACLocked(device.MAC, "")
+	}
+
+	if i < 0 {
+		if validate != nil {
+			if err := validate(&device); err != nil {
+				return ImportOutcome{Err: err}, nil
+			}
+		}
+		if err := s.checkMACsLocked(device, ""); err != nil {
+			return ImportOutcome{Err: err}, nil
+		}
+		if device.ID == "" {
+			device.ID = newID()
+		}
+		device.Revision = 1
+		device.CreatedAt = now
+		device.UpdatedAt = now
+		device.LastWokenAt = nil
+		s.devices = append(s.devices, &device)
+		return ImportOutcome{Op: OpAdd, Device: device}, &Change{Op: OpAdd, Device: device}
+	}
+
+	previous := s.devices[i]
+	switch {
+	case mode == ConflictSkip:
+		return ImportOutcome{Op: ImportSkipped, Device: *previous}, nil
+	case previous.Managed:
+		return ImportOutcome{Device: *previous, Err: fmt.Errorf("%w: %s", ErrManaged, previous.Name)}, nil
+	case mode == ConflictMerge:
+		merged, err := mergeFields(*previous, device, item.Fields)
+		if err != nil {
+			return ImportOutcome{Err: err}, nil
+		}
+		device = merged
+		device.Managed = false
+	}
+	if validate != nil {
+		if err := validate(&device); err != nil {
+			return ImportOutcome{Err: err}, nil
+		}
+	}
+	if err := s.checkMACsLocked(device, previous.ID); err != nil {
+		return ImportOutcome{Err: err}, nil
+	}
+
+	device.ID = previous.ID
+	device.Revision = previous.Revision
+	device.CreatedAt = previous.CreatedAt
+	device.UpdatedAt = previous.UpdatedAt
+	device.LastWokenAt = previous.LastWokenAt
+	if sameDevice(&device, previous) {
+		return ImportOutcome{Op: ImportUnchanged, Device: *previous}, nil
+	}
+	device.Revision++
+	device.UpdatedAt = now
+	s.devices[i] = &device
+	return ImportOutcome{Op: OpUpdate, Device: device}, &Change{Op: OpUpdate, Device: device, Previous: previous}
+}
+
+// mergeFields returns base with the given fields of update set; a nil
+// fields sets every field of update.
+func mergeFields(base, update Device, fields []string) (Device, error) {
+	if fields == nil {
+		return update, nil
+	}
+
+	var to, from map[string]json.RawMessage
+	data, _ := json.Marshal(base)
+	json.Unmarshal(data, &to)
+	data, _ = json.Marshal(update)
+	json.Unmarshal(data, &from)
+	for _, f := range fields {
+		if v, ok := from[f]; ok {
+			to[f] = v
+		} else {
+			delete(to, f)
+		}
+	}
+
+	var merged Device
+	data, _ = json.Marshal(to)
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return base, err
+	}
+	return merged, nil
+}
@@ -0,0 +1,337 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hzhq1255/wolgate/atomicfile"
+)
+
+// DefaultJournal is the default number of journal entries kept.
+const DefaultJournal = 1000
+
+// Change sources recorded in the journal.
+const (
+	SourceAPI     = "api"     // The HTTP API or web UI
+	SourceImport  = "import"  // Imported in bulk, e.g. from the ARP table
+	SourceFile    = "file"    // The store file was edited by hand
+	SourceRestore = "restore" // A restore to an earlier revision
+	SourceConfig  = "config"  // Devices declared in the config file
+)
+
+// ErrRevisionUnavailable is returned when restoring to a revision that is
+// no longer, or was never, covered by the journal.
+var ErrRevisionUnavailable = errors.New("revision not available in the journal")
+
+// Origin describes who made a change to the store.
+type Origin struct {
+	Source string // One of the Source constants
+	Actor  string // Who made the change, e.g. an API client's address
+}
+
+// Entry is a journal record of one device changed by a store revision.
+type Entry struct {
+	Revision int64     `json:"revision"`
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Device   string    `json:"device"` // Device ID
+	Source   string    `json:"source,omitempty"`
+	Actor    string    `json:"actor,omitempty"`
+	Before   *Device   `json:"before,omitempty"`
+	After    *Device   `json:"after,omitempty"`
+}
+
+// JournalPath returns the path of the journal of the store file at path,
+// a JSON object per line, oldest first.
+func JournalPath(path string) string {
+	return path + ".journal"
+}
+
+// SetJournal sets the number of journal entries kept; 0 disables the
+// journal.
+func (s *Store) SetJournal(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal = n
+}
+
+// Revision returns the current store revision.
+func (s *Store) Revision() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revision
+}
+
+// Journal returns the journal entries, oldest first.
+func (s *Store) Journal() ([]Entry, error) {
+	return readJournal(JournalPath(s.filePath))
+}
+
+// Restore returns the device list to how it was at revision to, as a new
+// revision, and returns the changes made. Every device changed since is
+// put back as it was before its first change after to; devices deleted
+// since keep their IDs and leave the trash, and devices added since are
+// moved to the trash.
+func (s *Store) Restore(to int64, origin Origin) ([]Change, error) {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := readJournal(JournalPath(s.filePath))
+	if err != nil {
+		return nil, err
+	}
+	since, err := entriesSince(entries, to, s.revision)
+	if err != nil {
+		return nil, err
+	}
+
+	// The state of each device before its first change after to
+	before := make(map[string]*Device)
+	var order []string
+	for _, e := range since {
+		if _, ok := before[e.Device]; !ok {
+			before[e.Device] = e.Before
+			order = append(order, e.Device)
+		}
+	}
+
+	now := time.Now().UTC()
+	oldDevices, oldTrash := s.devices, s.trash
+	s.devices = append([]*Device{}, oldDevices...)
+	var restored []Change
+	for _, id := range order {
+		want := before[id]
+		i := s.indexLocked(id)
+		switch {
+		case want == nil && i >= 0:
+			restored = append(restored, Change{Op: OpDelete, Device: *s.devices[i], Origin: origin})
+			s.trash = s.trashLocked(s.devices[i])
+			s.devices = append(s.devices[:i:i], s.devices[i+1:]...)
+		case want != nil && i >= 0 && !sameDevice(want, s.devices[i]):
+			device := *want
+			device.Revision = max(want.Revision, s.devices[i].Revision) + 1
+			device.UpdatedAt = now
+			restored = append(restored, Change{Op: OpUpdate, Device: device, Previous: s.devices[i], Origin: origin})
+			s.devices[i] = &device
+		case want != nil && i < 0:
+			device := *want
+			device.Revision++
+			device.UpdatedAt = now
+			restored = append(restored, Change{Op: OpAdd, Device: device, Origin: origin})
+			s.devices = append(s.devices, &device)
+			s.trash = s.untrashLocked(id)
+		}
+	}
+	if len(restored) == 0 {
+		s.devices, s.trash = oldDevices, oldTrash
+		return nil, nil
+	}
+
+	// Devices added since may have taken a MAC of a restored one
+	for _, c := range restored {
+		if c.Op == OpDelete {
+			continue
+		}
+		if err := s.checkMACsLocked(c.Device, c.Device.ID); err != nil {
+			s.devices, s.trash = oldDevices, oldTrash
+			return nil, err
+		}
+	}
+
+	if err := s.commitLocked(restored); err != nil {
+		s.devices, s.trash = oldDevices, oldTrash
+		return nil, err
+	}
+	changes = append(changes, restored...)
+	return restored, nil
+}
+
+// entriesSince returns the journal entries after revision to, checking
+// that they cover every revision up to current.
+func entriesSince(entries []Entry, to, current int64) ([]Entry, error) {
+	if to < 0 || to > current {
+		return nil, fmt.Errorf("%w: %d (current revision is %d)", ErrRevisionUnavailable, to, current)
+	}
+
+	var since []Entry
+	next := to + 1
+	for _, e := range entries {
+		if e.Revision <= to {
+			continue
+		}
+		if e.Revision != next && e.Revision != next-1 {
+			break
+		}
+		since = append(since, e)
+		next = e.Revision + 1
+	}
+	if next != current+1 {
+		oldest := current
+		if len(entries) > 0 {
+			oldest = entries[0].Revision - 1
+		}
+		return nil, fmt.Errorf("%w: %d (oldest is %d)", ErrRevisionUnavailable, to, oldest)
+	}
+	return since, nil
+}
+
+// commitLocked saves the devices as the next store revision, recording
+// changes in the journal first; if the save fails, the journal entries are
+// removed again (must be called with lock held, and the file lock taken by
+// syncLocked).
+func (s *Store) commitLocked(changes []Change) error {
+	revision := s.revision + 1
+	rollback, err := s.appendJournalLocked(revision, changes)
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	s.revision = revision
+	if err := s.writeLocked(true); err != nil {
+		s.revision--
+		rollback()
+		return err
+	}
+	return nil
+}
+
+// appendJournalLocked appends changes to the journal as revision, dropping
+// the oldest revisions beyond the limit, and returns a function undoing the
+// write (must be called with lock held).
+func (s *Store) appendJournalLocked(revision int64, changes []Change) (func(), error) {
+	if s.journal <= 0 {
+		return func() {}, nil
+	}
+
+	path := JournalPath(s.filePath)
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var buf bytes.Buffer
+	for _, c := range changes {
+		line, err := json.Marshal(newEntry(revision, now, c))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// Appending is cheap; trim only once a quarter over the limit
+	if bytes.Count(old, []byte{'\n'})+len(changes) > s.journal+s.journal/4 {
+		data := trimJournal(append(old[:len(old):len(old)], buf.Bytes()...), s.journal)
+		if err := atomicfile.WriteFile(path, data, 0644); err != nil {
+			return nil, err
+		}
+		return func() { atomicfile.WriteFile(path, old, 0644) }, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Truncate(path, int64(len(old)))
+		return nil, err
+	}
+	return func() { os.Truncate(path, int64(len(old))) }, nil
+}
+
+// newEntry returns the journal entry recording c as part of revision.
+func newEntry(revision int64, t time.Time, c Change) Entry {
+	e := Entry{
+		Revision: revision,
+		Time:     t,
+		Op:       c.Op,
+		Device:   c.Device.ID,
+		Source:   c.Origin.Source,
+		Actor:    c.Origin.Actor,
+	}
+	device := c.Device
+	switch c.Op {
+	case OpAdd:
+		e.After = &device
+	case OpUpdate:
+		e.Before = c.Previous
+		e.After = &device
+	case OpDelete:
+		e.Before = &device
+	}
+	return e
+}
+
+// trimJournal keeps the newest entries of a journal, at most limit of
+// them, dropping whole revisions so every revision kept is complete.
+func trimJournal(data []byte, limit int) []byte {
+	lines := bytes.SplitAfter(data, []byte{'\n'})
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	revisionAt := func(i int) int64 {
+		var e struct {
+			Revision int64 `json:"revision"`
+		}
+		json.Unmarshal(lines[i], &e)
+		return e.Revision
+	}
+
+	start := max(len(lines)-limit, 0)
+	for start > 0 && start < len(lines) && revisionAt(start) == revisionAt(start-1) {
+		start++
+	}
+	return bytes.Join(lines[start:], nil)
+}
+
+// readJournal reads the journal at path. A missing journal is empty, and
+// a truncated last line, left by a crash, is ignored.
+func readJournal(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Entry{}, nil
+		}
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	defer f.Close()
+
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	return entries, nil
+}
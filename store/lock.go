@@ -0,0 +1,63 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"fmt"
+	"os"
+)
+
+// LockPath returns the path of the lock file guarding the store file at
+// path. Processes sharing a store file hold an advisory lock on it while
+// they read, modify and write the store file.
+func LockPath(path string) string {
+	return path + ".lock"
+}
+
+// lockFileLocked takes the cross-process lock on the store file, waiting
+// for other processes to release it, and returns a function releasing it
+// (must be called with lock held).
+func (s *Store) lockFileLocked() (func(), error) {
+	if dir := dirPath(s.filePath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(LockPath(s.filePath), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock store file: %w", err)
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// syncLocked starts a mutation: it takes the cross-process lock and
+// re-reads the store file, so changes written by other processes are not
+// lost, appending them to changes. The returned function releases the lock
+// once the mutation is written. If the file exists but cannot be loaded,
+// it fails with ErrModified rather than let the mutation overwrite it
+// (must be called with lock held).
+func (s *Store) syncLocked(changes *[]Change) (func(), error) {
+	unlock, err := s.lockFileLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	// A missing file is recreated from memory
+	if statFile(s.filePath) == nil {
+		s.seen = nil
+		return unlock, nil
+	}
+	if err := s.reloadLocked(changes); err != nil {
+		unlock()
+		return nil, fmt.Errorf("%w: %v", ErrModified, err)
+	}
+	return unlock, nil
+}
@@ -0,0 +1,221 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// CurrentVersion is the schema version written by this build. Version 1
+// is the legacy format, a bare JSON array of devices.
+const CurrentVersion = 8
+
+// ErrUnsupportedVersion is returned for store files written by a newer build.
+var ErrUnsupportedVersion = errors.New("unsupported store file version")
+
+// Document is the on-disk format of the store.
+type Document struct {
+	Version  int              `json:"version"`
+	Revision int64            `json:"revision"` // Store revision, incremented on every change
+	Devices  []*Device        `json:"devices"`
+	Groups   []*Group         `json:"groups,omitempty"`
+	Trash    []*TrashedDevice `json:"trash,omitempty"` // Deleted devices, until restored or purged
+}
+
+// Migration upgrades a store document from one schema version to the next.
+type Migration struct {
+	From        int    `json:"from"`
+	To          int    `json:"to"`
+	Description string `json:"description"`
+	apply       func(doc map[string]json.RawMessage) error
+}
+
+// migrations lists every migration in order; migrations[i] upgrades
+// version i+1 to i+2.
+var migrations = []Migration{
+	{
+		From:        1,
+		To:          2,
+		Description: "wrap the device array in a versioned document",
+		// The legacy array is already decoded as the devices field
+		apply: func(doc map[string]json.RawMessage) error { return nil },
+	},
+	{
+		From:        2,
+		To:          3,
+		Description: "assign stable IDs to devices",
+		apply:       assignIDs,
+	},
+	{
+		From:        3,
+		To:          4,
+		Description: "add the trash of deleted devices",
+		// Older builds would drop the trash when rewriting the file
+		apply: func(doc map[string]json.RawMessage) error { return nil },
+	},
+	{
+		From:        4,
+		To:          5,
+		Description: "add device tags, notes, wake settings and timestamps",
+		// Timestamps are filled in on load, like IDs added by hand
+		apply: func(doc map[string]json.RawMessage) error { return nil },
+	},
+	{
+		From:        5,
+		To:          6,
+		Description: "add alias MACs of devices",
+		apply:       func(doc map[string]json.RawMessage) error { return nil },
+	},
+	{
+		From:        6,
+		To:          7,
+		Description: "store device groups with their own settings",
+		// Groups are created on load from the devices' group names
+		apply: func(doc map[string]json.RawMessage) error { return nil },
+	},
+	{
+		From:        7,
+		To:          8,
+		Description: "mark devices managed by the config file",
+		apply:       func(doc map[string]json.RawMessage) error { return nil },
+	},
+}
+
+// assignIDs gives every device in doc an ID.
+func assignIDs(doc map[string]json.RawMessage) error {
+	raw, ok := doc["devices"]
+	if !ok {
+		return nil
+	}
+	var devices []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &devices); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	for _, d := range devices {
+		var id string
+		if json.Unmarshal(d["id"], &id); id == "" {
+			d["id"], _ = json.Marshal(newID())
+		}
+	}
+	data, err := json.Marshal(devices)
+	if err != nil {
+		return err
+	}
+	doc["devices"] = data
+	return nil
+}
+
+// MigrationResult describes a store file upgraded in place on load.
+type MigrationResult struct {
+	From    int         // Version of the file before the upgrade
+	To      int         // Version after the upgrade
+	Backup  string      // Copy of the file as it was before the upgrade
+	Applied []Migration // Migrations run, in order
+}
+
+// Pending returns the migrations needed to bring the store file at path to
+// CurrentVersion, and the file's version. A missing or empty file needs no
+// migrations.
+func Pending(path string) ([]Migration, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, CurrentVersion, nil
+		}
+		return nil, 0, fmt.Errorf("failed to read store file: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, CurrentVersion, nil
+	}
+
+	version, _, err := decodeDocument(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	pending, err := migrationsFrom(version)
+	return pending, version, err
+}
+
+// BackupBeforeMigration returns the path of the copy of a store file made
+// before upgrading it from version.
+func BackupBeforeMigration(path string, version int) string {
+	return path + ".v" + strconv.Itoa(version) + ".bak"
+}
+
+// parseDocument decodes a store file of any supported version, applying
+// migrations in memory. It returns the document in the current format, the
+// version the data was in, and the migrations applied.
+func parseDocument(data []byte) (*Document, int, []Migration, error) {
+	version, doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	pending, err := migrationsFrom(version)
+	if err != nil {
+		return nil, version, nil, err
+	}
+	for _, m := range pending {
+		if err := m.apply(doc); err != nil {
+			return nil, version, nil, fmt.Errorf("migration from version %d failed: %w", m.From, err)
+		}
+	}
+
+	result := &Document{Version: CurrentVersion, Devices: make([]*Device, 0)}
+	if raw, ok := doc["devices"]; ok {
+		if err := json.Unmarshal(raw, &result.Devices); err != nil {
+			return nil, version, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+	if raw, ok := doc["groups"]; ok {
+		if err := json.Unmarshal(raw, &result.Groups); err != nil {
+			return nil, version, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+	if raw, ok := doc["trash"]; ok {
+		if err := json.Unmarshal(raw, &result.Trash); err != nil {
+			return nil, version, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+	if raw, ok := doc["revision"]; ok {
+		if err := json.Unmarshal(raw, &result.Revision); err != nil {
+			return nil, version, nil, fmt.Errorf("%w: invalid revision", ErrCorrupt)
+		}
+	}
+	return result, version, pending, nil
+}
+
+// decodeDocument splits a store file into its top-level fields and
+// version. A legacy array becomes the devices field of a version 1
+// document.
+func decodeDocument(data []byte) (int, map[string]json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		if !json.Valid(data) {
+			return 0, nil, fmt.Errorf("%w: invalid JSON", ErrCorrupt)
+		}
+		return 1, map[string]json.RawMessage{"devices": data}, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	var version int
+	if err := json.Unmarshal(doc["version"], &version); err != nil || version < 1 {
+		return 0, nil, fmt.Errorf("%w: missing or invalid version", ErrCorrupt)
+	}
+	return version, doc, nil
+}
+
+// migrationsFrom returns the migrations that upgrade version to
+// CurrentVersion.
+func migrationsFrom(version int) ([]Migration, error) {
+	if version > CurrentVersion {
+		return nil, fmt.Errorf("%w %d (this build supports up to %d)", ErrUnsupportedVersion, version, CurrentVersion)
+	}
+	return migrations[version-1:], nil
+}
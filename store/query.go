@@ -0,0 +1,235 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// ErrInvalidQuery is returned for a query with an unknown sort field or a
+// cursor that does not belong to it.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// SortFields are the device fields a query can sort by.
+var SortFields = []string{
+	"id", "name", "hostname", "mac", "ip", "group", "type",
+	"created_at", "updated_at", "last_woken_at",
+}
+
+// Query selects, orders and pages the devices returned by Find.
+type Query struct {
+	Search string   // Case-insensitive substring of the name, hostname, MAC, IP, tags or notes
+	Group  string   // Only devices in this group
+	Type   string   // Only devices of this type
+	Tags   []string // Only devices with every one of these tags
+
+	// Online keeps only devices online (true) or offline (false), as
+	// reported by IsOnline for the device's primary MAC.
+	Online   *bool
+	IsOnline func(mac string) bool
+
+	// Sort is the field to sort by, one of SortFields, prefixed with "-"
+	// for descending order. Devices with equal fields are ordered by ID.
+	// Without it, devices are in the order they were added.
+	Sort string
+
+	Offset int    // Devices to skip
+	Limit  int    // Maximum devices returned; 0 for all
+	Cursor string // Continue after the page that returned it, instead of Offset
+}
+
+// Page is one page of the devices matching a query.
+type Page struct {
+	Devices []Device
+	Total   int    // Devices matching the query, on all pages
+	Next    string // Cursor of the next page; empty on the last page
+}
+
+// cursor marks the last device of a page: its sort key and ID.
+type cursor struct {
+	Sort string `json:"s,omitempty"`
+	Key  string `json:"k,omitempty"`
+	ID   string `json:"i"`
+}
+
+// Find returns the devices matching q, sorted and paged.
+func (s *Store) Find(q Query) (Page, error) {
+	field, desc := strings.TrimPrefix(q.Sort, "-"), strings.HasPrefix(q.Sort, "-")
+	if field != "" && !validSortField(field) {
+		return Page{}, fmt.Errorf("%w: unknown sort field %q", ErrInvalidQuery, field)
+	}
+	var after *cursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.Sort != q.Sort {
+			return Page{}, fmt.Errorf("%w: cursor does not match the query", ErrInvalidQuery)
+		}
+		after = &c
+	}
+
+	var devices []Device
+	for _, d := range s.List() {
+		if q.matches(d) {
+			devices = append(devices, d)
+		}
+	}
+	if field != "" {
+		sort.SliceStable(devices, func(i, j int) bool {
+			ki, kj := sortKey(devices[i], field), sortKey(devices[j], field)
+			if ki == kj {
+				return (devices[i].ID < devices[j].ID) != desc
+			}
+			return (ki < kj) != desc
+		})
+	}
+
+	page := Page{Devices: []Device{}, Total: len(devices)}
+	start := min(max(q.Offset, 0), len(devices))
+	if after != nil {
+		start = resumeIndex(devices, field, desc, *after)
+	}
+	end := len(devices)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+	page.Devices = append(page.Devices, devices[start:end]...)
+	if end < len(devices) && end > start {
+		last := devices[end-1]
+		page.Next = encodeCursor(cursor{Sort: q.Sort, Key: sortKey(last, field), ID: last.ID})
+	}
+	return page, nil
+}
+
+// matches reports whether a device passes the query's filters.
+func (q Query) matches(d Device) bool {
+	if q.Group != "" && d.Group != q.Group {
+		return false
+	}
+	if q.Type != "" && d.Type != q.Type {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !d.HasTag(tag) {
+			return false
+		}
+	}
+	if q.Online != nil && q.IsOnline != nil && q.IsOnline(d.MAC) != *q.Online {
+		return false
+	}
+	if q.Search != "" {
+		fields := []string{d.Name, d.Hostname, d.MAC, d.IP, d.Notes}
+		for _, a := range d.Aliases {
+			fields = append(fields, a.MAC)
+		}
+		text := strings.Join(append(fields, d.Tags...), "\n")
+		if !strings.Contains(strings.ToLower(text), strings.ToLower(q.Search)) {
+			return false
+		}
+	}
+	return true
+}
+
+// resumeIndex returns the index of the first device after the one marked
+// by c. Sorted, that is the first device ordered after c's key and ID, so
+// a page never repeats or skips a device still present; unsorted, it is
+// the device after the one with c's ID, or the end if it is gone.
+func resumeIndex(devices []Device, field string, desc bool, c cursor) int {
+	if field == "" {
+		for i, d := range devices {
+			if d.ID == c.ID {
+				return i + 1
+			}
+		}
+		return len(devices)
+	}
+	return sort.Search(len(devices), func(i int) bool {
+		key := sortKey(devices[i], field)
+		if key == c.Key {
+			return (devices[i].ID > c.ID) != desc && devices[i].ID != c.ID
+		}
+		return (key > c.Key) != desc
+	})
+}
+
+// sortKey returns a string that orders devices by field when compared:
+// text case-insensitively, MACs and IPs by their bytes, and times
+// chronologically, with unset values first.
+func sortKey(d Device, field string) string {
+	switch field {
+	case "id":
+		return d.ID
+	case "name":
+		return strings.ToLower(d.Name)
+	case "hostname":
+		return strings.ToLower(d.Hostname)
+	case "mac":
+		if mac, err := wol.NormalizeMAC(d.MAC); err == nil {
+			return mac
+		}
+		return strings.ToUpper(d.MAC)
+	case "ip":
+		if ip := net.ParseIP(d.IP); ip != nil {
+			return string(ip.To16())
+		}
+		return ""
+	case "group":
+		return strings.ToLower(d.Group)
+	case "type":
+		return d.Type
+	case "created_at":
+		return timeKey(d.CreatedAt)
+	case "updated_at":
+		return timeKey(d.UpdatedAt)
+	case "last_woken_at":
+		if d.LastWokenAt != nil {
+			return timeKey(*d.LastWokenAt)
+		}
+	}
+	return ""
+}
+
+// timeKey returns a fixed-width form of t that sorts chronologically.
+func timeKey(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000000000")
+}
+
+// validSortField reports whether field is one of SortFields.
+func validSortField(field string) bool {
+	for _, f := range SortFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeCursor returns the opaque form of c handed to clients.
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor returned by encodeCursor.
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	if err == nil && c.ID == "" {
+		err = errors.New("cursor without an ID")
+	}
+	return c, err
+}
@@ -0,0 +1,176 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Reconcile policies for devices declared in the config file.
+const (
+	// PolicySeed adds declared devices that are missing, and leaves stored
+	// devices alone.
+	PolicySeed = "seed"
+	// PolicyAuthoritative makes the stored devices match the declared ones:
+	// declared devices are added or overwritten and marked Managed, and
+	// managed devices no longer declared are deleted.
+	PolicyAuthoritative = "authoritative"
+)
+
+// ErrInvalidPolicy is returned by Reconcile for an unknown policy.
+var ErrInvalidPolicy = errors.New("invalid reconcile policy")
+
+// Reconcile brings the stored devices in line with the declared devices
+// under policy, as one store revision, and returns the changes made. A
+// declared device matches the stored device with its ID, if it has one,
+// or else with its MAC. With PolicySeed, devices left marked Managed by an
+// earlier authoritative reconcile are released.
+func (s *Store) Reconcile(declared []Device, policy string) ([]Change, error) {
+	if policy != PolicySeed && policy != PolicyAuthoritative {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPolicy, policy)
+	}
+	if err := checkDeclared(declared); err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	now := time.Now().UTC()
+	origin := Origin{Source: SourceConfig}
+	authoritative := policy == PolicyAuthoritative
+	oldDevices, oldTrash := s.devices, s.trash
+	s.devices = append([]*Device{}, oldDevices...)
+
+	var reconciled []Change
+	matched := make(map[string]bool)
+	for _, d := range declared {
+		i := s.declaredIndexLocked(d)
+		if i < 0 {
+			device := d
+			device.ID = newID()
+			device.Revision = 1
+			device.CreatedAt = now
+			device.UpdatedAt = now
+			device.LastWokenAt = nil
+			device.Managed = authoritative
+			s.devices = append(s.devices, &device)
+			matched[device.ID] = true
+			reconciled = append(reconciled, Change{Op: OpAdd, Device: device, Origin: origin})
+			continue
+		}
+
+		previous := s.devices[i]
+		matched[previous.ID] = true
+		if !authoritative {
+			continue
+		}
+		device := d
+		device.ID = previous.ID
+		device.Revision = previous.Revision
+		device.CreatedAt = previous.CreatedAt
+		device.UpdatedAt = previous.UpdatedAt
+		device.LastWokenAt = previous.LastWokenAt
+		device.Managed = true
+		if sameDevice(&device, previous) {
+			continue
+		}
+		device.Revision++
+		device.UpdatedAt = now
+		s.devices[i] = &device
+		reconciled = append(reconciled, Change{Op: OpUpdate, Device: device, Previous: previous, Origin: origin})
+	}
+
+	// Managed devices no longer declared are deleted, or released
+	kept := s.devices[:0:0]
+	for _, d := range s.devices {
+		switch {
+		case !d.Managed || matched[d.ID]:
+			kept = append(kept, d)
+		case authoritative:
+			reconciled = append(reconciled, Change{Op: OpDelete, Device: *d, Origin: origin})
+			s.trash = s.trashLocked(d)
+		default:
+			device := *d
+			device.Managed = false
+			device.Revision++
+			device.UpdatedAt = now
+			kept = append(kept, &device)
+			reconciled = append(reconciled, Change{Op: OpUpdate, Device: device, Previous: d, Origin: origin})
+		}
+	}
+	s.devices = kept
+	if len(reconciled) == 0 {
+		s.devices = oldDevices
+		return nil, nil
+	}
+
+	// Declared devices may have taken the MAC of a device added by hand
+	for _, c := range reconciled {
+		if c.Op == OpDelete {
+			continue
+		}
+		if err := s.checkMACsLocked(c.Device, c.Device.ID); err != nil {
+			s.devices, s.trash = oldDevices, oldTrash
+			return nil, fmt.Errorf("declared device %q: %w", c.Device.Name, err)
+		}
+	}
+
+	if err := s.commitLocked(reconciled); err != nil {
+		// Rollback on save error
+		s.devices, s.trash = oldDevices, oldTrash
+		return nil, err
+	}
+	changes = append(changes, reconciled...)
+	return reconciled, nil
+}
+
+// declaredIndexLocked returns the index of the stored device a declared
+// device refers to, by ID or else by primary MAC, or -1 (must be called
+// with lock held).
+func (s *Store) declaredIndexLocked(d Device) int {
+	if d.ID != "" {
+		return s.indexLocked(d.ID)
+	}
+	for i, stored := range s.devices {
+		if normalizeMAC(stored.MAC) == normalizeMAC(d.MAC) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkDeclared checks that declared devices have a name and valid MACs,
+// unique among them.
+func checkDeclared(declared []Device) error {
+	seen := make(map[string]string)
+	for i, d := range declared {
+		if strings.TrimSpace(d.Name) == "" {
+			return fmt.Errorf("declared device %d: name is required", i+1)
+		}
+		for _, mac := range d.MACs() {
+			n, err := wol.NormalizeMAC(mac)
+			if err != nil {
+				return fmt.Errorf("declared device %q: %w", d.Name, err)
+			}
+			if other, ok := seen[n]; ok {
+				return fmt.Errorf("declared devices %q and %q: %w: %s", other, d.Name, ErrDuplicate, mac)
+			}
+			seen[n] = d.Name
+		}
+	}
+	return nil
+}
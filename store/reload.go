@@ -0,0 +1,223 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// ErrModified is returned by writes when the store file was changed
+// externally and cannot be loaded, so writing would discard the change.
+var ErrModified = errors.New("store file was modified externally and cannot be loaded")
+
+// ReloadResult describes a reload of the store file after it changed on
+// disk.
+type ReloadResult struct {
+	Added   int
+	Updated int
+	Deleted int
+	Err     error // Why the file could not be loaded; the previous devices are kept
+}
+
+// OnReload registers a callback invoked after every reload attempt.
+// Callbacks run after the store lock is released, so they may read the store.
+func (s *Store) OnReload(fn func(ReloadResult)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloaded = append(s.reloaded, fn)
+}
+
+// Changed reports whether the store file has changed on disk since it was
+// last loaded, written or checked by Reload.
+func (s *Store) Changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !sameFile(statFile(s.filePath), s.seen)
+}
+
+// Watch polls the store file every interval until stop is closed, and
+// reloads it when it changes on disk.
+func (s *Store) Watch(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if s.Changed() {
+				s.Reload()
+			}
+		}
+	}
+}
+
+// Reload replaces the devices in memory with those in the store file, and
+// reports the differences to change listeners. If the file is missing,
+// empty or invalid, the devices in memory are kept, and writes fail with
+// ErrModified until the file is fixed or removed.
+func (s *Store) Reload() error {
+	var changes []Change
+	var result ReloadResult
+	defer func() {
+		s.notify(changes)
+		s.notifyReload(result)
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lockFileLocked()
+	if err != nil {
+		result.Err = err
+		return err
+	}
+	defer unlock()
+
+	result.Err = s.reloadLocked(&changes)
+	for _, c := range changes {
+		switch c.Op {
+		case OpAdd:
+			result.Added++
+		case OpUpdate:
+			result.Updated++
+		case OpDelete:
+			result.Deleted++
+		}
+	}
+	return result.Err
+}
+
+// reloadLocked loads the store file over the devices in memory (must be
+// called with lock held).
+func (s *Store) reloadLocked(changes *[]Change) error {
+	info := statFile(s.filePath)
+	s.seen = info
+	if info == nil {
+		return fmt.Errorf("store file %s is missing", s.filePath)
+	}
+
+	doc, version, applied, err := readDevices(s.filePath)
+	if err != nil {
+		return err
+	}
+	if doc.Devices == nil {
+		// Likely an editor midway through saving
+		return fmt.Errorf("%w: file is empty", ErrCorrupt)
+	}
+	filled := fillIDs(doc.Devices)
+	groups, groupsFilled := fillGroups(doc.Groups, doc.Devices)
+	filled = filled || groupsFilled
+
+	diff := diffDevices(s.devices, doc.Devices)
+	s.devices = doc.Devices
+	s.trash = doc.Trash
+	s.groups = groups
+	if len(applied) > 0 {
+		if err := s.backupForUpgradeLocked(version, applied); err != nil {
+			return err
+		}
+	}
+
+	if doc.Revision <= s.revision && len(diff) > 0 {
+		// Edited by hand rather than by another process, which would have
+		// journaled its change as a new revision: journal the edit
+		for i := range diff {
+			diff[i].Origin = Origin{Source: SourceFile}
+		}
+		*changes = append(*changes, diff...)
+		return s.commitLocked(diff)
+	}
+
+	*changes = append(*changes, diff...)
+	if doc.Revision > s.revision {
+		s.revision = doc.Revision
+	}
+	if len(applied) > 0 || filled {
+		return s.writeLocked(false)
+	}
+	return nil
+}
+
+// diffDevices returns the changes from old to devices, matching devices by
+// ID. Revisions in devices are raised where needed, so clients holding a
+// revision from before an external edit get a conflict, and devices edited
+// without updating their timestamp are marked updated now.
+func diffDevices(old, devices []*Device) []Change {
+	byID := make(map[string]*Device, len(old))
+	for _, d := range old {
+		byID[d.ID] = d
+	}
+
+	var changes []Change
+	for _, d := range devices {
+		previous, ok := byID[d.ID]
+		delete(byID, d.ID)
+		switch {
+		case !ok:
+			changes = append(changes, Change{Op: OpAdd, Device: *d})
+		case !sameDevice(previous, d):
+			if d.Revision <= previous.Revision {
+				d.Revision = previous.Revision + 1
+			}
+			if !d.UpdatedAt.After(previous.UpdatedAt) {
+				d.UpdatedAt = time.Now().UTC()
+			}
+			changes = append(changes, Change{Op: OpUpdate, Device: *d, Previous: previous})
+		default:
+			if d.Revision < previous.Revision {
+				d.Revision = previous.Revision
+			}
+		}
+	}
+	for _, d := range old {
+		if _, ok := byID[d.ID]; ok {
+			changes = append(changes, Change{Op: OpDelete, Device: *d})
+		}
+	}
+	return changes
+}
+
+// sameDevice reports whether a and b are equal, ignoring their revisions
+// and when they were last woken.
+func sameDevice(a, b *Device) bool {
+	x, y := *a, *b
+	x.Revision = y.Revision
+	x.LastWokenAt = y.LastWokenAt
+	return reflect.DeepEqual(x, y)
+}
+
+// notifyReload delivers a reload result to listeners (must be called
+// without lock held).
+func (s *Store) notifyReload(result ReloadResult) {
+	s.mu.RLock()
+	listeners := append([]func(ReloadResult){}, s.reloaded...)
+	s.mu.RUnlock()
+
+	for _, fn := range listeners {
+		fn(result)
+	}
+}
+
+// statFile returns the state of the file at path, or nil if it cannot be
+// read.
+func statFile(path string) os.FileInfo {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// sameFile reports whether a and b describe the same, unchanged file: the
+// same inode, size and modification time.
+func sameFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
@@ -2,36 +2,196 @@
 package store
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/atomicfile"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// DefaultBackups is the default number of previous versions kept as backups.
+const DefaultBackups = 5
+
+// Store errors.
+var (
+	ErrCorrupt   = errors.New("store file is corrupt")
+	ErrNotFound  = errors.New("device not found")
+	ErrDuplicate = errors.New("device with this MAC already exists")
+	ErrConflict  = errors.New("device was modified by another request")
 )
 
 // Device represents a wake-on-LAN device.
 type Device struct {
-	Name  string `json:"name"`
-	MAC   string `json:"mac"`
-	IP    string `json:"ip,omitempty"`
-	Group string `json:"group,omitempty"`
+	ID          string        `json:"id"`       // Stable identifier, assigned by the store
+	Revision    int           `json:"revision"` // Incremented on every change
+	Name        string        `json:"name"`
+	MAC         string        `json:"mac"`               // Primary MAC
+	Aliases     []MACAlias    `json:"aliases,omitempty"` // Other network interfaces
+	IP          string        `json:"ip,omitempty"`
+	Hostname    string        `json:"hostname,omitempty"`
+	Group       string        `json:"group,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	Type        string        `json:"type,omitempty"` // One of DeviceTypes, also shown as its icon
+	Notes       string        `json:"notes,omitempty"`
+	Wake        *WakeSettings `json:"wake,omitempty"`          // Overrides of the wake configuration
+	CreatedAt   time.Time     `json:"created_at"`              // Set by the store
+	UpdatedAt   time.Time     `json:"updated_at"`              // Set by the store
+	LastWokenAt *time.Time    `json:"last_woken_at,omitempty"` // Set by MarkWoken
+	Managed     bool          `json:"managed,omitempty"`       // Declared in the config file, see Reconcile
+}
+
+// DeviceTypes lists the valid device types.
+var DeviceTypes = []string{"desktop", "laptop", "server", "nas", "tv", "console", "printer", "router", "phone", "other"}
+
+// Wake transports.
+const (
+	TransportBroadcast = "broadcast" // UDP to the broadcast address (default)
+	TransportUnicast   = "unicast"   // UDP to the device's IP, e.g. across a router
+)
+
+// WakeSettings override, for one device, where its magic packets are sent.
+// Empty fields keep the wake configuration.
+type WakeSettings struct {
+	Iface     string `json:"iface,omitempty"`
+	Broadcast string `json:"broadcast,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Transport string `json:"transport,omitempty"` // TransportBroadcast or TransportUnicast
+}
+
+// MACAlias is another network interface of a device, e.g. the wireless
+// adapter of a laptop. Its interface and broadcast address override the
+// device's wake settings.
+type MACAlias struct {
+	MAC       string `json:"mac"`
+	Name      string `json:"name,omitempty"` // e.g. "wifi"
+	Iface     string `json:"iface,omitempty"`
+	Broadcast string `json:"broadcast,omitempty"`
+}
+
+// MACs returns every MAC of d, the primary MAC first.
+func (d Device) MACs() []string {
+	macs := []string{d.MAC}
+	for _, a := range d.Aliases {
+		macs = append(macs, a.MAC)
+	}
+	return macs
+}
+
+// HasMAC reports whether mac, in any notation, is one of d's MACs.
+func (d Device) HasMAC(mac string) bool {
+	want := normalizeMAC(mac)
+	for _, m := range d.MACs() {
+		if normalizeMAC(m) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// WakeTarget returns where to send magic packets for mac, one of d's MACs.
+// Unicast wakes go to d's IP only for the primary MAC, as the IP belongs to
+// that interface.
+func (d Device) WakeTarget(mac string) wol.Target {
+	var target wol.Target
+	if d.Wake != nil {
+		target = wol.Target{Iface: d.Wake.Iface, Address: d.Wake.Broadcast, Port: d.Wake.Port}
+	}
+	want := normalizeMAC(mac)
+	for _, a := range d.Aliases {
+		if normalizeMAC(a.MAC) == want {
+			if a.Iface != "" {
+				target.Iface = a.Iface
+			}
+			if a.Broadcast != "" {
+				target.Address = a.Broadcast
+			}
+			return target
+		}
+	}
+	if d.Wake != nil && d.Wake.Transport == TransportUnicast {
+		target.Address = d.IP
+	}
+	return target
+}
+
+// HasTag reports whether d has tag, ignoring case.
+func (d Device) HasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Change operations reported to listeners.
+const (
+	OpAdd    = "add"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Change describes a successful mutation of the store.
+type Change struct {
+	Op       string  // OpAdd, OpUpdate or OpDelete
+	Device   Device  // The device after the change (before, for deletes)
+	Previous *Device // The device before an update
+	Origin   Origin  // Who made the change
 }
 
 // Store manages device persistence.
 type Store struct {
-	filePath string
-	devices  []*Device
-	mu       sync.RWMutex
+	filePath  string
+	devices   []*Device
+	trash     []*TrashedDevice
+	backups   int
+	retention time.Duration // How long deleted devices stay in the trash
+	recovery  *Recovery
+	migration *MigrationResult
+	seen      os.FileInfo // The file as last loaded, written or checked for changes
+	revision  int64       // Store revision of the devices in memory
+	journal   int         // Journal entries kept; 0 disables the journal
+	mu        sync.RWMutex
+	groups    []*Group
+	listeners []func(Change)
+	reloaded  []func(ReloadResult)
+	renamed   []func(oldName, newName string)
+}
+
+// Recovery describes a store loaded from a backup because its file was
+// corrupt.
+type Recovery struct {
+	Backup  string // Backup the devices were loaded from
+	Corrupt string // Copy of the corrupt file, kept for inspection
+	Err     error  // Why the store file was rejected
 }
 
-// NewStore creates a new store instance.
+// NewStore creates a new store instance. Files in an older format are
+// upgraded in place; see Migrated. If the store file is corrupt, the newest
+// valid backup is loaded instead; see Recovered.
 func NewStore(filePath string) (*Store, error) {
 	s := &Store{
-		filePath: filePath,
-		devices:  make([]*Device, 0),
+		filePath:  filePath,
+		devices:   make([]*Device, 0),
+		backups:   DefaultBackups,
+		retention: DefaultRetention,
+		journal:   DefaultJournal,
 	}
 
 	// Load existing data if file exists
-	if err := s.Load(); err != nil {
+	err := s.Load()
+	if errors.Is(err, ErrCorrupt) {
+		err = s.recover(err)
+	}
+	if err != nil {
 		// If file doesn't exist, that's ok - start with empty store
 		if !os.IsNotExist(err) {
 			return nil, fmt.Errorf("failed to load store: %w", err)
@@ -41,6 +201,66 @@ func NewStore(filePath string) (*Store, error) {
 	return s, nil
 }
 
+// SetBackups sets the number of previous versions kept as backups; 0
+// disables backups.
+func (s *Store) SetBackups(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backups = n
+}
+
+// Recovered returns how the store was recovered from a backup at startup,
+// or nil if its file loaded normally.
+func (s *Store) Recovered() *Recovery {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.recovery
+}
+
+// Migrated returns how the store file was upgraded to the current format
+// at startup, or nil if it was already current.
+func (s *Store) Migrated() *MigrationResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.migration
+}
+
+// recover loads the newest valid backup after the store file failed to
+// load with cause. The corrupt file is copied aside and the recovered
+// devices are written back, so the next start finds a valid file.
+func (s *Store) recover(cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lockFileLocked()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, backup := range atomicfile.Backups(s.filePath) {
+		doc, _, _, err := readDevices(backup)
+		if err != nil || doc.Devices == nil {
+			continue
+		}
+
+		corrupt := s.filePath + ".corrupt"
+		if data, err := os.ReadFile(s.filePath); err == nil {
+			if err := atomicfile.WriteFile(corrupt, data, 0644); err != nil {
+				corrupt = ""
+			}
+		}
+
+		s.devices = doc.Devices
+		s.trash = doc.Trash
+		s.groups, _ = fillGroups(doc.Groups, doc.Devices)
+		s.revision = doc.Revision
+		s.recovery = &Recovery{Backup: backup, Corrupt: corrupt, Err: cause}
+		return s.writeLocked(false)
+	}
+	return cause
+}
+
 // Load loads devices from the JSON file.
 func (s *Store) Load() error {
 	s.mu.Lock()
@@ -49,56 +269,133 @@ func (s *Store) Load() error {
 	// Check if file exists
 	if _, err := os.Stat(s.filePath); os.IsNotExist(err) {
 		s.devices = make([]*Device, 0)
+		s.trash = nil
+		s.groups = nil
+		s.seen = nil
 		return nil
 	}
 
-	// Read file
+	// Hold the file lock while reading, and upgrading the file if needed
+	unlock, err := s.lockFileLocked()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Remember the file's state, to detect external changes
+	s.seen = statFile(s.filePath)
+
+	doc, version, applied, err := readDevices(s.filePath)
+	if err != nil {
+		return err
+	}
+	if doc.Devices == nil {
+		// An empty file is a new store, unless backups show it was
+		// truncated by an interrupted write
+		if len(atomicfile.Backups(s.filePath)) > 0 {
+			return fmt.Errorf("%w: file is empty", ErrCorrupt)
+		}
+		doc.Devices = make([]*Device, 0)
+	}
+	filled := fillIDs(doc.Devices)
+	groups, groupsFilled := fillGroups(doc.Groups, doc.Devices)
+
+	s.devices = doc.Devices
+	s.trash = doc.Trash
+	s.groups = groups
+	s.revision = doc.Revision
+	if len(applied) > 0 {
+		if err := s.backupForUpgradeLocked(version, applied); err != nil {
+			return err
+		}
+	}
+	if len(applied) > 0 || filled || groupsFilled {
+		return s.writeLocked(false)
+	}
+	return nil
+}
+
+// fillIDs gives devices added to the file by hand, or saved before
+// revisions and timestamps were tracked, an ID, first revision and
+// timestamps. Duplicate IDs are replaced. It reports whether any device
+// was changed.
+func fillIDs(devices []*Device) bool {
+	filled := false
+	now := time.Now().UTC()
+	ids := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		if d.ID == "" || ids[d.ID] {
+			d.ID = newID()
+			filled = true
+		}
+		ids[d.ID] = true
+		if d.Revision < 1 {
+			d.Revision = 1
+			filled = true
+		}
+		if d.CreatedAt.IsZero() {
+			d.CreatedAt = now
+			filled = true
+		}
+		if d.UpdatedAt.IsZero() {
+			d.UpdatedAt = d.CreatedAt
+			filled = true
+		}
+	}
+	return filled
+}
+
+// backupForUpgradeLocked copies a store file loaded from an older version
+// aside, before it is rewritten in the current format (must be called with
+// lock held).
+func (s *Store) backupForUpgradeLocked(version int, applied []Migration) error {
 	data, err := os.ReadFile(s.filePath)
 	if err != nil {
 		return fmt.Errorf("failed to read store file: %w", err)
 	}
+	backup := BackupBeforeMigration(s.filePath, version)
+	if err := atomicfile.WriteFile(backup, data, 0644); err != nil {
+		return fmt.Errorf("failed to back up store file before migration: %w", err)
+	}
 
-	// Handle empty file
-	if len(data) == 0 {
-		s.devices = make([]*Device, 0)
-		return nil
+	s.migration = &MigrationResult{From: version, To: CurrentVersion, Backup: backup, Applied: applied}
+	return nil
+}
+
+// readDevices reads and parses a store file of any supported version. It
+// returns a document with nil devices for an empty file, along with the
+// file's version and the migrations applied in memory.
+func readDevices(path string) (*Document, int, []Migration, error) {
+	// Read file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to read store file: %w", err)
 	}
 
-	// Parse JSON
-	var devices []*Device
-	if err := json.Unmarshal(data, &devices); err != nil {
-		return fmt.Errorf("failed to parse store file: %w", err)
+	// Handle empty file
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &Document{Version: CurrentVersion}, CurrentVersion, nil, nil
 	}
 
-	s.devices = devices
-	return nil
+	return parseDocument(data)
 }
 
-// Save saves devices to the JSON file.
+// Save saves devices to the JSON file, after merging in changes written by
+// other processes.
 func (s *Store) Save() error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	var changes []Change
+	defer func() { s.notify(changes) }()
 
-	// Create directory if it doesn't exist
-	dir := dirPath(s.filePath)
-	if dir != "" {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory: %w", err)
-		}
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Marshal to JSON with indentation
-	data, err := json.MarshalIndent(s.devices, "", "  ")
+	unlock, err := s.syncLocked(&changes)
 	if err != nil {
-		return fmt.Errorf("failed to marshal devices: %w", err)
-	}
-
-	// Write to file
-	if err := os.WriteFile(s.filePath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write store file: %w", err)
+		return err
 	}
+	defer unlock()
 
-	return nil
+	return s.writeLocked(true)
 }
 
 // dirPath returns the directory path from a file path.
@@ -110,6 +407,42 @@ func dirPath(path string) string {
 	return path[:idx]
 }
 
+// OnChange registers a callback invoked after every successful mutation.
+// Callbacks run after the store lock is released, so they may read the store.
+func (s *Store) OnChange(fn func(Change)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// OnMACChange registers a callback invoked after the primary MAC of a
+// device changes, by any update, so references to the device by MAC can be
+// updated. Callbacks run after the store lock is released.
+func (s *Store) OnMACChange(fn func(oldMAC, newMAC string)) {
+	s.OnChange(func(c Change) {
+		if c.Op == OpUpdate && c.Previous != nil && normalizeMAC(c.Previous.MAC) != normalizeMAC(c.Device.MAC) {
+			fn(c.Previous.MAC, c.Device.MAC)
+		}
+	})
+}
+
+// notify delivers changes to listeners (must be called without lock held).
+func (s *Store) notify(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	s.mu.RLock()
+	listeners := append([]func(Change){}, s.listeners...)
+	s.mu.RUnlock()
+
+	for _, c := range changes {
+		for _, fn := range listeners {
+			fn(c)
+		}
+	}
+}
+
 // List returns all devices.
 func (s *Store) List() []Device {
 	s.mu.RLock()
@@ -124,63 +457,257 @@ func (s *Store) List() []Device {
 
 // Add adds a new device to the store.
 func (s *Store) Add(device Device) error {
+	_, err := s.Create(device, Origin{})
+	return err
+}
+
+// Create adds a new device to the store, assigning it an ID, and returns
+// the stored device.
+func (s *Store) Create(device Device, origin Origin) (Device, error) {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Check for duplicate MAC
-	for _, d := range s.devices {
-		if d.MAC == device.MAC {
-			return fmt.Errorf("device with MAC %s already exists", device.MAC)
-		}
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return Device{}, err
+	}
+	defer unlock()
+
+	// Check for duplicate MACs
+	if err := s.checkMACsLocked(device, ""); err != nil {
+		return Device{}, err
 	}
 
 	// Add device
+	device.ID = newID()
+	device.Revision = 1
+	device.CreatedAt = time.Now().UTC()
+	device.UpdatedAt = device.CreatedAt
+	device.LastWokenAt = nil
 	s.devices = append(s.devices, &device)
 
 	// Save to file
-	if err := s.saveLocked(); err != nil {
+	change := Change{Op: OpAdd, Device: device, Origin: origin}
+	if err := s.commitLocked([]Change{change}); err != nil {
 		// Rollback on save error
 		s.devices = s.devices[:len(s.devices)-1]
-		return err
+		return Device{}, err
+	}
+
+	changes = append(changes, change)
+	return device, nil
+}
+
+// Get returns a device by ID.
+func (s *Store) Get(id string) (Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i := s.indexLocked(id); i >= 0 {
+		return *s.devices[i], nil
+	}
+	return Device{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+}
+
+// Replace replaces the device with the given ID, keeping the ID. The MAC
+// may change, as long as no other device has the new MAC. If
+// device.Revision is set, it must match the stored revision or
+// ErrConflict is returned.
+func (s *Store) Replace(id string, device Device, origin Origin) (Device, error) {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return Device{}, err
+	}
+	defer unlock()
+
+	i := s.indexLocked(id)
+	if i < 0 {
+		return Device{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return s.replaceLocked(i, device, origin, &changes)
+}
+
+// replaceLocked replaces the device at index i, keeping the timestamps
+// managed by the store (must be called with lock held).
+func (s *Store) replaceLocked(i int, device Device, origin Origin, changes *[]Change) (Device, error) {
+	previous := s.devices[i]
+	if err := checkRevision(previous, device.Revision); err != nil {
+		return Device{}, err
+	}
+	if err := s.checkMACsLocked(device, previous.ID); err != nil {
+		return Device{}, err
+	}
+
+	device.ID = previous.ID
+	device.Revision = previous.Revision + 1
+	device.CreatedAt = previous.CreatedAt
+	device.UpdatedAt = time.Now().UTC()
+	device.LastWokenAt = previous.LastWokenAt
+	s.devices[i] = &device
+
+	// Save to file
+	change := Change{Op: OpUpdate, Device: device, Previous: previous, Origin: origin}
+	if err := s.commitLocked([]Change{change}); err != nil {
+		// Rollback on save error
+		s.devices[i] = previous
+		return Device{}, err
+	}
+
+	*changes = append(*changes, change)
+	return device, nil
+}
+
+// Remove deletes the device with the given ID, moving it to the trash, and
+// returns it. If revision is set, it must match the stored revision or
+// ErrConflict is returned.
+func (s *Store) Remove(id string, revision int, origin Origin) (Device, error) {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return Device{}, err
+	}
+	defer unlock()
+
+	i := s.indexLocked(id)
+	if i < 0 {
+		return Device{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	removed := s.devices[i]
+	if err := checkRevision(removed, revision); err != nil {
+		return Device{}, err
+	}
+	oldDevices, oldTrash := s.devices, s.trash
+	s.devices = append(append([]*Device{}, oldDevices[:i]...), oldDevices[i+1:]...)
+	s.trash = s.trashLocked(removed)
+
+	// Save to file
+	change := Change{Op: OpDelete, Device: *removed, Origin: origin}
+	if err := s.commitLocked([]Change{change}); err != nil {
+		// Rollback on save error
+		s.devices, s.trash = oldDevices, oldTrash
+		return Device{}, err
+	}
+
+	changes = append(changes, change)
+	return *removed, nil
+}
+
+// checkRevision returns ErrConflict if revision is set and is not the
+// revision of d.
+func checkRevision(d *Device, revision int) error {
+	if revision != 0 && revision != d.Revision {
+		return fmt.Errorf("%w: revision %d, current revision %d", ErrConflict, revision, d.Revision)
+	}
+	return nil
+}
+
+// indexLocked returns the index of the device with the given ID, or -1
+// (must be called with lock held).
+func (s *Store) indexLocked(id string) int {
+	for i, d := range s.devices {
+		if d.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexByMACLocked returns the index of a device other than exceptID
+// with a MAC, primary or alias, matching mac in any notation, or -1 (must
+// be called with lock held).
+func (s *Store) indexByMACLocked(mac, exceptID string) int {
+	for i, d := range s.devices {
+		if d.ID != exceptID && d.HasMAC(mac) {
+			return i
+		}
 	}
+	return -1
+}
 
+// checkMACsLocked returns ErrDuplicate if device lists a MAC twice, or
+// shares one with a device other than exceptID (must be called with lock
+// held).
+func (s *Store) checkMACsLocked(device Device, exceptID string) error {
+	seen := make(map[string]bool)
+	for _, mac := range device.MACs() {
+		if seen[normalizeMAC(mac)] || s.indexByMACLocked(mac, exceptID) >= 0 {
+			return fmt.Errorf("%w: %s", ErrDuplicate, mac)
+		}
+		seen[normalizeMAC(mac)] = true
+	}
 	return nil
 }
 
-// Delete removes a device by MAC address.
+// normalizeMAC returns mac in canonical form, or unchanged if invalid.
+func normalizeMAC(mac string) string {
+	if n, err := wol.NormalizeMAC(mac); err == nil {
+		return n
+	}
+	return mac
+}
+
+// Delete removes a device by MAC address, moving it to the trash.
 func (s *Store) Delete(mac string) error {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Find and remove device
-	found := false
+	var removed *Device
 	newDevices := make([]*Device, 0, len(s.devices))
 	for _, d := range s.devices {
 		if d.MAC != mac {
 			newDevices = append(newDevices, d)
 		} else {
-			found = true
+			removed = d
 		}
 	}
 
-	if !found {
-		return fmt.Errorf("device with MAC %s not found", mac)
+	if removed == nil {
+		return fmt.Errorf("%w: MAC %s", ErrNotFound, mac)
 	}
 
-	oldDevices := s.devices
+	oldDevices, oldTrash := s.devices, s.trash
 	s.devices = newDevices
+	s.trash = s.trashLocked(removed)
 
 	// Save to file
-	if err := s.saveLocked(); err != nil {
+	change := Change{Op: OpDelete, Device: *removed}
+	if err := s.commitLocked([]Change{change}); err != nil {
 		// Rollback on save error
-		s.devices = oldDevices
+		s.devices, s.trash = oldDevices, oldTrash
 		return err
 	}
 
+	changes = append(changes, change)
 	return nil
 }
 
-// GetByMAC finds a device by MAC address.
+// GetByMAC finds a device by MAC address: its primary MAC, or else any of
+// its MACs in any notation.
 func (s *Store) GetByMAC(mac string) (*Device, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -192,8 +719,12 @@ func (s *Store) GetByMAC(mac string) (*Device, error) {
 			return &copy, nil
 		}
 	}
+	if i := s.indexByMACLocked(mac, ""); i >= 0 {
+		copy := *s.devices[i]
+		return &copy, nil
+	}
 
-	return nil, fmt.Errorf("device with MAC %s not found", mac)
+	return nil, fmt.Errorf("%w: MAC %s", ErrNotFound, mac)
 }
 
 // GetByGroup returns all devices in a group.
@@ -210,51 +741,64 @@ func (s *Store) GetByGroup(group string) []Device {
 	return result
 }
 
-// Groups returns all unique group names.
-func (s *Store) Groups() []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	groupMap := make(map[string]bool)
-	for _, d := range s.devices {
-		if d.Group != "" {
-			groupMap[d.Group] = true
-		}
-	}
-
-	groups := make([]string, 0, len(groupMap))
-	for g := range groupMap {
-		groups = append(groups, g)
-	}
-	return groups
-}
-
-// Update updates an existing device.
+// Update updates an existing device, keeping its MAC and timestamps. If
+// updated.Revision is set, it must match the stored revision or
+// ErrConflict is returned.
 func (s *Store) Update(mac string, updated Device) error {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Find and update device
-	found := false
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	for i, d := range s.devices {
 		if d.MAC == mac {
 			// Keep the original MAC
 			updated.MAC = mac
-			s.devices[i] = &updated
-			found = true
-			break
+			_, err := s.replaceLocked(i, updated, Origin{}, &changes)
+			return err
 		}
 	}
+	return fmt.Errorf("%w: MAC %s", ErrNotFound, mac)
+}
 
-	if !found {
-		return fmt.Errorf("device with MAC %s not found", mac)
-	}
+// MarkWoken records that the device with the given MAC was woken at t.
+// This is not a change of the device: its revision is kept, and neither
+// listeners nor the journal are told.
+func (s *Store) MarkWoken(mac string, t time.Time) error {
+	var changes []Change
+	defer func() { s.notify(changes) }()
 
-	// Save to file
-	if err := s.saveLocked(); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	i := s.indexByMACLocked(mac, "")
+	if i < 0 {
+		return fmt.Errorf("%w: MAC %s", ErrNotFound, mac)
+	}
 
+	previous := s.devices[i]
+	device := *previous
+	t = t.UTC()
+	device.LastWokenAt = &t
+	s.devices[i] = &device
+	if err := s.writeLocked(false); err != nil {
+		// Rollback on save error
+		s.devices[i] = previous
+		return err
+	}
 	return nil
 }
 
@@ -265,8 +809,11 @@ func (s *Store) Count() int {
 	return len(s.devices)
 }
 
-// saveLocked saves devices to file (must be called with lock held).
-func (s *Store) saveLocked() error {
+// writeLocked writes devices to file atomically, first copying the current
+// file to a backup if rotate is set. Devices in the trash past the
+// retention period are dropped, and groups devices refer to are created
+// (must be called with lock held).
+func (s *Store) writeLocked(rotate bool) error {
 	// Create directory if it doesn't exist
 	dir := dirPath(s.filePath)
 	if dir != "" {
@@ -276,15 +823,32 @@ func (s *Store) saveLocked() error {
 	}
 
 	// Marshal to JSON
-	data, err := json.MarshalIndent(s.devices, "", "  ")
+	s.trash = s.liveTrashLocked()
+	s.groups, _ = fillGroups(s.groups, s.devices)
+	doc := Document{Version: CurrentVersion, Revision: s.revision, Devices: s.devices, Groups: s.groups, Trash: s.trash}
+	data, err := json.MarshalIndent(doc, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal devices: %w", err)
 	}
 
-	// Write to file
-	if err := os.WriteFile(s.filePath, data, 0644); err != nil {
+	if rotate {
+		if err := atomicfile.Rotate(s.filePath, s.backups); err != nil {
+			return fmt.Errorf("failed to back up store file: %w", err)
+		}
+	}
+
+	// Write to a temp file and rename, so a crash never leaves a partial file
+	if err := atomicfile.WriteFile(s.filePath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write store file: %w", err)
 	}
 
+	s.seen = statFile(s.filePath)
 	return nil
 }
+
+// newID returns a random identifier.
+func newID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -2,10 +2,17 @@
 package store
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/atomicfile"
 )
 
 func TestNewStore(t *testing.T) {
@@ -300,3 +307,921 @@ func TestStore_InvalidJSON(t *testing.T) {
 		t.Error("NewStore() should return error for invalid JSON")
 	}
 }
+
+func TestStore_OnChange(t *testing.T) {
+	tmpDir := t.TempDir()
+	storePath := filepath.Join(tmpDir, "test.json")
+
+	store, _ := NewStore(storePath)
+
+	var changes []Change
+	store.OnChange(func(c Change) {
+		// Listeners run without the lock held and may read the store
+		store.Count()
+		changes = append(changes, c)
+	})
+
+	store.Add(Device{Name: "Old", MAC: "AA:BB:CC:DD:EE:FF"})
+	store.Update("AA:BB:CC:DD:EE:FF", Device{Name: "New"})
+	store.Delete("AA:BB:CC:DD:EE:FF")
+	store.Delete("AA:BB:CC:DD:EE:FF") // Not found, no change
+
+	if len(changes) != 3 {
+		t.Fatalf("Expected 3 changes, got %d", len(changes))
+	}
+	if changes[0].Op != OpAdd || changes[1].Op != OpUpdate || changes[2].Op != OpDelete {
+		t.Errorf("Unexpected change ops: %s, %s, %s", changes[0].Op, changes[1].Op, changes[2].Op)
+	}
+	if changes[1].Previous == nil || changes[1].Previous.Name != "Old" {
+		t.Error("Update change should include the previous device")
+	}
+}
+
+func TestStore_Backups(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+	store.SetBackups(2)
+
+	for _, mac := range []string{"AA:BB:CC:DD:EE:01", "AA:BB:CC:DD:EE:02", "AA:BB:CC:DD:EE:03"} {
+		if err := store.Add(Device{Name: "PC", MAC: mac}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	// The backups hold the two previous versions
+	for n, want := range map[int]int{1: 2, 2: 1} {
+		doc, _, _, err := readDevices(atomicfile.BackupPath(storePath, n))
+		if err != nil || len(doc.Devices) != want {
+			t.Errorf("Backup %d has %+v (err %v), want %d devices", n, doc, err, want)
+		}
+	}
+	if _, err := os.Stat(atomicfile.BackupPath(storePath, 3)); !os.IsNotExist(err) {
+		t.Error("Only 2 backups should be kept")
+	}
+}
+
+func TestStore_RecoverFromBackup(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+	store.Add(Device{Name: "PC1", MAC: "AA:BB:CC:DD:EE:01"})
+	store.Add(Device{Name: "PC2", MAC: "AA:BB:CC:DD:EE:02"})
+
+	// Simulate a write cut short by a power loss
+	os.WriteFile(storePath, []byte(`[{"name":"PC1","mac":"AA:BB`), 0644)
+
+	recovered, err := NewStore(storePath)
+	if err != nil {
+		t.Fatalf("NewStore() should recover from a backup, got %v", err)
+	}
+	r := recovered.Recovered()
+	if r == nil || r.Backup != atomicfile.BackupPath(storePath, 1) || !errors.Is(r.Err, ErrCorrupt) {
+		t.Fatalf("Unexpected recovery: %+v", r)
+	}
+	if recovered.Count() != 1 {
+		t.Errorf("Expected the 1 device of the newest backup, got %d", recovered.Count())
+	}
+	if data, _ := os.ReadFile(r.Corrupt); !strings.Contains(string(data), "AA:BB") {
+		t.Error("The corrupt file should be kept")
+	}
+
+	// The recovered devices were written back
+	reloaded, err := NewStore(storePath)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	if reloaded.Recovered() != nil || reloaded.Count() != 1 {
+		t.Errorf("Reload after recovery: count %d, recovery %+v", reloaded.Count(), reloaded.Recovered())
+	}
+}
+
+func TestStore_TruncatedWithBackups(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+	store.Add(Device{Name: "PC1", MAC: "AA:BB:CC:DD:EE:01"})
+	store.Add(Device{Name: "PC2", MAC: "AA:BB:CC:DD:EE:02"})
+
+	os.WriteFile(storePath, nil, 0644)
+
+	recovered, err := NewStore(storePath)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	if recovered.Recovered() == nil || recovered.Count() != 1 {
+		t.Errorf("An empty file with backups should be recovered, got %d devices", recovered.Count())
+	}
+}
+
+func TestStore_MigrateLegacy(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	legacy := `[{"name":"PC","mac":"AA:BB:CC:DD:EE:FF","group":"Office"}]`
+	os.WriteFile(storePath, []byte(legacy), 0644)
+
+	pending, version, err := Pending(storePath)
+	if err != nil || version != 1 || len(pending) != CurrentVersion-1 || pending[len(pending)-1].To != CurrentVersion {
+		t.Fatalf("Pending() = %+v, %d, %v", pending, version, err)
+	}
+
+	store, err := NewStore(storePath)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	if store.Count() != 1 || store.GetByGroup("Office") == nil {
+		t.Errorf("Legacy devices not loaded")
+	}
+	if store.List()[0].ID == "" {
+		t.Error("Migrated devices should be assigned an ID")
+	}
+
+	m := store.Migrated()
+	if m == nil || m.From != 1 || m.To != CurrentVersion {
+		t.Fatalf("Unexpected migration result: %+v", m)
+	}
+	if data, _ := os.ReadFile(m.Backup); string(data) != legacy {
+		t.Error("The original file should be kept before migrating")
+	}
+
+	// The file is now a versioned document
+	var doc Document
+	data, _ := os.ReadFile(storePath)
+	if err := json.Unmarshal(data, &doc); err != nil || doc.Version != CurrentVersion || len(doc.Devices) != 1 || doc.Devices[0].ID == "" {
+		t.Errorf("Unexpected document after migration: %s", data)
+	}
+	if pending, _, _ := Pending(storePath); len(pending) != 0 {
+		t.Errorf("No migrations should be pending, got %+v", pending)
+	}
+}
+
+func TestStore_NewerVersion(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+	store.Add(Device{Name: "PC1", MAC: "AA:BB:CC:DD:EE:01"})
+	store.Add(Device{Name: "PC2", MAC: "AA:BB:CC:DD:EE:02"})
+
+	// A file from a newer build must not be replaced by a backup
+	os.WriteFile(storePath, []byte(`{"version": 99, "devices": []}`), 0644)
+	if _, err := NewStore(storePath); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("NewStore() error = %v, want ErrUnsupportedVersion", err)
+	}
+	if _, _, err := Pending(storePath); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Pending() error = %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestStore_DeviceIDs(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+
+	pc, err := store.Create(Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, Origin{})
+	if err != nil || pc.ID == "" {
+		t.Fatalf("Create() = %+v, %v", pc, err)
+	}
+	nas, _ := store.Create(Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}, Origin{})
+
+	// Duplicates are detected in any MAC notation
+	if _, err := store.Create(Device{Name: "Dup", MAC: "aa-bb-cc-dd-ee-01"}, Origin{}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Create() error = %v, want ErrDuplicate", err)
+	}
+
+	// The MAC can change, but not to one used by another device
+	renamed, err := store.Replace(pc.ID, Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:03"}, Origin{})
+	if err != nil || renamed.ID != pc.ID {
+		t.Fatalf("Replace() = %+v, %v", renamed, err)
+	}
+	if _, err := store.Replace(pc.ID, Device{Name: "PC", MAC: nas.MAC}, Origin{}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Replace() error = %v, want ErrDuplicate", err)
+	}
+	if _, err := store.GetByMAC("AA:BB:CC:DD:EE:01"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("The old MAC should be gone, got %v", err)
+	}
+
+	// IDs survive a reload
+	reloaded, _ := NewStore(storePath)
+	if got, err := reloaded.Get(pc.ID); err != nil || got.MAC != "AA:BB:CC:DD:EE:03" {
+		t.Errorf("Get() = %+v, %v", got, err)
+	}
+
+	if _, err := reloaded.Remove(nas.ID, 0, Origin{}); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := reloaded.Get(nas.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() error = %v, want ErrNotFound", err)
+	}
+	if _, err := reloaded.Remove("missing", 0, Origin{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Remove() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestStore_Revisions(t *testing.T) {
+	store, _ := NewStore(filepath.Join(t.TempDir(), "test.json"))
+
+	pc, _ := store.Create(Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, Origin{})
+	if pc.Revision != 1 {
+		t.Fatalf("New device revision = %d, want 1", pc.Revision)
+	}
+
+	pc.Name = "Desktop"
+	updated, err := store.Replace(pc.ID, pc, Origin{})
+	if err != nil || updated.Revision != 2 {
+		t.Fatalf("Replace() = %+v, %v", updated, err)
+	}
+
+	// A second edit based on the first revision loses
+	pc.Name = "Laptop"
+	if _, err := store.Replace(pc.ID, pc, Origin{}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Replace() error = %v, want ErrConflict", err)
+	}
+	if err := store.Update(pc.MAC, pc); !errors.Is(err, ErrConflict) {
+		t.Errorf("Update() error = %v, want ErrConflict", err)
+	}
+	if _, err := store.Remove(pc.ID, 1, Origin{}); !errors.Is(err, ErrConflict) {
+		t.Errorf("Remove() error = %v, want ErrConflict", err)
+	}
+	if got, _ := store.Get(pc.ID); got.Name != "Desktop" {
+		t.Errorf("Conflicting edits should not be applied, got %q", got.Name)
+	}
+
+	if _, err := store.Remove(pc.ID, 2, Origin{}); err != nil {
+		t.Errorf("Remove() error = %v", err)
+	}
+}
+
+func TestStore_Reload(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+	pc, _ := store.Create(Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, Origin{})
+	nas, _ := store.Create(Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}, Origin{})
+
+	var results []ReloadResult
+	store.OnReload(func(r ReloadResult) { results = append(results, r) })
+	var changes []Change
+	store.OnChange(func(c Change) { changes = append(changes, c) })
+
+	if store.Changed() {
+		t.Fatal("The store's own writes should not count as changes")
+	}
+
+	// Rename PC by hand without bumping its revision, drop the NAS and add
+	// a device without an ID
+	edited := `{"version": 8, "devices": [
+		{"id": "` + pc.ID + `", "revision": 1, "name": "Desktop", "mac": "AA:BB:CC:DD:EE:01"},
+		{"name": "Laptop", "mac": "AA:BB:CC:DD:EE:03"}
+	]}`
+	os.WriteFile(storePath, []byte(edited), 0644)
+	if !store.Changed() {
+		t.Fatal("Changed() should detect the external edit")
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if len(results) != 1 || results[0].Added != 1 || results[0].Updated != 1 || results[0].Deleted != 1 {
+		t.Errorf("Unexpected reload result: %+v", results)
+	}
+	if len(changes) != 3 {
+		t.Errorf("Expected 3 changes, got %+v", changes)
+	}
+	if got, _ := store.Get(pc.ID); got.Name != "Desktop" || got.Revision != 2 {
+		t.Errorf("Edited device = %+v, want Desktop at revision 2", got)
+	}
+	if _, err := store.Get(nas.ID); !errors.Is(err, ErrNotFound) {
+		t.Error("Removed device should be gone")
+	}
+	if laptop, err := store.GetByMAC("AA:BB:CC:DD:EE:03"); err != nil || laptop.ID == "" {
+		t.Errorf("Added device should get an ID, got %+v, %v", laptop, err)
+	}
+	if entries, _ := store.Journal(); entries[len(entries)-1].Source != SourceFile || store.Revision() != 3 {
+		t.Errorf("The hand edit should be journaled as revision 3, got %+v", entries[len(entries)-1])
+	}
+
+	// A broken file keeps the last good data and is not overwritten
+	os.WriteFile(storePath, []byte(`{"version": 8, "devices": [`), 0644)
+	if err := store.Reload(); err == nil {
+		t.Error("Reload() of an invalid file should fail")
+	}
+	if store.Count() != 2 {
+		t.Errorf("Expected the last good 2 devices, got %d", store.Count())
+	}
+	if _, err := store.Create(Device{Name: "TV", MAC: "AA:BB:CC:DD:EE:04"}, Origin{}); !errors.Is(err, ErrModified) {
+		t.Errorf("Create() error = %v, want ErrModified", err)
+	}
+	if data, _ := os.ReadFile(storePath); string(data) != `{"version": 8, "devices": [` {
+		t.Error("The externally edited file should not be overwritten")
+	}
+	if store.Changed() {
+		t.Error("A failed reload should not be retried until the file changes again")
+	}
+
+	// Once fixed, it loads and writes succeed again
+	os.WriteFile(storePath, []byte(`{"version": 8, "devices": []}`), 0644)
+	if err := store.Reload(); err != nil || store.Count() != 0 {
+		t.Fatalf("Reload() = %v with %d devices", err, store.Count())
+	}
+	if _, err := store.Create(Device{Name: "TV", MAC: "AA:BB:CC:DD:EE:04"}, Origin{}); err != nil {
+		t.Errorf("Create() error = %v", err)
+	}
+}
+
+func TestStore_SharedFile(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+
+	// Two stores on one file stand in for two processes
+	a, _ := NewStore(storePath)
+	b, _ := NewStore(storePath)
+
+	pc, err := a.Create(Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, Origin{})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := b.Create(Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}, Origin{}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := b.Create(Device{Name: "Dup", MAC: pc.MAC}, Origin{}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Create() should see the other writer's device, got %v", err)
+	}
+
+	// Each writer sees the other's changes before applying its own
+	if _, err := a.Remove(pc.ID, 0, Origin{}); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if a.Count() != 1 || b.Count() != 2 {
+		t.Errorf("Counts = %d, %d, want 1, 2", a.Count(), b.Count())
+	}
+
+	// Interleaved writers never lose each other's updates
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		s := a
+		if i%2 == 1 {
+			s = b
+		}
+		wg.Add(1)
+		go func(s *Store, i int) {
+			defer wg.Done()
+			mac := fmt.Sprintf("AA:BB:CC:DD:FF:%02X", i)
+			if _, err := s.Create(Device{Name: "Host", MAC: mac}, Origin{}); err != nil {
+				t.Errorf("Create(%s) error = %v", mac, err)
+			}
+		}(s, i)
+	}
+	wg.Wait()
+
+	reloaded, _ := NewStore(storePath)
+	if reloaded.Count() != 21 {
+		t.Errorf("Expected 21 devices in the file, got %d", reloaded.Count())
+	}
+	if _, err := os.Stat(LockPath(storePath)); err != nil {
+		t.Errorf("Lock file should exist: %v", err)
+	}
+}
+
+func TestStore_JournalRestore(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+	origin := Origin{Source: SourceAPI, Actor: "192.168.1.10"}
+
+	pc, _ := store.Create(Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, origin)
+	nas, _ := store.Create(Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}, origin)
+	good := store.Revision()
+
+	// Rename one device, delete the other, add a third
+	pc.Name = "Renamed"
+	store.Replace(pc.ID, pc, origin)
+	store.Remove(nas.ID, 0, origin)
+	store.Create(Device{Name: "TV", MAC: "AA:BB:CC:DD:EE:03"}, origin)
+
+	entries, err := store.Journal()
+	if err != nil || len(entries) != 5 || store.Revision() != 5 {
+		t.Fatalf("Journal() = %d entries at revision %d, %v", len(entries), store.Revision(), err)
+	}
+	if e := entries[3]; e.Op != OpDelete || e.Before == nil || e.Before.Name != "NAS" || e.Actor != "192.168.1.10" {
+		t.Errorf("Unexpected delete entry: %+v", e)
+	}
+
+	changes, err := store.Restore(good, Origin{Source: SourceRestore})
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("Restore() = %d changes, %v", len(changes), err)
+	}
+	names := map[string]bool{}
+	for _, d := range store.List() {
+		names[d.Name] = true
+	}
+	if len(names) != 2 || !names["PC"] || !names["NAS"] {
+		t.Errorf("Devices after restore = %v, want PC and NAS", names)
+	}
+	if d, err := store.Get(nas.ID); err != nil || d.Revision <= nas.Revision {
+		t.Errorf("Restored device should keep its ID with a new revision, got %+v, %v", d, err)
+	}
+
+	// The restore is itself a revision, so it can be undone
+	if _, err := store.Restore(5, Origin{Source: SourceRestore}); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if store.Count() != 2 || store.GetByGroup("")[0].Name != "Renamed" {
+		t.Errorf("Undoing the restore should bring back the later state, got %+v", store.List())
+	}
+
+	if _, err := store.Restore(99, Origin{}); !errors.Is(err, ErrRevisionUnavailable) {
+		t.Errorf("Restore(99) error = %v, want ErrRevisionUnavailable", err)
+	}
+
+	// The revision survives a reload
+	if reloaded, _ := NewStore(storePath); reloaded.Revision() != 7 {
+		t.Errorf("Reloaded revision = %d, want 7", reloaded.Revision())
+	}
+}
+
+func TestStore_JournalTrim(t *testing.T) {
+	store, _ := NewStore(filepath.Join(t.TempDir(), "test.json"))
+	store.SetJournal(4)
+
+	for i := 0; i < 10; i++ {
+		store.Create(Device{Name: "Host", MAC: fmt.Sprintf("AA:BB:CC:DD:EE:%02X", i)}, Origin{})
+	}
+
+	entries, _ := store.Journal()
+	if len(entries) > 5 || entries[len(entries)-1].Revision != 10 {
+		t.Fatalf("Journal should be trimmed to about 4 entries, got %d", len(entries))
+	}
+	oldest := entries[0].Revision - 1
+	if _, err := store.Restore(oldest-1, Origin{}); !errors.Is(err, ErrRevisionUnavailable) {
+		t.Errorf("Restoring past the journal should fail, got %v", err)
+	}
+	if _, err := store.Restore(oldest, Origin{}); err != nil {
+		t.Errorf("Restore(%d) error = %v", oldest, err)
+	}
+}
+
+func TestStore_Trash(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+
+	pc, _ := store.Create(Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, Origin{})
+	store.Create(Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}, Origin{})
+	store.Remove(pc.ID, 0, Origin{})
+	store.Delete("AA:BB:CC:DD:EE:02")
+
+	trash := store.Trash()
+	if len(trash) != 2 || trash[0].Name != "NAS" || trash[1].ID != pc.ID || trash[1].DeletedAt.IsZero() {
+		t.Fatalf("Trash() = %+v", trash)
+	}
+
+	// The trash survives a restart
+	reopened, _ := NewStore(storePath)
+	if len(reopened.Trash()) != 2 {
+		t.Fatalf("Expected 2 devices in trash after reload, got %d", len(reopened.Trash()))
+	}
+
+	restored, err := reopened.Undelete(pc.ID, Origin{})
+	if err != nil || restored.ID != pc.ID || restored.Revision != pc.Revision+1 {
+		t.Fatalf("Undelete() = %+v, %v", restored, err)
+	}
+	if reopened.Count() != 1 || len(reopened.Trash()) != 1 {
+		t.Errorf("Expected 1 device and 1 in trash, got %d and %d", reopened.Count(), len(reopened.Trash()))
+	}
+	if _, err := reopened.Undelete(pc.ID, Origin{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Undelete() twice error = %v, want ErrNotFound", err)
+	}
+
+	// A device whose MAC has been taken again cannot come back
+	nas := reopened.Trash()[0]
+	reopened.Create(Device{Name: "New NAS", MAC: "aa:bb:cc:dd:ee:02"}, Origin{})
+	if _, err := reopened.Undelete(nas.ID, Origin{}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Undelete() error = %v, want ErrDuplicate", err)
+	}
+
+	if err := reopened.Purge(nas.ID); err != nil || len(reopened.Trash()) != 0 {
+		t.Errorf("Purge() = %v, %d left in trash", err, len(reopened.Trash()))
+	}
+	if err := reopened.Purge(nas.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Purge() twice error = %v, want ErrNotFound", err)
+	}
+
+	// Without retention, devices are deleted permanently
+	reopened.SetRetention(0)
+	reopened.Remove(pc.ID, 0, Origin{})
+	if len(reopened.Trash()) != 0 {
+		t.Errorf("Expected an empty trash without retention, got %d", len(reopened.Trash()))
+	}
+}
+
+func TestStore_DeviceMetadata(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+
+	pc, _ := store.Create(Device{
+		Name: "PC",
+		MAC:  "AA:BB:CC:DD:EE:01",
+		IP:   "192.168.1.10",
+		Tags: []string{"work"},
+		Wake: &WakeSettings{Iface: "eth1", Port: 7, Transport: TransportUnicast},
+	}, Origin{})
+	if pc.CreatedAt.IsZero() || !pc.UpdatedAt.Equal(pc.CreatedAt) {
+		t.Fatalf("Create() timestamps = %v, %v", pc.CreatedAt, pc.UpdatedAt)
+	}
+	if target := pc.WakeTarget(pc.MAC); target.Iface != "eth1" || target.Address != "192.168.1.10" || target.Port != 7 {
+		t.Errorf("WakeTarget() = %+v", target)
+	}
+	if !pc.HasTag("WORK") || pc.HasTag("home") {
+		t.Errorf("HasTag() on %v", pc.Tags)
+	}
+
+	// Waking a device does not change its revision
+	woken := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := store.MarkWoken("aa:bb:cc:dd:ee:01", woken); err != nil {
+		t.Fatalf("MarkWoken() error = %v", err)
+	}
+	got, _ := store.Get(pc.ID)
+	if got.LastWokenAt == nil || !got.LastWokenAt.Equal(woken) || got.Revision != pc.Revision {
+		t.Errorf("After MarkWoken() = %+v", got)
+	}
+
+	// Updates keep the timestamps the store manages
+	if err := store.Update(pc.MAC, Device{Name: "Renamed", CreatedAt: woken}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	reopened, _ := NewStore(storePath)
+	got, _ = reopened.Get(pc.ID)
+	if !got.CreatedAt.Equal(pc.CreatedAt) || got.UpdatedAt.Before(pc.UpdatedAt) || got.LastWokenAt == nil {
+		t.Errorf("After Update() = %+v", got)
+	}
+}
+
+func TestStore_MACAliases(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+
+	laptop, err := store.Create(Device{
+		Name:    "Laptop",
+		MAC:     "AA:BB:CC:DD:EE:01",
+		IP:      "192.168.1.10",
+		Aliases: []MACAlias{{MAC: "AA:BB:CC:DD:EE:02", Name: "wifi", Broadcast: "192.168.2.255"}},
+		Wake:    &WakeSettings{Port: 7, Transport: TransportUnicast},
+	}, Origin{})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	// MACs are unique across primaries and aliases, in any notation
+	if _, err := store.Create(Device{Name: "Dock", MAC: "aa-bb-cc-dd-ee-02"}, Origin{}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Create() with an alias MAC error = %v, want ErrDuplicate", err)
+	}
+	if _, err := store.Create(Device{Name: "Server", MAC: "AA:BB:CC:DD:EE:03", Aliases: []MACAlias{{MAC: "AA:BB:CC:DD:EE:01"}}}, Origin{}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Create() with a taken alias error = %v, want ErrDuplicate", err)
+	}
+	if _, err := store.Create(Device{Name: "Server", MAC: "AA:BB:CC:DD:EE:03", Aliases: []MACAlias{{MAC: "aa:bb:cc:dd:ee:03"}}}, Origin{}); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Create() with its own MAC as alias error = %v, want ErrDuplicate", err)
+	}
+
+	if d, err := store.GetByMAC("aa:bb:cc:dd:ee:02"); err != nil || d.ID != laptop.ID {
+		t.Errorf("GetByMAC() by alias = %+v, %v", d, err)
+	}
+	if got := laptop.MACs(); len(got) != 2 || got[0] != laptop.MAC {
+		t.Errorf("MACs() = %v", got)
+	}
+
+	// Aliases use their own broadcast address, and only the primary MAC is
+	// woken by unicast to the device IP
+	if target := laptop.WakeTarget("AA:BB:CC:DD:EE:02"); target.Address != "192.168.2.255" || target.Port != 7 {
+		t.Errorf("WakeTarget(alias) = %+v", target)
+	}
+	if target := laptop.WakeTarget(laptop.MAC); target.Address != "192.168.1.10" {
+		t.Errorf("WakeTarget(primary) = %+v", target)
+	}
+}
+
+func TestStore_OnMACChange(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "test.json"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+
+	var changed []string
+	store.OnMACChange(func(oldMAC, newMAC string) {
+		changed = append(changed, oldMAC+"->"+newMAC)
+	})
+
+	pc, _ := store.Create(Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, Origin{})
+	pc.Name = "Desktop"
+	pc.MAC = "aa-bb-cc-dd-ee-01"
+	if pc, err = store.Replace(pc.ID, pc, Origin{}); err != nil {
+		t.Fatalf("Replace() error = %v", err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("OnMACChange calls for the same MAC = %v", changed)
+	}
+
+	pc.MAC = "AA:BB:CC:DD:EE:02"
+	if _, err := store.Replace(pc.ID, pc, Origin{}); err != nil {
+		t.Fatalf("Replace() error = %v", err)
+	}
+	if len(changed) != 1 || changed[0] != "aa-bb-cc-dd-ee-01->AA:BB:CC:DD:EE:02" {
+		t.Errorf("OnMACChange calls = %v", changed)
+	}
+}
+
+func TestStore_GroupEntities(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "test.json")
+	store, _ := NewStore(storePath)
+
+	var renamed []string
+	store.OnGroupRename(func(oldName, newName string) {
+		renamed = append(renamed, oldName+"->"+newName)
+	})
+
+	d1, _ := store.Create(Device{Name: "D1", MAC: "AA:BB:CC:DD:EE:01", Group: "Office"}, Origin{})
+	store.Create(Device{Name: "D2", MAC: "AA:BB:CC:DD:EE:02", Group: "Office"}, Origin{})
+	d3, _ := store.Create(Device{Name: "D3", MAC: "AA:BB:CC:DD:EE:03"}, Origin{})
+
+	// Groups referenced by devices are created automatically
+	office, err := store.GroupByName("Office")
+	if err != nil || office.ID == "" || office.Revision != 1 {
+		t.Fatalf("GroupByName() = %+v, %v", office, err)
+	}
+	lab, err := store.CreateGroup(Group{Name: "Lab", Order: -1, Wake: &GroupWake{Broadcast: "10.0.0.255", Stagger: 500}})
+	if err != nil {
+		t.Fatalf("CreateGroup() error = %v", err)
+	}
+	if _, err := store.CreateGroup(Group{Name: "Lab"}); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("CreateGroup() duplicate error = %v, want ErrGroupExists", err)
+	}
+	if got := store.Groups(); len(got) != 2 || got[0] != "Lab" || got[1] != "Office" {
+		t.Errorf("Groups() = %v, want in order", got)
+	}
+
+	// Group defaults fill in what the device leaves unset
+	if target := lab.WakeDefaults(d3.WakeTarget(d3.MAC)); target.Address != "10.0.0.255" {
+		t.Errorf("WakeDefaults() = %+v", target)
+	}
+	if lab.StaggerDelay() != 500*time.Millisecond {
+		t.Errorf("StaggerDelay() = %v", lab.StaggerDelay())
+	}
+
+	// Renaming moves every member as one revision
+	revision := store.Revision()
+	office.Name = "Work"
+	if _, err := store.UpdateGroup(office.ID, office, Origin{}); err != nil {
+		t.Fatalf("UpdateGroup() error = %v", err)
+	}
+	if got := store.GetByGroup("Work"); len(got) != 2 {
+		t.Errorf("GetByGroup(Work) = %d devices, want 2", len(got))
+	}
+	if store.Revision() != revision+1 {
+		t.Errorf("Revision() = %d, want %d", store.Revision(), revision+1)
+	}
+	if len(renamed) != 1 || renamed[0] != "Office->Work" {
+		t.Errorf("OnGroupRename calls = %v", renamed)
+	}
+	if _, err := store.UpdateGroup(office.ID, Group{Name: "Lab"}, Origin{}); !errors.Is(err, ErrGroupExists) {
+		t.Errorf("UpdateGroup() to a taken name error = %v, want ErrGroupExists", err)
+	}
+
+	// Setting members moves devices in and out of the group
+	if _, err := store.SetGroupMembers(lab.ID, []string{d1.ID, d3.ID}, Origin{}); err != nil {
+		t.Fatalf("SetGroupMembers() error = %v", err)
+	}
+	if got := store.GetByGroup("Lab"); len(got) != 2 {
+		t.Errorf("GetByGroup(Lab) = %d devices, want 2", len(got))
+	}
+	if _, err := store.SetGroupMembers(lab.ID, []string{"missing"}, Origin{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetGroupMembers() with an unknown device error = %v, want ErrNotFound", err)
+	}
+
+	// Deleting keeps the members, without a group
+	if err := store.DeleteGroup(lab.ID, Origin{}); err != nil {
+		t.Fatalf("DeleteGroup() error = %v", err)
+	}
+	if d, _ := store.Get(d1.ID); d.Group != "" {
+		t.Errorf("Group after DeleteGroup() = %q, want none", d.Group)
+	}
+	if _, err := store.GetGroup(lab.ID); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("GetGroup() after delete error = %v, want ErrGroupNotFound", err)
+	}
+
+	// Groups survive a reload
+	reopened, err := NewStore(storePath)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	if g, err := reopened.GroupByName("Work"); err != nil || g.ID != office.ID {
+		t.Errorf("GroupByName() after reopen = %+v, %v", g, err)
+	}
+}
+
+func TestStore_Find(t *testing.T) {
+	store, _ := NewStore(filepath.Join(t.TempDir(), "test.json"))
+
+	for i, d := range []Device{
+		{Name: "web-2", MAC: "AA:BB:CC:DD:EE:05", IP: "10.0.0.20", Group: "Servers", Tags: []string{"prod"}},
+		{Name: "Desk", MAC: "AA:BB:CC:DD:EE:01", IP: "10.0.0.3", Hostname: "desk.lan"},
+		{Name: "web-1", MAC: "AA:BB:CC:DD:EE:04", IP: "10.0.0.100", Group: "Servers", Tags: []string{"prod", "web"}},
+		{Name: "nas", MAC: "AA:BB:CC:DD:EE:02", IP: "10.0.0.9", Group: "Servers"},
+		{Name: "TV", MAC: "AA:BB:CC:DD:EE:03"},
+	} {
+		if _, err := store.Create(d, Origin{}); err != nil {
+			t.Fatalf("Create(%d) error = %v", i, err)
+		}
+	}
+	names := func(p Page) string {
+		var s []string
+		for _, d := range p.Devices {
+			s = append(s, d.Name)
+		}
+		return strings.Join(s, ",")
+	}
+
+	tests := []struct {
+		query Query
+		want  string
+	}{
+		{Query{}, "web-2,Desk,web-1,nas,TV"},
+		{Query{Search: "DESK.lan"}, "Desk"},
+		{Query{Search: "ee:04"}, "web-1"},
+		{Query{Group: "Servers", Tags: []string{"PROD"}}, "web-2,web-1"},
+		{Query{Sort: "name"}, "Desk,nas,TV,web-1,web-2"},
+		{Query{Sort: "-mac"}, "web-2,web-1,TV,nas,Desk"},
+		{Query{Sort: "ip"}, "TV,Desk,nas,web-2,web-1"},
+		{Query{Sort: "name", Offset: 1, Limit: 2}, "nas,TV"},
+		{Query{Sort: "name", Offset: 9}, ""},
+	}
+	for _, tt := range tests {
+		page, err := store.Find(tt.query)
+		if err != nil {
+			t.Fatalf("Find(%+v) error = %v", tt.query, err)
+		}
+		if got := names(page); got != tt.want {
+			t.Errorf("Find(%+v) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	online := true
+	page, _ := store.Find(Query{Online: &online, IsOnline: func(mac string) bool { return mac == "AA:BB:CC:DD:EE:03" }})
+	if names(page) != "TV" || page.Total != 1 {
+		t.Errorf("Find(online) = %s, total %d", names(page), page.Total)
+	}
+
+	// Cursors page through without repeats, even when devices are added
+	page, _ = store.Find(Query{Sort: "-name", Limit: 2})
+	if names(page) != "web-2,web-1" || page.Total != 5 || page.Next == "" {
+		t.Fatalf("First page = %s, total %d, next %q", names(page), page.Total, page.Next)
+	}
+	store.Create(Device{Name: "zeta", MAC: "AA:BB:CC:DD:EE:06"}, Origin{})
+	page, _ = store.Find(Query{Sort: "-name", Limit: 2, Cursor: page.Next})
+	if names(page) != "TV,nas" {
+		t.Errorf("Second page = %s, want TV,nas", names(page))
+	}
+	page, _ = store.Find(Query{Sort: "-name", Limit: 2, Cursor: page.Next})
+	if names(page) != "Desk" || page.Next != "" {
+		t.Errorf("Last page = %s, next %q", names(page), page.Next)
+	}
+
+	if _, err := store.Find(Query{Sort: "color"}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Find() with an unknown field error = %v, want ErrInvalidQuery", err)
+	}
+	first, _ := store.Find(Query{Sort: "name", Limit: 1})
+	if _, err := store.Find(Query{Sort: "mac", Cursor: first.Next}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Find() with another query's cursor error = %v, want ErrInvalidQuery", err)
+	}
+}
+
+func TestStore_Reconcile(t *testing.T) {
+	store, _ := NewStore(filepath.Join(t.TempDir(), "test.json"))
+	manual, _ := store.Create(Device{Name: "Manual", MAC: "AA:BB:CC:DD:EE:09"}, Origin{})
+	existing, _ := store.Create(Device{Name: "Old NAS", MAC: "AA:BB:CC:DD:EE:02"}, Origin{})
+
+	declared := []Device{
+		{Name: "PC", MAC: "aa:bb:cc:dd:ee:01"},
+		{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02", Group: "Storage"},
+	}
+
+	// Seeding adds only what is missing
+	changes, err := store.Reconcile(declared, PolicySeed)
+	if err != nil || len(changes) != 1 || changes[0].Op != OpAdd || changes[0].Device.Managed {
+		t.Fatalf("Reconcile(seed) = %+v, %v", changes, err)
+	}
+	if d, _ := store.Get(existing.ID); d.Name != "Old NAS" {
+		t.Errorf("Seeding changed an existing device: %+v", d)
+	}
+	if changes, _ := store.Reconcile(declared, PolicySeed); len(changes) != 0 {
+		t.Errorf("Reconcile(seed) again = %+v, want no changes", changes)
+	}
+
+	// Authoritative overwrites and marks the declared devices
+	changes, err = store.Reconcile(declared, PolicyAuthoritative)
+	if err != nil || len(changes) != 2 {
+		t.Fatalf("Reconcile(authoritative) = %+v, %v", changes, err)
+	}
+	nas, _ := store.Get(existing.ID)
+	if nas.Name != "NAS" || nas.Group != "Storage" || !nas.Managed || nas.CreatedAt != existing.CreatedAt {
+		t.Errorf("Reconciled device = %+v", nas)
+	}
+	if changes, _ := store.Reconcile(declared, PolicyAuthoritative); len(changes) != 0 {
+		t.Errorf("Reconcile(authoritative) again = %+v, want no changes", changes)
+	}
+
+	// Managed devices are kept in their group
+	group, _ := store.GroupByName("Storage")
+	store.DeleteGroup(group.ID, Origin{})
+	if d, _ := store.Get(nas.ID); d.Group != "Storage" {
+		t.Errorf("Group of a managed device after DeleteGroup() = %q", d.Group)
+	}
+
+	// Managed devices no longer declared are deleted; others are kept
+	changes, err = store.Reconcile(declared[1:], PolicyAuthoritative)
+	if err != nil || len(changes) != 1 || changes[0].Op != OpDelete || changes[0].Device.Name != "PC" {
+		t.Fatalf("Reconcile(authoritative) after removal = %+v, %v", changes, err)
+	}
+	if _, err := store.Get(manual.ID); err != nil {
+		t.Errorf("Device added by hand was deleted: %v", err)
+	}
+
+	// Seeding releases managed devices
+	if changes, _ := store.Reconcile(nil, PolicySeed); len(changes) != 1 || changes[0].Device.Managed {
+		t.Errorf("Reconcile(seed) release = %+v", changes)
+	}
+
+	invalid := [][]Device{
+		{{Name: "Bad", MAC: "not-a-mac"}},
+		{{MAC: "AA:BB:CC:DD:EE:03"}},
+		{{Name: "A", MAC: "AA:BB:CC:DD:EE:03"}, {Name: "B", MAC: "aa-bb-cc-dd-ee-03"}},
+		{{Name: "Clash", MAC: "AA:BB:CC:DD:EE:04", Aliases: []MACAlias{{MAC: "AA:BB:CC:DD:EE:09"}}}},
+	}
+	for _, devices := range invalid {
+		if _, err := store.Reconcile(devices, PolicyAuthoritative); err == nil {
+			t.Errorf("Reconcile(%+v) succeeded, want error", devices)
+		}
+	}
+	if _, err := store.Reconcile(declared, "merge"); !errors.Is(err, ErrInvalidPolicy) {
+		t.Errorf("Reconcile() with an unknown policy error = %v, want ErrInvalidPolicy", err)
+	}
+}
+
+func TestStore_Import(t *testing.T) {
+	store, _ := NewStore(filepath.Join(t.TempDir(), "test.json"))
+	pc, _ := store.Create(Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01", Notes: "desk"}, Origin{})
+
+	items := []ImportItem{
+		{Device: Device{Name: "Desktop", MAC: "aa:bb:cc:dd:ee:01"}, Fields: []string{"name", "mac"}},
+		{Device: Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}},
+	}
+
+	// Dry runs change nothing
+	revision := store.Revision()
+	outcomes, err := store.Import(items, ImportOptions{Mode: ConflictMerge, DryRun: true})
+	if err != nil || len(outcomes) != 2 || outcomes[0].Op != OpUpdate || outcomes[1].Op != OpAdd {
+		t.Fatalf("Import(dry run) = %+v, %v", outcomes, err)
+	}
+	if store.Count() != 1 || store.Revision() != revision {
+		t.Errorf("Dry run changed the store: %d devices, revision %d", store.Count(), store.Revision())
+	}
+
+	// Skip keeps existing devices
+	outcomes, err = store.Import(items, ImportOptions{})
+	if err != nil || outcomes[0].Op != ImportSkipped || outcomes[1].Op != OpAdd {
+		t.Fatalf("Import(skip) = %+v, %v", outcomes, err)
+	}
+	if store.Count() != 2 {
+		t.Errorf("Count() = %d, want 2", store.Count())
+	}
+
+	// Merge sets only the given fields
+	outcomes, err = store.Import(items, ImportOptions{Mode: ConflictMerge})
+	if err != nil || outcomes[0].Op != OpUpdate || outcomes[1].Op != ImportUnchanged {
+		t.Fatalf("Import(merge) = %+v, %v", outcomes, err)
+	}
+	if d, _ := store.Get(pc.ID); d.Name != "Desktop" || d.Notes != "desk" || d.CreatedAt != pc.CreatedAt {
+		t.Errorf("Merged device = %+v", d)
+	}
+
+	// Overwrite replaces the device
+	outcomes, err = store.Import(items[:1], ImportOptions{Mode: ConflictOverwrite})
+	if err != nil || outcomes[0].Op != OpUpdate {
+		t.Fatalf("Import(overwrite) = %+v, %v", outcomes, err)
+	}
+	if d, _ := store.Get(pc.ID); d.Notes != "" {
+		t.Errorf("Overwritten device kept its notes: %+v", d)
+	}
+
+	// Invalid and managed devices are reported, and the rest imported
+	store.Reconcile([]Device{{Name: "Router", MAC: "AA:BB:CC:DD:EE:03"}}, PolicyAuthoritative)
+	validate := func(d *Device) error {
+		if d.Name == "" {
+			return errors.New("name is required")
+		}
+		return nil
+	}
+	outcomes, err = store.Import([]ImportItem{
+		{Device: Device{MAC: "AA:BB:CC:DD:EE:04"}},
+		{Device: Device{Name: "Router", MAC: "AA:BB:CC:DD:EE:03"}},
+		{Device: Device{Name: "TV", MAC: "AA:BB:CC:DD:EE:05"}},
+	}, ImportOptions{Mode: ConflictOverwrite, Validate: validate})
+	if err != nil || outcomes[0].Err == nil || !errors.Is(outcomes[1].Err, ErrManaged) || outcomes[2].Op != OpAdd {
+		t.Fatalf("Import() with failures = %+v, %v", outcomes, err)
+	}
+	if _, err := store.GetByMAC("AA:BB:CC:DD:EE:05"); err != nil {
+		t.Errorf("Valid device not imported: %v", err)
+	}
+
+	if _, err := store.Import(items, ImportOptions{Mode: "replace"}); err == nil {
+		t.Error("Import() with an unknown mode should fail")
+	}
+}
@@ -0,0 +1,185 @@
+// Package store handles device data persistence.
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultRetention is how long deleted devices are kept in the trash by
+// default.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// TrashedDevice is a deleted device kept in the trash until it is restored
+// or purged.
+type TrashedDevice struct {
+	Device
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// SetRetention sets how long deleted devices are kept in the trash; 0
+// deletes devices permanently.
+func (s *Store) SetRetention(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retention = d
+}
+
+// Trash returns the deleted devices still in the trash, most recently
+// deleted first.
+func (s *Store) Trash() []TrashedDevice {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]TrashedDevice, 0, len(s.trash))
+	for _, t := range s.liveTrashLocked() {
+		result = append(result, *t)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].DeletedAt.After(result[j].DeletedAt)
+	})
+	return result
+}
+
+// Undelete moves a device from the trash back to the device list, keeping
+// its ID, and returns it. It fails with ErrDuplicate if another device has
+// since taken one of its MACs.
+func (s *Store) Undelete(id string, origin Origin) (Device, error) {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return Device{}, err
+	}
+	defer unlock()
+
+	i := s.trashIndexLocked(id)
+	if i < 0 {
+		return Device{}, fmt.Errorf("%w in trash: %s", ErrNotFound, id)
+	}
+	if s.indexLocked(id) >= 0 {
+		return Device{}, fmt.Errorf("%w: ID %s", ErrDuplicate, id)
+	}
+	device := s.trash[i].Device
+	if err := s.checkMACsLocked(device, ""); err != nil {
+		return Device{}, err
+	}
+
+	oldDevices, oldTrash := s.devices, s.trash
+	device.Revision++
+	device.UpdatedAt = time.Now().UTC()
+	s.devices = append(append([]*Device{}, oldDevices...), &device)
+	s.trash = append(append([]*TrashedDevice{}, oldTrash[:i]...), oldTrash[i+1:]...)
+
+	// Save to file
+	change := Change{Op: OpAdd, Device: device, Origin: origin}
+	if err := s.commitLocked([]Change{change}); err != nil {
+		// Rollback on save error
+		s.devices, s.trash = oldDevices, oldTrash
+		return Device{}, err
+	}
+
+	changes = append(changes, change)
+	return device, nil
+}
+
+// Purge permanently deletes a device from the trash.
+func (s *Store) Purge(id string) error {
+	return s.purge(func(t *TrashedDevice) bool { return t.ID == id }, id)
+}
+
+// EmptyTrash permanently deletes every device in the trash.
+func (s *Store) EmptyTrash() error {
+	return s.purge(func(*TrashedDevice) bool { return true }, "")
+}
+
+// purge permanently deletes the devices in the trash matching match. If id
+// is set, it fails with ErrNotFound when nothing matches.
+func (s *Store) purge(match func(*TrashedDevice) bool, id string) error {
+	var changes []Change
+	defer func() { s.notify(changes) }()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.syncLocked(&changes)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	kept := make([]*TrashedDevice, 0, len(s.trash))
+	for _, t := range s.trash {
+		if !match(t) {
+			kept = append(kept, t)
+		}
+	}
+	if id != "" && len(kept) == len(s.trash) {
+		return fmt.Errorf("%w in trash: %s", ErrNotFound, id)
+	}
+
+	oldTrash := s.trash
+	s.trash = kept
+	if err := s.writeLocked(true); err != nil {
+		// Rollback on save error
+		s.trash = oldTrash
+		return err
+	}
+	return nil
+}
+
+// trashLocked returns the trash with device added, deleted now, or the
+// trash unchanged if the trash is disabled (must be called with lock
+// held).
+func (s *Store) trashLocked(device *Device) []*TrashedDevice {
+	if s.retention <= 0 {
+		return s.trash
+	}
+	trashed := &TrashedDevice{Device: *device, DeletedAt: time.Now().UTC()}
+	return append(append([]*TrashedDevice{}, s.trash...), trashed)
+}
+
+// liveTrashLocked returns the devices in the trash deleted within the
+// retention period (must be called with lock held).
+func (s *Store) liveTrashLocked() []*TrashedDevice {
+	if s.retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-s.retention)
+	live := make([]*TrashedDevice, 0, len(s.trash))
+	for _, t := range s.trash {
+		if t.DeletedAt.After(cutoff) {
+			live = append(live, t)
+		}
+	}
+	return live
+}
+
+// trashIndexLocked returns the index of the live trashed device with the
+// given ID, or -1 (must be called with lock held).
+func (s *Store) trashIndexLocked(id string) int {
+	cutoff := time.Now().Add(-s.retention)
+	for i, t := range s.trash {
+		if t.ID == id && s.retention > 0 && t.DeletedAt.After(cutoff) {
+			return i
+		}
+	}
+	return -1
+}
+
+// untrashLocked returns the trash without the device with the given ID
+// (must be called with lock held).
+func (s *Store) untrashLocked(id string) []*TrashedDevice {
+	kept := make([]*TrashedDevice, 0, len(s.trash))
+	for _, t := range s.trash {
+		if t.ID != id {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,114 @@
+// Package wake provides the wake service shared by all wake sources.
+package wake
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Wake sources.
+const (
+	SourceAPI        = "api"
+	SourceCLI        = "cli"
+	SourceSchedule   = "schedule"
+	SourceProxy      = "proxy"
+	SourceDNS        = "dns"
+	SourceSleepProxy = "sleep-proxy"
+	SourceRule       = "rule"
+)
+
+// repeatCount is the number of magic packets sent per wake for reliability.
+const repeatCount = 3
+
+// Request describes a wake attempt.
+type Request struct {
+	MAC    string // Target MAC address
+	Source string // What triggered the wake (SourceAPI, SourceSchedule, ...)
+	Detail string // Source-specific detail, e.g. the schedule name
+	Actor  string // Who asked, e.g. an API client's address; optional
+	User   string // Authenticated user who asked, if known
+}
+
+// Target is a MAC address to send magic packets to, and where to send
+// them.
+type Target struct {
+	MAC string
+	wol.Target
+}
+
+// Result is the outcome of a wake attempt.
+type Result struct {
+	Request
+	Targets []Target // Where the magic packets were sent
+	Time    time.Time
+	Err     error
+}
+
+// Service sends wake packets and notifies listeners of every attempt.
+type Service struct {
+	sender    *wol.WOLSender
+	mu        sync.RWMutex
+	targets   func(mac string) []Target
+	listeners []func(Result)
+}
+
+// NewService creates a wake service using sender.
+func NewService(sender *wol.WOLSender) *Service {
+	return &Service{sender: sender}
+}
+
+// SetTargets sets a function returning the MACs to wake for a MAC and where
+// to send their magic packets, e.g. every network interface of a stored
+// device with its wake settings. If it returns none, or is not set, packets
+// go to the MAC itself via the sender's interface and broadcast address.
+func (s *Service) SetTargets(fn func(mac string) []Target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets = fn
+}
+
+// OnWake registers a callback invoked after every wake attempt.
+func (s *Service) OnWake(fn func(Result)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Wake sends magic packets to req.MAC, or to every target SetTargets
+// returns for it, and reports the result to listeners. It fails if sending
+// to any target fails.
+func (s *Service) Wake(req Request) error {
+	s.mu.RLock()
+	resolve := s.targets
+	s.mu.RUnlock()
+
+	var targets []Target
+	if resolve != nil {
+		targets = resolve(req.MAC)
+	}
+	if len(targets) == 0 {
+		targets = []Target{{MAC: req.MAC}}
+	}
+	var errs []error
+	sent := make([]Target, len(targets))
+	for i, t := range targets {
+		if err := s.sender.SendRepeatTo(t.MAC, repeatCount, t.Target); err != nil {
+			errs = append(errs, err)
+		}
+		sent[i] = Target{MAC: t.MAC, Target: s.sender.Resolve(t.Target)}
+	}
+	err := errors.Join(errs...)
+
+	result := Result{Request: req, Targets: sent, Time: time.Now(), Err: err}
+	s.mu.RLock()
+	listeners := append([]func(Result){}, s.listeners...)
+	s.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(result)
+	}
+
+	return err
+}
@@ -0,0 +1,76 @@
+// Package wake tests.
+package wake
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+func TestService_Wake(t *testing.T) {
+	sender, _ := wol.NewSender("", "127.0.0.1")
+	s := NewService(sender)
+
+	var results []Result
+	s.OnWake(func(r Result) { results = append(results, r) })
+
+	if err := s.Wake(Request{MAC: "AA:BB:CC:DD:EE:FF", Source: SourceCLI}); err != nil {
+		t.Fatalf("Wake() error = %v", err)
+	}
+	if err := s.Wake(Request{MAC: "invalid", Source: SourceAPI}); err == nil {
+		t.Error("Wake() should fail for invalid MAC")
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	if results[0].Err != nil || results[0].Source != SourceCLI {
+		t.Errorf("Unexpected first result: %+v", results[0])
+	}
+	if results[1].Err == nil {
+		t.Error("Failed wake should be reported with its error")
+	}
+}
+
+func TestService_WakeTargets(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	sender, _ := wol.NewSender("", "127.0.0.1")
+	s := NewService(sender)
+	s.SetTargets(func(mac string) []Target {
+		target := wol.Target{Address: "127.0.0.1", Port: port}
+		return []Target{{MAC: "AA:BB:CC:DD:EE:01", Target: target}, {MAC: "AA:BB:CC:DD:EE:02", Target: target}}
+	})
+	var result Result
+	s.OnWake(func(r Result) { result = r })
+	if err := s.Wake(Request{MAC: "AA:BB:CC:DD:EE:01", Source: SourceAPI}); err != nil {
+		t.Fatalf("Wake() error = %v", err)
+	}
+	if len(result.Targets) != 2 || result.Targets[1].MAC != "AA:BB:CC:DD:EE:02" || result.Targets[1].Port != port {
+		t.Errorf("Result targets = %+v", result.Targets)
+	}
+
+	// Each target gets its own magic packets, the MAC repeated after 6 bytes of 0xFF
+	woken := make(map[byte]int)
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 2*repeatCount; i++ {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Expected %d packets, got %d: %v", 2*repeatCount, i, err)
+		}
+		if n >= 12 {
+			woken[buf[11]]++
+		}
+	}
+	if woken[0x01] != repeatCount || woken[0x02] != repeatCount {
+		t.Errorf("Packets per MAC = %v", woken)
+	}
+}
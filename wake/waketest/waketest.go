@@ -0,0 +1,53 @@
+// Package waketest provides a wake service recording its wakes, for tests
+// of the wake sources.
+package waketest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/hzhq1255/wolgate/wake"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// Recorder records the requests of every wake made through a service.
+type Recorder struct {
+	C chan wake.Request // Receives each request, unless its buffer is full
+
+	mu       sync.Mutex
+	requests []wake.Request
+}
+
+// NewService returns a wake service sending magic packets to 127.0.0.1,
+// and a recorder of its wakes.
+func NewService(t testing.TB) (*wake.Service, *Recorder) {
+	t.Helper()
+	sender, err := wol.NewSender("", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+	waker := wake.NewService(sender)
+	return waker, Record(waker)
+}
+
+// Record returns a recorder of the wakes made through waker from now on.
+func Record(waker *wake.Service) *Recorder {
+	r := &Recorder{C: make(chan wake.Request, 100)}
+	waker.OnWake(func(res wake.Result) {
+		r.mu.Lock()
+		r.requests = append(r.requests, res.Request)
+		r.mu.Unlock()
+		select {
+		case r.C <- res.Request:
+		default:
+		}
+	})
+	return r
+}
+
+// Requests returns the requests recorded so far, oldest first.
+func (r *Recorder) Requests() []wake.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]wake.Request(nil), r.requests...)
+}
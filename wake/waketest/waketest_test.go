@@ -0,0 +1,26 @@
+// Package waketest tests.
+package waketest
+
+import (
+	"testing"
+
+	"github.com/hzhq1255/wolgate/wake"
+)
+
+func TestRecorder(t *testing.T) {
+	waker, woken := NewService(t)
+
+	waker.Wake(wake.Request{MAC: "AA:BB:CC:DD:EE:01", Source: wake.SourceAPI})
+	waker.Wake(wake.Request{MAC: "invalid", Source: wake.SourceRule})
+
+	requests := woken.Requests()
+	if len(requests) != 2 || requests[0].Source != wake.SourceAPI || requests[1].MAC != "invalid" {
+		t.Fatalf("Requests() = %+v", requests)
+	}
+	if r := <-woken.C; r.MAC != "AA:BB:CC:DD:EE:01" {
+		t.Errorf("First request on C = %+v", r)
+	}
+	if r := <-woken.C; r.MAC != "invalid" {
+		t.Errorf("Second request on C = %+v", r)
+	}
+}
@@ -3,26 +3,76 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/hzhq1255/wolgate/arp"
+	"github.com/hzhq1255/wolgate/inventory"
+	"github.com/hzhq1255/wolgate/leases"
 	"github.com/hzhq1255/wolgate/store"
 )
 
-// ARPEntry represents an ARP entry for import.
+// sourceARP is the import source reading the local ARP table.
+const sourceARP = "arp"
+
+// ARPEntry represents a discovered device offered for import.
 type ARPEntry struct {
-	IP     string `json:"ip"`
-	MAC    string `json:"mac"`
-	Device string `json:"device"`
+	IP       string   `json:"ip"`
+	MAC      string   `json:"mac"`
+	Device   string   `json:"device"`
+	Hostname string   `json:"hostname,omitempty"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Name     string   `json:"name,omitempty"` // Suggested device name
+}
+
+// ImportSource is a source of devices offered for import.
+type ImportSource struct {
+	Name      string `json:"name"` // "arp" or a lease file format
+	Path      string `json:"path,omitempty"`
+	Available bool   `json:"available"` // Whether the file exists
+}
+
+// SetLeases sets the lease files offered for import, by format.
+func (h *Handler) SetLeases(paths map[string]string) {
+	h.leases = paths
+}
+
+// importSourcesHandler lists the import sources at GET /api/import/sources:
+// the ARP table, then every lease file configured.
+func (h *Handler) importSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sources := []ImportSource{{Name: sourceARP, Path: arp.DefaultARPPath, Available: true}}
+	for _, format := range leases.Formats {
+		path := h.leases[format]
+		if path == "" {
+			continue
+		}
+		_, err := os.Stat(path)
+		sources = append(sources, ImportSource{Name: format, Path: path, Available: err == nil})
+	}
+	h.respondSuccess(w, sources)
 }
 
-// importHandler returns a list of ARP entries for device discovery.
+// importHandler returns the devices found by an import source for device
+// discovery, chosen with ?source= (default arp), and imports the selected
+// ones.
 func (h *Handler) importHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method == http.MethodGet {
-		h.handleImportGet(w)
+		source := r.URL.Query().Get("source")
+		if source == "" || source == sourceARP {
+			h.handleImportGet(w)
+		} else {
+			h.handleLeaseImportGet(w, source)
+		}
 	} else if r.Method == http.MethodPost {
 		h.handleImportPost(w, r)
 	} else {
@@ -39,26 +89,91 @@ func (h *Handler) handleImportGet(w http.ResponseWriter) {
 		return
 	}
 
-	// Convert to API format
+	// Convert to API format, naming hosts the DHCP server knows
+	hostnames := h.leaseHostnames()
 	result := make([]ARPEntry, 0, len(entries))
 	for _, entry := range entries {
+		hostname := hostnames[strings.ToLower(entry.MAC)]
 		result = append(result, ARPEntry{
-			IP:     entry.IP,
-			MAC:    entry.MAC,
-			Device: entry.Device,
+			IP:       entry.IP,
+			MAC:      entry.MAC,
+			Device:   entry.Device,
+			Hostname: hostname,
+			Name:     hostname,
 		})
 	}
 
 	h.respondSuccess(w, result)
 }
 
-// handleImportPost imports selected ARP entries into the device store.
+// handleLeaseImportGet returns the hosts in the lease file of a format.
+func (h *Handler) handleLeaseImportGet(w http.ResponseWriter, format string) {
+	path := h.leases[format]
+	if path == "" {
+		h.respondError(w, "Unknown import source: "+format, http.StatusNotFound)
+		return
+	}
+	entries, err := leases.ParsePath(format, path)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, os.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		h.respondError(w, "Failed to read lease file: "+err.Error(), status)
+		return
+	}
+
+	result := make([]ARPEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, ARPEntry{
+			IP:       entry.IP,
+			MAC:      entry.MAC,
+			Hostname: entry.Hostname,
+			Aliases:  entry.Aliases,
+			Name:     entry.Hostname,
+		})
+	}
+	h.respondSuccess(w, result)
+}
+
+// leaseHostnames returns the hostnames in the configured lease files, by
+// lowercase MAC. Files that cannot be read are skipped.
+func (h *Handler) leaseHostnames() map[string]string {
+	hostnames := make(map[string]string)
+	for _, format := range leases.Formats {
+		path := h.leases[format]
+		if path == "" {
+			continue
+		}
+		entries, err := leases.ParsePath(format, path)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Hostname == "" {
+				continue
+			}
+			for _, mac := range append([]string{entry.MAC}, entry.Aliases...) {
+				if _, ok := hostnames[mac]; !ok {
+					hostnames[mac] = entry.Hostname
+				}
+			}
+		}
+	}
+	return hostnames
+}
+
+// handleImportPost imports selected ARP entries into the device store. Each
+// device is validated as /api/devices does; it responds with the outcome of
+// every device, see inventory.Report.
 func (h *Handler) handleImportPost(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Devices []struct {
-			Name string `json:"name"`
-			MAC  string `json:"mac"`
-			IP   string `json:"ip,omitempty"`
+			Name     string   `json:"name"`
+			MAC      string   `json:"mac"`
+			IP       string   `json:"ip,omitempty"`
+			Hostname string   `json:"hostname,omitempty"`
+			Aliases  []string `json:"aliases,omitempty"`
 		} `json:"devices"`
 	}
 
@@ -67,45 +182,63 @@ func (h *Handler) handleImportPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	successCount := 0
-	skippedCount := 0
-	for _, device := range req.Devices {
-		// Validate MAC
-		if device.MAC == "" {
-			continue
-		}
+	report := inventory.Report{Rows: make([]inventory.Result, len(req.Devices))}
+	for i, device := range req.Devices {
+		result := &report.Rows[i]
+		result.Row = i + 1
 
 		// Skip if already exists
 		if _, err := h.store.GetByMAC(device.MAC); err == nil {
-			skippedCount++
+			result.Op = store.ImportSkipped
+			report.Skipped++
 			continue
 		}
 
-		// Use provided name or generate one
+		// Use provided name or hostname, or generate one
 		name := device.Name
 		if name == "" {
-			name = "Device-" + device.MAC[:8]
+			name = device.Hostname
+		}
+		if name == "" {
+			name = "Device-" + device.MAC[:min(len(device.MAC), 8)]
 		}
 
 		newDevice := store.Device{
-			Name: name,
-			MAC:  device.MAC,
-			IP:   device.IP,
+			Name:     name,
+			MAC:      device.MAC,
+			IP:       device.IP,
+			Hostname: device.Hostname,
+		}
+		for _, alias := range device.Aliases {
+			newDevice.Aliases = append(newDevice.Aliases, store.MACAlias{MAC: alias})
 		}
 
-		// Add device
-		if err := h.store.Add(newDevice); err == nil {
-			successCount++
+		if err := validateDevice(&newDevice); err != nil {
+			result.Error = err.Error()
+			report.Failed++
+			continue
 		}
+		created, err := h.store.Create(newDevice, h.requestOrigin(r, store.SourceImport))
+		if err != nil {
+			result.Error = err.Error()
+			report.Failed++
+			continue
+		}
+		result.Op, result.Device = store.OpAdd, &created
+		report.Added++
 	}
 
-	message := fmt.Sprintf("Imported %d devices", successCount)
-	if skippedCount > 0 {
-		message += fmt.Sprintf(", skipped %d (already exist)", skippedCount)
+	message := fmt.Sprintf("Imported %d devices", report.Added)
+	if report.Skipped > 0 {
+		message += fmt.Sprintf(", skipped %d (already exist)", report.Skipped)
+	}
+	if report.Failed > 0 {
+		message += fmt.Sprintf(", failed %d", report.Failed)
 	}
 
 	h.respond(w, Response{
-		Success: successCount > 0,
+		Success: report.Added > 0,
+		Data:    report,
 		Message: message,
 	})
 }
@@ -0,0 +1,98 @@
+// Package web provides the wake audit log API for wolgate.
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hzhq1255/wolgate/audit"
+	"github.com/hzhq1255/wolgate/wol"
+)
+
+// SetAudit attaches the wake audit log served at /api/audit.
+func (h *Handler) SetAudit(l *audit.Log) {
+	h.audit = l
+}
+
+// auditHandler returns wake attempts from the audit log, newest first.
+// Query parameters: device (a device ID or MAC), since and until (RFC 3339
+// times or dates; until is exclusive, a date covering that day), limit
+// (default 100; 0 for all) and format=csv to download them.
+func (h *Handler) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.audit == nil {
+		h.respondError(w, "Audit log not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	params := r.URL.Query()
+	q := audit.Query{Limit: 100}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			h.respondError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+	if device := params.Get("device"); device != "" {
+		if err := wol.ValidateMAC(device); err == nil {
+			q.MACs = []string{device}
+		} else {
+			q.DeviceID = device
+			if d, err := h.store.Get(device); err == nil {
+				q.MACs = d.MACs()
+			}
+		}
+	}
+	var err error
+	if q.Since, err = parseAuditTime(params.Get("since"), false); err != nil {
+		h.respondError(w, "Invalid since: "+params.Get("since"), http.StatusBadRequest)
+		return
+	}
+	if q.Until, err = parseAuditTime(params.Get("until"), true); err != nil {
+		h.respondError(w, "Invalid until: "+params.Get("until"), http.StatusBadRequest)
+		return
+	}
+	format := params.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		h.respondError(w, "Format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := h.audit.Entries(q)
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="wolgate-audit.csv"`)
+		audit.WriteCSV(w, entries)
+		return
+	}
+	h.respondSuccess(w, entries)
+}
+
+// parseAuditTime parses an RFC 3339 time or a date, in local time. A date
+// given as the end of a range covers that day.
+func parseAuditTime(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,385 @@
+// Package web provides the device API for wolgate.
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+)
+
+// devicesHandler lists (GET) and creates (POST) devices at /api/devices.
+// The list may be searched, filtered, sorted and paged, see listDevices.
+func (h *Handler) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.listDevices(w, r)
+	case http.MethodPost:
+		var device store.Device
+		if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateDevice(&device); err != nil {
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		device, err := h.store.Create(device, h.requestOrigin(r, store.SourceAPI))
+		if err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/api/devices/"+device.ID)
+		w.Header().Set("ETag", deviceETag(device))
+		h.respondWithStatus(w, Response{Success: true, Data: device}, http.StatusCreated)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deviceByIDHandler reads (GET), replaces (PUT), patches (PATCH) and
+// deletes (DELETE) a device at /api/devices/{id}, and wakes it with
+// POST /api/devices/{id}/wake. Writes must name the revision they are
+// based on, see revisionPrecondition, and are refused for devices managed
+// by the config file.
+func (h *Handler) deviceByIDHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/")
+	if id == "" || (action != "" && action != "wake") {
+		h.respondError(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	if action == "wake" {
+		if r.Method != http.MethodPost {
+			h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		device, err := h.store.Get(id)
+		if err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		h.wakeDevice(w, h.wakeRequest(r, device.MAC))
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	current, err := h.store.Get(id)
+	if err != nil {
+		h.respondDeviceError(w, err)
+		return
+	}
+	if r.Method != http.MethodGet && h.rejectManaged(w, current) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("ETag", deviceETag(current))
+		h.respondSuccess(w, h.deviceDetail(current))
+	case http.MethodPut, http.MethodPatch:
+		var device store.Device
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
+				h.respondError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		} else {
+			if device, err = patchDevice(current, r); err != nil {
+				h.respondError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		revision, mismatch, ok := h.revisionPrecondition(w, r, device.Revision)
+		if !ok {
+			return
+		}
+		device.Revision = revision
+		if err := validateDevice(&device); err != nil {
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		device, err := h.store.Replace(id, device, h.requestOrigin(r, store.SourceAPI))
+		if err != nil {
+			h.respondWriteError(w, err, mismatch)
+			return
+		}
+		w.Header().Set("ETag", deviceETag(device))
+		h.respondSuccess(w, device)
+	case http.MethodDelete:
+		// The revision may also be given in an optional body
+		var req struct {
+			Revision int `json:"revision"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		revision, mismatch, ok := h.revisionPrecondition(w, r, req.Revision)
+		if !ok {
+			return
+		}
+
+		if _, err := h.store.Remove(id, revision, h.requestOrigin(r, store.SourceAPI)); err != nil {
+			h.respondWriteError(w, err, mismatch)
+			return
+		}
+		h.respondSuccess(w, nil)
+	}
+}
+
+// rejectManaged responds 403 and returns true if device is managed by the
+// config file, and so read-only in the API.
+func (h *Handler) rejectManaged(w http.ResponseWriter, device store.Device) bool {
+	if !device.Managed {
+		return false
+	}
+	h.respondError(w, fmt.Sprintf("Device %s is managed by the config file", device.Name), http.StatusForbidden)
+	return true
+}
+
+// listDevices responds with the devices matching the query parameters,
+// see deviceQuery, along with the total number matching and the cursor of
+// the next page, if any.
+func (h *Handler) listDevices(w http.ResponseWriter, r *http.Request) {
+	q, err := h.deviceQuery(r.URL.Query())
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := h.store.Find(q)
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.respond(w, Response{Success: true, Data: page.Devices, Total: &page.Total, Next: page.Next})
+}
+
+// deviceQuery parses the query parameters of a device list: q, a
+// case-insensitive search of the name, hostname, MAC, IP, tags and notes;
+// the filters group, type, every tag given and online (true or false);
+// sort, a field prefixed with "-" for descending order; and the paging
+// parameters limit and offset, or cursor.
+func (h *Handler) deviceQuery(values url.Values) (store.Query, error) {
+	q := store.Query{
+		Search: values.Get("q"),
+		Group:  values.Get("group"),
+		Type:   values.Get("type"),
+		Tags:   values["tag"],
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+	if v := values.Get("online"); v != "" {
+		online, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid online: %s", v)
+		}
+		if h.monitor == nil {
+			return q, errors.New("online status is not available")
+		}
+		q.Online, q.IsOnline = &online, h.monitor.Online
+	}
+	for name, n := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if v := values.Get(name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return q, fmt.Errorf("invalid %s: %s", name, v)
+			}
+			*n = i
+		}
+	}
+	return q, nil
+}
+
+// patchDevice applies a JSON merge patch (RFC 7386) from the request body
+// to device. Unknown fields are rejected and the ID cannot be changed. The
+// patched device's revision is the one given in the patch, if any.
+func patchDevice(device store.Device, r *http.Request) (store.Device, error) {
+	var patch map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		return device, fmt.Errorf("invalid request body")
+	}
+	delete(patch, "id")
+
+	var fields map[string]interface{}
+	data, _ := json.Marshal(device)
+	json.Unmarshal(data, &fields)
+	delete(fields, "revision")
+
+	data, _ = json.Marshal(mergePatch(fields, patch))
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var patched store.Device
+	if err := dec.Decode(&patched); err != nil {
+		return device, fmt.Errorf("invalid patch: %v", err)
+	}
+	patched.ID = device.ID
+	return patched, nil
+}
+
+// mergePatch applies a JSON merge patch to target, both decoded JSON
+// values: objects are merged recursively, null removes a member, and any
+// other value replaces the target.
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	result, ok := target.(map[string]interface{})
+	if !ok {
+		result = make(map[string]interface{})
+	}
+	for k, v := range fields {
+		if v == nil {
+			delete(result, k)
+		} else {
+			result[k] = mergePatch(result[k], v)
+		}
+	}
+	return result
+}
+
+// revisionPrecondition returns the revision a write to a device must be
+// based on: the one in the If-Match header, or else the one in the request
+// body. It also returns the status to report if the device has since
+// changed: 412 for If-Match, 409 for the body. If neither is given, it
+// responds 428 and returns false.
+func (h *Handler) revisionPrecondition(w http.ResponseWriter, r *http.Request, bodyRevision int) (int, int, bool) {
+	if match := r.Header.Get("If-Match"); match != "" {
+		if match == "*" {
+			return 0, http.StatusPreconditionFailed, true
+		}
+		// Only strong, single ETags can match
+		revision, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(match, `"`), `"`))
+		if err != nil || revision < 1 {
+			h.respondError(w, "If-Match does not match the device", http.StatusPreconditionFailed)
+			return 0, 0, false
+		}
+		return revision, http.StatusPreconditionFailed, true
+	}
+	if bodyRevision > 0 {
+		return bodyRevision, http.StatusConflict, true
+	}
+
+	h.respondError(w, "An If-Match header or revision is required", http.StatusPreconditionRequired)
+	return 0, 0, false
+}
+
+// deviceETag returns the ETag of a device, its quoted revision.
+func deviceETag(device store.Device) string {
+	return `"` + strconv.Itoa(device.Revision) + `"`
+}
+
+// requestOrigin returns the origin of a change made by an API request: the
+// client's address.
+func (h *Handler) requestOrigin(r *http.Request, source string) store.Origin {
+	actor, _ := h.clientAddr(r)
+	return store.Origin{Source: source, Actor: actor}
+}
+
+// clientAddr returns the address of the client that made r, and whether
+// it came through a trusted proxy. Behind a trusted proxy it is the last
+// address in X-Forwarded-For not of a trusted proxy itself.
+func (h *Handler) clientAddr(r *http.Request) (string, bool) {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !h.trustedProxy(addr) {
+		return addr, false
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+		if !h.trustedProxy(hop) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// trustedProxy reports whether addr is one of the trusted proxies.
+func (h *Handler) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// wakeRequest returns the request to wake mac on behalf of an API client,
+// with the client's address and, behind a trusted proxy, the user it
+// authenticated in Remote-User. Whether the client is the web UI is only
+// its own claim, so it is recorded as the detail of an API wake.
+func (h *Handler) wakeRequest(r *http.Request, mac string) wake.Request {
+	actor, proxied := h.clientAddr(r)
+	req := wake.Request{MAC: mac, Source: wake.SourceAPI, Actor: actor}
+	if proxied {
+		req.User = r.Header.Get("Remote-User")
+	}
+	if r.Header.Get("X-Wolgate-Client") == "ui" {
+		req.Detail = "web UI"
+	}
+	return req
+}
+
+// wakeDevice sends a magic packet on behalf of an API client.
+func (h *Handler) wakeDevice(w http.ResponseWriter, req wake.Request) {
+	if err := h.waker.Wake(req); err != nil {
+		h.logf(logger.ERROR, "Failed to wake %s for %s via %s: %v", req.MAC, req.Actor, req.Source, err)
+		h.respondError(w, fmt.Sprintf("Failed to send WOL packet: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	h.logf(logger.INFO, "Woke %s for %s via %s", req.MAC, req.Actor, req.Source)
+	h.respond(w, Response{
+		Success: true,
+		Message: fmt.Sprintf("WOL packet sent to %s", req.MAC),
+	})
+}
+
+// respondDeviceError maps store errors to HTTP status codes.
+func (h *Handler) respondDeviceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, store.ErrGroupNotFound):
+		h.respondError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, store.ErrDuplicate), errors.Is(err, store.ErrConflict), errors.Is(err, store.ErrModified), errors.Is(err, store.ErrGroupExists):
+		h.respondError(w, err.Error(), http.StatusConflict)
+	default:
+		h.respondError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// respondWriteError is respondDeviceError for writes guarded by
+// revisionPrecondition, reporting a revision mismatch with status mismatch.
+func (h *Handler) respondWriteError(w http.ResponseWriter, err error, mismatch int) {
+	if errors.Is(err, store.ErrConflict) {
+		h.respondError(w, err.Error(), mismatch)
+		return
+	}
+	h.respondDeviceError(w, err)
+}
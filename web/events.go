@@ -0,0 +1,112 @@
+// Package web provides the Server-Sent Events stream for wolgate.
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hzhq1255/wolgate/events"
+	"github.com/hzhq1255/wolgate/monitor"
+)
+
+// heartbeatInterval keeps idle connections alive through proxies.
+const heartbeatInterval = 25 * time.Second
+
+// eventsHandler streams server events as Server-Sent Events. Clients that
+// reconnect with a Last-Event-ID header get the events they missed replayed
+// from the backlog, or a resync event if they are no longer available.
+func (h *Handler) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.events == nil {
+		h.respondError(w, "Event stream not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.respondError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var since uint64
+	if lastID != "" {
+		since, _ = strconv.ParseUint(lastID, 10, 64)
+	}
+
+	sub, replay, complete := h.events.Subscribe(since)
+	defer h.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Disable response buffering in Nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		writeEvent(w, events.Event{ID: h.events.LastID(), Type: events.Resync, Time: time.Now()})
+	}
+	for _, ev := range replay {
+		writeEvent(w, ev)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				// Dropped for being too slow; the client will reconnect
+				return
+			}
+			writeEvent(w, ev)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes a single event in SSE wire format.
+func writeEvent(w http.ResponseWriter, ev events.Event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+}
+
+// statusHandler returns the reachability status of all known devices.
+func (h *Handler) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := make(map[string]monitor.Status)
+	if h.monitor != nil {
+		for _, d := range h.store.List() {
+			if status, ok := h.monitor.Status(d.MAC); ok {
+				result[d.MAC] = status
+			}
+		}
+	}
+
+	h.respondSuccess(w, result)
+}
@@ -0,0 +1,227 @@
+// Package web provides the device group API for wolgate.
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
+)
+
+// maxStagger limits the pause between group members when a group is woken.
+const maxStagger = 10 * 60 * 1000 // 10 minutes, in milliseconds
+
+// GroupDetail is a group with the IDs of its member devices.
+type GroupDetail struct {
+	store.Group
+	Devices []string `json:"devices"`
+}
+
+// groupsHandler lists (GET) and creates (POST) device groups at
+// /api/groups.
+func (h *Handler) groupsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		groups := h.store.ListGroups()
+		result := make([]GroupDetail, len(groups))
+		for i, g := range groups {
+			result[i] = h.groupDetail(g)
+		}
+		h.respondSuccess(w, result)
+	case http.MethodPost:
+		var group store.Group
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateGroup(&group); err != nil {
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		group, err := h.store.CreateGroup(group)
+		if err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/api/groups/"+group.ID)
+		h.respondWithStatus(w, Response{Success: true, Data: h.groupDetail(group)}, http.StatusCreated)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// groupHandler reads (GET), replaces (PUT) and deletes (DELETE) a group at
+// /api/groups/{id}. Renaming a group moves its members, and deleting it
+// leaves them without a group. PUT /api/groups/{id}/members sets the
+// members, given as {"devices": [id, ...]}, and POST /api/groups/{id}/wake
+// wakes them.
+func (h *Handler) groupHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/groups/"), "/")
+	if id == "" || (action != "" && action != "members" && action != "wake") {
+		h.respondError(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "wake" && r.Method == http.MethodPost:
+		group, err := h.store.GetGroup(id)
+		if err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		h.wakeGroup(w, r, group)
+	case action == "members" && r.Method == http.MethodPut:
+		var req struct {
+			Devices []string `json:"devices"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		group, err := h.store.GetGroup(id)
+		if err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		// Managed devices keep the group the config file gives them
+		for _, deviceID := range req.Devices {
+			if device, err := h.store.Get(deviceID); err == nil && device.Group != group.Name && h.rejectManaged(w, device) {
+				return
+			}
+		}
+		if _, err := h.store.SetGroupMembers(id, req.Devices, h.requestOrigin(r, store.SourceAPI)); err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		h.respondSuccess(w, h.groupDetail(group))
+	case action != "":
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case r.Method == http.MethodGet:
+		group, err := h.store.GetGroup(id)
+		if err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		h.respondSuccess(w, h.groupDetail(group))
+	case r.Method == http.MethodPut:
+		var group store.Group
+		if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateGroup(&group); err != nil {
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		group, err := h.store.UpdateGroup(id, group, h.requestOrigin(r, store.SourceAPI))
+		if err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		h.respondSuccess(w, h.groupDetail(group))
+	case r.Method == http.MethodDelete:
+		if err := h.store.DeleteGroup(id, h.requestOrigin(r, store.SourceAPI)); err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		h.respondSuccess(w, nil)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// groupDetail returns a group with its members.
+func (h *Handler) groupDetail(group store.Group) GroupDetail {
+	detail := GroupDetail{Group: group, Devices: []string{}}
+	for _, d := range h.store.GetByGroup(group.Name) {
+		detail.Devices = append(detail.Devices, d.ID)
+	}
+	return detail
+}
+
+// wakeGroup sends a magic packet to every member of a group. Without a
+// stagger delay it reports the result of each wake; with one, the wakes
+// continue in the background and it responds 202 at once.
+func (h *Handler) wakeGroup(w http.ResponseWriter, r *http.Request, group store.Group) {
+	members := h.store.GetByGroup(group.Name)
+	// Built now, as the request must not be read after the response
+	reqs := make([]wake.Request, len(members))
+	for i, d := range members {
+		reqs[i] = h.wakeRequest(r, d.MAC)
+		reqs[i].Detail = "group " + group.Name
+	}
+	wakeMember := func(req wake.Request) error {
+		err := h.waker.Wake(req)
+		if err != nil {
+			h.logf(logger.ERROR, "Failed to wake %s in %s for %s via %s: %v", req.MAC, group.Name, req.Actor, req.Source, err)
+		} else {
+			h.logf(logger.INFO, "Woke %s in %s for %s via %s", req.MAC, group.Name, req.Actor, req.Source)
+		}
+		return err
+	}
+
+	if delay := group.StaggerDelay(); delay > 0 {
+		go func() {
+			for i, req := range reqs {
+				if i > 0 {
+					time.Sleep(delay)
+				}
+				wakeMember(req)
+			}
+		}()
+		h.respondWithStatus(w, Response{
+			Success: true,
+			Message: fmt.Sprintf("Waking %d device(s) in %s, %v apart", len(members), group.Name, delay),
+		}, http.StatusAccepted)
+		return
+	}
+
+	var failed []string
+	for i, d := range members {
+		if err := wakeMember(reqs[i]); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", d.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		h.respondError(w, "Failed to send WOL packet to "+strings.Join(failed, "; "), http.StatusInternalServerError)
+		return
+	}
+	h.respond(w, Response{
+		Success: true,
+		Message: fmt.Sprintf("WOL packet sent to %d device(s) in %s", len(members), group.Name),
+	})
+}
+
+// validateGroup checks a group's name and wake defaults, normalizing them.
+func validateGroup(group *store.Group) error {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return errors.New("group name is required")
+	}
+	if group.Wake == nil {
+		return nil
+	}
+
+	if group.Wake.Broadcast != "" {
+		ip := net.ParseIP(group.Wake.Broadcast)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid broadcast address: %s", group.Wake.Broadcast)
+		}
+	}
+	if group.Wake.Stagger < 0 || group.Wake.Stagger > maxStagger {
+		return fmt.Errorf("stagger must be between 0 and %d milliseconds", maxStagger)
+	}
+	if *group.Wake == (store.GroupWake{}) {
+		group.Wake = nil
+	}
+	return nil
+}
@@ -4,17 +4,42 @@ package web
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"regexp"
-
+	"strings"
+
+	"github.com/hzhq1255/wolgate/audit"
+	"github.com/hzhq1255/wolgate/events"
+	"github.com/hzhq1255/wolgate/logger"
+	"github.com/hzhq1255/wolgate/monitor"
+	"github.com/hzhq1255/wolgate/proxy"
+	"github.com/hzhq1255/wolgate/rules"
+	"github.com/hzhq1255/wolgate/schedule"
+	"github.com/hzhq1255/wolgate/sleepproxy"
 	"github.com/hzhq1255/wolgate/store"
+	"github.com/hzhq1255/wolgate/wake"
 	"github.com/hzhq1255/wolgate/wol"
 )
 
 // Handler handles HTTP requests.
 type Handler struct {
-	store *store.Store
-	wol   *wol.WOLSender
+	store      *store.Store
+	wol        *wol.WOLSender
+	waker      *wake.Service
+	monitor    *monitor.Monitor
+	events     *events.Hub
+	scheduler  *schedule.Scheduler
+	calendars  *schedule.Calendars
+	proxy      *proxy.Proxy
+	sleepProxy *sleepproxy.Proxy
+	rules      *rules.Engine
+	leases     map[string]string // Lease files offered for import, by format
+	audit      *audit.Log
+	log        *logger.Logger
+	// trustedProxies are the reverse proxies whose X-Forwarded-For and
+	// Remote-User headers are believed.
+	trustedProxies []*net.IPNet
 }
 
 // NewHandler creates a new HTTP handler.
@@ -22,7 +47,64 @@ func NewHandler(store *store.Store, wol *wol.WOLSender) *Handler {
 	return &Handler{
 		store: store,
 		wol:   wol,
+		waker: wake.NewService(wol),
+	}
+}
+
+// SetWaker replaces the wake service, so wakes from the API share
+// listeners with other wake sources.
+func (h *Handler) SetWaker(w *wake.Service) {
+	h.waker = w
+}
+
+// SetMonitor attaches a reachability monitor used for device status
+// and boot time tracking.
+func (h *Handler) SetMonitor(m *monitor.Monitor) {
+	h.monitor = m
+}
+
+// SetLogger attaches a logger for API wakes.
+func (h *Handler) SetLogger(log *logger.Logger) {
+	h.log = log
+}
+
+// logf logs a message if a logger is attached.
+func (h *Handler) logf(level logger.Level, format string, args ...interface{}) {
+	if h.log != nil {
+		h.log.Log(level, format, args...)
+	}
+}
+
+// SetTrustedProxies sets the reverse proxies, by address or CIDR, whose
+// X-Forwarded-For and Remote-User headers name the client and its user.
+func (h *Handler) SetTrustedProxies(addrs []string) error {
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", addr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q", addr)
+		}
+		nets = append(nets, n)
 	}
+	h.trustedProxies = nets
+	return nil
+}
+
+// SetEvents attaches an event hub that is streamed at /api/events.
+func (h *Handler) SetEvents(hub *events.Hub) {
+	h.events = hub
 }
 
 // Response represents a standard API response.
@@ -31,6 +113,8 @@ type Response struct {
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
 	Message string      `json:"message,omitempty"`
+	Total   *int        `json:"total,omitempty"` // Items matching a list query, on all pages
+	Next    string      `json:"next,omitempty"`  // Cursor of the next page of a list
 }
 
 // RegisterRoutes registers all HTTP routes.
@@ -39,11 +123,36 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/", h.indexHandler)
 
 	// API routes
+	mux.HandleFunc("/api/devices", h.devicesHandler)
+	mux.HandleFunc("/api/devices/", h.deviceByIDHandler)
 	mux.HandleFunc("/api/list", h.listHandler)
+	mux.HandleFunc("/api/device", h.deviceHandler)
 	mux.HandleFunc("/api/add", h.addHandler)
 	mux.HandleFunc("/api/delete", h.deleteHandler)
 	mux.HandleFunc("/api/wake", h.wakeHandler)
 	mux.HandleFunc("/api/import", h.importHandler)
+	mux.HandleFunc("/api/import/file", h.importFileHandler)
+	mux.HandleFunc("/api/import/sources", h.importSourcesHandler)
+	mux.HandleFunc("/api/export", h.exportHandler)
+	mux.HandleFunc("/api/trash", h.trashHandler)
+	mux.HandleFunc("/api/trash/", h.trashedDeviceHandler)
+	mux.HandleFunc("/api/groups", h.groupsHandler)
+	mux.HandleFunc("/api/groups/", h.groupHandler)
+	mux.HandleFunc("/api/store/revisions", h.revisionsHandler)
+	mux.HandleFunc("/api/store/restore", h.restoreHandler)
+	mux.HandleFunc("/api/status", h.statusHandler)
+	mux.HandleFunc("/api/events", h.eventsHandler)
+	mux.HandleFunc("/api/audit", h.auditHandler)
+	mux.HandleFunc("/api/schedules", h.schedulesHandler)
+	mux.HandleFunc("/api/schedules/", h.scheduleHandler)
+	mux.HandleFunc("/api/calendars", h.calendarsHandler)
+	mux.HandleFunc("/api/calendars/", h.calendarHandler)
+	mux.HandleFunc("/api/proxy", h.proxyHandler)
+	mux.HandleFunc("/api/sleep-proxy", h.sleepProxyHandler)
+	mux.HandleFunc("/api/rules", h.rulesHandler)
+	mux.HandleFunc("/api/rules/", h.ruleHandler)
+	mux.HandleFunc("/api/rules/history", h.ruleHistoryHandler)
+	mux.HandleFunc("/api/hooks/", h.hookHandler)
 }
 
 // indexHandler serves the main HTML page.
@@ -63,18 +172,63 @@ func (h *Handler) indexHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(content)
 }
 
-// listHandler returns the list of all devices.
+// listHandler returns the list of all devices. Legacy alias of GET
+// /api/devices.
 func (h *Handler) listHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	devices := h.store.List()
-	h.respondSuccess(w, devices)
+	h.listDevices(w, r)
+}
+
+// DeviceDetail is a device with its reachability status and boot statistics.
+type DeviceDetail struct {
+	store.Device
+	Status *monitor.Status    `json:"status,omitempty"`
+	Boot   *monitor.BootStats `json:"boot,omitempty"`
 }
 
-// addHandler adds a new device.
+// deviceHandler returns the details of a single device.
+func (h *Handler) deviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mac := r.URL.Query().Get("mac")
+	if mac == "" {
+		h.respondError(w, "MAC address is required", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.store.GetByMAC(mac)
+	if err != nil {
+		h.respondDeviceError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", deviceETag(*device))
+	h.respondSuccess(w, h.deviceDetail(*device))
+}
+
+// deviceDetail attaches monitor data to a device, if a monitor is set.
+func (h *Handler) deviceDetail(device store.Device) DeviceDetail {
+	detail := DeviceDetail{Device: device}
+	if h.monitor != nil {
+		if status, ok := h.monitor.Status(device.MAC); ok {
+			detail.Status = &status
+		}
+		boot := h.monitor.BootStats(device.MAC)
+		detail.Boot = &boot
+	}
+	return detail
+}
+
+// addHandler adds a new device, or replaces the device with the same
+// primary MAC. Legacy alias of POST /api/devices and PUT /api/devices/{id};
+// a revision in the body is checked but not required.
 func (h *Handler) addHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -93,26 +247,33 @@ func (h *Handler) addHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if device exists (for updates)
-	existing, _ := h.store.GetByMAC(device.MAC)
-	if existing != nil {
-		// Update existing device
-		if err := h.store.Update(device.MAC, device); err != nil {
-			h.respondError(w, err.Error(), http.StatusInternalServerError)
+	var err error
+	if existing, _ := h.store.GetByMAC(device.MAC); existing != nil {
+		if h.rejectManaged(w, *existing) {
 			return
 		}
-	} else {
-		// Add new device
-		if err := h.store.Add(device); err != nil {
-			h.respondError(w, err.Error(), http.StatusInternalServerError)
+		// Only the device whose primary MAC it is may be overwritten; one
+		// that merely has it as an alias would lose its own MACs
+		primary, _ := wol.NormalizeMAC(existing.MAC)
+		if mac, _ := wol.NormalizeMAC(device.MAC); mac != primary {
+			h.respondDeviceError(w, fmt.Errorf("%w: %s is an alias of %s", store.ErrDuplicate, device.MAC, existing.Name))
 			return
 		}
+		_, err = h.store.Replace(existing.ID, device, h.requestOrigin(r, store.SourceAPI))
+	} else {
+		_, err = h.store.Create(device, h.requestOrigin(r, store.SourceAPI))
+	}
+	if err != nil {
+		h.respondDeviceError(w, err)
+		return
 	}
 
 	h.respondSuccess(w, nil)
 }
 
-// deleteHandler deletes a device.
+// deleteHandler deletes a device by MAC. Legacy alias of
+// DELETE /api/devices/{id}; a revision in the body is checked but not
+// required.
 func (h *Handler) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -120,7 +281,8 @@ func (h *Handler) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		MAC string `json:"mac"`
+		MAC      string `json:"mac"`
+		Revision int    `json:"revision"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -133,15 +295,22 @@ func (h *Handler) deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.store.Delete(req.MAC); err != nil {
-		h.respondError(w, err.Error(), http.StatusNotFound)
+	device, err := h.store.GetByMAC(req.MAC)
+	if err == nil && h.rejectManaged(w, *device) {
+		return
+	}
+	if err == nil {
+		_, err = h.store.Remove(device.ID, req.Revision, h.requestOrigin(r, store.SourceAPI))
+	}
+	if err != nil {
+		h.respondDeviceError(w, err)
 		return
 	}
 
 	h.respondSuccess(w, nil)
 }
 
-// wakeHandler sends a WOL magic packet.
+// wakeHandler sends a WOL magic packet to any MAC, stored or not.
 func (h *Handler) wakeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -163,20 +332,30 @@ func (h *Handler) wakeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Send magic packet (3 times for reliability)
-	if err := h.wol.SendRepeat(req.MAC, 3); err != nil {
-		h.respondError(w, fmt.Sprintf("Failed to send WOL packet: %v", err), http.StatusInternalServerError)
-		return
-	}
+	h.wakeDevice(w, h.wakeRequest(r, req.MAC))
+}
 
-	h.respond(w, Response{
-		Success: true,
-		Message: fmt.Sprintf("WOL packet sent to %s", req.MAC),
-	})
+// hostnameRegex validates a DNS hostname (RFC 1123).
+var hostnameRegex = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+
+// Limits on free-text device fields.
+const (
+	maxTagLength = 64
+	maxNotes     = 4096
+)
+
+// ValidateDevice validates a device as the API does, for devices added by
+// other means such as the CLI.
+func ValidateDevice(device *store.Device) error {
+	return validateDevice(device)
 }
 
-// validateDevice validates a device before adding/updating.
+// validateDevice validates a device before adding/updating. Tags are
+// trimmed and duplicates dropped.
 func validateDevice(device *store.Device) error {
+	// Only the config file manages devices
+	device.Managed = false
+
 	if device.Name == "" {
 		return fmt.Errorf("device name is required")
 	}
@@ -189,6 +368,18 @@ func validateDevice(device *store.Device) error {
 		return fmt.Errorf("invalid MAC address: %w", err)
 	}
 
+	for _, alias := range device.Aliases {
+		if err := wol.ValidateMAC(alias.MAC); err != nil {
+			return fmt.Errorf("invalid alias MAC address: %w", err)
+		}
+		if alias.Broadcast != "" && net.ParseIP(alias.Broadcast).To4() == nil {
+			return fmt.Errorf("invalid broadcast address for %s: %s", alias.MAC, alias.Broadcast)
+		}
+	}
+	if device.Aliases != nil && len(device.Aliases) == 0 {
+		device.Aliases = nil
+	}
+
 	// Validate IP if provided
 	if device.IP != "" {
 		ipRegex := regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}$`)
@@ -197,9 +388,69 @@ func validateDevice(device *store.Device) error {
 		}
 	}
 
+	if device.Hostname != "" && (len(device.Hostname) > 253 || !hostnameRegex.MatchString(device.Hostname)) {
+		return fmt.Errorf("invalid hostname: %s", device.Hostname)
+	}
+
+	tags := make([]string, 0, len(device.Tags))
+	seen := make(map[string]bool, len(device.Tags))
+	for _, tag := range device.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || len(tag) > maxTagLength || strings.Contains(tag, ",") {
+			return fmt.Errorf("invalid tag: %q", tag)
+		}
+		if !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			tags = append(tags, tag)
+		}
+	}
+	device.Tags = nil
+	if len(tags) > 0 {
+		device.Tags = tags
+	}
+
+	if device.Type != "" && !validDeviceType(device.Type) {
+		return fmt.Errorf("invalid device type: %s (must be one of %s)", device.Type, strings.Join(store.DeviceTypes, ", "))
+	}
+
+	if len(device.Notes) > maxNotes {
+		return fmt.Errorf("notes must be at most %d bytes", maxNotes)
+	}
+
+	if ws := device.Wake; ws != nil {
+		if ws.Broadcast != "" && net.ParseIP(ws.Broadcast).To4() == nil {
+			return fmt.Errorf("invalid wake broadcast address: %s", ws.Broadcast)
+		}
+		if ws.Port < 0 || ws.Port > 65535 {
+			return fmt.Errorf("invalid wake port: %d", ws.Port)
+		}
+		switch ws.Transport {
+		case "", store.TransportBroadcast:
+		case store.TransportUnicast:
+			if device.IP == "" {
+				return fmt.Errorf("unicast wake requires an IP address")
+			}
+		default:
+			return fmt.Errorf("invalid wake transport: %s (must be %s or %s)", ws.Transport, store.TransportBroadcast, store.TransportUnicast)
+		}
+		if *ws == (store.WakeSettings{}) {
+			device.Wake = nil
+		}
+	}
+
 	return nil
 }
 
+// validDeviceType reports whether t is one of store.DeviceTypes.
+func validDeviceType(t string) bool {
+	for _, known := range store.DeviceTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
 // respondSuccess sends a success response.
 func (h *Handler) respondSuccess(w http.ResponseWriter, data interface{}) {
 	h.respond(w, Response{
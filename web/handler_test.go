@@ -3,12 +3,21 @@ package web
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
+	"github.com/hzhq1255/wolgate/audit"
+	"github.com/hzhq1255/wolgate/events"
+	"github.com/hzhq1255/wolgate/inventory"
+	"github.com/hzhq1255/wolgate/monitor"
+	"github.com/hzhq1255/wolgate/rules"
+	"github.com/hzhq1255/wolgate/schedule"
 	"github.com/hzhq1255/wolgate/store"
 	"github.com/hzhq1255/wolgate/wol"
 )
@@ -202,6 +211,35 @@ func TestAddHandler_InvalidIP(t *testing.T) {
 	}
 }
 
+func TestAddHandler_AliasMAC(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	h := &Handler{store: s}
+	s.Add(store.Device{Name: "Laptop", MAC: "AA:BB:CC:DD:EE:01", Aliases: []store.MACAlias{{MAC: "AA:BB:CC:DD:EE:02"}}})
+
+	add := func(body string) int {
+		req := httptest.NewRequest("POST", "/api/add", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.addHandler(w, req)
+		return w.Code
+	}
+
+	// An alias MAC does not select the device to overwrite
+	if code := add(`{"name":"Other","mac":"aa-bb-cc-dd-ee-02"}`); code != http.StatusConflict {
+		t.Errorf("Expected status 409 for an alias MAC, got %d", code)
+	}
+	if d, _ := s.GetByMAC("AA:BB:CC:DD:EE:01"); d == nil || d.Name != "Laptop" || len(d.Aliases) != 1 {
+		t.Errorf("Device after adding its alias MAC = %+v", d)
+	}
+
+	// The primary MAC, in any notation, still updates it
+	if code := add(`{"name":"Work laptop","mac":"aa:bb:cc:dd:ee:01"}`); code != http.StatusOK {
+		t.Errorf("Expected status 200 for the primary MAC, got %d", code)
+	}
+	if d, _ := s.GetByMAC("AA:BB:CC:DD:EE:01"); d == nil || d.Name != "Work laptop" {
+		t.Errorf("Device after updating = %+v", d)
+	}
+}
+
 func TestDeleteHandler(t *testing.T) {
 	s, _ := store.NewStore(t.TempDir() + "/test.json")
 	h := &Handler{store: s}
@@ -277,7 +315,7 @@ func TestDeleteHandler_MissingMAC(t *testing.T) {
 
 func TestWakeHandler(t *testing.T) {
 	wolSender, _ := wol.NewSender("", "127.0.0.1")
-	h := &Handler{wol: wolSender}
+	h := NewHandler(nil, wolSender)
 
 	req := struct {
 		MAC string `json:"mac"`
@@ -379,6 +417,64 @@ func TestValidateDevice(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "device with metadata",
+			device: &store.Device{
+				Name:     "Test",
+				MAC:      "AA:BB:CC:DD:EE:FF",
+				IP:       "192.168.1.100",
+				Hostname: "desktop.lan",
+				Tags:     []string{"work", " gpu "},
+				Type:     "desktop",
+				Wake:     &store.WakeSettings{Broadcast: "192.168.1.255", Port: 7, Transport: store.TransportUnicast},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid hostname",
+			device: &store.Device{
+				Name:     "Test",
+				MAC:      "AA:BB:CC:DD:EE:FF",
+				Hostname: "bad host",
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty tag",
+			device: &store.Device{
+				Name: "Test",
+				MAC:  "AA:BB:CC:DD:EE:FF",
+				Tags: []string{" "},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown type",
+			device: &store.Device{
+				Name: "Test",
+				MAC:  "AA:BB:CC:DD:EE:FF",
+				Type: "toaster",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid wake port",
+			device: &store.Device{
+				Name: "Test",
+				MAC:  "AA:BB:CC:DD:EE:FF",
+				Wake: &store.WakeSettings{Port: 70000},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unicast wake without IP",
+			device: &store.Device{
+				Name: "Test",
+				MAC:  "AA:BB:CC:DD:EE:FF",
+				Wake: &store.WakeSettings{Transport: store.TransportUnicast},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -418,3 +514,1009 @@ func TestResponse_Structure(t *testing.T) {
 		t.Error("Message mismatch")
 	}
 }
+
+func TestDeviceHandler(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	h := &Handler{store: s}
+	h.SetMonitor(monitor.New(s, monitor.Config{ARPPath: t.TempDir() + "/arp"}))
+
+	s.Add(store.Device{Name: "Test", MAC: "AA:BB:CC:DD:EE:FF"})
+
+	req := httptest.NewRequest("GET", "/api/device?mac=AA:BB:CC:DD:EE:FF", nil)
+	w := httptest.NewRecorder()
+
+	h.deviceHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var resp struct {
+		Success bool         `json:"success"`
+		Data    DeviceDetail `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Data.Name != "Test" {
+		t.Errorf("Expected device name Test, got %s", resp.Data.Name)
+	}
+	if resp.Data.Boot == nil {
+		t.Error("Expected boot statistics in device detail")
+	}
+}
+
+func TestDeviceHandler_NotFound(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	h := &Handler{store: s}
+
+	req := httptest.NewRequest("GET", "/api/device?mac=AA:BB:CC:DD:EE:FF", nil)
+	w := httptest.NewRecorder()
+
+	h.deviceHandler(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	hub := events.NewHub(0)
+	h := &Handler{}
+	h.SetEvents(hub)
+
+	hub.Publish(events.WakeSent, events.WakeData{MAC: "AA:BB:CC:DD:EE:01"})
+	hub.Publish(events.WakeSent, events.WakeData{MAC: "AA:BB:CC:DD:EE:02"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/api/events", nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "1")
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		h.eventsHandler(w, req)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %s", ct)
+	}
+
+	body := w.Body.String()
+	if strings.Contains(body, "AA:BB:CC:DD:EE:01") {
+		t.Error("Event before Last-Event-ID should not be replayed")
+	}
+	if !strings.Contains(body, "id: 2\nevent: wake.sent\n") || !strings.Contains(body, "AA:BB:CC:DD:EE:02") {
+		t.Errorf("Expected replay of event 2, got %q", body)
+	}
+}
+
+func TestEventsHandler_Unavailable(t *testing.T) {
+	h := &Handler{}
+
+	req := httptest.NewRequest("GET", "/api/events", nil)
+	w := httptest.NewRecorder()
+
+	h.eventsHandler(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", w.Code)
+	}
+}
+
+func TestScheduleHandlers(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, _ := store.NewStore(tmpDir + "/test.json")
+	schedules, _ := schedule.NewStore(tmpDir + "/schedules.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	h.SetScheduler(schedule.NewScheduler(schedules, s, h.waker, schedule.Config{}))
+
+	body := `{"name":"Office","cron":"30 8 * * 1-5","groups":["Office"]}`
+	req := httptest.NewRequest("POST", "/api/schedules", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.schedulesHandler(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var created struct {
+		Data schedule.Entry `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.Data.ID == "" || !created.Data.Enabled || created.Data.NextRun.IsZero() {
+		t.Errorf("Created schedule should have an ID, be enabled and have a next run: %+v", created.Data)
+	}
+
+	// Invalid cron
+	req = httptest.NewRequest("POST", "/api/schedules", strings.NewReader(`{"name":"x","cron":"bad","groups":["g"]}`))
+	w = httptest.NewRecorder()
+	h.schedulesHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid cron, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/schedules/"+created.Data.ID, nil)
+	w = httptest.NewRecorder()
+	h.scheduleHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for delete, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/schedules/"+created.Data.ID, nil)
+	w = httptest.NewRecorder()
+	h.scheduleHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestCalendarHandlers(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, _ := store.NewStore(tmpDir + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	cals, _ := schedule.NewCalendars(tmpDir+"/calendars", nil)
+	h.SetCalendars(cals)
+
+	ics := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:Holiday\r\nDTSTART;VALUE=DATE:20261019\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	req := httptest.NewRequest("POST", "/api/calendars?name=holidays", strings.NewReader(ics))
+	w := httptest.NewRecorder()
+	h.calendarsHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/api/calendars?name=bad", strings.NewReader("not a calendar"))
+	w = httptest.NewRecorder()
+	h.calendarsHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid calendar, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/calendars/holidays", nil)
+	w = httptest.NewRecorder()
+	h.calendarHandler(w, req)
+	var events struct {
+		Data []schedule.Event `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&events)
+	if w.Code != http.StatusOK || len(events.Data) != 1 || events.Data[0].Summary != "Holiday" {
+		t.Errorf("Unexpected calendar events (status %d): %+v", w.Code, events.Data)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/calendars/holidays", nil)
+	w = httptest.NewRecorder()
+	h.calendarHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for delete, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/calendars/holidays", nil)
+	w = httptest.NewRecorder()
+	h.calendarHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestRuleHandlers(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, _ := store.NewStore(tmpDir + "/test.json")
+	ruleStore, _ := rules.NewStore(tmpDir + "/rules.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	h.SetRules(rules.NewEngine(ruleStore, s, h.waker, wolSender, rules.Config{ARPPath: tmpDir + "/arp"}))
+
+	body := `{"name":"Doorbell","trigger":{"type":"webhook","hook":"doorbell"},"actions":[{"type":"wake","mac":"AA:BB:CC:DD:EE:FF"}]}`
+	req := httptest.NewRequest("POST", "/api/rules", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.rulesHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var created struct {
+		Data rules.Rule `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.Data.ID == "" || !created.Data.Enabled {
+		t.Errorf("Created rule should have an ID and be enabled: %+v", created.Data)
+	}
+
+	// Invalid trigger
+	req = httptest.NewRequest("POST", "/api/rules", strings.NewReader(`{"name":"x","trigger":{"type":"bad"},"actions":[{"type":"wake","mac":"AA:BB:CC:DD:EE:FF"}]}`))
+	w = httptest.NewRecorder()
+	h.rulesHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid trigger, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/hooks/doorbell", nil)
+	w = httptest.NewRecorder()
+	h.hookHandler(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected status 202 for hook, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/hooks/unknown", nil)
+	w = httptest.NewRecorder()
+	h.hookHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown hook, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/rules/"+created.Data.ID, nil)
+	w = httptest.NewRecorder()
+	h.ruleHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for delete, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/rules/"+created.Data.ID, nil)
+	w = httptest.NewRecorder()
+	h.ruleHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestDeviceResourceHandlers(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, _ := store.NewStore(tmpDir + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/api/devices", `{"name":"PC","mac":"AA:BB:CC:DD:EE:01","group":"Office"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Data store.Device `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	id := created.Data.ID
+	if id == "" || w.Header().Get("Location") != "/api/devices/"+id {
+		t.Fatalf("Created device should have an ID and location: %+v", created.Data)
+	}
+	do("POST", "/api/devices", `{"name":"NAS","mac":"AA:BB:CC:DD:EE:02"}`)
+
+	// Duplicates conflict instead of silently updating
+	if w := do("POST", "/api/devices", `{"name":"Dup","mac":"aa:bb:cc:dd:ee:01"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for duplicate MAC, got %d", w.Code)
+	}
+
+	// PATCH changes only the given fields, including the MAC
+	w = do("PATCH", "/api/devices/"+id, `{"mac":"AA:BB:CC:DD:EE:03","id":"ignored","revision":1}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for patch, got %d: %s", w.Code, w.Body.String())
+	}
+	if d, err := s.Get(id); err != nil || d.MAC != "AA:BB:CC:DD:EE:03" || d.Group != "Office" {
+		t.Errorf("Unexpected device after patch: %+v, %v", d, err)
+	}
+	if w := do("PATCH", "/api/devices/"+id, `{"colour":"red","revision":2}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unknown field, got %d", w.Code)
+	}
+	if w := do("PUT", "/api/devices/"+id, `{"name":"PC","mac":"AA:BB:CC:DD:EE:02","revision":2}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for MAC taken by another device, got %d", w.Code)
+	}
+
+	if w := do("GET", "/api/devices/"+id, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for get, got %d", w.Code)
+	}
+	if w := do("POST", "/api/devices/"+id+"/wake", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for wake, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("DELETE", "/api/devices/"+id, `{"revision":2}`); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for delete, got %d", w.Code)
+	}
+	if w := do("GET", "/api/devices/"+id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after delete, got %d", w.Code)
+	}
+	if w := do("POST", "/api/devices/"+id+"/wake", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 waking a deleted device, got %d", w.Code)
+	}
+}
+
+func TestDeviceRevisions(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	device, _ := s.Create(store.Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, store.Origin{})
+	path := "/api/devices/" + device.ID
+
+	do := func(method, body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	etag := do("GET", "", "").Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("ETag = %q, want %q", etag, `"1"`)
+	}
+
+	// Writes must say which revision they are based on
+	if w := do("PATCH", `{"name":"Desktop"}`, ""); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected status 428 without a revision, got %d", w.Code)
+	}
+
+	w := do("PATCH", `{"name":"Desktop"}`, etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected status 200 and new ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	// A second tab still holding the first revision is rejected
+	if w := do("PUT", `{"name":"Laptop","mac":"AA:BB:CC:DD:EE:01"}`, etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 for a stale If-Match, got %d", w.Code)
+	}
+	if w := do("PUT", `{"name":"Laptop","mac":"AA:BB:CC:DD:EE:01","revision":1}`, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a stale revision, got %d", w.Code)
+	}
+	if w := do("DELETE", "", `W/"2"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412 for a weak ETag, got %d", w.Code)
+	}
+
+	// The legacy route checks a revision if one is given
+	req := httptest.NewRequest("POST", "/api/add", strings.NewReader(`{"name":"Laptop","mac":"AA:BB:CC:DD:EE:01","revision":1}`))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 from /api/add for a stale revision, got %d", rec.Code)
+	}
+
+	if got, _ := s.Get(device.ID); got.Name != "Desktop" {
+		t.Errorf("Stale writes should not be applied, got %q", got.Name)
+	}
+	if w := do("DELETE", "", "*"); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 deleting with If-Match: *, got %d", w.Code)
+	}
+}
+
+func TestStoreRevisionHandlers(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	do("POST", "/api/devices", `{"name":"PC","mac":"AA:BB:CC:DD:EE:01"}`)
+	do("POST", "/api/devices", `{"name":"NAS","mac":"AA:BB:CC:DD:EE:02"}`)
+	for _, d := range s.List() {
+		do("DELETE", "/api/devices/"+d.ID, `{"revision":1}`)
+	}
+	if s.Count() != 0 {
+		t.Fatalf("Expected all devices deleted, got %d", s.Count())
+	}
+
+	w := do("GET", "/api/store/revisions?limit=3", "")
+	var revisions struct {
+		Data struct {
+			Revision int64         `json:"revision"`
+			Entries  []store.Entry `json:"entries"`
+		} `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&revisions)
+	if revisions.Data.Revision != 4 || len(revisions.Data.Entries) != 3 || revisions.Data.Entries[0].Revision != 4 {
+		t.Fatalf("Unexpected revisions: %+v", revisions.Data)
+	}
+	if e := revisions.Data.Entries[0]; e.Op != store.OpDelete || e.Source != store.SourceAPI || e.Actor == "" {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+
+	if w := do("POST", "/api/store/restore", `{"revision":2}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for restore, got %d: %s", w.Code, w.Body.String())
+	}
+	if s.Count() != 2 {
+		t.Errorf("Expected 2 devices after restore, got %d", s.Count())
+	}
+	if w := do("POST", "/api/store/restore", `{"revision":42}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown revision, got %d", w.Code)
+	}
+	if w := do("POST", "/api/store/restore", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a revision, got %d", w.Code)
+	}
+}
+
+func TestTrashHandlers(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	pc, _ := s.Create(store.Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}, store.Origin{})
+	nas, _ := s.Create(store.Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}, store.Origin{})
+	do("DELETE", "/api/devices/"+pc.ID, `{"revision":1}`)
+	do("DELETE", "/api/devices/"+nas.ID, `{"revision":1}`)
+
+	w := do("GET", "/api/trash", "")
+	var trash struct {
+		Data []store.TrashedDevice `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&trash)
+	if len(trash.Data) != 2 || trash.Data[0].ID != nas.ID {
+		t.Fatalf("Unexpected trash: %+v", trash.Data)
+	}
+
+	if w := do("POST", "/api/trash/"+pc.ID+"/restore", ""); w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Fatalf("Expected status 200 and ETag \"2\" for restore, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	if _, err := s.Get(pc.ID); err != nil {
+		t.Errorf("Expected restored device, got %v", err)
+	}
+	if w := do("POST", "/api/trash/"+pc.ID+"/restore", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 restoring twice, got %d", w.Code)
+	}
+	if w := do("GET", "/api/trash/"+nas.ID+"/restore", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+
+	if w := do("DELETE", "/api/trash/"+nas.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for purge, got %d", w.Code)
+	}
+	do("DELETE", "/api/devices/"+pc.ID, `{"revision":2}`)
+	if w := do("DELETE", "/api/trash", ""); w.Code != http.StatusOK || len(s.Trash()) != 0 {
+		t.Errorf("Expected an empty trash, got %d with %d left", w.Code, len(s.Trash()))
+	}
+}
+
+func TestDeviceMetadata(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	list := func(query string) []store.Device {
+		var resp struct {
+			Data []store.Device `json:"data"`
+		}
+		json.NewDecoder(do("GET", "/api/devices?"+query, "").Body).Decode(&resp)
+		return resp.Data
+	}
+
+	w := do("POST", "/api/devices", `{"name":"PC","mac":"AA:BB:CC:DD:EE:01","tags":["work","gpu","Work"],"type":"desktop","notes":"Under the desk"}`)
+	var created struct {
+		Data store.Device `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	pc := created.Data
+	if len(pc.Tags) != 2 || pc.CreatedAt.IsZero() || !pc.UpdatedAt.Equal(pc.CreatedAt) {
+		t.Fatalf("Unexpected device: %+v", pc)
+	}
+	do("POST", "/api/devices", `{"name":"NAS","mac":"AA:BB:CC:DD:EE:02","tags":["storage"],"type":"nas"}`)
+
+	if got := list("tag=work"); len(got) != 1 || got[0].Name != "PC" {
+		t.Errorf("Filter by tag = %+v", got)
+	}
+	if got := list("tag=WORK&tag=storage"); len(got) != 0 {
+		t.Errorf("Filter by two tags = %+v", got)
+	}
+	if got := list("type=nas"); len(got) != 1 || got[0].Name != "NAS" {
+		t.Errorf("Filter by type = %+v", got)
+	}
+	if got := list("q=desk"); len(got) != 1 || got[0].Name != "PC" {
+		t.Errorf("Search notes = %+v", got)
+	}
+
+	// Nested wake settings are merged, and timestamps kept
+	req := httptest.NewRequest("PATCH", "/api/devices/"+pc.ID, strings.NewReader(`{"wake":{"port":7}}`))
+	req.Header.Set("If-Match", deviceETag(pc))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	req = httptest.NewRequest("PATCH", "/api/devices/"+pc.ID, strings.NewReader(`{"wake":{"broadcast":"192.168.1.255"}}`))
+	req.Header.Set("If-Match", `"2"`)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for patch, got %d: %s", w.Code, w.Body.String())
+	}
+	patched, _ := s.Get(pc.ID)
+	if patched.Wake == nil || patched.Wake.Port != 7 || patched.Wake.Broadcast != "192.168.1.255" {
+		t.Errorf("Unexpected wake settings: %+v", patched.Wake)
+	}
+	if !patched.CreatedAt.Equal(pc.CreatedAt) || patched.Notes != "Under the desk" {
+		t.Errorf("Patch lost fields: %+v", patched)
+	}
+}
+
+func TestDeviceAliases(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("POST", "/api/devices", `{"name":"Laptop","mac":"AA:BB:CC:DD:EE:01","aliases":[{"mac":"AA:BB:CC:DD:EE:02","name":"wifi"}]}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/api/devices", `{"name":"Dock","mac":"AA:BB:CC:DD:EE:02"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for an alias MAC, got %d", w.Code)
+	}
+	if w := do("POST", "/api/devices", `{"name":"Server","mac":"AA:BB:CC:DD:EE:03","aliases":[{"mac":"invalid"}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid alias, got %d", w.Code)
+	}
+
+	// Importing an alias MAC from the ARP table is skipped
+	w := do("POST", "/api/import", `{"devices":[{"mac":"aa:bb:cc:dd:ee:02"}]}`)
+	if s.Count() != 1 {
+		t.Errorf("Expected the alias import to be skipped, got %d devices: %s", s.Count(), w.Body.String())
+	}
+}
+
+func TestGroupHandlers(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) GroupDetail {
+		var resp struct {
+			Data GroupDetail `json:"data"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Data
+	}
+
+	pc, _ := s.Create(store.Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01", Group: "Office"}, store.Origin{})
+	nas, _ := s.Create(store.Device{Name: "NAS", MAC: "AA:BB:CC:DD:EE:02"}, store.Origin{})
+
+	w := do("POST", "/api/groups", `{"name":" Lab ","description":"Test bench","wake":{"broadcast":"127.0.0.1"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	lab := decode(w)
+	if lab.Name != "Lab" || w.Header().Get("Location") != "/api/groups/"+lab.ID {
+		t.Errorf("Unexpected group %+v at %q", lab, w.Header().Get("Location"))
+	}
+	if w := do("POST", "/api/groups", `{"name":"Lab"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a duplicate name, got %d", w.Code)
+	}
+	for _, body := range []string{`{"name":""}`, `{"name":"X","wake":{"broadcast":"::1"}}`, `{"name":"X","wake":{"stagger":-1}}`} {
+		if w := do("POST", "/api/groups", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+
+	w = do("GET", "/api/groups", "")
+	var list struct {
+		Data []GroupDetail `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Data) != 2 || list.Data[0].Name != "Office" || len(list.Data[0].Devices) != 1 || list.Data[1].Name != "Lab" {
+		t.Fatalf("Unexpected groups: %+v", list.Data)
+	}
+	office := list.Data[0]
+
+	// Renaming a group moves its members
+	if w := do("PUT", "/api/groups/"+office.ID, `{"name":"Work"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for rename, got %d: %s", w.Code, w.Body.String())
+	}
+	if d, _ := s.Get(pc.ID); d.Group != "Work" {
+		t.Errorf("Expected member moved to Work, got %q", d.Group)
+	}
+
+	w = do("PUT", "/api/groups/"+lab.ID+"/members", `{"devices":["`+pc.ID+`","`+nas.ID+`"]}`)
+	if got := decode(w); w.Code != http.StatusOK || len(got.Devices) != 2 {
+		t.Fatalf("Expected 2 members, got %d %+v", w.Code, got)
+	}
+	if w := do("POST", "/api/groups/"+lab.ID+"/wake", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for wake, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := do("DELETE", "/api/groups/"+lab.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for delete, got %d", w.Code)
+	}
+	if d, _ := s.Get(nas.ID); d.Group != "" {
+		t.Errorf("Expected member left without a group, got %q", d.Group)
+	}
+	if w := do("GET", "/api/groups/"+lab.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestDeviceListQuery(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	for _, name := range []string{"c", "a", "b"} {
+		s.Create(store.Device{Name: name, MAC: "AA:BB:CC:DD:EE:0" + string(name[0]-'a'+'1')}, store.Origin{})
+	}
+
+	get := func(path string) (*httptest.ResponseRecorder, []store.Device, int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		var resp struct {
+			Data  []store.Device `json:"data"`
+			Total int            `json:"total"`
+			Next  string         `json:"next"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w, resp.Data, resp.Total, resp.Next
+	}
+
+	w, devices, total, next := get("/api/devices?sort=name&limit=2")
+	if w.Code != http.StatusOK || len(devices) != 2 || devices[0].Name != "a" || total != 3 || next == "" {
+		t.Fatalf("Unexpected first page: %d %+v total %d next %q", w.Code, devices, total, next)
+	}
+	_, devices, _, next = get("/api/list?sort=name&limit=2&cursor=" + next)
+	if len(devices) != 1 || devices[0].Name != "c" || next != "" {
+		t.Errorf("Unexpected last page: %+v next %q", devices, next)
+	}
+
+	for _, query := range []string{"sort=color", "limit=-1", "online=maybe", "online=true"} {
+		if w, _, _, _ := get("/api/devices?" + query); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestManagedDevices(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	s.Reconcile([]store.Device{{Name: "PC", MAC: "AA:BB:CC:DD:EE:01"}}, store.PolicyAuthoritative)
+	pc, _ := s.GetByMAC("AA:BB:CC:DD:EE:01")
+
+	writes := []struct{ method, path, body string }{
+		{"PUT", "/api/devices/" + pc.ID, `{"name":"X","mac":"AA:BB:CC:DD:EE:01","revision":1}`},
+		{"PATCH", "/api/devices/" + pc.ID, `{"name":"X","revision":1}`},
+		{"DELETE", "/api/devices/" + pc.ID, `{"revision":1}`},
+		{"POST", "/api/add", `{"name":"X","mac":"AA:BB:CC:DD:EE:01"}`},
+		{"POST", "/api/delete", `{"mac":"AA:BB:CC:DD:EE:01"}`},
+	}
+	for _, tt := range writes {
+		if w := do(tt.method, tt.path, tt.body); w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403 for %s %s, got %d", tt.method, tt.path, w.Code)
+		}
+	}
+	if w := do("GET", "/api/devices/"+pc.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 reading a managed device, got %d", w.Code)
+	}
+	if w := do("POST", "/api/devices/"+pc.ID+"/wake", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 waking a managed device, got %d", w.Code)
+	}
+
+	// Clients cannot mark devices managed
+	w := do("POST", "/api/devices", `{"name":"NAS","mac":"AA:BB:CC:DD:EE:02","managed":true}`)
+	if nas, _ := s.GetByMAC("AA:BB:CC:DD:EE:02"); w.Code != http.StatusCreated || nas == nil || nas.Managed {
+		t.Errorf("Expected an unmanaged device, got %d %+v", w.Code, nas)
+	}
+}
+
+func TestImportExportHandlers(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	s.Create(store.Device{Name: "PC", MAC: "AA:BB:CC:DD:EE:01", Notes: "desk"}, store.Origin{})
+
+	upload := func(name, content string, fields map[string][]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write([]byte(content))
+		for k, vs := range fields {
+			for _, v := range vs {
+				mw.WriteField(k, v)
+			}
+		}
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/import/file", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	report := func(w *httptest.ResponseRecorder) inventory.Report {
+		var resp struct{ Data inventory.Report }
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Data
+	}
+
+	csv := "Device,MAC Address,Notes\nDesktop,aa:bb:cc:dd:ee:01,\nNAS,AA:BB:CC:DD:EE:02,\n,AA:BB:CC:DD:EE:03,\n"
+	mapping := map[string][]string{"map": {"Device=name", "MAC Address=mac"}}
+
+	// A dry run previews the import
+	w := upload("devices.csv", csv, map[string][]string{"map": mapping["map"], "dry_run": {"true"}, "mode": {"merge"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if r := report(w); !r.DryRun || r.Updated != 1 || r.Added != 1 || r.Failed != 1 || r.Rows[2].Error == "" {
+		t.Errorf("Dry run report = %+v", r)
+	}
+	if s.Count() != 1 {
+		t.Errorf("Dry run changed the store: %d devices", s.Count())
+	}
+
+	// Merging keeps fields the file leaves empty
+	w = upload("devices.csv", csv, map[string][]string{"map": mapping["map"], "mode": {"merge"}})
+	if r := report(w); w.Code != http.StatusOK || r.Updated != 1 || r.Added != 1 {
+		t.Errorf("Import report = %d %+v", w.Code, r)
+	}
+	if pc, _ := s.GetByMAC("AA:BB:CC:DD:EE:01"); pc.Name != "Desktop" || pc.Notes != "desk" {
+		t.Errorf("Merged device = %+v", pc)
+	}
+
+	// JSON files are read by their extension
+	w = upload("devices.json", `[{"name":"TV","mac":"AA:BB:CC:DD:EE:04"}]`, nil)
+	if r := report(w); w.Code != http.StatusOK || r.Added != 1 {
+		t.Errorf("JSON import report = %d %+v", w.Code, r)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		fields map[string][]string
+	}{
+		{"devices.txt", nil},
+		{"devices.csv", map[string][]string{"mode": {"replace"}}},
+		{"devices.csv", map[string][]string{"dry_run": {"maybe"}}},
+		{"devices.csv", map[string][]string{"map": {"Device"}}},
+	} {
+		if w := upload(tt.name, csv, tt.fields); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s %v, got %d", tt.name, tt.fields, w.Code)
+		}
+	}
+
+	// Exports
+	req := httptest.NewRequest("GET", "/api/export?format=csv&sort=name", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("Expected a CSV export, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[1], ",Desktop,") {
+		t.Errorf("CSV export = %q", lines)
+	}
+
+	req = httptest.NewRequest("GET", "/api/export?q=tv", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var devices []store.Device
+	if err := json.NewDecoder(w.Body).Decode(&devices); err != nil || len(devices) != 1 || devices[0].Name != "TV" {
+		t.Errorf("JSON export = %+v, %v", devices, err)
+	}
+
+	req = httptest.NewRequest("GET", "/api/export?format=dnsmasq&q=tv", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\ndhcp-host=aa:bb:cc:dd:ee:04,tv\n") {
+		t.Errorf("dnsmasq export = %d %q", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/export?format=xml", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown format, got %d", w.Code)
+	}
+}
+
+func TestLeaseImport(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	dir := t.TempDir()
+	os.WriteFile(dir+"/dhcp.leases", []byte("1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 desktop *\n"), 0644)
+	h.SetLeases(map[string]string{"dnsmasq": dir + "/dhcp.leases", "ethers": dir + "/ethers", "dhcpd": ""})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/api/import/sources", "")
+	var sources struct{ Data []ImportSource }
+	json.NewDecoder(w.Body).Decode(&sources)
+	if len(sources.Data) != 3 || sources.Data[0].Name != "arp" || !sources.Data[1].Available || sources.Data[2].Available {
+		t.Errorf("Import sources = %+v", sources.Data)
+	}
+
+	w = do("GET", "/api/import?source=dnsmasq", "")
+	var entries struct{ Data []ARPEntry }
+	json.NewDecoder(w.Body).Decode(&entries)
+	if w.Code != http.StatusOK || len(entries.Data) != 1 || entries.Data[0].Name != "desktop" || entries.Data[0].IP != "192.168.1.10" {
+		t.Fatalf("Lease entries = %d %+v", w.Code, entries.Data)
+	}
+	for _, source := range []string{"ethers", "dhcpd", "hosts"} {
+		if w := do("GET", "/api/import?source="+source, ""); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404 for source %s, got %d", source, w.Code)
+		}
+	}
+
+	// The hostname names the imported device
+	do("POST", "/api/import", `{"devices":[{"mac":"aa:bb:cc:dd:ee:01","ip":"192.168.1.10","hostname":"desktop"}]}`)
+	if d, err := s.GetByMAC("AA:BB:CC:DD:EE:01"); err != nil || d.Name != "desktop" || d.Hostname != "desktop" {
+		t.Errorf("Imported device = %+v, %v", d, err)
+	}
+
+	// Devices are validated, and every device's outcome reported
+	w = do("POST", "/api/import", `{"devices":[
+		{"mac":"aa:bb:cc:dd:ee:01"},
+		{"mac":"aa:bb"},
+		{"mac":"aa:bb:cc:dd:ee:02","hostname":"bad_name"},
+		{"mac":"aa:bb:cc:dd:ee:03","aliases":["invalid"]},
+		{"mac":"aa:bb:cc:dd:ee:04","hostname":"laptop"}
+	]}`)
+	var report struct {
+		Data    inventory.Report
+		Message string
+	}
+	json.NewDecoder(w.Body).Decode(&report)
+	if w.Code != http.StatusOK || report.Data.Added != 1 || report.Data.Skipped != 1 || report.Data.Failed != 3 {
+		t.Fatalf("Import = %d %+v", w.Code, report)
+	}
+	for i, op := range []string{store.ImportSkipped, "", "", "", store.OpAdd} {
+		if row := report.Data.Rows[i]; row.Row != i+1 || row.Op != op || (op == "") != (row.Error != "") {
+			t.Errorf("Import row %d = %+v", i+1, row)
+		}
+	}
+	if s.Count() != 2 {
+		t.Errorf("Expected 2 devices after the import, got %d", s.Count())
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	s, _ := store.NewStore(t.TempDir() + "/test.json")
+	s.Add(store.Device{Name: "Desktop", MAC: "AA:BB:CC:DD:EE:01"})
+	device, _ := s.GetByMAC("AA:BB:CC:DD:EE:01")
+	wolSender, _ := wol.NewSender("", "127.0.0.1")
+	h := NewHandler(s, wolSender)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	do := func(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/api/audit", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 without an audit log, got %d", w.Code)
+	}
+
+	l := audit.New(audit.Config{Path: t.TempDir() + "/test.json.audit"})
+	l.RecordWakes(h.waker, s)
+	h.SetAudit(l)
+
+	if err := h.SetTrustedProxies([]string{"192.0.2.1", "10.0.0.0/8"}); err != nil {
+		t.Fatalf("SetTrustedProxies() error = %v", err)
+	}
+	if err := h.SetTrustedProxies([]string{"proxy.lan"}); err == nil {
+		t.Error("SetTrustedProxies() should reject a hostname")
+	}
+
+	// Headers naming the client and user are believed only from a trusted proxy
+	proxied := map[string]string{"X-Wolgate-Client": "ui", "Remote-User": "alice", "X-Forwarded-For": "198.51.100.7, 10.0.0.2"}
+	do("POST", "/api/wake", `{"mac":"aa:bb:cc:dd:ee:01"}`, proxied)
+	req := httptest.NewRequest("POST", "/api/wake", strings.NewReader(`{"mac":"AA:BB:CC:DD:EE:02"}`))
+	req.RemoteAddr = "192.0.2.99:1234"
+	req.SetBasicAuth("bob", "anything")
+	req.Header.Set("Remote-User", "mallory")
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	var resp struct{ Data []audit.Entry }
+	w := do("GET", "/api/audit", "", nil)
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || len(resp.Data) != 2 {
+		t.Fatalf("Audit = %d %+v", w.Code, resp.Data)
+	}
+	if e := resp.Data[0]; e.Source != "api" || e.MAC != "AA:BB:CC:DD:EE:02" || e.Client != "192.0.2.99" || e.User != "" {
+		t.Errorf("Untrusted wake recorded as %+v", e)
+	}
+	if e := resp.Data[1]; e.Source != "api" || e.Detail != "web UI" || e.Client != "198.51.100.7" || e.User != "alice" ||
+		e.DeviceID != device.ID || e.Device != "Desktop" || e.Result != audit.ResultOK {
+		t.Errorf("Proxied wake recorded as %+v", e)
+	}
+
+	// A device is selected by ID or MAC
+	for _, device := range []string{device.ID, "aa:bb:cc:dd:ee:01"} {
+		resp.Data = nil
+		json.NewDecoder(do("GET", "/api/audit?device="+device, "", nil).Body).Decode(&resp)
+		if len(resp.Data) != 1 || resp.Data[0].Device != "Desktop" {
+			t.Errorf("Audit of device %s = %+v", device, resp.Data)
+		}
+	}
+	resp.Data = nil
+	json.NewDecoder(do("GET", "/api/audit?until=2000-01-01", "", nil).Body).Decode(&resp)
+	if len(resp.Data) != 0 {
+		t.Errorf("Audit until 2000 = %+v", resp.Data)
+	}
+
+	w = do("GET", "/api/audit?format=csv&since=2000-01-01", "", nil)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Expected CSV content type, got %s", ct)
+	}
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "time,source") {
+		t.Errorf("Audit CSV = %q", w.Body.String())
+	}
+
+	for _, query := range []string{"since=yesterday", "limit=-1", "format=xml"} {
+		if w := do("GET", "/api/audit?"+query, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", query, w.Code)
+		}
+	}
+}
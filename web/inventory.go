@@ -0,0 +1,126 @@
+// Package web provides the device import and export API for wolgate.
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/hzhq1255/wolgate/hostsfile"
+	"github.com/hzhq1255/wolgate/inventory"
+	"github.com/hzhq1255/wolgate/store"
+)
+
+// maxImportSize limits the size of imported device files.
+const maxImportSize = 8 << 20
+
+// exportHandler downloads the device list as a file with
+// GET /api/export?format=csv|json|ethers|dnsmasq|openwrt (default json).
+// The list may be searched, filtered and sorted like GET /api/devices.
+func (h *Handler) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = inventory.FormatJSON
+	}
+	if format != inventory.FormatCSV && format != inventory.FormatJSON && !hostsfile.ValidFormat(format) {
+		h.respondError(w, "Format must be csv, json, ethers, dnsmasq or openwrt", http.StatusBadRequest)
+		return
+	}
+	q, err := h.deviceQuery(r.URL.Query())
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Offset, q.Limit, q.Cursor = 0, 0, ""
+	page, err := h.store.Find(q)
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if hostsfile.ValidFormat(format) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="wolgate-%s"`, format))
+		hostsfile.Render(w, format, page.Devices)
+		return
+	}
+
+	contentType := "application/json"
+	if format == inventory.FormatCSV {
+		contentType = "text/csv; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="wolgate-devices.%s"`, format))
+	inventory.Write(w, format, page.Devices)
+}
+
+// importFileHandler imports devices from a CSV or JSON file uploaded as the
+// multipart "file" field to POST /api/import/file. Other form fields:
+// format (default: by the file name), mode (skip, overwrite or merge;
+// default skip), dry_run, and map, repeatable, as "CSV header=column". It
+// responds with the outcome of every row, see inventory.Report.
+func (h *Handler) importFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		h.respondError(w, "Missing device file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = inventory.FormatOf(header.Filename)
+	}
+	if format != inventory.FormatCSV && format != inventory.FormatJSON {
+		h.respondError(w, "Format must be csv or json", http.StatusBadRequest)
+		return
+	}
+	dryRun := false
+	if v := r.FormValue("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			h.respondError(w, "Invalid dry_run: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	mode := r.FormValue("mode")
+	switch mode {
+	case "", store.ConflictSkip, store.ConflictOverwrite, store.ConflictMerge:
+	default:
+		h.respondError(w, "Mode must be skip, overwrite or merge", http.StatusBadRequest)
+		return
+	}
+	mapping, err := inventory.ParseMapping(r.MultipartForm.Value["map"])
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, ignored, err := inventory.Read(file, format, mapping)
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report, err := inventory.Import(h.store, records, store.ImportOptions{
+		Mode:     mode,
+		DryRun:   dryRun,
+		Validate: validateDevice,
+		Origin:   h.requestOrigin(r, store.SourceImport),
+	})
+	if err != nil {
+		h.respondDeviceError(w, err)
+		return
+	}
+	report.Ignored = ignored
+	h.respondSuccess(w, report)
+}
@@ -0,0 +1,47 @@
+// Package web provides the proxy status APIs for wolgate.
+package web
+
+import (
+	"net/http"
+
+	"github.com/hzhq1255/wolgate/proxy"
+	"github.com/hzhq1255/wolgate/sleepproxy"
+)
+
+// SetProxy attaches the wake-on-demand proxy whose metrics are served.
+func (h *Handler) SetProxy(p *proxy.Proxy) {
+	h.proxy = p
+}
+
+// SetSleepProxy attaches the sleep proxy whose state is served.
+func (h *Handler) SetSleepProxy(p *sleepproxy.Proxy) {
+	h.sleepProxy = p
+}
+
+// proxyHandler returns the metrics of every proxy mapping.
+func (h *Handler) proxyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := []proxy.Stats{}
+	if h.proxy != nil {
+		stats = h.proxy.Stats()
+	}
+	h.respondSuccess(w, stats)
+}
+
+// sleepProxyHandler returns the sleep proxy state of every opted-in device.
+func (h *Handler) sleepProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := []sleepproxy.Status{}
+	if h.sleepProxy != nil {
+		status = h.sleepProxy.Status()
+	}
+	h.respondSuccess(w, status)
+}
@@ -0,0 +1,132 @@
+// Package web provides the automation rule API for wolgate.
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/hzhq1255/wolgate/rules"
+)
+
+// SetRules attaches the rule engine managed by the rule API.
+func (h *Handler) SetRules(e *rules.Engine) {
+	h.rules = e
+}
+
+// rulesHandler lists (GET) and creates (POST) rules.
+func (h *Handler) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.rules == nil {
+		h.respondError(w, "Rules not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.respondSuccess(w, h.rules.List())
+	case http.MethodPost:
+		rule := rules.Rule{Enabled: true}
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := h.rules.Add(rule)
+		if err != nil {
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.respondWithStatus(w, Response{Success: true, Data: rule}, http.StatusCreated)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ruleHandler reads (GET), replaces (PUT) and deletes (DELETE) a rule at
+// /api/rules/{id}.
+func (h *Handler) ruleHandler(w http.ResponseWriter, r *http.Request) {
+	if h.rules == nil {
+		h.respondError(w, "Rules not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/rules/")
+	if id == "" || strings.Contains(id, "/") {
+		h.respondError(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rule, err := h.rules.Get(id)
+		if err != nil {
+			h.respondRuleError(w, err)
+			return
+		}
+		h.respondSuccess(w, rule)
+	case http.MethodPut:
+		var rule rules.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := h.rules.Update(id, rule)
+		if err != nil {
+			h.respondRuleError(w, err)
+			return
+		}
+		h.respondSuccess(w, rule)
+	case http.MethodDelete:
+		if err := h.rules.Delete(id); err != nil {
+			h.respondRuleError(w, err)
+			return
+		}
+		h.respondSuccess(w, nil)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ruleHistoryHandler returns the most recent rule firings.
+func (h *Handler) ruleHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	history := []rules.Firing{}
+	if h.rules != nil {
+		history = h.rules.History()
+	}
+	h.respondSuccess(w, history)
+}
+
+// hookHandler fires the rules listening on the webhook at /api/hooks/{hook}.
+func (h *Handler) hookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.rules == nil {
+		h.respondError(w, "Rules not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	count, err := h.rules.Hook(strings.TrimPrefix(r.URL.Path, "/api/hooks/"))
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.respondWithStatus(w, Response{Success: true, Data: map[string]int{"rules": count}}, http.StatusAccepted)
+}
+
+// respondRuleError maps rule errors to HTTP status codes.
+func (h *Handler) respondRuleError(w http.ResponseWriter, err error) {
+	if errors.Is(err, rules.ErrNotFound) {
+		h.respondError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.respondError(w, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,184 @@
+// Package web provides the schedule API for wolgate.
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/hzhq1255/wolgate/schedule"
+)
+
+// SetScheduler attaches the scheduler managed by the schedule API.
+func (h *Handler) SetScheduler(s *schedule.Scheduler) {
+	h.scheduler = s
+}
+
+// SetCalendars attaches the calendars managed by the calendar API.
+func (h *Handler) SetCalendars(c *schedule.Calendars) {
+	h.calendars = c
+}
+
+// maxCalendarSize limits the size of uploaded calendars.
+const maxCalendarSize = 4 << 20
+
+// schedulesHandler lists (GET) and creates (POST) schedules.
+func (h *Handler) schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if h.scheduler == nil {
+		h.respondError(w, "Scheduler not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.respondSuccess(w, h.scheduler.List())
+	case http.MethodPost:
+		sc := schedule.Schedule{Enabled: true}
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		entry, err := h.scheduler.Add(sc)
+		if err != nil {
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.respondWithStatus(w, Response{Success: true, Data: entry}, http.StatusCreated)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// scheduleHandler reads (GET), replaces (PUT) and deletes (DELETE) a
+// schedule at /api/schedules/{id}.
+func (h *Handler) scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if h.scheduler == nil {
+		h.respondError(w, "Scheduler not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/schedules/")
+	if id == "" || strings.Contains(id, "/") {
+		h.respondError(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, err := h.scheduler.Get(id)
+		if err != nil {
+			h.respondScheduleError(w, err)
+			return
+		}
+		h.respondSuccess(w, entry)
+	case http.MethodPut:
+		var sc schedule.Schedule
+		if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+			h.respondError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		entry, err := h.scheduler.Update(id, sc)
+		if err != nil {
+			h.respondScheduleError(w, err)
+			return
+		}
+		h.respondSuccess(w, entry)
+	case http.MethodDelete:
+		if err := h.scheduler.Delete(id); err != nil {
+			h.respondScheduleError(w, err)
+			return
+		}
+		h.respondSuccess(w, nil)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// calendarsHandler lists (GET) and uploads (POST) calendars. Uploads take
+// the calendar name from the "name" query parameter and the .ics data from
+// a multipart "file" field or the raw request body.
+func (h *Handler) calendarsHandler(w http.ResponseWriter, r *http.Request) {
+	if h.calendars == nil {
+		h.respondError(w, "Calendars not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.respondSuccess(w, h.calendars.List())
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxCalendarSize)
+
+		var body io.Reader = r.Body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				h.respondError(w, "Missing calendar file", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			body = file
+		}
+
+		data, err := io.ReadAll(body)
+		if err != nil {
+			h.respondError(w, "Failed to read calendar", http.StatusBadRequest)
+			return
+		}
+
+		info, err := h.calendars.Upload(r.URL.Query().Get("name"), data)
+		if err != nil {
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.respondWithStatus(w, Response{Success: true, Data: info}, http.StatusCreated)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// calendarHandler returns the events of (GET) or deletes (DELETE) a
+// calendar at /api/calendars/{name}.
+func (h *Handler) calendarHandler(w http.ResponseWriter, r *http.Request) {
+	if h.calendars == nil {
+		h.respondError(w, "Calendars not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/calendars/")
+
+	switch r.Method {
+	case http.MethodGet:
+		cal, ok := h.calendars.Get(name)
+		if !ok {
+			h.respondError(w, "Calendar not found", http.StatusNotFound)
+			return
+		}
+		h.respondSuccess(w, cal.Events)
+	case http.MethodDelete:
+		if err := h.calendars.Delete(name); err != nil {
+			if errors.Is(err, schedule.ErrCalendarNotFound) {
+				h.respondError(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.respondSuccess(w, nil)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// respondScheduleError maps schedule errors to HTTP status codes.
+func (h *Handler) respondScheduleError(w http.ResponseWriter, err error) {
+	if errors.Is(err, schedule.ErrNotFound) {
+		h.respondError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.respondError(w, err.Error(), http.StatusBadRequest)
+}
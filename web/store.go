@@ -0,0 +1,84 @@
+// Package web provides the store revision API for wolgate.
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/hzhq1255/wolgate/store"
+)
+
+// revisionsResponse is the store journal, newest entries first.
+type revisionsResponse struct {
+	Revision int64         `json:"revision"` // Current store revision
+	Entries  []store.Entry `json:"entries"`
+}
+
+// revisionsHandler returns the journal of changes to the device list. The
+// limit query parameter caps the number of entries (default 100), and
+// device filters them by device ID.
+func (h *Handler) revisionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			h.respondError(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	device := r.URL.Query().Get("device")
+
+	entries, err := h.store.Journal()
+	if err != nil {
+		h.respondError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := revisionsResponse{Revision: h.store.Revision(), Entries: []store.Entry{}}
+	for i := len(entries) - 1; i >= 0 && len(result.Entries) < limit; i-- {
+		if device == "" || entries[i].Device == device {
+			result.Entries = append(result.Entries, entries[i])
+		}
+	}
+	h.respondSuccess(w, result)
+}
+
+// restoreHandler returns the device list to an earlier revision, given as
+// {"revision": N}.
+func (h *Handler) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Revision *int64 `json:"revision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Revision == nil {
+		h.respondError(w, "A revision is required", http.StatusBadRequest)
+		return
+	}
+
+	changes, err := h.store.Restore(*req.Revision, h.requestOrigin(r, store.SourceRestore))
+	if err != nil {
+		if errors.Is(err, store.ErrRevisionUnavailable) {
+			h.respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.respondDeviceError(w, err)
+		return
+	}
+
+	h.respondSuccess(w, map[string]interface{}{
+		"revision": h.store.Revision(),
+		"changes":  len(changes),
+	})
+}
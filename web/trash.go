@@ -0,0 +1,57 @@
+// Package web provides the device trash API for wolgate.
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/hzhq1255/wolgate/store"
+)
+
+// trashHandler lists (GET) and empties (DELETE) the trash of deleted
+// devices at /api/trash.
+func (h *Handler) trashHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.respondSuccess(w, h.store.Trash())
+	case http.MethodDelete:
+		if err := h.store.EmptyTrash(); err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		h.respondSuccess(w, nil)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// trashedDeviceHandler purges a deleted device for good with
+// DELETE /api/trash/{id}, and puts it back in the device list with
+// POST /api/trash/{id}/restore.
+func (h *Handler) trashedDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/trash/"), "/")
+	if id == "" || (action != "" && action != "restore") {
+		h.respondError(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "restore" && r.Method == http.MethodPost:
+		device, err := h.store.Undelete(id, h.requestOrigin(r, store.SourceAPI))
+		if err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		w.Header().Set("Location", "/api/devices/"+device.ID)
+		w.Header().Set("ETag", deviceETag(device))
+		h.respondSuccess(w, device)
+	case action == "" && r.Method == http.MethodDelete:
+		if err := h.store.Purge(id); err != nil {
+			h.respondDeviceError(w, err)
+			return
+		}
+		h.respondSuccess(w, nil)
+	default:
+		h.respondError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
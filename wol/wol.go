@@ -19,6 +19,17 @@ type WOLSender struct {
 	broadcast string
 }
 
+// DefaultPort is the UDP port magic packets are sent to by default.
+const DefaultPort = 9
+
+// Target overrides where magic packets are sent. Empty fields keep the
+// sender's interface, broadcast address and DefaultPort.
+type Target struct {
+	Iface   string // Network interface to send from
+	Address string // Broadcast address, or the device's own IP for unicast
+	Port    int    // UDP port
+}
+
 // NewSender creates a new WOL sender.
 // If iface is empty, uses the default network interface.
 // If broadcast is empty, uses "255.255.255.255".
@@ -46,6 +57,16 @@ func (w *WOLSender) Send(mac string) error {
 
 // SendRepeat sends multiple Wake-on-LAN magic packets for reliability.
 func (w *WOLSender) SendRepeat(mac string, count int) error {
+	return w.SendRepeatTo(mac, count, Target{})
+}
+
+// SendRepeatTo is SendRepeat sending to target instead of the sender's
+// defaults.
+func (w *WOLSender) SendRepeatTo(mac string, count int, target Target) error {
+	if target.Address != "" && net.ParseIP(target.Address) == nil {
+		return fmt.Errorf("invalid target address: %s", target.Address)
+	}
+
 	// Validate and normalize MAC address
 	macBytes, err := parseMAC(mac)
 	if err != nil {
@@ -57,7 +78,7 @@ func (w *WOLSender) SendRepeat(mac string, count int) error {
 
 	// Send the packet
 	for i := 0; i < count; i++ {
-		if err := w.sendPacket(magicPacket); err != nil {
+		if err := w.sendPacketTo(magicPacket, target); err != nil {
 			return err
 		}
 		// Small delay between packets
@@ -69,6 +90,22 @@ func (w *WOLSender) SendRepeat(mac string, count int) error {
 	return nil
 }
 
+// SendSleep sends a Sleep-on-LAN packet to the specified MAC address: a
+// magic packet carrying the reversed MAC, as understood by agents such as
+// sleep-on-lan. Devices without such an agent ignore it.
+func (w *WOLSender) SendSleep(mac string) error {
+	macBytes, err := parseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	reversed := make([]byte, len(macBytes))
+	for i, b := range macBytes {
+		reversed[len(macBytes)-1-i] = b
+	}
+	return w.sendPacket(constructMagicPacket(reversed))
+}
+
 // parseMAC validates and parses a MAC address string.
 func parseMAC(mac string) ([]byte, error) {
 	// Remove any separators
@@ -133,15 +170,38 @@ func constructMagicPacket(mac []byte) []byte {
 
 // sendPacket sends a magic packet via UDP broadcast.
 func (w *WOLSender) sendPacket(packet []byte) error {
+	return w.sendPacketTo(packet, Target{})
+}
+
+// Resolve returns target with the sender's defaults filled in, as packets
+// are sent to it.
+func (w *WOLSender) Resolve(target Target) Target {
+	if target.Iface == "" {
+		target.Iface = w.iface
+	}
+	if target.Address == "" {
+		target.Address = w.broadcast
+	}
+	if target.Port == 0 {
+		target.Port = DefaultPort
+	}
+	return target
+}
+
+// sendPacketTo sends a magic packet via UDP to target, filling in the
+// sender's defaults.
+func (w *WOLSender) sendPacketTo(packet []byte, target Target) error {
+	target = w.Resolve(target)
+
 	// Create UDP connection
 	var conn *net.UDPConn
 	var err error
 
-	if w.iface != "" {
+	if target.Iface != "" {
 		// Set the interface to use for sending
-		iface, err := net.InterfaceByName(w.iface)
+		iface, err := net.InterfaceByName(target.Iface)
 		if err != nil {
-			return fmt.Errorf("interface %s not found: %w", w.iface, err)
+			return fmt.Errorf("interface %s not found: %w", target.Iface, err)
 		}
 
 		// Get the interface addresses
@@ -160,7 +220,7 @@ func (w *WOLSender) sendPacket(packet []byte) error {
 		}
 
 		if localIP == nil {
-			return fmt.Errorf("no suitable IPv4 address found on interface %s", w.iface)
+			return fmt.Errorf("no suitable IPv4 address found on interface %s", target.Iface)
 		}
 
 		// Bind to specific interface IP to control outgoing interface
@@ -171,7 +231,7 @@ func (w *WOLSender) sendPacket(packet []byte) error {
 
 		conn, err = net.ListenUDP("udp4", addr)
 		if err != nil {
-			return fmt.Errorf("failed to create UDP socket on %s: %w", w.iface, err)
+			return fmt.Errorf("failed to create UDP socket on %s: %w", target.Iface, err)
 		}
 		defer conn.Close()
 	} else {
@@ -191,10 +251,10 @@ func (w *WOLSender) sendPacket(packet []byte) error {
 	// Set broadcast permission
 	// In Go, this is handled automatically when sending to a broadcast address
 
-	// Send to broadcast address
+	// Send to the broadcast address, or the device itself
 	destAddr := &net.UDPAddr{
-		IP:   net.ParseIP(w.broadcast),
-		Port: 9, // Standard WOL port (alternatively 7)
+		IP:   net.ParseIP(target.Address),
+		Port: target.Port, // Standard WOL port is 9 (alternatively 7)
 	}
 
 	_, err = conn.WriteToUDP(packet, destAddr)
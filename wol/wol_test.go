@@ -2,9 +2,11 @@
 package wol
 
 import (
+	"bytes"
 	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewSender(t *testing.T) {
@@ -183,6 +185,35 @@ func TestWOLSender_SendInvalidMAC(t *testing.T) {
 	}
 }
 
+func TestWOLSender_SendSleep(t *testing.T) {
+	// Receive on a local port standing in for the sleep agent
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Skipf("Cannot listen on port 9: %v", err)
+	}
+	defer conn.Close()
+
+	s, _ := NewSender("", "127.0.0.1")
+	if err := s.SendSleep("AA:BB:CC:DD:EE:FF"); err != nil {
+		t.Fatalf("SendSleep() error = %v", err)
+	}
+
+	buf := make([]byte, 200)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("No packet received: %v", err)
+	}
+	want := constructMagicPacket([]byte{0xFF, 0xEE, 0xDD, 0xCC, 0xBB, 0xAA})
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("Sleep packet should carry the reversed MAC, got % X", buf[:n])
+	}
+
+	if err := s.SendSleep("invalid-mac"); err == nil {
+		t.Error("SendSleep() should return error for invalid MAC")
+	}
+}
+
 func TestSendRepeat(t *testing.T) {
 	s, err := NewSender("", "127.0.0.1")
 	if err != nil {